@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"net/http"
 
 	"go.uber.org/zap"
@@ -14,6 +16,7 @@ import (
 	// nolint:staticcheck
 
 	"github.com/xmidt-org/webpa-common/v2/xhttp"
+	"github.com/xmidt-org/wrp-go/v3"
 	"github.com/xmidt-org/wrp-go/v3/wrphttp"
 )
 
@@ -23,6 +26,12 @@ func withDeviceAccessCheck(errorLogger *zap.Logger, wrpRouterHandler wrphttp.Han
 	return func(w wrphttp.ResponseWriter, r *wrphttp.Request) {
 		err := d.authorizeWRP(r.Context(), &r.Entity.Message)
 		if err != nil {
+			var denial *deviceAccessDenial
+			if errors.As(err, &denial) {
+				writeDeviceAccessDenial(errorLogger, w, r, denial)
+				return
+			}
+
 			encodeError(r.Context(), err, w)
 			return
 		}
@@ -30,6 +39,52 @@ func withDeviceAccessCheck(errorLogger *zap.Logger, wrpRouterHandler wrphttp.Han
 	}
 }
 
+// writeDeviceAccessDenial writes the JSON form of the denial as the response body, or as
+// the payload of a WRP reply to the request if the denial is to be written as WRP
+func writeDeviceAccessDenial(errorLogger *zap.Logger, w wrphttp.ResponseWriter, r *wrphttp.Request, denial *deviceAccessDenial) {
+	body, err := json.Marshal(denial)
+	if err != nil {
+		errorLogger.Error("Unable to encode device access denial", zap.Error(err))
+		w.WriteHeader(denial.Code)
+		return
+	}
+
+	contentType := wrp.MimeTypeJson
+	if denial.asWRP {
+		var (
+			status  = int64(denial.Code)
+			request = r.Entity.Message
+			reply   []byte
+		)
+
+		err = wrp.NewEncoderBytes(&reply, w.WRPFormat()).Encode(&wrp.Message{
+			Type:            request.Type,
+			Source:          request.Destination,
+			Destination:     request.Source,
+			TransactionUUID: request.TransactionUUID,
+			ContentType:     wrp.MimeTypeJson,
+			Status:          &status,
+			PartnerIDs:      request.PartnerIDs,
+			Payload:         body,
+		})
+
+		if err != nil {
+			errorLogger.Error("Unable to encode device access denial", zap.Error(err))
+			w.WriteHeader(denial.Code)
+			return
+		}
+
+		body, contentType = reply, w.WRPFormat().ContentType()
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Xmidt-Message-Error", denial.Error())
+	w.WriteHeader(denial.Code)
+	if _, err := w.Write(body); err != nil {
+		errorLogger.Error("Error while writing device access denial", zap.Error(err))
+	}
+}
+
 func wrpRouterHandler(logger *zap.Logger, router device.Router, ctxlogger func(ctx context.Context) *zap.Logger) wrphttp.HandlerFunc {
 	if logger == nil {
 		log := adapter.DefaultLogger()
@@ -57,21 +112,7 @@ func wrpRouterHandler(logger *zap.Logger, router device.Router, ctxlogger func(c
 		deviceResponse, err := router.Route(deviceRequest.WithContext(r.Context()))
 
 		if err != nil {
-			code := http.StatusGatewayTimeout
-			// nolint:errorlint
-			switch err {
-			case device.ErrorInvalidDeviceName:
-				code = http.StatusBadRequest
-			case device.ErrorDeviceNotFound:
-				code = http.StatusNotFound
-			case device.ErrorNonUniqueID:
-				code = http.StatusBadRequest
-			case device.ErrorInvalidTransactionKey:
-				code = http.StatusBadRequest
-			case device.ErrorTransactionAlreadyRegistered:
-				code = http.StatusBadRequest
-			}
-
+			code := routeErrorCode(err)
 			errorLogger.Error("Could not process device request", zap.Error(err), zap.Int("code", code))
 			w.Header().Set("X-Xmidt-Message-Error", err.Error())
 			xhttp.WriteErrorf(
@@ -114,6 +155,25 @@ func wrpRouterHandler(logger *zap.Logger, router device.Router, ctxlogger func(c
 	}
 }
 
+// routeErrorCode returns the HTTP status code for an error routing a request to a device
+func routeErrorCode(err error) int {
+	// nolint:errorlint
+	switch err {
+	case device.ErrorInvalidDeviceName:
+		return http.StatusBadRequest
+	case device.ErrorDeviceNotFound:
+		return http.StatusNotFound
+	case device.ErrorNonUniqueID:
+		return http.StatusBadRequest
+	case device.ErrorInvalidTransactionKey:
+		return http.StatusBadRequest
+	case device.ErrorTransactionAlreadyRegistered:
+		return http.StatusBadRequest
+	}
+
+	return http.StatusGatewayTimeout
+}
+
 func decorateRequestDecoder(decode wrphttp.Decoder) wrphttp.Decoder {
 	return func(c context.Context, r *http.Request) (*wrphttp.Entity, error) {
 		entity, err := decode(c, r)
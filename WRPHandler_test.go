@@ -64,6 +64,70 @@ func testWithDeviceAccessCheck(t *testing.T, authorized bool) {
 	}
 }
 
+func testWithDeviceAccessDenial(t *testing.T, asWRP bool) {
+	var (
+		assert   = assert.New(t)
+		require  = require.New(t)
+		d        = new(mockDeviceAccess)
+		recorder = httptest.NewRecorder()
+		w        = newTestWRPResponseWriter(recorder)
+		r        = &wrphttp.Request{
+			Entity: &wrphttp.Entity{
+				Message: wrp.Message{
+					Type:            wrp.SimpleRequestResponseMessageType,
+					Source:          "dns:caller.com",
+					Destination:     "mac:112233445566",
+					TransactionUUID: "DEADBEEF",
+				},
+			},
+		}
+		denial = &deviceAccessDenial{
+			err:           errDeniedDeviceAccess,
+			asWRP:         asWRP,
+			Code:          http.StatusForbidden,
+			Message:       errDeniedDeviceAccess.Error(),
+			Reason:        denied,
+			Check:         "partner",
+			Policy:        defaultPolicyName,
+			CorrelationID: "DEADBEEF",
+		}
+		wrpRouterHandler = func(_ wrphttp.ResponseWriter, _ *wrphttp.Request) {
+			assert.Fail("the router should not be called for denials")
+		}
+	)
+
+	d.On("authorizeWRP", r.Context(), &r.Entity.Message).Return(denial)
+	withDeviceAccessCheck(zaptest.NewLogger(t), wrpRouterHandler, d)(w, r)
+	assert.Equal(http.StatusForbidden, recorder.Code)
+	assert.Equal(errDeniedDeviceAccess.Error(), recorder.Header().Get("X-Xmidt-Message-Error"))
+
+	body := recorder.Body.Bytes()
+	if asWRP {
+		assert.Equal(wrp.Msgpack.ContentType(), recorder.Header().Get("Content-Type"))
+
+		var reply wrp.Message
+		require.NoError(wrp.NewDecoderBytes(body, wrp.Msgpack).Decode(&reply))
+		assert.Equal(wrp.SimpleRequestResponseMessageType, reply.Type)
+		assert.Equal("mac:112233445566", reply.Source)
+		assert.Equal("dns:caller.com", reply.Destination)
+		assert.Equal("DEADBEEF", reply.TransactionUUID)
+		require.NotNil(reply.Status)
+		assert.Equal(int64(http.StatusForbidden), *reply.Status)
+		body = reply.Payload
+	} else {
+		assert.Equal(wrp.MimeTypeJson, recorder.Header().Get("Content-Type"))
+	}
+
+	assert.JSONEq(`{
+		"code": 403,
+		"message": "Denied Access to Device",
+		"reason": "denied",
+		"check": "partner",
+		"policy": "default",
+		"correlationID": "DEADBEEF"
+	}`, string(body))
+}
+
 func testMessageHandlerServeHTTPEncodeError(t *testing.T) {
 	const transactionKey = "transaction-key"
 
@@ -337,6 +401,14 @@ func TestMessageHandlerWithDeviceAccessCheck(t *testing.T) {
 	t.Run("Denied", func(t *testing.T) {
 		testWithDeviceAccessCheck(t, false)
 	})
+
+	t.Run("DeniedJSON", func(t *testing.T) {
+		testWithDeviceAccessDenial(t, false)
+	})
+
+	t.Run("DeniedWRP", func(t *testing.T) {
+		testWithDeviceAccessDenial(t, true)
+	})
 }
 
 type testWRPResponseWriter struct {
@@ -0,0 +1,203 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/xmidt-org/bascule"
+	"github.com/xmidt-org/webpa-common/v2/device"
+	"go.uber.org/zap"
+)
+
+// defaultPolicyName is the name of the policy made of the top level deviceAccessCheckConfig,
+// which applies to messages no other policy selects
+const defaultPolicyName = "default"
+
+var errPolicySelectorRequired = errors.New("Policies require at least one of Principals, PartnerIDs or DeviceIDPattern")
+
+// deviceAccessPolicy is a set of checks, with its own mode, for the WRP messages it
+// selects.  A policy selects a message if it matches every selector that is set.
+type deviceAccessPolicy struct {
+	// Name identifies the policy in logs and the policy label of metrics.
+	// (Optional. Defaults to policy followed by its index).
+	Name string
+
+	// Principals selects messages sent by callers authenticated as one of these principals.
+	Principals []string
+
+	// PartnerIDs selects messages sent by callers whose token claims one of these partner
+	// IDs.  The partner IDs carried by the message itself are not considered, since the
+	// caller is free to set them.
+	PartnerIDs []string
+
+	// DeviceIDPattern selects messages sent to devices whose canonical ID matches this
+	// regular expression, e.g. mac:112233.*
+	DeviceIDPattern string
+
+	// Type can either be "enforce" or "monitor", as for deviceAccessCheckConfig.
+	Type string
+
+	// Checks is the list of checks that will be run against the messages selected.
+	Checks []deviceAccessCheck
+
+	// Rule combines the Checks as for deviceAccessCheckConfig.
+	// (Optional. Defaults to allOf every check, in order).
+	Rule *deviceAccessRule
+}
+
+// accessPolicy is the compiled form of a deviceAccessPolicy, or of the default policy
+type accessPolicy struct {
+	name   string
+	strict bool
+	rule   *parsedRule
+
+	principals map[string]bool
+	partnerIDs map[string]bool
+	deviceID   *regexp.Regexp
+
+	// facts are the device fact namespaces the policy's checks refer to
+	facts map[string]bool
+}
+
+// newAccessPolicy validates and compiles the checks and mode shared by the default policy
+// and deviceAccessPolicy
+func newAccessPolicy(name, accessType string, checks []deviceAccessCheck, rule *deviceAccessRule, logger *zap.Logger) (*accessPolicy, error) {
+	logger = logger.With(zap.String("policy", name))
+	if len(checks) < 1 {
+		logger.Error("Potential security misconfig. Include checks for deviceAccessCheck or disable it")
+		return nil, errors.New("failed enabling DeviceAccessCheck")
+	}
+
+	if accessType != "enforce" && accessType != "monitor" {
+		logger.Error("Unexpected type for deviceAccessCheck. Supported types are 'monitor' and 'enforce'")
+		return nil, errors.New("failed verifying DeviceAccessCheck type")
+	}
+
+	// nolint:prealloc
+	var parsedChecks []*parsedCheck
+	for _, check := range checks {
+		parsedCheck, err := parseDeviceAccessCheck(check)
+		if err != nil {
+			logger.Error("deviceAccesscheck parse failure", zap.Error(err))
+			return nil, errors.New("failed parsing DeviceAccessCheck checks")
+		}
+		parsedChecks = append(parsedChecks, parsedCheck)
+	}
+
+	p := &accessPolicy{
+		name:   name,
+		strict: accessType == "enforce",
+		rule:   newAllOfRule(parsedChecks),
+	}
+
+	if rule != nil {
+		var err error
+		if p.rule, err = parseDeviceAccessRule(*rule, parsedChecks); err != nil {
+			logger.Error("deviceAccessCheck rule parse failure", zap.Error(err))
+			return nil, errors.New("failed parsing DeviceAccessCheck rule")
+		}
+	}
+
+	return p, nil
+}
+
+// parseDeviceAccessPolicy compiles the policy at the given index of the configured policies
+func parseDeviceAccessPolicy(index int, config deviceAccessPolicy, logger *zap.Logger) (*accessPolicy, error) {
+	name := strings.TrimSpace(config.Name)
+	if len(name) == 0 {
+		name = fmt.Sprintf("policy%d", index)
+	}
+
+	p, err := newAccessPolicy(name, config.Type, config.Checks, config.Rule, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(config.Principals) > 0 {
+		p.principals = make(map[string]bool, len(config.Principals))
+		for _, id := range config.Principals {
+			p.principals[id] = true
+		}
+	}
+
+	if len(config.PartnerIDs) > 0 {
+		p.partnerIDs = make(map[string]bool, len(config.PartnerIDs))
+		for _, partnerID := range config.PartnerIDs {
+			p.partnerIDs[partnerID] = true
+		}
+	}
+
+	if len(config.DeviceIDPattern) > 0 {
+		if p.deviceID, err = anchored(config.DeviceIDPattern); err != nil {
+			logger.Error("deviceAccessCheck policy parse failure", zap.String("policy", name), zap.Error(err))
+			return nil, errors.New("failed parsing DeviceAccessCheck policy")
+		}
+	}
+
+	if p.principals == nil && p.partnerIDs == nil && p.deviceID == nil {
+		logger.Error("deviceAccessCheck policy parse failure", zap.String("policy", name), zap.Error(errPolicySelectorRequired))
+		return nil, errors.New("failed parsing DeviceAccessCheck policy")
+	}
+
+	return p, nil
+}
+
+// selects tests whether the policy applies to a message sent by the given principal, on
+// behalf of the given partner, to the device with the given ID, which is empty if the
+// destination is not a device
+func (p *accessPolicy) selects(principal, partnerID string, id device.ID) bool {
+	if p.principals != nil && !p.principals[principal] {
+		return false
+	}
+
+	if p.partnerIDs != nil && !p.partnerIDs[partnerID] {
+		return false
+	}
+
+	if p.deviceID != nil && (len(id) == 0 || !p.deviceID.MatchString(string(id))) {
+		return false
+	}
+
+	return true
+}
+
+// principal returns the principal the caller authenticated as, if any
+func principal(ctx context.Context) string {
+	if auth, ok := bascule.FromContext(ctx); ok && auth.Token != nil {
+		return auth.Token.Principal()
+	}
+
+	return ""
+}
+
+// tokenPartnerID returns the partner ID claimed by the token the caller authenticated with,
+// if any
+func tokenPartnerID(ctx context.Context) string {
+	if auth, ok := bascule.FromContext(ctx); ok && auth.Token != nil {
+		if claim, ok := auth.Token.Attributes().Get(device.PartnerIDClaimKey); ok {
+			partnerID, _ := claim.(string)
+			return strings.TrimSpace(partnerID)
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,157 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/bascule"
+	"github.com/xmidt-org/webpa-common/v2/device"
+	"go.uber.org/zap/zaptest"
+
+	// nolint:staticcheck
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func newTestPolicyChecks() []deviceAccessCheck {
+	return []deviceAccessCheck{
+		{Name: "partner", DeviceCredentialPath: device.PartnerIDClaimKey, WRPCredentialPath: "PartnerIDs", Op: ContainsOp, Inversed: true},
+	}
+}
+
+// newTestTokenContext returns a context authenticated with a token for the given principal
+// that claims the given partner ID, unless it is empty
+func newTestTokenContext(principal, partnerID string) context.Context {
+	claims := map[string]interface{}{}
+	if len(partnerID) > 0 {
+		claims[device.PartnerIDClaimKey] = partnerID
+	}
+
+	return bascule.WithAuthentication(context.Background(), bascule.Authentication{
+		Token: bascule.NewToken("Bearer", principal, bascule.NewAttributes(claims)),
+	})
+}
+
+func testParseDeviceAccessPolicyInvalid(t *testing.T) {
+	testData := []struct {
+		description string
+		config      deviceAccessPolicy
+	}{
+		{"No selector", deviceAccessPolicy{Type: "enforce", Checks: newTestPolicyChecks()}},
+		{"Bad pattern", deviceAccessPolicy{DeviceIDPattern: "mac:[", Type: "enforce", Checks: newTestPolicyChecks()}},
+		{"Bad type", deviceAccessPolicy{PartnerIDs: []string{"comcast"}, Type: "strict", Checks: newTestPolicyChecks()}},
+		{"No checks", deviceAccessPolicy{PartnerIDs: []string{"comcast"}, Type: "enforce"}},
+	}
+
+	for _, record := range testData {
+		t.Run(record.description, func(t *testing.T) {
+			p, err := parseDeviceAccessPolicy(0, record.config, zaptest.NewLogger(t))
+			assert.Nil(t, p)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func testDeviceAccessPolicySelection(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		logger  = zaptest.NewLogger(t)
+	)
+
+	tda, err := buildDeviceAccessCheck(&deviceAccessCheckConfig{
+		Type:   "monitor",
+		Checks: newTestPolicyChecks(),
+		Policies: []deviceAccessPolicy{
+			{Name: "partner-a", Principals: []string{"partner-a-client"}, Type: "enforce", Checks: newTestPolicyChecks()},
+			{PartnerIDs: []string{"comcast"}, DeviceIDPattern: "mac:1122.*", Type: "enforce", Checks: newTestPolicyChecks()},
+		},
+	}, logger, newTestCounter(), new(device.MockRegistry), nil)
+
+	require.NoError(err)
+
+	testData := []struct {
+		description string
+		ctx         context.Context
+		id          device.ID
+		expected    string
+	}{
+		{"Principal", newTestTokenContext("partner-a-client", ""), "mac:665544332211", "partner-a"},
+		{"Partner and device", newTestTokenContext("client", " comcast"), "mac:112233445566", "policy1"},
+		{"Partner only", newTestTokenContext("client", "comcast"), "mac:665544332211", defaultPolicyName},
+		{"Device only", newTestTokenContext("client", "nbc"), "mac:112233445566", defaultPolicyName},
+		{"Invalid destination", newTestTokenContext("client", "comcast"), "", defaultPolicyName},
+		{"Unauthenticated", context.Background(), "mac:112233445566", defaultPolicyName},
+	}
+
+	for _, record := range testData {
+		p := tda.policy(principal(record.ctx), tokenPartnerID(record.ctx), record.id)
+		assert.Equal(record.expected, p.name, record.description)
+	}
+
+	assert.False(tda.defaultPolicy.strict)
+	assert.True(tda.policies[0].strict)
+}
+
+func testDeviceAccessPolicyAuthorize(t *testing.T) {
+	var (
+		assert             = assert.New(t)
+		require            = require.New(t)
+		mockDeviceRegistry = new(device.MockRegistry)
+		mockDevice         = new(device.MockDevice)
+		counter            = newTestCounter()
+	)
+
+	mockDeviceRegistry.On("Get", device.ID("mac:112233445566")).Return(mockDevice, true)
+	mockDevice.On("Metadata").Return(getTestDeviceMetadata())
+	da, err := buildDeviceAccessCheck(&deviceAccessCheckConfig{
+		Type:   "monitor",
+		Checks: newTestPolicyChecks(),
+		Policies: []deviceAccessPolicy{
+			{Name: "comcast", PartnerIDs: []string{"comcast"}, Type: "enforce", Checks: newTestPolicyChecks()},
+		},
+	}, zaptest.NewLogger(t), counter, mockDeviceRegistry, nil)
+
+	require.NoError(err)
+
+	// the same denial is only enforced for the partner whose policy is strict
+	err = da.authorizeWRP(context.Background(), &wrp.Message{PartnerIDs: []string{"nbc"}, Destination: "mac:112233445566"})
+	assert.NoError(err)
+	assert.Equal(defaultPolicyName, counter.labelPairs[policyLabel])
+	assert.Equal(accepted, counter.labelPairs[outcomeLabel])
+	assert.Equal(denied, counter.labelPairs[reasonLabel])
+
+	// the partner IDs of the message do not select a policy, only those of the token do
+	err = da.authorizeWRP(context.Background(), &wrp.Message{PartnerIDs: []string{"comcast"}, Destination: "mac:112233445566"})
+	assert.NoError(err)
+	assert.Equal(defaultPolicyName, counter.labelPairs[policyLabel])
+
+	err = da.authorizeWRP(newTestTokenContext("client", "comcast"), &wrp.Message{PartnerIDs: []string{"comcast"}, Destination: "mac:112233445566"})
+	assert.ErrorIs(err, errDeniedDeviceAccess)
+	assert.Equal("comcast", counter.labelPairs[policyLabel])
+	assert.Equal(rejected, counter.labelPairs[outcomeLabel])
+	assert.Equal("partner", counter.labelPairs[checkLabel])
+}
+
+func TestDeviceAccessPolicy(t *testing.T) {
+	t.Run("Invalid", testParseDeviceAccessPolicyInvalid)
+	t.Run("Selection", testDeviceAccessPolicySelection)
+	t.Run("Authorize", testDeviceAccessPolicyAuthorize)
+}
@@ -19,6 +19,7 @@ package main
 import (
 	"context"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/go-kit/kit/metrics"
@@ -44,11 +45,30 @@ type ackDispatcher struct {
 	AckFailure        metrics.Counter
 	AckSuccessLatency metrics.Histogram
 	AckFailureLatency metrics.Histogram
+	deliveries        *deliveryTracker
+	rules             map[wrp.MessageType]ackRule
+
+	// pending holds a token for each ack held back waiting for its delivery outcome
+	pending chan struct{}
+
+	// lock guards inFlight, the number of acks being sent, and idle, which is closed
+	// whenever inFlight drops to zero
+	lock     sync.Mutex
+	inFlight int
+	idle     chan struct{}
 }
 
 // NewAckDispatcher is an ackDispatcher factory which processes outbound events
-// and determines whether or not an ack to the source device is required.
-func NewAckDispatcher(om OutboundMeasures, o *Outbounder) (Dispatcher, error) {
+// and determines whether or not an ack to the source device is required.  If
+// deliveries is non-nil, acks are held back until the delivery outcome of the
+// message is known, and otherwise are sent immediately.  An error is returned if the
+// Outbounder's AckRules are invalid.
+func NewAckDispatcher(om OutboundMeasures, o *Outbounder, deliveries *deliveryTracker) (Dispatcher, error) {
+	rules, err := newAckRules(o)
+	if err != nil {
+		return nil, err
+	}
+
 	l := o.logger()
 	n, err := os.Hostname()
 	if err != nil {
@@ -64,14 +84,15 @@ func NewAckDispatcher(om OutboundMeasures, o *Outbounder) (Dispatcher, error) {
 		AckFailure:        om.AckFailure,
 		AckSuccessLatency: om.AckSuccessLatency,
 		AckFailureLatency: om.AckFailureLatency,
+		deliveries:        deliveries,
+		rules:             rules,
+		pending:           make(chan struct{}, o.maxPendingAcks()),
 	}, nil
 }
 
 // OnDeviceEvent is the device.Listener function that processes outbound events
 // and determines whether or not an ack to the source device is required.
 func (d *ackDispatcher) OnDeviceEvent(event *device.Event) {
-	var r *device.Request
-
 	if event == nil {
 		d.logger.Error("Error nil event")
 		return
@@ -86,62 +107,83 @@ func (d *ackDispatcher) OnDeviceEvent(event *device.Event) {
 		return
 	}
 
-	// rdr of 0 is success https://xmidt.io/docs/wrp/basics/#request-delivery-response-rdr-codes
-	// Atm, there doesn't exist any conditions that'll cause a request delivery response to be a nonzero
-	var rdr int64 = 0
-	// Verify ack conditions are met for a given event
-	switch event.Type {
 	// Atm, we're only supporting acks for MessageReceived events
-	case device.MessageReceived:
-		// Verify ack conditions are met for a given message and their type
-		switch m.Type {
-		// Atm, we're only supporting acks for SimpleEventMessageTypes QOS
-		case wrp.SimpleEventMessageType:
-			// Atm, we're only supporting acks for QOS
-			if !m.IsQOSAckPart() {
-				return
-			}
+	if event.Type != device.MessageReceived {
+		return
+	}
 
-			// https://xmidt.io/docs/wrp/simple-messages/#qos-details
-			r = &device.Request{
-				Message: &wrp.Message{
-					// When a qos field is specified that requires an ack, the response ack message SHALL be a msg_type=4.
-					Type: wrp.SimpleEventMessageType,
-					// The `source` SHALL be the component that cannot process the event further.
-					Source: d.hostname,
-					// The `dest` SHALL be the original requesting `source` address.
-					Destination: m.Source,
-					// The `content_type` and `payload` SHALL be omitted & set to empty, or may set to `application/text` and text to help describe the result.  **DO NOT** process this text beyond for logging/debugging.
-					ContentType: "",
-					Payload:     []byte{},
-					// The `partner_ids` SHALL be the same as the original message.
-					PartnerIDs: m.PartnerIDs,
-					// The `headers` SHOULD generally be the same as the original message, except where updating their values is correct.
-					Headers: m.Headers,
-					// The `metadata` map SHALL be populated with the original data or set to empty.
-					Metadata: m.Metadata,
-					// The `session_id` MAY be added by the cloud.
-					SessionID: dm.SessionID(),
-					// The `qos` SHALL be the same as the original message.
-					QualityOfService: m.QualityOfService,
-					// The `transaction_uuid` SHALL be the same as the original message.
-					TransactionUUID: m.TransactionUUID,
-					// The `rdr` SHALL be present and represent the outcome of the handling of the message.
-					RequestDeliveryResponse: &rdr,
-				},
-				Format: event.Format,
-			}
+	// A delivery is tracked for every QoS message, so it is taken whether or not the
+	// message's type is acked
+	dv := d.deliveries.take(m)
+	rule, ok := d.rules[m.Type]
+	if !ok || !requiresQOSAck(m) {
+		return
+	}
+
+	// rdr of 0 is success https://xmidt.io/docs/wrp/basics/#request-delivery-response-rdr-codes
+	// The rdr is updated with the delivery outcome when deliveries are tracked
+	var rdr int64 = rdrDelivered
+	// https://xmidt.io/docs/wrp/simple-messages/#qos-details
+	ack := &wrp.Message{
+		// Acks are always simple events, i.e. msg_type=4, whatever the type of the original.
+		Type: wrp.SimpleEventMessageType,
+		// The `source` SHALL be the component that cannot process the event further.
+		Source: d.hostname,
+		// The `dest` SHALL be the original requesting `source` address.
+		Destination: m.Source,
+		// The `content_type` and `payload` SHALL be omitted & set to empty, or may set to `application/text` and text to help describe the result.  **DO NOT** process this text beyond for logging/debugging.
+		ContentType: "",
+		Payload:     []byte{},
+		// The `session_id` MAY be added by the cloud.
+		SessionID: dm.SessionID(),
+		// The `qos` SHALL be the same as the original message.
+		QualityOfService: m.QualityOfService,
+		// The `transaction_uuid` SHALL be the same as the original message.
+		TransactionUUID: m.TransactionUUID,
+		// The `rdr` SHALL be present and represent the outcome of the handling of the message.
+		RequestDeliveryResponse: &rdr,
+	}
+
+	// By default, the `partner_ids` SHALL be the same as the original message, the `headers`
+	// SHOULD generally be the same and the `metadata` map SHALL be populated with the original data.
+	rule.apply(ack, m)
+	r := &device.Request{
+		Message: ack,
+		Format:  event.Format,
+	}
+
+	d.begin()
+	if dv != nil {
+		select {
+		case d.pending <- struct{}{}:
+			// hold the ack back without blocking the device's other messages
+			go func(dev device.Interface, p string) {
+				defer d.end()
+				rdr = dv.wait(d.deliveries.timeout)
+				<-d.pending
+				d.sendAck(dev, r, m, p)
+			}(event.Device, dm.PartnerIDClaim())
 
-		default:
 			return
-		}
 
-	default:
-		return
+		default:
+			// too many acks are already held back, so this one is sent right away.  Unless
+			// the outcome is already known, the message is still queued and the ack reports
+			// it as delivered, as it would without deliveries being tracked, rather than
+			// claim a failure that would make the device resend it.
+			if outcome, settled := dv.outcome(); settled {
+				rdr = outcome
+			}
+		}
 	}
 
+	defer d.end()
+	d.sendAck(event.Device, r, m, dm.PartnerIDClaim())
+}
+
+// sendAck sends the ack r for the message m to the device, whose partner is p
+func (d *ackDispatcher) sendAck(dev device.Interface, r *device.Request, m *wrp.Message, p string) {
 	l := m.QualityOfService.Level()
-	p := dm.PartnerIDClaim()
 	t := m.Type.FriendlyName()
 	// Metric labels
 	ls := []string{qosLevelLabel, l.String(), partnerIDLabel, p, messageType, t}
@@ -154,7 +196,7 @@ func (d *ackDispatcher) OnDeviceEvent(event *device.Event) {
 		d.recordAckLatency(s, ackFailure, ls...)
 	}(time.Now())
 
-	if _, err := event.Device.Send(r.WithContext(ctx)); err != nil {
+	if _, err := dev.Send(r.WithContext(ctx)); err != nil {
 		d.logger.Error("Error dispatching QOS ack", zap.Any("qosLevel", l), zap.Any("partnerID", p), zap.Any("messageType", t), zap.Error(err))
 		d.AckFailure.With(ls...).Add(1)
 		ackFailure = true
@@ -164,6 +206,58 @@ func (d *ackDispatcher) OnDeviceEvent(event *device.Event) {
 	d.AckSuccess.With(ls...).Add(1)
 }
 
+// requiresQOSAck tests whether the QoS level of the message requires an ack, regardless of
+// its message type.  See https://xmidt.io/docs/wrp/basics/#qos-description-qos
+func requiresQOSAck(m *wrp.Message) bool {
+	switch m.QualityOfService.Level() {
+	case wrp.QOSMedium, wrp.QOSHigh, wrp.QOSCritical:
+		return true
+	default:
+		return false
+	}
+}
+
+func (d *ackDispatcher) begin() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.inFlight == 0 {
+		d.idle = make(chan struct{})
+	}
+
+	d.inFlight++
+}
+
+func (d *ackDispatcher) end() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.inFlight--
+	if d.inFlight == 0 {
+		close(d.idle)
+	}
+}
+
+// wait blocks until no acks are being sent or the given context is done, returning the
+// number of acks still being sent
+func (d *ackDispatcher) wait(ctx context.Context) int {
+	d.lock.Lock()
+	if d.inFlight == 0 {
+		d.lock.Unlock()
+		return 0
+	}
+
+	idle := d.idle
+	d.lock.Unlock()
+
+	select {
+	case <-idle:
+		return 0
+	case <-ctx.Done():
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		return d.inFlight
+	}
+}
+
 // recordAckLatency records the latency for both successful and failed acks
 func (d *ackDispatcher) recordAckLatency(s time.Time, f bool, l ...string) {
 	switch {
@@ -75,7 +75,7 @@ func testAckDispatcherOnDeviceEventQOSEventFailure(t *testing.T) {
 					}), zapcore.AddSync(&b), zapcore.ErrorLevel),
 			)
 			o.Logger = logger
-			dp, err := NewAckDispatcher(om, o)
+			dp, err := NewAckDispatcher(om, o, nil)
 			require.NotNil(dp)
 			require.NoError(err)
 			// Purge init logs
@@ -200,7 +200,7 @@ func testAckDispatcherOnDeviceEventQOSDeviceFailure(t *testing.T) {
 					}), zapcore.AddSync(&b), zapcore.ErrorLevel),
 			)
 			o.Logger = logger
-			dp, err := NewAckDispatcher(om, o)
+			dp, err := NewAckDispatcher(om, o, nil)
 			require.NotNil(dp)
 			require.NoError(err)
 			// Purge init logs
@@ -524,7 +524,7 @@ func testAckDispatcherOnDeviceEventQOSSuccess(t *testing.T) {
 					}), zapcore.AddSync(&b), zapcore.ErrorLevel),
 			)
 			o.Logger = logger
-			dp, err := NewAckDispatcher(om, o)
+			dp, err := NewAckDispatcher(om, o, nil)
 			require.NotNil(dp)
 			require.NoError(err)
 			// Purge init logs
@@ -0,0 +1,113 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	// nolint:staticcheck
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+// DefaultAckFields are the fields of a message copied into its QoS ack when an AckRule
+// does not list any
+var DefaultAckFields = []string{"partnerIDs", "headers", "metadata"}
+
+// AckRule describes the QoS acks sent for messages of one WRP message type.  An ack is
+// sent for a message of that type whose QoS level is medium or above.  The ack itself is
+// always a SimpleEvent.
+type AckRule struct {
+	// MessageType is the message type acked, e.g. SimpleEvent, Create, Retrieve, Update,
+	// Delete or SimpleRequestResponse.
+	MessageType string `json:"messageType"`
+
+	// Fields are the fields of the message copied into the ack, in addition to the
+	// destination, QoS and transaction UUID that every ack carries.  If unset,
+	// DefaultAckFields are copied.
+	Fields []string `json:"fields"`
+}
+
+// ackFields are the functions that copy each field that an AckRule may list from a
+// message into its ack
+var ackFields = map[string]func(ack, m *wrp.Message){
+	"partnerids":  func(ack, m *wrp.Message) { ack.PartnerIDs = m.PartnerIDs },
+	"headers":     func(ack, m *wrp.Message) { ack.Headers = m.Headers },
+	"metadata":    func(ack, m *wrp.Message) { ack.Metadata = m.Metadata },
+	"path":        func(ack, m *wrp.Message) { ack.Path = m.Path },
+	"servicename": func(ack, m *wrp.Message) { ack.ServiceName = m.ServiceName },
+	"url":         func(ack, m *wrp.Message) { ack.URL = m.URL },
+	"accept":      func(ack, m *wrp.Message) { ack.Accept = m.Accept },
+	"spans":       func(ack, m *wrp.Message) { ack.Spans = m.Spans },
+}
+
+// ackRule is the compiled form of an AckRule
+type ackRule []func(ack, m *wrp.Message)
+
+// apply copies the rule's fields from the message m into its ack
+func (r ackRule) apply(ack, m *wrp.Message) {
+	for _, f := range r {
+		f(ack, m)
+	}
+}
+
+// newAckRules compiles the Outbounder's AckRules, keyed by the message type each applies
+// to.  Only simple events are acked unless rules are configured.
+func newAckRules(o *Outbounder) (map[wrp.MessageType]ackRule, error) {
+	configured := []AckRule{{MessageType: wrp.SimpleEventMessageType.FriendlyName()}}
+	if o != nil && len(o.AckRules) > 0 {
+		configured = o.AckRules
+	}
+
+	rules := make(map[wrp.MessageType]ackRule, len(configured))
+	for _, ar := range configured {
+		mt, err := wrp.StringToMessageType(ar.MessageType)
+		if err != nil {
+			return nil, err
+		}
+
+		switch mt {
+		case wrp.SimpleRequestResponseMessageType, wrp.SimpleEventMessageType,
+			wrp.CreateMessageType, wrp.RetrieveMessageType, wrp.UpdateMessageType, wrp.DeleteMessageType:
+		default:
+			return nil, fmt.Errorf("acks are not supported for message type %s", ar.MessageType)
+		}
+
+		if _, ok := rules[mt]; ok {
+			return nil, fmt.Errorf("duplicate ack rule for message type %s", ar.MessageType)
+		}
+
+		fields := ar.Fields
+		if len(fields) == 0 {
+			fields = DefaultAckFields
+		}
+
+		var rule ackRule
+		for _, field := range fields {
+			f, ok := ackFields[strings.ToLower(field)]
+			if !ok {
+				return nil, fmt.Errorf("invalid ack field %s for message type %s", field, ar.MessageType)
+			}
+
+			rule = append(rule, f)
+		}
+
+		rules[mt] = rule
+	}
+
+	return rules, nil
+}
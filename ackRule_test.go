@@ -0,0 +1,138 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/webpa-common/v2/device"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func testAckRulesDefault(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+	)
+
+	rules, err := newAckRules(nil)
+	require.NoError(err)
+	require.Len(rules, 1)
+	require.Contains(rules, wrp.SimpleEventMessageType)
+
+	ack := new(wrp.Message)
+	rules[wrp.SimpleEventMessageType].apply(ack, &wrp.Message{
+		PartnerIDs: []string{"foo"},
+		Headers:    []string{"Header1"},
+		Metadata:   map[string]string{"name": "value"},
+		Path:       "/some/where",
+	})
+
+	assert.Equal([]string{"foo"}, ack.PartnerIDs)
+	assert.Equal([]string{"Header1"}, ack.Headers)
+	assert.Equal(map[string]string{"name": "value"}, ack.Metadata)
+	assert.Empty(ack.Path)
+}
+
+func testAckRulesInvalid(t *testing.T) {
+	testData := []struct {
+		description string
+		rules       []AckRule
+	}{
+		{"UnknownType", []AckRule{{MessageType: "Unknown"}}},
+		{"UnsupportedType", []AckRule{{MessageType: "Auth"}}},
+		{"Duplicate", []AckRule{{MessageType: "Create"}, {MessageType: "Create"}}},
+		{"UnknownField", []AckRule{{MessageType: "Create", Fields: []string{"payload"}}}},
+	}
+
+	for _, record := range testData {
+		t.Run(record.description, func(t *testing.T) {
+			rules, err := newAckRules(&Outbounder{AckRules: record.rules})
+			assert.Nil(t, rules)
+			assert.Error(t, err)
+
+			dispatcher, err := NewAckDispatcher(NewTestOutboundMeasures(), &Outbounder{AckRules: record.rules}, nil)
+			assert.Nil(t, dispatcher)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func testAckRulesDispatcher(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		d       = new(device.MockDevice)
+		acks    = make(chan *wrp.Message, 10)
+	)
+
+	d.On("Metadata").Return(genTestMetadata())
+	d.On("Send", mock.AnythingOfType("*device.Request")).Run(func(args mock.Arguments) {
+		acks <- args.Get(0).(*device.Request).Message.(*wrp.Message)
+	}).Return(nil, error(nil))
+
+	dispatcher, err := NewAckDispatcher(NewTestOutboundMeasures(), &Outbounder{
+		AckRules: []AckRule{
+			{MessageType: "Create", Fields: []string{"Path", "partnerIDs"}},
+			{MessageType: "SimpleRequestResponse"},
+		},
+	}, nil)
+
+	require.NoError(err)
+	for _, mt := range []wrp.MessageType{wrp.CreateMessageType, wrp.SimpleEventMessageType, wrp.SimpleRequestResponseMessageType} {
+		dispatcher.OnDeviceEvent(&device.Event{
+			Type:   device.MessageReceived,
+			Device: d,
+			Message: &wrp.Message{
+				Type:             mt,
+				Source:           "mac:112233445566/service",
+				Destination:      "dns:external.com",
+				TransactionUUID:  "DEADBEEF",
+				Path:             "/some/where",
+				Headers:          []string{"Header1"},
+				PartnerIDs:       []string{"foo"},
+				QualityOfService: wrp.QOSMediumValue,
+			},
+		})
+	}
+
+	// simple events are no longer acked once rules are configured
+	require.Len(acks, 2)
+	// acks are simple events whatever the type of the acked message
+	ack := <-acks
+	assert.Equal(wrp.SimpleEventMessageType, ack.Type)
+	assert.Equal("mac:112233445566/service", ack.Destination)
+	assert.Equal("DEADBEEF", ack.TransactionUUID)
+	assert.Equal(wrp.QOSMediumValue, ack.QualityOfService)
+	assert.Equal("/some/where", ack.Path)
+	assert.Equal([]string{"foo"}, ack.PartnerIDs)
+	assert.Empty(ack.Headers)
+
+	ack = <-acks
+	assert.Equal(wrp.SimpleEventMessageType, ack.Type)
+	assert.Equal([]string{"Header1"}, ack.Headers)
+	assert.Empty(ack.Path)
+}
+
+func TestAckRules(t *testing.T) {
+	t.Run("Default", testAckRulesDefault)
+	t.Run("Invalid", testAckRulesInvalid)
+	t.Run("Dispatcher", testAckRulesDispatcher)
+}
@@ -0,0 +1,406 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/gorilla/mux"
+	"github.com/segmentio/ksuid"
+	"github.com/spf13/viper"
+	"github.com/xmidt-org/webpa-common/v2/xmetrics"
+	"go.uber.org/zap"
+
+	// nolint:staticcheck
+	"github.com/xmidt-org/webpa-common/v2/xhttp"
+	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/wrp-go/v3/wrphttp"
+)
+
+const (
+	// DefaultAsyncMaxResults is the default for the most asynchronous requests whose results
+	// are kept at once, including those still in progress
+	DefaultAsyncMaxResults = 1000
+
+	// DefaultAsyncTTL is the default for how long the result of an asynchronous request is
+	// kept once it is complete
+	DefaultAsyncTTL = 5 * time.Minute
+
+	// DefaultAsyncCallbackTimeout is the default timeout for posting a result to a callback URL
+	DefaultAsyncCallbackTimeout = 10 * time.Second
+
+	// asyncTransactionIDHeader names the asynchronous request that a result belongs to
+	asyncTransactionIDHeader = "X-Xmidt-Transaction-Id"
+
+	// asyncStatusHeader carries the status code of the result posted to a callback URL
+	asyncStatusHeader = "X-Xmidt-Status"
+
+	// asyncPending and asyncComplete are the states of an asynchronous request
+	asyncPending  = "pending"
+	asyncComplete = "complete"
+)
+
+var (
+	errAsyncResultsFull      = errors.New("Too many asynchronous requests are in progress")
+	errAsyncResultNotFound   = errors.New("No result for the transaction")
+	errAsyncCallbackDisabled = errors.New("Callback URLs require outbound to be running")
+)
+
+// AsyncConfig bounds the results kept for asynchronous requests to /device/send
+type AsyncConfig struct {
+	// MaxResults is the most results kept at once, including those of requests still in
+	// progress.  Asynchronous requests are rejected with a 503 while it is reached.
+	// (Optional. Defaults to 1000).
+	MaxResults int
+
+	// TTL is how long a result is kept once the request is complete.
+	// (Optional. Defaults to 5m).
+	TTL time.Duration
+
+	// CallbackTimeout is the timeout for posting a result to a callback URL.
+	// (Optional. Defaults to 10s).
+	CallbackTimeout time.Duration
+}
+
+// asyncResult is the state of an asynchronous request.  Only the caller that made the
+// request may read its result.
+type asyncResult struct {
+	ID     string `json:"transactionID"`
+	Status string `json:"status"`
+
+	principal string
+	callback  string
+	expires   time.Time
+	code      int
+	header    http.Header
+	body      []byte
+}
+
+// asyncResults keeps the results of asynchronous requests until they expire
+type asyncResults struct {
+	logger    *zap.Logger
+	client    *http.Client
+	filter    URLFilter
+	requests  metrics.Counter
+	callbacks metrics.Counter
+	now       func() time.Time
+
+	// timeout bounds how long a request runs in the background
+	timeout    time.Duration
+	ttl        time.Duration
+	maxResults int
+
+	lock    sync.Mutex
+	results map[string]*asyncResult
+}
+
+// newAsyncResults creates the store for asynchronous request results described by the
+// Viper environment.  Callback URLs must pass filter, and are refused if it is nil.
+func newAsyncResults(logger *zap.Logger, v *viper.Viper, registry xmetrics.Registry, filter URLFilter, timeout time.Duration) (*asyncResults, error) {
+	var config AsyncConfig
+	if err := v.UnmarshalKey(InboundAsyncConfigKey, &config); err != nil {
+		return nil, err
+	}
+
+	if config.MaxResults < 1 {
+		config.MaxResults = DefaultAsyncMaxResults
+	}
+
+	if config.TTL <= 0 {
+		config.TTL = DefaultAsyncTTL
+	}
+
+	if config.CallbackTimeout <= 0 {
+		config.CallbackTimeout = DefaultAsyncCallbackTimeout
+	}
+
+	return &asyncResults{
+		logger:     logger,
+		client:     &http.Client{Timeout: config.CallbackTimeout},
+		filter:     filter,
+		requests:   registry.NewCounter(AsyncRequestCounter),
+		callbacks:  registry.NewCounter(AsyncCallbackCounter),
+		now:        time.Now,
+		timeout:    timeout,
+		ttl:        config.TTL,
+		maxResults: config.MaxResults,
+		results:    make(map[string]*asyncResult),
+	}, nil
+}
+
+// add starts keeping the result of a new asynchronous request, returning its pending
+// state.  Pending results expire as well, in case the request never completes.
+func (ar *asyncResults) add(principal, callback string) (asyncResult, error) {
+	now := ar.now()
+	ar.lock.Lock()
+	defer ar.lock.Unlock()
+
+	for id, result := range ar.results {
+		if now.After(result.expires) {
+			delete(ar.results, id)
+		}
+	}
+
+	if len(ar.results) >= ar.maxResults {
+		return asyncResult{}, errAsyncResultsFull
+	}
+
+	result := &asyncResult{
+		ID:        ksuid.New().String(),
+		Status:    asyncPending,
+		principal: principal,
+		callback:  callback,
+		expires:   now.Add(ar.timeout + ar.ttl),
+	}
+
+	ar.results[result.ID] = result
+	return *result, nil
+}
+
+// complete records the response written for an asynchronous request, and posts it to
+// the request's callback URL if it has one
+func (ar *asyncResults) complete(id string, rw *asyncResponseWriter) {
+	now := ar.now()
+	ar.lock.Lock()
+	result, ok := ar.results[id]
+	if ok {
+		result.Status = asyncComplete
+		result.expires = now.Add(ar.ttl)
+		result.code, result.header, result.body = rw.code, rw.header, rw.body.Bytes()
+	}
+
+	ar.lock.Unlock()
+	if ok && len(result.callback) > 0 {
+		ar.post(result)
+	}
+}
+
+// get returns the result of the given request, if it has not expired and was made by
+// the given principal
+func (ar *asyncResults) get(id, principal string) (asyncResult, bool) {
+	now := ar.now()
+	ar.lock.Lock()
+	defer ar.lock.Unlock()
+
+	result, ok := ar.results[id]
+	if !ok || result.principal != principal || now.After(result.expires) {
+		return asyncResult{}, false
+	}
+
+	return *result, true
+}
+
+// post sends a complete result to its callback URL.  The body and Content-Type are those
+// of the response the request would have had.
+func (ar *asyncResults) post(result *asyncResult) {
+	request, err := http.NewRequest(http.MethodPost, result.callback, bytes.NewReader(result.body))
+	if err != nil {
+		ar.logger.Error("Unable to create asynchronous result callback", zap.String("transactionID", result.ID), zap.Error(err))
+		ar.callbacks.With(outcomeLabel, failure).Add(1.0)
+		return
+	}
+
+	request.Header.Set("Content-Type", result.header.Get("Content-Type"))
+	request.Header.Set(asyncTransactionIDHeader, result.ID)
+	request.Header.Set(asyncStatusHeader, strconv.Itoa(result.code))
+
+	response, err := ar.client.Do(request)
+	if err == nil {
+		io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+		if response.StatusCode >= 300 {
+			err = httpStatusError{response.Status}
+		}
+	}
+
+	if err != nil {
+		ar.logger.Error("Unable to post asynchronous result to callback", zap.String("transactionID", result.ID), zap.String("callback", result.callback), zap.Error(err))
+		ar.callbacks.With(outcomeLabel, failure).Add(1.0)
+		return
+	}
+
+	ar.callbacks.With(outcomeLabel, success).Add(1.0)
+}
+
+// asyncResponseWriter captures the response written for a request that runs in the
+// background, in the WRP format negotiated with the caller
+type asyncResponseWriter struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+	format wrp.Format
+}
+
+func newAsyncResponseWriter(format wrp.Format) *asyncResponseWriter {
+	return &asyncResponseWriter{
+		header: make(http.Header),
+		code:   http.StatusOK,
+		format: format,
+	}
+}
+
+func (rw *asyncResponseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *asyncResponseWriter) WriteHeader(code int) {
+	rw.code = code
+}
+
+func (rw *asyncResponseWriter) Write(p []byte) (int, error) {
+	return rw.body.Write(p)
+}
+
+func (rw *asyncResponseWriter) WriteWRP(e *wrphttp.Entity) (int, error) {
+	if len(e.Bytes) > 0 && e.Format == rw.format {
+		return rw.WriteWRPBytes(rw.format, e.Bytes)
+	}
+
+	var output []byte
+	if err := wrp.NewEncoderBytes(&output, rw.format).Encode(&e.Message); err != nil {
+		return 0, err
+	}
+
+	return rw.WriteWRPBytes(rw.format, output)
+}
+
+func (rw *asyncResponseWriter) WriteWRPBytes(f wrp.Format, encodedWRP []byte) (int, error) {
+	if encodedWRP == nil {
+		return 0, wrphttp.ErrEmptyWRPBytes
+	}
+
+	if f != rw.format {
+		return 0, wrphttp.ErrContentNegotiationMismatch
+	}
+
+	rw.header.Set("Content-Type", f.ContentType())
+	return rw.body.Write(encodedWRP)
+}
+
+func (rw *asyncResponseWriter) WRPFormat() wrp.Format {
+	return rw.format
+}
+
+// detachedContext keeps the values of a request's context, such as its logger and
+// authentication, but not its cancellation, so that work can outlive the request
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// withAsync runs requests to /device/send in the background when the async query parameter
+// is true or a callback URL is given, responding at once with a 202 and the transaction ID
+// whose result may be fetched from /device/send/{transactionID}.  The result is posted to
+// the callback URL, if there is one, once the device responds or the request times out.
+func withAsync(errorLogger *zap.Logger, next wrphttp.HandlerFunc, ar *asyncResults) wrphttp.HandlerFunc {
+	return func(w wrphttp.ResponseWriter, r *wrphttp.Request) {
+		var (
+			query       = r.Original.URL.Query()
+			async, _    = strconv.ParseBool(query.Get("async"))
+			callback    = query.Get("callback")
+			callbackErr error
+		)
+
+		if !async && len(callback) == 0 {
+			next(w, r)
+			return
+		}
+
+		if len(callback) > 0 {
+			if ar.filter == nil {
+				callbackErr = errAsyncCallbackDisabled
+			} else {
+				callback, callbackErr = ar.filter.Filter(callback)
+			}
+		}
+
+		if callbackErr != nil {
+			ar.requests.With(outcomeLabel, rejected).Add(1.0)
+			xhttp.WriteErrorf(w, http.StatusBadRequest, "Invalid callback URL: %s", callbackErr)
+			return
+		}
+
+		result, err := ar.add(principal(r.Context()), callback)
+		if err != nil {
+			ar.requests.With(outcomeLabel, rejected).Add(1.0)
+			xhttp.WriteError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+
+		ar.requests.With(outcomeLabel, accepted).Add(1.0)
+
+		// w must not be used once this handler returns
+		go func(id string, format wrp.Format) {
+			ctx, cancel := context.WithTimeout(detachedContext{r.Context()}, ar.timeout)
+			defer cancel()
+
+			rw := newAsyncResponseWriter(format)
+			next(rw, r.WithContext(ctx))
+			errorLogger.Debug("Asynchronous device request complete", zap.String("transactionID", id), zap.Int("code", rw.code))
+			ar.complete(id, rw)
+		}(result.ID, w.WRPFormat())
+
+		w.Header().Set("Location", r.Original.URL.Path+"/"+result.ID)
+		w.Header().Set(asyncTransactionIDHeader, result.ID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// asyncResultHandler serves the results of asynchronous requests.  A request still in
+// progress is a 202 with its status, and a complete one is the response the request would
+// have had.
+type asyncResultHandler struct {
+	results *asyncResults
+}
+
+func (h asyncResultHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	id := mux.Vars(request)["transactionID"]
+	result, ok := h.results.get(id, principal(request.Context()))
+	if !ok {
+		xhttp.WriteError(response, http.StatusNotFound, errAsyncResultNotFound)
+		return
+	}
+
+	response.Header().Set(asyncTransactionIDHeader, result.ID)
+	if result.Status == asyncPending {
+		response.Header().Set("Content-Type", "application/json")
+		response.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(response).Encode(result)
+		return
+	}
+
+	for name, values := range result.header {
+		response.Header()[name] = values
+	}
+
+	response.WriteHeader(result.code)
+	response.Write(result.body)
+}
@@ -0,0 +1,243 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/bascule"
+	"github.com/xmidt-org/webpa-common/v2/xmetrics"
+	"go.uber.org/zap/zaptest"
+
+	// nolint:staticcheck
+	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/wrp-go/v3/wrphttp"
+)
+
+func newTestAsyncResults(t *testing.T, filter URLFilter, maxResults int) *asyncResults {
+	v := viper.New()
+	v.Set(InboundAsyncConfigKey+".maxResults", maxResults)
+	v.Set(InboundAsyncConfigKey+".ttl", "1m")
+
+	ar, err := newAsyncResults(zaptest.NewLogger(t), v, xmetrics.MustNewRegistry(nil, Metrics), filter, time.Second)
+	require.NoError(t, err)
+	return ar
+}
+
+// newAsyncTestRequest returns a /device/send request made with the given query, in the
+// given context
+func newAsyncTestRequest(ctx context.Context, query string) *wrphttp.Request {
+	return (&wrphttp.Request{
+		Original: httptest.NewRequest("POST", "/api/v3/device/send"+query, nil),
+		Entity: &wrphttp.Entity{
+			Message: wrp.Message{
+				Type:            wrp.SimpleRequestResponseMessageType,
+				Destination:     "mac:112233445566",
+				TransactionUUID: "DEADBEEF",
+			},
+		},
+	}).WithContext(ctx)
+}
+
+// getAsyncResult fetches the result of the given transaction from /device/send/{transactionID}
+func getAsyncResult(ctx context.Context, ar *asyncResults, id string) *httptest.ResponseRecorder {
+	var (
+		response = httptest.NewRecorder()
+		request  = httptest.NewRequest("GET", "/api/v3/device/send/"+id, nil).WithContext(ctx)
+	)
+
+	asyncResultHandler{results: ar}.ServeHTTP(response, mux.SetURLVars(request, map[string]string{"transactionID": id}))
+	return response
+}
+
+// respondingHandler is a wrpRouterHandler whose device responds once release is closed
+func respondingHandler(release <-chan struct{}) wrphttp.HandlerFunc {
+	return func(w wrphttp.ResponseWriter, r *wrphttp.Request) {
+		<-release
+		w.WriteWRP(&wrphttp.Entity{
+			Message: wrp.Message{
+				Type:            wrp.SimpleRequestResponseMessageType,
+				Source:          r.Entity.Message.Destination,
+				TransactionUUID: r.Entity.Message.TransactionUUID,
+				Payload:         []byte("ok"),
+			},
+		})
+	}
+}
+
+func testWithAsyncPolling(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		ar      = newTestAsyncResults(t, nil, 10)
+		release = make(chan struct{})
+		handler = withAsync(zaptest.NewLogger(t), respondingHandler(release), ar)
+		caller  = bascule.WithAuthentication(context.Background(), bascule.Authentication{
+			Token: bascule.NewToken("Bearer", "caller", bascule.NewAttributes(nil)),
+		})
+		recorder = httptest.NewRecorder()
+	)
+
+	handler(newTestWRPResponseWriter(recorder), newAsyncTestRequest(caller, "?async=true"))
+	assert.Equal(http.StatusAccepted, recorder.Code)
+
+	var pending asyncResult
+	require.NoError(json.Unmarshal(recorder.Body.Bytes(), &pending))
+	require.NotEmpty(pending.ID)
+	assert.Equal(asyncPending, pending.Status)
+	assert.Equal("/api/v3/device/send/"+pending.ID, recorder.Header().Get("Location"))
+	assert.Equal(pending.ID, recorder.Header().Get(asyncTransactionIDHeader))
+
+	response := getAsyncResult(caller, ar, pending.ID)
+	assert.Equal(http.StatusAccepted, response.Code)
+
+	// only the caller may fetch the result
+	assert.Equal(http.StatusNotFound, getAsyncResult(context.Background(), ar, pending.ID).Code)
+	assert.Equal(http.StatusNotFound, getAsyncResult(caller, ar, "nonsense").Code)
+
+	close(release)
+	require.Eventually(func() bool {
+		response = getAsyncResult(caller, ar, pending.ID)
+		return response.Code != http.StatusAccepted
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Equal(http.StatusOK, response.Code)
+	assert.Equal(wrp.Msgpack.ContentType(), response.Header().Get("Content-Type"))
+
+	var reply wrp.Message
+	require.NoError(wrp.NewDecoderBytes(response.Body.Bytes(), wrp.Msgpack).Decode(&reply))
+	assert.Equal("DEADBEEF", reply.TransactionUUID)
+	assert.Equal([]byte("ok"), reply.Payload)
+
+	// results expire once the TTL has passed
+	ar.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	assert.Equal(http.StatusNotFound, getAsyncResult(caller, ar, pending.ID).Code)
+}
+
+func testWithAsyncCallback(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		require  = require.New(t)
+		received = make(chan *http.Request, 1)
+		bodies   = make(chan []byte, 1)
+		server   = httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			body, _ := io.ReadAll(request.Body)
+			received <- request
+			bodies <- body
+		}))
+
+		filter   = new(mockURLFilter)
+		ar       = newTestAsyncResults(t, filter, 10)
+		release  = make(chan struct{})
+		handler  = withAsync(zaptest.NewLogger(t), respondingHandler(release), ar)
+		recorder = httptest.NewRecorder()
+	)
+
+	defer server.Close()
+	close(release)
+
+	filter.On("Filter", server.URL).Return(server.URL, nil).Once()
+	filter.On("Filter", "ftp://nonsense.com").Return("", errors.New("Scheme not allowed: ftp")).Once()
+
+	// a callback implies an asynchronous request
+	handler(newTestWRPResponseWriter(recorder), newAsyncTestRequest(context.Background(), "?callback="+server.URL))
+	assert.Equal(http.StatusAccepted, recorder.Code)
+	id := recorder.Header().Get(asyncTransactionIDHeader)
+
+	select {
+	case request := <-received:
+		assert.Equal(http.MethodPost, request.Method)
+		assert.Equal(id, request.Header.Get(asyncTransactionIDHeader))
+		assert.Equal("200", request.Header.Get(asyncStatusHeader))
+		assert.Equal(wrp.Msgpack.ContentType(), request.Header.Get("Content-Type"))
+
+		var reply wrp.Message
+		require.NoError(wrp.NewDecoderBytes(<-bodies, wrp.Msgpack).Decode(&reply))
+		assert.Equal([]byte("ok"), reply.Payload)
+
+	case <-time.After(time.Second):
+		assert.Fail("The result was not posted to the callback")
+	}
+
+	recorder = httptest.NewRecorder()
+	handler(newTestWRPResponseWriter(recorder), newAsyncTestRequest(context.Background(), "?callback=ftp://nonsense.com"))
+	assert.Equal(http.StatusBadRequest, recorder.Code)
+	filter.AssertExpectations(t)
+
+	// callbacks are refused without a filter to apply to them
+	ar.filter = nil
+	recorder = httptest.NewRecorder()
+	handler(newTestWRPResponseWriter(recorder), newAsyncTestRequest(context.Background(), "?callback="+server.URL))
+	assert.Equal(http.StatusBadRequest, recorder.Code)
+}
+
+func testWithAsyncLimits(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		ar      = newTestAsyncResults(t, nil, 1)
+		release = make(chan struct{})
+		handler = withAsync(zaptest.NewLogger(t), respondingHandler(release), ar)
+	)
+
+	defer close(release)
+
+	recorder := httptest.NewRecorder()
+	handler(newTestWRPResponseWriter(recorder), newAsyncTestRequest(context.Background(), "?async=true"))
+	assert.Equal(http.StatusAccepted, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	handler(newTestWRPResponseWriter(recorder), newAsyncTestRequest(context.Background(), "?async=true"))
+	assert.Equal(http.StatusServiceUnavailable, recorder.Code)
+
+	// pending results expire once the request would have timed out
+	ar.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	recorder = httptest.NewRecorder()
+	handler(newTestWRPResponseWriter(recorder), newAsyncTestRequest(context.Background(), "?async=true"))
+	assert.Equal(http.StatusAccepted, recorder.Code)
+}
+
+func testWithAsyncSync(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		release  = make(chan struct{})
+		handler  = withAsync(zaptest.NewLogger(t), respondingHandler(release), newTestAsyncResults(t, nil, 1))
+		recorder = httptest.NewRecorder()
+	)
+
+	close(release)
+	handler(newTestWRPResponseWriter(recorder), newAsyncTestRequest(context.Background(), "?async=false"))
+	assert.Equal(http.StatusOK, recorder.Code)
+	assert.Empty(recorder.Header().Get(asyncTransactionIDHeader))
+}
+
+func TestWithAsync(t *testing.T) {
+	t.Run("Polling", testWithAsyncPolling)
+	t.Run("Callback", testWithAsyncCallback)
+	t.Run("Limits", testWithAsyncLimits)
+	t.Run("Sync", testWithAsyncSync)
+}
@@ -0,0 +1,383 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"go.uber.org/zap"
+
+	// nolint:staticcheck
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+// Supported batch body content types
+const (
+	// BatchContentTypeMsgpack is a msgpack array of msgpack encoded WRP messages
+	BatchContentTypeMsgpack = wrp.MimeTypeMsgpack
+
+	// BatchContentTypeNDJSON is newline-delimited JSON encoded WRP messages
+	BatchContentTypeNDJSON = "application/x-ndjson"
+)
+
+const (
+	DefaultBatchMaxBytes    = 1024 * 1024
+	DefaultBatchLinger      = 100 * time.Millisecond
+	DefaultBatchContentType = BatchContentTypeMsgpack
+)
+
+var errBatchContentTypeNotSupported = errors.New("Batch content type must be either " + BatchContentTypeMsgpack + " or " + BatchContentTypeNDJSON)
+
+// BatchConfig describes how outbound HTTP requests to the same endpoint are combined
+// into a single request.
+type BatchConfig struct {
+	// MaxCount is the number of messages that triggers sending a batch.  Batching is
+	// disabled unless this is greater than 1.  Note that each worker waits for its
+	// batch to be sent, so batches never hold more messages than there are workers.
+	MaxCount int `json:"maxCount"`
+
+	// MaxBytes is the number of message bytes that triggers sending a batch.
+	MaxBytes int `json:"maxBytes"`
+
+	// Linger is how long a batch waits for more messages before being sent.
+	Linger time.Duration `json:"linger"`
+
+	// ContentType is the body format of batches, either "application/msgpack" for a
+	// msgpack array or "application/x-ndjson" for newline-delimited JSON.
+	ContentType string `json:"contentType"`
+
+	// ContentTypes overrides ContentType for specific endpoint URLs.
+	ContentTypes map[string]string `json:"contentTypes"`
+}
+
+func validBatchContentType(contentType string) bool {
+	return contentType == BatchContentTypeMsgpack || contentType == BatchContentTypeNDJSON
+}
+
+// batchResult is the outcome of sending a batch, reported to each of its messages
+type batchResult struct {
+	err      error
+	attempts int
+}
+
+// httpBatch accumulates the encoded messages bound for a single endpoint, along with
+// the requests they came from
+type httpBatch struct {
+	endpoint    string
+	method      string
+	contentType string
+	header      http.Header
+	started     time.Time
+	messages    [][]byte
+	requests    []*http.Request
+	results     []chan<- batchResult
+	size        int
+	timer       *time.Timer
+}
+
+// batchSink is an OutboundSink that combines requests for the same endpoint into a
+// single request, which it sends through the next sink.
+type batchSink struct {
+	logger       *zap.Logger
+	next         OutboundSink
+	maxCount     int
+	maxBytes     int
+	linger       time.Duration
+	timeout      time.Duration
+	contentType  string
+	contentTypes map[string]string
+	batchSize    metrics.Histogram
+	batchLinger  metrics.Histogram
+	now          func() time.Time
+
+	lock    sync.Mutex
+	batches map[string]*httpBatch
+}
+
+// NewBatchSink decorates next with batching, if configured.  If batching is not
+// configured, next is returned as is.
+func NewBatchSink(om OutboundMeasures, o *Outbounder, next OutboundSink) (OutboundSink, error) {
+	if o.batchMaxCount() < 2 {
+		return next, nil
+	}
+
+	bs := &batchSink{
+		logger:       o.logger(),
+		next:         next,
+		maxCount:     o.batchMaxCount(),
+		maxBytes:     o.batchMaxBytes(),
+		linger:       o.batchLinger(),
+		timeout:      o.requestTimeout(),
+		contentType:  o.batchContentType(),
+		contentTypes: o.batchContentTypes(),
+		batchSize:    om.BatchSize,
+		batchLinger:  om.BatchLinger,
+		now:          time.Now,
+		batches:      make(map[string]*httpBatch),
+	}
+
+	if !validBatchContentType(bs.contentType) {
+		return nil, errBatchContentTypeNotSupported
+	}
+
+	for _, contentType := range bs.contentTypes {
+		if !validBatchContentType(contentType) {
+			return nil, errBatchContentTypeNotSupported
+		}
+	}
+
+	return bs, nil
+}
+
+// Send adds the request's WRP message to the batch for its endpoint, blocking until
+// that batch has been sent or the request's context is done.  The outcome of the batch
+// is the outcome of each of its messages, so that the caller completes the message's
+// delivery and records its attempts as if it had been sent on its own.
+func (bs *batchSink) Send(request *http.Request) error {
+	var (
+		endpoint    = request.URL.String()
+		contentType = bs.contentType
+	)
+
+	if override, ok := bs.contentTypes[endpoint]; ok {
+		contentType = override
+	}
+
+	message, err := bs.encode(request, contentType)
+	if err != nil {
+		return err
+	}
+
+	result := make(chan batchResult, 1)
+	if full := bs.enqueue(request, endpoint, contentType, message, result); full != nil {
+		bs.flush(full)
+	}
+
+	select {
+	case r := <-result:
+		if counter, ok := request.Context().Value(attemptsContextKey{}).(*int); ok {
+			*counter = r.attempts
+		}
+
+		return r.err
+	case <-request.Context().Done():
+		return request.Context().Err()
+	}
+}
+
+// encode returns the request's WRP message in the batch's format, transcoding it if
+// the request was built in the other format
+func (bs *batchSink) encode(request *http.Request, contentType string) ([]byte, error) {
+	var body []byte
+	if request.Body != nil {
+		var err error
+		if body, err = io.ReadAll(request.Body); err != nil {
+			return nil, err
+		}
+	}
+
+	source, err := wrp.FormatFromContentType(request.Header.Get("Content-Type"), wrp.Msgpack)
+	if err != nil {
+		return nil, err
+	}
+
+	target := wrp.Msgpack
+	if contentType == BatchContentTypeNDJSON {
+		target = wrp.JSON
+	}
+
+	if source != target {
+		var message wrp.Message
+		if err := wrp.NewDecoderBytes(body, source).Decode(&message); err != nil {
+			return nil, err
+		}
+
+		body = nil
+		if err := wrp.NewEncoderBytes(&body, target).Encode(&message); err != nil {
+			return nil, err
+		}
+	}
+
+	if target == wrp.JSON {
+		// each message must occupy exactly one line
+		body = bytes.TrimSpace(body)
+	}
+
+	return body, nil
+}
+
+// enqueue adds a message to its endpoint's batch, returning the batch if it is now full
+func (bs *batchSink) enqueue(request *http.Request, endpoint, contentType string, message []byte, result chan<- batchResult) *httpBatch {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+
+	key := request.Method + " " + endpoint
+	b, ok := bs.batches[key]
+	if !ok {
+		b = &httpBatch{
+			endpoint:    endpoint,
+			method:      request.Method,
+			contentType: contentType,
+			header:      request.Header.Clone(),
+			started:     bs.now(),
+		}
+
+		b.timer = time.AfterFunc(bs.linger, func() { bs.flush(b) })
+		bs.batches[key] = b
+	}
+
+	b.messages = append(b.messages, message)
+	b.requests = append(b.requests, request)
+	b.results = append(b.results, result)
+	b.size += len(message)
+	if len(b.messages) >= bs.maxCount || b.size >= bs.maxBytes {
+		return b
+	}
+
+	return nil
+}
+
+// flush sends the given batch, unless it has already been sent, and reports the
+// outcome to each of its messages
+func (bs *batchSink) flush(b *httpBatch) {
+	bs.lock.Lock()
+	key := b.method + " " + b.endpoint
+	if bs.batches[key] != b {
+		bs.lock.Unlock()
+		return
+	}
+
+	delete(bs.batches, key)
+	b.timer.Stop()
+	bs.lock.Unlock()
+
+	bs.batchSize.Observe(float64(len(b.messages)))
+	bs.batchLinger.Observe(bs.now().Sub(b.started).Seconds())
+
+	attempts := 1
+	err := bs.send(b, &attempts)
+	if err != nil {
+		bs.logger.Error("Unable to send outbound batch", zap.String("url", b.endpoint), zap.Int("messages", len(b.messages)), zap.Error(err))
+	}
+
+	for _, result := range b.results {
+		result <- batchResult{err: err, attempts: attempts}
+	}
+}
+
+// Close sends the batches still lingering, then closes the next sink
+func (bs *batchSink) Close() error {
+	bs.lock.Lock()
+	batches := make([]*httpBatch, 0, len(bs.batches))
+	for _, b := range bs.batches {
+		batches = append(batches, b)
+	}
+
+	bs.lock.Unlock()
+	for _, b := range batches {
+		bs.flush(b)
+	}
+
+	return bs.next.Close()
+}
+
+// context returns the context of the batch's request.  The request is sent at the highest
+// QoS level of its messages and may take as long as the message with the latest deadline.
+// It is cancelled once the contexts of all its messages are done, e.g. when they are
+// abandoned on shutdown.
+func (bs *batchSink) context(b *httpBatch, attempts *int) (context.Context, context.CancelFunc) {
+	var (
+		level    wrp.QOSLevel
+		deadline time.Time
+	)
+
+	for _, request := range b.requests {
+		if l, _ := request.Context().Value(qosLevelContextKey{}).(wrp.QOSLevel); l > level {
+			level = l
+		}
+
+		if d, ok := request.Context().Deadline(); ok && d.After(deadline) {
+			deadline = d
+		}
+	}
+
+	if deadline.IsZero() {
+		deadline = bs.now().Add(bs.timeout)
+	}
+
+	ctx := context.WithValue(context.Background(), qosLevelContextKey{}, level)
+	ctx = context.WithValue(ctx, attemptsContextKey{}, attempts)
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	go func() {
+		for _, request := range b.requests {
+			select {
+			case <-request.Context().Done():
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		cancel()
+	}()
+
+	return ctx, cancel
+}
+
+func (bs *batchSink) send(b *httpBatch, attempts *int) error {
+	var body []byte
+	if b.contentType == BatchContentTypeNDJSON {
+		body = bytes.Join(b.messages, []byte{'\n'})
+		body = append(body, '\n')
+	} else {
+		body = appendMsgpackArrayHeader(make([]byte, 0, b.size+5), len(b.messages))
+		for _, message := range b.messages {
+			body = append(body, message...)
+		}
+	}
+
+	ctx, cancel := bs.context(b, attempts)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, b.method, b.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	request.Header = b.header
+	request.Header.Set("Content-Type", b.contentType)
+	return bs.next.Send(request)
+}
+
+// appendMsgpackArrayHeader appends the msgpack header of an array with n elements
+func appendMsgpackArrayHeader(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return append(b, 0xdc, byte(n>>8), byte(n))
+	default:
+		return append(b, 0xdd, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+}
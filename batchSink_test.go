@@ -0,0 +1,216 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/wrp-go/v3"
+	"go.uber.org/zap/zaptest"
+)
+
+// batchTestServer records the content type and body of every request it receives
+type batchTestServer struct {
+	*httptest.Server
+
+	lock         sync.Mutex
+	contentTypes []string
+	bodies       [][]byte
+}
+
+func newBatchTestServer(t *testing.T) *batchTestServer {
+	s := new(batchTestServer)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		body, err := io.ReadAll(request.Body)
+		assert.NoError(t, err)
+
+		s.lock.Lock()
+		s.contentTypes = append(s.contentTypes, request.Header.Get("Content-Type"))
+		s.bodies = append(s.bodies, body)
+		s.lock.Unlock()
+	}))
+
+	t.Cleanup(s.Close)
+	return s
+}
+
+func newTestBatchSink(t *testing.T, config BatchConfig) OutboundSink {
+	sink, err := NewBatchSink(NewTestOutboundMeasures(), &Outbounder{Batch: config}, &httpSink{
+		logger:     zaptest.NewLogger(t),
+		transactor: http.DefaultClient.Do,
+	})
+
+	require.NoError(t, err)
+	return sink
+}
+
+func newTestBatchRequest(t *testing.T, url string, format wrp.Format, source string) *http.Request {
+	var body []byte
+	require.NoError(t, wrp.NewEncoderBytes(&body, format).Encode(&wrp.Message{
+		Type:        wrp.SimpleEventMessageType,
+		Source:      source,
+		Destination: "event:iot",
+	}))
+
+	request, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	require.NoError(t, err)
+	request.Header.Set("Content-Type", format.ContentType())
+	return request
+}
+
+func testBatchSinkDisabled(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		next    = &httpSink{}
+		o       = &Outbounder{Batch: BatchConfig{MaxCount: 1}}
+		sink, _ = NewBatchSink(NewTestOutboundMeasures(), o, next)
+	)
+
+	assert.Equal(next, sink)
+}
+
+func testBatchSinkMsgpack(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		server  = newBatchTestServer(t)
+		sink    = newTestBatchSink(t, BatchConfig{MaxCount: 3, Linger: time.Hour})
+
+		wg sync.WaitGroup
+	)
+
+	// a JSON message is transcoded to msgpack to fit the batch
+	for i, format := range []wrp.Format{wrp.Msgpack, wrp.JSON, wrp.Msgpack} {
+		request := newTestBatchRequest(t, server.URL, format, "mac:11223344556"+string(rune('0'+i)))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(sink.Send(request))
+		}()
+	}
+
+	wg.Wait()
+	require.Len(server.bodies, 1)
+	assert.Equal(wrp.MimeTypeMsgpack, server.contentTypes[0])
+
+	var messages []wrp.Message
+	require.NoError(wrp.NewDecoderBytes(server.bodies[0], wrp.Msgpack).Decode(&messages))
+	require.Len(messages, 3)
+
+	var sources []string
+	for _, message := range messages {
+		assert.Equal("event:iot", message.Destination)
+		sources = append(sources, message.Source)
+	}
+
+	assert.ElementsMatch([]string{"mac:112233445560", "mac:112233445561", "mac:112233445562"}, sources)
+}
+
+func testBatchSinkNDJSON(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		server  = newBatchTestServer(t)
+		sink    = newTestBatchSink(t, BatchConfig{
+			MaxCount:     10,
+			Linger:       10 * time.Millisecond,
+			ContentTypes: map[string]string{server.URL: BatchContentTypeNDJSON},
+		})
+	)
+
+	// the linger time elapses long before the batch fills up
+	require.NoError(sink.Send(newTestBatchRequest(t, server.URL, wrp.Msgpack, "mac:112233445566")))
+	require.Len(server.bodies, 1)
+	assert.Equal(BatchContentTypeNDJSON, server.contentTypes[0])
+
+	lines := bytes.Split(bytes.TrimSuffix(server.bodies[0], []byte{'\n'}), []byte{'\n'})
+	require.Len(lines, 1)
+
+	var message wrp.Message
+	require.NoError(wrp.NewDecoderBytes(lines[0], wrp.JSON).Decode(&message))
+	assert.Equal("mac:112233445566", message.Source)
+
+	_, err := NewBatchSink(NewTestOutboundMeasures(), &Outbounder{Batch: BatchConfig{MaxCount: 2, ContentType: "text/plain"}}, &httpSink{})
+	assert.Equal(errBatchContentTypeNotSupported, err)
+}
+
+func testBatchSinkContext(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		require  = require.New(t)
+		next     = new(mockOutboundSink)
+		sink, _  = NewBatchSink(NewTestOutboundMeasures(), &Outbounder{Batch: BatchConfig{MaxCount: 2, Linger: time.Hour}}, next)
+		levels   = []wrp.QOSLevel{wrp.QOSLow, wrp.QOSCritical}
+		counters = []*int{new(int), new(int)}
+		batched  context.Context
+		errs     = make(chan error, len(levels))
+	)
+
+	next.On("Send", mock.Anything).Run(func(arguments mock.Arguments) {
+		batched = arguments.Get(0).(*http.Request).Context()
+		*batched.Value(attemptsContextKey{}).(*int) = 3
+	}).Return(nil).Once()
+
+	for i := range levels {
+		request := newTestBatchRequest(t, "http://localhost/events", wrp.Msgpack, "mac:112233445566")
+		ctx := context.WithValue(context.Background(), qosLevelContextKey{}, levels[i])
+		ctx = context.WithValue(ctx, attemptsContextKey{}, counters[i])
+		go func(request *http.Request) {
+			errs <- sink.Send(request)
+		}(request.WithContext(ctx))
+	}
+
+	for range levels {
+		require.NoError(<-errs)
+	}
+
+	// the batch is retried as the most important of its messages, and each message
+	// records the attempts made to send the batch
+	next.AssertExpectations(t)
+	assert.Equal(wrp.QOSCritical, batched.Value(qosLevelContextKey{}))
+	for _, counter := range counters {
+		assert.Equal(3, *counter)
+	}
+
+	// the batch's request is cancelled once it has been sent
+	assert.Error(batched.Err())
+}
+
+func testAppendMsgpackArrayHeader(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal([]byte{0x93}, appendMsgpackArrayHeader(nil, 3))
+	assert.Equal([]byte{0xdc, 0x01, 0x00}, appendMsgpackArrayHeader(nil, 256))
+	assert.Equal([]byte{0xdd, 0x00, 0x01, 0x00, 0x00}, appendMsgpackArrayHeader(nil, 65536))
+}
+
+func TestBatchSink(t *testing.T) {
+	t.Run("Disabled", testBatchSinkDisabled)
+	t.Run("Msgpack", testBatchSinkMsgpack)
+	t.Run("NDJSON", testBatchSinkNDJSON)
+	t.Run("Context", testBatchSinkContext)
+	t.Run("AppendMsgpackArrayHeader", testAppendMsgpackArrayHeader)
+}
@@ -2,7 +2,11 @@ package main
 
 import (
 	"errors"
+	"net"
 	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/spf13/cast"
 )
@@ -12,6 +16,11 @@ var (
 	errIterableTypeOnly  = errors.New("Only slices and arrays are currently supported as iterable")
 	errNumericalTypeOnly = errors.New("Only numerical values are supported")
 	errOpNotSupported    = errors.New("Operation not supported")
+	errStringTypeOnly    = errors.New("Only string values are supported")
+	errInvalidPattern    = errors.New("Only valid regular expressions are supported as patterns")
+	errRangeTypeOnly     = errors.New("Only ranges of two numerical values are supported")
+	errIPTypeOnly        = errors.New("Only IP addresses and CIDR blocks are supported")
+	errSemverTypeOnly    = errors.New("Only semantic versions are supported")
 )
 
 // Supported operations
@@ -20,6 +29,16 @@ const (
 	ContainsOp    = "contains"
 	EqualsOp      = "eq"
 	GreaterThanOp = "gt"
+
+	MatchesOp            = "matches"
+	StartsWithOp         = "startsWith"
+	EndsWithOp           = "endsWith"
+	LessThanOp           = "lt"
+	GreaterThanOrEqualOp = "gte"
+	LessThanOrEqualOp    = "lte"
+	BetweenOp            = "between"
+	InCIDROp             = "inCIDR"
+	SemverGteOp          = "semverGte"
 )
 
 // binOp encapsulates the execution of a generic binary operator.
@@ -31,6 +50,14 @@ type binOp interface {
 	name() string
 }
 
+// precompiler is implemented by binOps that can prepare a fixed right operand, such as a
+// check's InputValue, once rather than on every evaluation.
+type precompiler interface {
+	// precompile returns the binOp that applies the operation to the given right operand
+	// regardless of the right operand it is evaluated with.
+	precompile(right interface{}) (binOp, error)
+}
+
 func newBinOp(operation string) (binOp, error) {
 	switch operation {
 	case IntersectsOp:
@@ -41,6 +68,24 @@ func newBinOp(operation string) (binOp, error) {
 		return new(equals), nil
 	case GreaterThanOp:
 		return new(greaterThan), nil
+	case MatchesOp:
+		return new(matches), nil
+	case StartsWithOp:
+		return new(startsWith), nil
+	case EndsWithOp:
+		return new(endsWith), nil
+	case LessThanOp:
+		return new(lessThan), nil
+	case GreaterThanOrEqualOp:
+		return new(greaterThanOrEqual), nil
+	case LessThanOrEqualOp:
+		return new(lessThanOrEqual), nil
+	case BetweenOp:
+		return new(between), nil
+	case InCIDROp:
+		return new(inCIDR), nil
+	case SemverGteOp:
+		return new(semverGte), nil
 	default:
 		return nil, errOpNotSupported
 	}
@@ -140,6 +185,354 @@ func (g greaterThan) name() string {
 	return GreaterThanOp
 }
 
+// matches returns true if left is a string matched by the regular expression right.
+// The expression is compiled once when it is a check's InputValue.
+type matches struct {
+	pattern *regexp.Regexp
+}
+
+func (m matches) evaluate(left interface{}, right interface{}) (bool, error) {
+	s, ok := left.(string)
+	if !ok {
+		return false, errStringTypeOnly
+	}
+
+	pattern := m.pattern
+	if pattern == nil {
+		var err error
+		if pattern, err = compilePattern(right); err != nil {
+			return false, err
+		}
+	}
+
+	return pattern.MatchString(s), nil
+}
+
+func (m matches) precompile(right interface{}) (binOp, error) {
+	pattern, err := compilePattern(right)
+	if err != nil {
+		return nil, err
+	}
+
+	return matches{pattern: pattern}, nil
+}
+
+func (m matches) name() string {
+	return MatchesOp
+}
+
+func compilePattern(e interface{}) (*regexp.Regexp, error) {
+	s, ok := e.(string)
+	if !ok {
+		return nil, errStringTypeOnly
+	}
+
+	pattern, err := regexp.Compile(s)
+	if err != nil {
+		return nil, errInvalidPattern
+	}
+
+	return pattern, nil
+}
+
+// startsWith returns true if the string left begins with the string right
+type startsWith struct{}
+
+func (s startsWith) evaluate(left interface{}, right interface{}) (bool, error) {
+	l, r, err := stringOperands(left, right)
+	if err != nil {
+		return false, err
+	}
+
+	return strings.HasPrefix(l, r), nil
+}
+
+func (s startsWith) name() string {
+	return StartsWithOp
+}
+
+// endsWith returns true if the string left ends with the string right
+type endsWith struct{}
+
+func (e endsWith) evaluate(left interface{}, right interface{}) (bool, error) {
+	l, r, err := stringOperands(left, right)
+	if err != nil {
+		return false, err
+	}
+
+	return strings.HasSuffix(l, r), nil
+}
+
+func (e endsWith) name() string {
+	return EndsWithOp
+}
+
+func stringOperands(left, right interface{}) (string, string, error) {
+	l, leftOk := left.(string)
+	r, rightOk := right.(string)
+	if !leftOk || !rightOk {
+		return "", "", errStringTypeOnly
+	}
+
+	return l, r, nil
+}
+
+type lessThan struct{}
+
+func (l lessThan) evaluate(left interface{}, right interface{}) (bool, error) {
+	leftNumber, rightNumber, err := numericalOperands(left, right)
+	if err != nil {
+		return false, err
+	}
+
+	return leftNumber < rightNumber, nil
+}
+
+func (l lessThan) name() string {
+	return LessThanOp
+}
+
+type greaterThanOrEqual struct{}
+
+func (g greaterThanOrEqual) evaluate(left interface{}, right interface{}) (bool, error) {
+	leftNumber, rightNumber, err := numericalOperands(left, right)
+	if err != nil {
+		return false, err
+	}
+
+	return leftNumber >= rightNumber, nil
+}
+
+func (g greaterThanOrEqual) name() string {
+	return GreaterThanOrEqualOp
+}
+
+type lessThanOrEqual struct{}
+
+func (l lessThanOrEqual) evaluate(left interface{}, right interface{}) (bool, error) {
+	leftNumber, rightNumber, err := numericalOperands(left, right)
+	if err != nil {
+		return false, err
+	}
+
+	return leftNumber <= rightNumber, nil
+}
+
+func (l lessThanOrEqual) name() string {
+	return LessThanOrEqualOp
+}
+
+func numericalOperands(left, right interface{}) (int64, int64, error) {
+	leftNumber, leftErr := cast.ToInt64E(left)
+	rightNumber, rightErr := cast.ToInt64E(right)
+	if leftErr != nil || rightErr != nil {
+		return 0, 0, errNumericalTypeOnly
+	}
+
+	return leftNumber, rightNumber, nil
+}
+
+// between returns true if left is a number within the inclusive range right, given as
+// a slice of its lower and upper bounds.
+type between struct{}
+
+func (b between) evaluate(left interface{}, right interface{}) (bool, error) {
+	number, err := cast.ToInt64E(left)
+	if err != nil {
+		return false, errNumericalTypeOnly
+	}
+
+	if right == nil {
+		return false, errRangeTypeOnly
+	}
+
+	bounds, ok := iterable(right)
+	if !ok || len(bounds) != 2 {
+		return false, errRangeTypeOnly
+	}
+
+	lower, upper, err := numericalOperands(bounds[0], bounds[1])
+	if err != nil {
+		return false, errRangeTypeOnly
+	}
+
+	return lower <= number && number <= upper, nil
+}
+
+func (b between) name() string {
+	return BetweenOp
+}
+
+// inCIDR returns true if left is an IP address within the CIDR block right, or within
+// any of them if right is a slice.
+type inCIDR struct{}
+
+func (i inCIDR) evaluate(left interface{}, right interface{}) (bool, error) {
+	s, ok := left.(string)
+	if !ok {
+		return false, errIPTypeOnly
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return false, errIPTypeOnly
+	}
+
+	blocks := []interface{}{right}
+	if right != nil && reflect.TypeOf(right).Kind() != reflect.String {
+		if blocks, ok = iterable(right); !ok {
+			return false, errIPTypeOnly
+		}
+	}
+
+	for _, b := range blocks {
+		cidr, ok := b.(string)
+		if !ok {
+			return false, errIPTypeOnly
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return false, errIPTypeOnly
+		}
+
+		if network.Contains(ip) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (i inCIDR) name() string {
+	return InCIDROp
+}
+
+// semverGte returns true if left is a semantic version at or above the semantic
+// version right.  A leading v is allowed, as are missing minor and patch versions.
+type semverGte struct{}
+
+func (s semverGte) evaluate(left interface{}, right interface{}) (bool, error) {
+	l, lok := left.(string)
+	r, rok := right.(string)
+	if !lok || !rok {
+		return false, errSemverTypeOnly
+	}
+
+	leftVersion, leftErr := parseSemver(l)
+	rightVersion, rightErr := parseSemver(r)
+	if leftErr != nil || rightErr != nil {
+		return false, errSemverTypeOnly
+	}
+
+	return leftVersion.compare(rightVersion) >= 0, nil
+}
+
+func (s semverGte) name() string {
+	return SemverGteOp
+}
+
+type semver struct {
+	core       [3]uint64
+	prerelease []string
+}
+
+func parseSemver(s string) (semver, error) {
+	var v semver
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		v.prerelease = strings.Split(s[i+1:], ".")
+		s = s[:i]
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) > len(v.core) {
+		return v, errSemverTypeOnly
+	}
+
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return v, errSemverTypeOnly
+		}
+
+		v.core[i] = n
+	}
+
+	for _, identifier := range v.prerelease {
+		if identifier == "" {
+			return v, errSemverTypeOnly
+		}
+	}
+
+	return v, nil
+}
+
+// compare returns -1, 0 or 1 as v is below, equal to or above o, following the
+// precedence rules of https://semver.org/#spec-item-11
+func (v semver) compare(o semver) int {
+	for i := range v.core {
+		switch {
+		case v.core[i] < o.core[i]:
+			return -1
+		case v.core[i] > o.core[i]:
+			return 1
+		}
+	}
+
+	switch {
+	case len(v.prerelease) == 0 && len(o.prerelease) == 0:
+		return 0
+	case len(v.prerelease) == 0:
+		return 1
+	case len(o.prerelease) == 0:
+		return -1
+	}
+
+	for i := 0; i < len(v.prerelease) && i < len(o.prerelease); i++ {
+		if c := comparePrerelease(v.prerelease[i], o.prerelease[i]); c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case len(v.prerelease) < len(o.prerelease):
+		return -1
+	case len(v.prerelease) > len(o.prerelease):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// comparePrerelease compares pre-release identifiers, numerically if both are numbers
+// and lexically otherwise, with numbers ranked below other identifiers
+func comparePrerelease(a, b string) int {
+	an, aErr := strconv.ParseUint(a, 10, 64)
+	bn, bErr := strconv.ParseUint(b, 10, 64)
+	switch {
+	case aErr == nil && bErr == nil:
+		switch {
+		case an < bn:
+			return -1
+		case an > bn:
+			return 1
+		default:
+			return 0
+		}
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	default:
+		return strings.Compare(a, b)
+	}
+}
+
 //iterable checks that the given interface is of a
 //supported iterable reflect.Kind and if so,
 //returns a slice of its elements
@@ -153,6 +153,262 @@ func TestGreater(t *testing.T) {
 	testBinOp(testCases, GreaterThanOp, t)
 }
 
+func TestMatches(t *testing.T) {
+	testCases := []testCase{
+		{
+			name:     "Match",
+			left:     "SER-12345",
+			right:    "^SER-[0-9]+$",
+			expected: true,
+		},
+		{
+			name:  "No match",
+			left:  "ABC-12345",
+			right: "^SER-[0-9]+$",
+		},
+		{
+			name:        "Not a string",
+			left:        12345,
+			right:       "^SER-[0-9]+$",
+			expectedErr: errStringTypeOnly,
+		},
+		{
+			name:        "Invalid pattern",
+			left:        "SER-12345",
+			right:       "^SER-[0-9+$",
+			expectedErr: errInvalidPattern,
+		},
+	}
+	testBinOp(testCases, MatchesOp, t)
+
+	t.Run("Precompiled", func(t *testing.T) {
+		assert := assert.New(t)
+		op, err := newBinOp(MatchesOp)
+		require.NoError(t, err)
+
+		precompiled, err := op.(precompiler).precompile("^SER-")
+		require.NoError(t, err)
+		assert.Equal(MatchesOp, precompiled.name())
+
+		// the precompiled pattern is used regardless of the right operand
+		actual, err := precompiled.evaluate("SER-12345", nil)
+		assert.True(actual)
+		assert.NoError(err)
+
+		_, err = op.(precompiler).precompile("^SER-[")
+		assert.Equal(errInvalidPattern, err)
+	})
+}
+
+func TestStartsWith(t *testing.T) {
+	testCases := []testCase{
+		{
+			name:     "Prefix",
+			left:     "SER-12345",
+			right:    "SER-",
+			expected: true,
+		},
+		{
+			name:  "Suffix",
+			left:  "SER-12345",
+			right: "345",
+		},
+		{
+			name:        "Not a string",
+			left:        []string{"SER-12345"},
+			right:       "SER-",
+			expectedErr: errStringTypeOnly,
+		},
+	}
+	testBinOp(testCases, StartsWithOp, t)
+}
+
+func TestEndsWith(t *testing.T) {
+	testCases := []testCase{
+		{
+			name:     "Suffix",
+			left:     "SER-12345",
+			right:    "345",
+			expected: true,
+		},
+		{
+			name:  "Prefix",
+			left:  "SER-12345",
+			right: "SER-",
+		},
+		{
+			name:        "Not a string",
+			left:        "SER-12345",
+			right:       345,
+			expectedErr: errStringTypeOnly,
+		},
+	}
+	testBinOp(testCases, EndsWithOp, t)
+}
+
+func TestNumericalComparisons(t *testing.T) {
+	testData := []struct {
+		operation string
+		less      bool
+		equal     bool
+		greater   bool
+	}{
+		{LessThanOp, true, false, false},
+		{LessThanOrEqualOp, true, true, false},
+		{GreaterThanOrEqualOp, false, true, true},
+	}
+
+	for _, record := range testData {
+		t.Run(record.operation, func(t *testing.T) {
+			testBinOp([]testCase{
+				{name: "Less", left: 1, right: "2", expected: record.less},
+				{name: "Equal", left: int64(2), right: 2, expected: record.equal},
+				{name: "Greater", left: math.MaxInt64, right: math.MaxInt8, expected: record.greater},
+				{name: "Not a number", left: "NaNaNaNaN Batman", right: 0, expectedErr: errNumericalTypeOnly},
+			}, record.operation, t)
+		})
+	}
+}
+
+func TestBetween(t *testing.T) {
+	testCases := []testCase{
+		{
+			name:     "Within",
+			left:     500,
+			right:    []interface{}{100, 1000},
+			expected: true,
+		},
+		{
+			name:     "Inclusive",
+			left:     1000,
+			right:    []int{100, 1000},
+			expected: true,
+		},
+		{
+			name:  "Outside",
+			left:  1001,
+			right: []int{100, 1000},
+		},
+		{
+			name:        "Not a number",
+			left:        "NaNaNaNaN Batman",
+			right:       []int{100, 1000},
+			expectedErr: errNumericalTypeOnly,
+		},
+		{
+			name:        "Not a range",
+			left:        500,
+			right:       []int{100},
+			expectedErr: errRangeTypeOnly,
+		},
+		{
+			name:        "Not a numerical range",
+			left:        500,
+			right:       []string{"low", "high"},
+			expectedErr: errRangeTypeOnly,
+		},
+		{
+			name:        "Nil range",
+			left:        500,
+			expectedErr: errRangeTypeOnly,
+		},
+	}
+	testBinOp(testCases, BetweenOp, t)
+}
+
+func TestInCIDR(t *testing.T) {
+	testCases := []testCase{
+		{
+			name:     "Within",
+			left:     "10.1.2.3",
+			right:    "10.0.0.0/8",
+			expected: true,
+		},
+		{
+			name:  "Outside",
+			left:  "192.168.1.1",
+			right: "10.0.0.0/8",
+		},
+		{
+			name:     "Any block",
+			left:     "2001:db8::1",
+			right:    []string{"10.0.0.0/8", "2001:db8::/32"},
+			expected: true,
+		},
+		{
+			name:        "Not an IP",
+			left:        "localhost",
+			right:       "10.0.0.0/8",
+			expectedErr: errIPTypeOnly,
+		},
+		{
+			name:        "Not a CIDR block",
+			left:        "10.1.2.3",
+			right:       "10.1.2.3",
+			expectedErr: errIPTypeOnly,
+		},
+		{
+			name:        "Not a string",
+			left:        "10.1.2.3",
+			right:       8,
+			expectedErr: errIPTypeOnly,
+		},
+	}
+	testBinOp(testCases, InCIDROp, t)
+}
+
+func TestSemverGte(t *testing.T) {
+	testCases := []testCase{
+		{
+			name:     "Equal",
+			left:     "v1.2.3",
+			right:    "1.2.3",
+			expected: true,
+		},
+		{
+			name:     "Greater minor",
+			left:     "1.10.0",
+			right:    "1.9.7",
+			expected: true,
+		},
+		{
+			name:  "Lesser patch",
+			left:  "1.2.2",
+			right: "1.2.3",
+		},
+		{
+			name:     "Missing patch",
+			left:     "2.1",
+			right:    "2.0.9",
+			expected: true,
+		},
+		{
+			name:  "Pre-release",
+			left:  "1.2.3-rc.1",
+			right: "1.2.3",
+		},
+		{
+			name:     "Later pre-release",
+			left:     "1.2.3-rc.10+build.5",
+			right:    "1.2.3-rc.2",
+			expected: true,
+		},
+		{
+			name:        "Not a version",
+			left:        "1.2.x",
+			right:       "1.2.3",
+			expectedErr: errSemverTypeOnly,
+		},
+		{
+			name:        "Not a string",
+			left:        "1.2.3",
+			right:       1,
+			expectedErr: errSemverTypeOnly,
+		},
+	}
+	testBinOp(testCases, SemverGteOp, t)
+}
+
 func TestUnsupportedOp(t *testing.T) {
 	assert := assert.New(t)
 
@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"strings"
 )
 
@@ -46,7 +47,130 @@ func parseDeviceAccessCheck(config deviceAccessCheck) (*parsedCheck, error) {
 		return nil, errBinOp
 	}
 
+	// a fixed right operand, i.e. an InputValue that is not inversed, is prepared once
+	if p, ok := check.(precompiler); ok && parsedCheck.inputValue != nil && !parsedCheck.inversed {
+		if check, errBinOp = p.precompile(parsedCheck.inputValue); errBinOp != nil {
+			return nil, errBinOp
+		}
+	}
+
 	parsedCheck.assertion = check
 
 	return parsedCheck, nil
 }
+
+// Rule operations
+const (
+	checkRule = "check"
+	allOfRule = "allOf"
+	anyOfRule = "anyOf"
+	notRule   = "not"
+)
+
+var (
+	errRuleOperationRequired = errors.New("Exactly one of Check, AllOf, AnyOf or Not is required")
+	errRuleOperandsRequired  = errors.New("AllOf and AnyOf require at least one rule")
+	errUnknownCheck          = errors.New("Rule references an unknown check")
+	errDuplicateCheckName    = errors.New("Check names must be unique when a rule is configured")
+)
+
+// parsedRule is a node in the tree of checks run against inbound WRP messages
+type parsedRule struct {
+	// name labels the branch rooted at this node in rejection reasons and metrics
+	name      string
+	operation string
+	check     *parsedCheck
+	rules     []*parsedRule
+}
+
+// newAllOfRule returns the rule that requires every one of the given checks, in order,
+// which is used when no rule is configured
+func newAllOfRule(checks []*parsedCheck) *parsedRule {
+	rule := &parsedRule{operation: allOfRule}
+	names := make([]string, 0, len(checks))
+	for _, c := range checks {
+		rule.rules = append(rule.rules, &parsedRule{name: c.name, operation: checkRule, check: c})
+		names = append(names, c.name)
+	}
+
+	rule.name = fmt.Sprintf("%s(%s)", allOfRule, strings.Join(names, ","))
+	return rule
+}
+
+// parseDeviceAccessRule validates the given rule tree, resolving its leaves to the
+// given checks by name
+func parseDeviceAccessRule(config deviceAccessRule, checks []*parsedCheck) (*parsedRule, error) {
+	byName := make(map[string]*parsedCheck, len(checks))
+	for _, c := range checks {
+		if _, ok := byName[c.name]; ok {
+			return nil, errDuplicateCheckName
+		}
+
+		byName[c.name] = c
+	}
+
+	return parseRule(config, byName)
+}
+
+func parseRule(config deviceAccessRule, checks map[string]*parsedCheck) (*parsedRule, error) {
+	var (
+		rule = &parsedRule{name: strings.TrimSpace(config.Name)}
+		set  = 0
+
+		operands []deviceAccessRule
+	)
+
+	if check := strings.TrimSpace(config.Check); check != "" {
+		set++
+		rule.operation = checkRule
+		rule.check = checks[check]
+		if rule.check == nil {
+			return nil, errUnknownCheck
+		}
+	}
+
+	if config.AllOf != nil {
+		set++
+		rule.operation, operands = allOfRule, config.AllOf
+	}
+
+	if config.AnyOf != nil {
+		set++
+		rule.operation, operands = anyOfRule, config.AnyOf
+	}
+
+	if config.Not != nil {
+		set++
+		rule.operation, operands = notRule, []deviceAccessRule{*config.Not}
+	}
+
+	if set != 1 {
+		return nil, errRuleOperationRequired
+	}
+
+	if rule.operation != checkRule && len(operands) == 0 {
+		return nil, errRuleOperandsRequired
+	}
+
+	names := make([]string, 0, len(operands))
+	for _, operand := range operands {
+		parsed, err := parseRule(operand, checks)
+		if err != nil {
+			return nil, err
+		}
+
+		rule.rules = append(rule.rules, parsed)
+		names = append(names, parsed.name)
+	}
+
+	if rule.name == "" {
+		switch rule.operation {
+		case checkRule:
+			rule.name = rule.check.name
+		default:
+			rule.name = fmt.Sprintf("%s(%s)", rule.operation, strings.Join(names, ","))
+		}
+	}
+
+	return rule, nil
+}
@@ -61,6 +61,18 @@ func TestParseDeviceAccessCheck(t *testing.T) {
 			fails:       true,
 		},
 
+		{
+			name: "Invalid pattern",
+			config: deviceAccessCheck{
+				Name:                 "serial",
+				DeviceCredentialPath: "serial",
+				InputValue:           "^SER-[",
+				Op:                   MatchesOp,
+			},
+			expectedErr: errInvalidPattern,
+			fails:       true,
+		},
+
 		{
 			name: "Happpy path",
 			config: deviceAccessCheck{
@@ -102,3 +114,75 @@ func TestParseDeviceAccessCheck(t *testing.T) {
 		})
 	}
 }
+
+func TestParseDeviceAccessRule(t *testing.T) {
+	checks := []*parsedCheck{{name: "partner"}, {name: "trust"}, {name: "happy"}}
+	testCases := []struct {
+		name         string
+		config       deviceAccessRule
+		expectedName string
+		expectedErr  error
+	}{
+		{
+			name:         "Check",
+			config:       deviceAccessRule{Check: " partner "},
+			expectedName: "partner",
+		},
+		{
+			name: "Nested",
+			config: deviceAccessRule{
+				AllOf: []deviceAccessRule{
+					{AnyOf: []deviceAccessRule{{Check: "partner"}, {Check: "trust"}}},
+					{Not: &deviceAccessRule{Check: "happy"}},
+				},
+			},
+			expectedName: "allOf(anyOf(partner,trust),not(happy))",
+		},
+		{
+			name:         "Named",
+			config:       deviceAccessRule{Name: "partnerOrTrusted", AnyOf: []deviceAccessRule{{Check: "partner"}, {Check: "trust"}}},
+			expectedName: "partnerOrTrusted",
+		},
+		{
+			name:        "Unknown check",
+			config:      deviceAccessRule{AnyOf: []deviceAccessRule{{Check: "partner"}, {Check: "unknown"}}},
+			expectedErr: errUnknownCheck,
+		},
+		{
+			name:        "No operation",
+			config:      deviceAccessRule{Name: "empty"},
+			expectedErr: errRuleOperationRequired,
+		},
+		{
+			name:        "Several operations",
+			config:      deviceAccessRule{Check: "partner", Not: &deviceAccessRule{Check: "trust"}},
+			expectedErr: errRuleOperationRequired,
+		},
+		{
+			name:        "No operands",
+			config:      deviceAccessRule{AllOf: []deviceAccessRule{}},
+			expectedErr: errRuleOperandsRequired,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			rule, err := parseDeviceAccessRule(testCase.config, checks)
+			assert.Equal(testCase.expectedErr, err)
+			if testCase.expectedErr != nil {
+				assert.Nil(rule)
+				return
+			}
+
+			assert.Equal(testCase.expectedName, rule.name)
+		})
+	}
+
+	t.Run("Duplicate check names", func(t *testing.T) {
+		rule, err := parseDeviceAccessRule(deviceAccessRule{Check: "partner"}, append(checks, &parsedCheck{name: "partner"}))
+		assert.Nil(t, rule)
+		assert.Equal(t, errDuplicateCheckName, err)
+	})
+}
@@ -0,0 +1,326 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultCircuitBreakerMinRequests      uint          = 20
+	DefaultCircuitBreakerWindow           time.Duration = time.Minute
+	DefaultCircuitBreakerCoolDown         time.Duration = 30 * time.Second
+	DefaultCircuitBreakerHalfOpenRequests uint          = 1
+)
+
+var errCircuitOpen = errors.New("circuit breaker open")
+
+// breakerState is the state of a single circuit breaker.  The numeric value is
+// what gets reported through the state gauge.
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerHalfOpen:
+		return "half-open"
+	case breakerOpen:
+		return "open"
+	default:
+		return "unknown"
+	}
+}
+
+// CircuitBreakerConfig configures the per-host circuit breakers in the outbound
+// round-tripper chain.  Circuit breaking is disabled unless at least one of
+// ConsecutiveFailures or FailureRatio is set.
+type CircuitBreakerConfig struct {
+	// ConsecutiveFailures trips a breaker after this many failures in a row.
+	ConsecutiveFailures uint `json:"consecutiveFailures"`
+
+	// FailureRatio trips a breaker when the ratio of failed to total requests within
+	// the current Window reaches this value, provided at least MinRequests were made.
+	FailureRatio float64 `json:"failureRatio"`
+
+	// MinRequests is the number of requests needed in a Window before FailureRatio applies.
+	MinRequests uint `json:"minRequests"`
+
+	// Window is the interval after which a closed breaker's counts are reset.
+	Window time.Duration `json:"window"`
+
+	// CoolDown is how long a breaker stays open before allowing trial requests.
+	CoolDown time.Duration `json:"coolDown"`
+
+	// HalfOpenRequests is the number of trial requests allowed while half-open.  All of
+	// them must succeed for the breaker to close again.
+	HalfOpenRequests uint `json:"halfOpenRequests"`
+}
+
+// circuitBreaker guards a single destination host.
+type circuitBreaker struct {
+	host   string
+	config *circuitBreakers
+
+	lock        sync.Mutex
+	state       breakerState
+	requests    uint
+	failures    uint
+	consecutive uint
+	windowStart time.Time
+	openedAt    time.Time
+	probes      uint
+	successes   uint
+	generation  uint64
+}
+
+// allow returns errCircuitOpen if a request to this host should not be attempted.  Otherwise,
+// the breaker's current generation is returned, which the outcome of the request must be
+// recorded with.
+func (cb *circuitBreaker) allow(now time.Time) (uint64, error) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	switch cb.state {
+	case breakerOpen:
+		if now.Sub(cb.openedAt) < cb.config.coolDown {
+			return 0, errCircuitOpen
+		}
+
+		cb.setState(breakerHalfOpen)
+		cb.probes, cb.successes = 0, 0
+		fallthrough
+
+	case breakerHalfOpen:
+		if cb.probes >= cb.config.halfOpenRequests {
+			return 0, errCircuitOpen
+		}
+
+		cb.probes++
+
+	default:
+		if now.Sub(cb.windowStart) >= cb.config.window {
+			cb.reset(now)
+		}
+	}
+
+	return cb.generation, nil
+}
+
+// record updates this breaker with the outcome of an attempted request, which was allowed
+// in the given generation.  The outcome is ignored if the breaker has changed state since
+// then, e.g. a slow request allowed while closed does not count as a half-open probe.
+func (cb *circuitBreaker) record(now time.Time, generation uint64, success bool) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	if generation != cb.generation {
+		return
+	}
+
+	switch cb.state {
+	case breakerHalfOpen:
+		if !success {
+			cb.trip(now)
+			return
+		}
+
+		cb.successes++
+		if cb.successes >= cb.config.halfOpenRequests {
+			cb.setState(breakerClosed)
+			cb.reset(now)
+		}
+
+	case breakerClosed:
+		cb.requests++
+		if success {
+			cb.consecutive = 0
+			return
+		}
+
+		cb.failures++
+		cb.consecutive++
+		if cb.config.consecutiveFailures > 0 && cb.consecutive >= cb.config.consecutiveFailures {
+			cb.trip(now)
+			return
+		}
+
+		if cb.config.failureRatio > 0 && cb.requests >= cb.config.minRequests &&
+			float64(cb.failures)/float64(cb.requests) >= cb.config.failureRatio {
+			cb.trip(now)
+		}
+	}
+}
+
+func (cb *circuitBreaker) trip(now time.Time) {
+	cb.config.logger.Error("Outbound circuit breaker opened", zap.String("host", cb.host), zap.Uint("failures", cb.failures), zap.Uint("requests", cb.requests))
+	cb.setState(breakerOpen)
+	cb.openedAt = now
+}
+
+func (cb *circuitBreaker) reset(now time.Time) {
+	cb.requests, cb.failures, cb.consecutive = 0, 0, 0
+	cb.windowStart = now
+}
+
+func (cb *circuitBreaker) setState(s breakerState) {
+	cb.state = s
+	cb.generation++
+	cb.config.state.With(hostLabel, cb.host).Set(float64(s))
+}
+
+// circuitBreakerStatus is the JSON representation of a breaker served by the control server
+type circuitBreakerStatus struct {
+	Host                string     `json:"host"`
+	State               string     `json:"state"`
+	Requests            uint       `json:"requests"`
+	Failures            uint       `json:"failures"`
+	ConsecutiveFailures uint       `json:"consecutiveFailures"`
+	OpenedAt            *time.Time `json:"openedAt,omitempty"`
+}
+
+func (cb *circuitBreaker) status() circuitBreakerStatus {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	s := circuitBreakerStatus{
+		Host:                cb.host,
+		State:               cb.state.String(),
+		Requests:            cb.requests,
+		Failures:            cb.failures,
+		ConsecutiveFailures: cb.consecutive,
+	}
+
+	if cb.state != breakerClosed {
+		openedAt := cb.openedAt
+		s.OpenedAt = &openedAt
+	}
+
+	return s
+}
+
+// circuitBreakers is the set of per-host breakers for outbound traffic.  Breakers
+// are created lazily the first time a host is seen.
+type circuitBreakers struct {
+	logger              *zap.Logger
+	consecutiveFailures uint
+	failureRatio        float64
+	minRequests         uint
+	window              time.Duration
+	coolDown            time.Duration
+	halfOpenRequests    uint
+	state               metrics.Gauge
+	rejected            metrics.Counter
+	now                 func() time.Time
+
+	lock     sync.RWMutex
+	breakers map[string]*circuitBreaker
+}
+
+// NewCircuitBreakers creates the circuit breakers described by the Outbounder.  If
+// circuit breaking is not configured, this function returns nil.
+func NewCircuitBreakers(om OutboundMeasures, o *Outbounder) *circuitBreakers {
+	if o == nil || (o.CircuitBreaker.ConsecutiveFailures == 0 && o.CircuitBreaker.FailureRatio <= 0) {
+		return nil
+	}
+
+	return &circuitBreakers{
+		logger:              o.logger(),
+		consecutiveFailures: o.CircuitBreaker.ConsecutiveFailures,
+		failureRatio:        o.CircuitBreaker.FailureRatio,
+		minRequests:         o.circuitBreakerMinRequests(),
+		window:              o.circuitBreakerWindow(),
+		coolDown:            o.circuitBreakerCoolDown(),
+		halfOpenRequests:    o.circuitBreakerHalfOpenRequests(),
+		state:               om.CircuitBreakerState,
+		rejected:            om.CircuitBreakerRejected,
+		now:                 time.Now,
+		breakers:            make(map[string]*circuitBreaker),
+	}
+}
+
+func (cbs *circuitBreakers) get(host string) *circuitBreaker {
+	cbs.lock.RLock()
+	cb, ok := cbs.breakers[host]
+	cbs.lock.RUnlock()
+	if ok {
+		return cb
+	}
+
+	cbs.lock.Lock()
+	defer cbs.lock.Unlock()
+	if cb, ok = cbs.breakers[host]; !ok {
+		cb = &circuitBreaker{host: host, config: cbs, windowStart: cbs.now()}
+		cb.setState(breakerClosed)
+		cbs.breakers[host] = cb
+	}
+
+	return cb
+}
+
+// RoundTripper decorates next so that requests to a host whose breaker is open fail
+// immediately with errCircuitOpen.  Transport errors and 5xx responses count as failures.
+// A nil circuitBreakers returns next unchanged.
+func (cbs *circuitBreakers) RoundTripper(next http.RoundTripper) http.RoundTripper {
+	if cbs == nil {
+		return next
+	}
+
+	return promhttp.RoundTripperFunc(func(request *http.Request) (*http.Response, error) {
+		cb := cbs.get(request.URL.Host)
+		generation, err := cb.allow(cbs.now())
+		if err != nil {
+			cbs.rejected.With(hostLabel, cb.host).Add(1.0)
+			return nil, err
+		}
+
+		response, err := next.RoundTrip(request)
+		cb.record(cbs.now(), generation, err == nil && response.StatusCode < http.StatusInternalServerError)
+		return response, err
+	})
+}
+
+// ServeHTTP writes the status of every known breaker as a JSON array.
+func (cbs *circuitBreakers) ServeHTTP(response http.ResponseWriter, _ *http.Request) {
+	statuses := []circuitBreakerStatus{}
+	if cbs != nil {
+		cbs.lock.RLock()
+		for _, cb := range cbs.breakers {
+			statuses = append(statuses, cb.status())
+		}
+		cbs.lock.RUnlock()
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Host < statuses[j].Host })
+	response.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(response).Encode(statuses)
+}
@@ -0,0 +1,235 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCircuitBreakers(config CircuitBreakerConfig) (*circuitBreakers, *time.Time) {
+	var (
+		now = time.Now()
+		cbs = NewCircuitBreakers(NewTestOutboundMeasures(), &Outbounder{CircuitBreaker: config})
+	)
+
+	if cbs != nil {
+		cbs.now = func() time.Time { return now }
+	}
+
+	return cbs, &now
+}
+
+// admit asserts that the breaker allows a request, returning the generation to record it with
+func admit(t *testing.T, cb *circuitBreaker, now time.Time) uint64 {
+	generation, err := cb.allow(now)
+	assert.NoError(t, err)
+	return generation
+}
+
+// rejection returns the error of a request that the breaker does not allow
+func rejection(cb *circuitBreaker, now time.Time) error {
+	_, err := cb.allow(now)
+	return err
+}
+
+func testCircuitBreakersDisabled(t *testing.T) {
+	var (
+		assert = assert.New(t)
+		next   = promhttp.RoundTripperFunc(func(*http.Request) (*http.Response, error) { return nil, nil })
+	)
+
+	cbs, _ := newTestCircuitBreakers(CircuitBreakerConfig{CoolDown: time.Minute})
+	assert.Nil(cbs)
+	assert.NotNil(cbs.RoundTripper(next))
+
+	response := httptest.NewRecorder()
+	cbs.ServeHTTP(response, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(http.StatusOK, response.Code)
+	assert.JSONEq(`[]`, response.Body.String())
+}
+
+func testCircuitBreakersConsecutiveFailures(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		cbs, _  = newTestCircuitBreakers(CircuitBreakerConfig{ConsecutiveFailures: 3})
+		cb      = cbs.get("caduceus:6000")
+		current = cbs.now()
+	)
+
+	for i := 0; i < 2; i++ {
+		cb.record(current, admit(t, cb, current), false)
+	}
+
+	// a success resets the consecutive count
+	cb.record(current, admit(t, cb, current), true)
+
+	for i := 0; i < 3; i++ {
+		cb.record(current, admit(t, cb, current), false)
+	}
+
+	assert.Equal(breakerOpen, cb.state)
+	assert.Equal(errCircuitOpen, rejection(cb, current))
+	admit(t, cbs.get("other:6000"), current)
+}
+
+func testCircuitBreakersFailureRatio(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		cbs, _  = newTestCircuitBreakers(CircuitBreakerConfig{FailureRatio: 0.5, MinRequests: 4, Window: time.Minute})
+		cb      = cbs.get("caduceus:6000")
+		current = cbs.now()
+	)
+
+	for _, success := range []bool{false, true, false} {
+		cb.record(current, admit(t, cb, current), success)
+	}
+
+	assert.Equal(breakerClosed, cb.state, "not enough requests to apply the failure ratio")
+
+	// the window elapses, so the counts start over
+	current = current.Add(time.Minute)
+	for _, success := range []bool{false, true, false} {
+		cb.record(current, admit(t, cb, current), success)
+	}
+
+	assert.Equal(breakerClosed, cb.state)
+	cb.record(current, admit(t, cb, current), true)
+	assert.Equal(breakerClosed, cb.state)
+
+	cb.record(current, admit(t, cb, current), false)
+	assert.Equal(breakerOpen, cb.state)
+}
+
+func testCircuitBreakersHalfOpen(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		cbs, _  = newTestCircuitBreakers(CircuitBreakerConfig{ConsecutiveFailures: 1, CoolDown: time.Minute, HalfOpenRequests: 2})
+		cb      = cbs.get("caduceus:6000")
+		current = cbs.now()
+	)
+
+	cb.record(current, admit(t, cb, current), false)
+	assert.Equal(breakerOpen, cb.state)
+
+	current = current.Add(30 * time.Second)
+	assert.Equal(errCircuitOpen, rejection(cb, current))
+
+	// cool down has elapsed, so only the configured number of probes are allowed
+	current = current.Add(30 * time.Second)
+	probe := admit(t, cb, current)
+	assert.Equal(breakerHalfOpen, cb.state)
+	admit(t, cb, current)
+	assert.Equal(errCircuitOpen, rejection(cb, current))
+
+	// a failed probe opens the breaker again
+	cb.record(current, probe, false)
+	assert.Equal(breakerOpen, cb.state)
+
+	current = current.Add(time.Minute)
+	first, second := admit(t, cb, current), admit(t, cb, current)
+	cb.record(current, first, true)
+	assert.Equal(breakerHalfOpen, cb.state)
+	cb.record(current, second, true)
+	assert.Equal(breakerClosed, cb.state)
+	admit(t, cb, current)
+}
+
+func testCircuitBreakersStaleResults(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		cbs, _  = newTestCircuitBreakers(CircuitBreakerConfig{ConsecutiveFailures: 1, CoolDown: time.Minute})
+		cb      = cbs.get("caduceus:6000")
+		current = cbs.now()
+		slow    = admit(t, cb, current)
+	)
+
+	cb.record(current, admit(t, cb, current), false)
+	assert.Equal(breakerOpen, cb.state)
+
+	// the slow request was allowed while closed, so it does not count as a probe
+	current = current.Add(time.Minute)
+	probe := admit(t, cb, current)
+	cb.record(current, slow, true)
+	assert.Equal(breakerHalfOpen, cb.state)
+	cb.record(current, slow, false)
+	assert.Equal(breakerHalfOpen, cb.state)
+
+	cb.record(current, probe, true)
+	assert.Equal(breakerClosed, cb.state)
+}
+
+func testCircuitBreakersRoundTripper(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		require  = require.New(t)
+		cbs, now = newTestCircuitBreakers(CircuitBreakerConfig{ConsecutiveFailures: 2, CoolDown: time.Minute})
+
+		calls        int
+		transportErr = errors.New("expected")
+		next         = promhttp.RoundTripperFunc(func(*http.Request) (*http.Response, error) {
+			calls++
+			if calls == 1 {
+				return &http.Response{StatusCode: http.StatusServiceUnavailable}, nil
+			}
+
+			return nil, transportErr
+		})
+
+		rt = cbs.RoundTripper(next)
+	)
+
+	for i := 0; i < 2; i++ {
+		// nolint:bodyclose
+		rt.RoundTrip(httptest.NewRequest("POST", "http://caduceus:6000/api/v4/notify", nil))
+	}
+
+	// nolint:bodyclose
+	response, err := rt.RoundTrip(httptest.NewRequest("POST", "http://caduceus:6000/api/v4/notify", nil))
+	assert.Nil(response)
+	assert.Equal(errCircuitOpen, err)
+	assert.Equal(2, calls)
+
+	recorder := httptest.NewRecorder()
+	cbs.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	assert.Equal("application/json", recorder.Header().Get("Content-Type"))
+
+	var statuses []circuitBreakerStatus
+	require.NoError(json.Unmarshal(recorder.Body.Bytes(), &statuses))
+	require.Len(statuses, 1)
+	assert.Equal("caduceus:6000", statuses[0].Host)
+	assert.Equal("open", statuses[0].State)
+	require.NotNil(statuses[0].OpenedAt)
+	assert.True(now.Equal(*statuses[0].OpenedAt))
+}
+
+func TestCircuitBreakers(t *testing.T) {
+	t.Run("Disabled", testCircuitBreakersDisabled)
+	t.Run("ConsecutiveFailures", testCircuitBreakersConsecutiveFailures)
+	t.Run("FailureRatio", testCircuitBreakersFailureRatio)
+	t.Run("HalfOpen", testCircuitBreakersHalfOpen)
+	t.Run("StaleResults", testCircuitBreakersStaleResults)
+	t.Run("RoundTripper", testCircuitBreakersRoundTripper)
+}
@@ -0,0 +1,113 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// configReloader rereads the configuration file and applies it to the components that
+// can be reconfigured while running.  Reloads are triggered by SIGHUP and by the control
+// server, and are serialized so that each reads the file once and applies it in full
+// before the next begins.
+type configReloader struct {
+	v            *viper.Viper
+	outbound     *Outbound
+	deviceAccess *talariaDeviceAccess
+
+	lock sync.Mutex
+}
+
+func newConfigReloader(v *viper.Viper, outbound *Outbound, deviceAccess *talariaDeviceAccess) *configReloader {
+	return &configReloader{
+		v:            v,
+		outbound:     outbound,
+		deviceAccess: deviceAccess,
+	}
+}
+
+// Reload rereads the configuration file and applies it to every running component.
+// Failures are logged and counted by each component.
+func (r *configReloader) Reload() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	err := r.v.ReadInConfig()
+	if r.outbound != nil {
+		_ = r.reloadOutbound(err)
+	}
+
+	if r.deviceAccess != nil {
+		_ = r.reloadDeviceAccess(err)
+	}
+}
+
+// ReloadOutbound rereads the configuration file and applies its outbound section as
+// Outbound.Reload does
+func (r *configReloader) ReloadOutbound() error {
+	if r.outbound == nil {
+		return errOutboundNotRunning
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.reloadOutbound(r.v.ReadInConfig())
+}
+
+// ReloadDeviceAccess rereads the configuration file and applies its deviceAccessCheck
+// section as talariaDeviceAccess.Reload does
+func (r *configReloader) ReloadDeviceAccess() error {
+	if r.deviceAccess == nil {
+		return errDeviceAccessNotEnabled
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.reloadDeviceAccess(r.v.ReadInConfig())
+}
+
+// reloadOutbound applies the outbound section of the configuration file, which was just
+// read with the given outcome.  The lock must be held.
+func (r *configReloader) reloadOutbound(readErr error) error {
+	err := readErr
+	if err == nil {
+		var o *Outbounder
+		if o, err = unmarshalOutbounder(r.outbound.logger, r.v.Sub(OutbounderKey)); err == nil {
+			return r.outbound.Reload(o)
+		}
+	}
+
+	r.outbound.recordReload(err)
+	return err
+}
+
+// reloadDeviceAccess applies the deviceAccessCheck section of the configuration file, which
+// was just read with the given outcome.  The lock must be held.
+func (r *configReloader) reloadDeviceAccess(readErr error) error {
+	err := readErr
+	if err == nil {
+		config := new(deviceAccessCheckConfig)
+		if err = r.v.UnmarshalKey(DeviceAccessCheckConfigKey, config); err == nil {
+			return r.deviceAccess.Reload(config)
+		}
+	}
+
+	r.deviceAccess.recordReload(err)
+	return err
+}
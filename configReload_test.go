@@ -0,0 +1,144 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func testConfigReloaderNotRunning(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		reloader = newConfigReloader(viper.New(), nil, nil)
+	)
+
+	reloader.Reload()
+	assert.Equal(errOutboundNotRunning, reloader.ReloadOutbound())
+	assert.Equal(errDeviceAccessNotEnabled, reloader.ReloadDeviceAccess())
+}
+
+func testConfigReloaderConcurrent(t *testing.T) {
+	var (
+		assert        = assert.New(t)
+		require       = require.New(t)
+		server, paths = newReloadTestServer(t)
+		reloads       = new(mockCounter)
+		da            = newReloadTestDeviceAccess(t, reloads)
+		file          = filepath.Join(t.TempDir(), "talaria.yaml")
+		v             = viper.New()
+	)
+
+	writeConfig := func(path string) {
+		require.NoError(os.WriteFile(file, []byte(strings.Join([]string{
+			"device:",
+			"  outbound:",
+			"    defaultScheme: http",
+			"    allowedSchemes: [http]",
+			"    eventEndpoints:",
+			"      default: " + server.URL + path,
+			"deviceAccessCheck:",
+			"  type: monitor",
+			"  checks:",
+			"    - name: partner",
+			"      deviceCredentialPath: partner-id",
+			"      wrpCredentialPath: PartnerIDs",
+			"      op: contains",
+		}, "\n")), 0o600))
+	}
+
+	writeConfig("/before")
+	v.SetConfigFile(file)
+	require.NoError(v.ReadInConfig())
+
+	o, _, err := NewOutbounder(zaptest.NewLogger(t), v.Sub(OutbounderKey))
+	require.NoError(err)
+	ob, err := o.Start(NewTestOutboundMeasures())
+	require.NoError(err)
+	defer ob.Shutdown()
+
+	reloads.On("With", []string{outcomeLabel, success})
+	reloads.On("Add", 1.0)
+
+	// SIGHUP and the control server may reload at the same time
+	writeConfig("/after")
+	var (
+		reloader = newConfigReloader(v, ob, da)
+		reloaded sync.WaitGroup
+	)
+
+	for i := 0; i < 5; i++ {
+		reloaded.Add(3)
+		go func() {
+			defer reloaded.Done()
+			reloader.Reload()
+		}()
+
+		go func() {
+			defer reloaded.Done()
+			assert.NoError(reloader.ReloadOutbound())
+		}()
+
+		go func() {
+			defer reloaded.Done()
+			assert.NoError(reloader.ReloadDeviceAccess())
+		}()
+	}
+
+	reloaded.Wait()
+	reloads.AssertNotCalled(t, "With", []string{outcomeLabel, failure})
+	reloads.AssertNumberOfCalls(t, "With", 10)
+	assert.False(da.defaultPolicy.strict)
+
+	sendReloadTestEvent(ob)
+	expectPath(t, paths, "/after")
+}
+
+func testConfigReloaderReadFailure(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		reloads = new(mockCounter)
+		da      = newReloadTestDeviceAccess(t, reloads)
+		file    = filepath.Join(t.TempDir(), "talaria.yaml")
+		v       = viper.New()
+	)
+
+	require.NoError(os.WriteFile(file, []byte("deviceAccessCheck: ["), 0o600))
+	v.SetConfigFile(file)
+	reloads.On("With", []string{outcomeLabel, failure}).Once()
+	reloads.On("Add", 1.0).Once()
+
+	// a configuration file that cannot be read is counted as a failed reload
+	newConfigReloader(v, nil, da).Reload()
+	assert.True(da.defaultPolicy.strict)
+	reloads.AssertExpectations(t)
+}
+
+func TestConfigReloader(t *testing.T) {
+	t.Run("NotRunning", testConfigReloaderNotRunning)
+	t.Run("Concurrent", testConfigReloaderConcurrent)
+	t.Run("ReadFailure", testConfigReloaderReadFailure)
+}
@@ -28,16 +28,28 @@ const (
 	gatePath   = "/device/gate"
 	filterPath = "/device/gate/filter"
 	drainPath  = "/device/drain"
+
+	circuitBreakersPath = "/outbound/breakers"
+	reloadPath          = "/outbound/reload"
+	deadLettersPath     = "/outbound/deadletters"
+	replayPath          = "/outbound/deadletters/replay"
+
+	deviceAccessReloadPath = "/device/access/reload"
+	deviceAccessPolicyPath = "/device/access/policy"
+	deviceAccessDryRunPath = "/device/access/dryrun"
 )
 
-func StartControlServer(logger *zap.Logger, manager device.Manager, deviceGate devicegate.Interface, registry xmetrics.Registry, v *viper.Viper, tracing candlelight.Tracing) (func(http.Handler) http.Handler, error) {
+// StartControlServer starts the control server, if configured, returning the constructor
+// that guards device connections with the control server's gate.  The gate is nil if the
+// control server is not configured.
+func StartControlServer(logger *zap.Logger, manager device.Manager, deviceGate devicegate.Interface, outbound *Outbound, access *talariaDeviceAccess, reloader *configReloader, registry xmetrics.Registry, v *viper.Viper, tracing candlelight.Tracing) (func(http.Handler) http.Handler, gate.Interface, error) {
 	if !v.IsSet(ControlKey) {
-		return xhttp.NilConstructor, nil
+		return xhttp.NilConstructor, nil, nil
 	}
 
 	var options xhttp.ServerOptions
 	if err := v.UnmarshalKey(ControlKey, &options); err != nil {
-		return xhttp.NilConstructor, err
+		return xhttp.NilConstructor, nil, err
 	}
 
 	options.Logger = logger
@@ -85,6 +97,26 @@ func StartControlServer(logger *zap.Logger, manager device.Manager, deviceGate d
 
 	apiHandler.Handle(drainPath, &drain.Status{Drainer: d}).Methods("GET")
 
+	apiHandler.Handle(circuitBreakersPath, outbound.circuitBreakers()).Methods("GET")
+
+	apiHandler.Handle(reloadPath, outboundReloadHandler{reloader: reloader}).Methods("POST")
+
+	deadLetters := deadLetterHandler{outbound: outbound}
+
+	apiHandler.HandleFunc(deadLettersPath, deadLetters.List).Methods("GET")
+
+	apiHandler.HandleFunc(deadLettersPath, deadLetters.Purge).Methods("DELETE")
+
+	apiHandler.HandleFunc(replayPath, deadLetters.Replay).Methods("POST")
+
+	deviceAccess := deviceAccessHandler{access: access, reloader: reloader}
+
+	apiHandler.HandleFunc(deviceAccessReloadPath, deviceAccess.Reload).Methods("POST")
+
+	apiHandler.HandleFunc(deviceAccessPolicyPath, deviceAccess.Update).Methods("POST", "PUT")
+
+	apiHandler.HandleFunc(deviceAccessDryRunPath, deviceAccess.DryRun).Methods("POST")
+
 	server := xhttp.NewServer(options)
 	server.Handler = setLogger(logger)(r)
 
@@ -95,5 +127,5 @@ func StartControlServer(logger *zap.Logger, manager device.Manager, deviceGate d
 		}
 	}()
 
-	return gate.NewConstructor(g), nil
+	return gate.NewConstructor(g), g, nil
 }
@@ -0,0 +1,458 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"go.uber.org/zap"
+)
+
+// DeadLetterConfig describes the bounded store of outbound requests that could not be
+// delivered.
+type DeadLetterConfig struct {
+	// Capacity is the number of dead letters kept, after which the oldest are discarded.
+	// The store is disabled unless this is positive.
+	Capacity int `json:"capacity"`
+
+	// File, if set, persists dead letters as JSON lines so that they survive a restart.
+	// Otherwise dead letters are only kept in memory.
+	File string `json:"file"`
+}
+
+// deadLetter is an outbound request that could not be delivered, together with why
+type deadLetter struct {
+	ID        uint64      `json:"id"`
+	Method    string      `json:"method"`
+	URL       string      `json:"url"`
+	Header    http.Header `json:"header"`
+	Body      []byte      `json:"body"`
+	EventType string      `json:"eventType"`
+	PartnerID string      `json:"partnerID,omitempty"`
+	DeviceID  string      `json:"deviceID,omitempty"`
+	Reason    string      `json:"reason"`
+	Attempts  int         `json:"attempts"`
+	FailedAt  time.Time   `json:"failedAt"`
+}
+
+// deadLetterFilter selects dead letters.  Each field that is set must match.
+type deadLetterFilter struct {
+	ids       map[uint64]bool
+	eventType string
+	endpoint  string
+}
+
+// newDeadLetterFilter parses a filter from the "id", "eventType" and "endpoint" query
+// parameters of a request.  The id parameter may be repeated.
+func newDeadLetterFilter(request *http.Request) (deadLetterFilter, error) {
+	query := request.URL.Query()
+	f := deadLetterFilter{
+		eventType: query.Get("eventType"),
+		endpoint:  query.Get("endpoint"),
+	}
+
+	for _, value := range query["id"] {
+		id, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return deadLetterFilter{}, err
+		}
+
+		if f.ids == nil {
+			f.ids = make(map[uint64]bool)
+		}
+
+		f.ids[id] = true
+	}
+
+	return f, nil
+}
+
+func (f deadLetterFilter) matches(dl deadLetter) bool {
+	return (f.ids == nil || f.ids[dl.ID]) &&
+		(len(f.eventType) == 0 || f.eventType == dl.EventType) &&
+		(len(f.endpoint) == 0 || f.endpoint == dl.URL)
+}
+
+// deadLetterStore is a bounded, oldest-first store of dead letters, optionally persisted
+// to a file.  The file is appended to as dead letters arrive and rewritten whenever dead
+// letters are removed or it has grown well past the capacity.
+type deadLetterStore struct {
+	logger   *zap.Logger
+	capacity int
+	path     string
+	stored   metrics.Counter
+	size     metrics.Gauge
+	now      func() time.Time
+
+	// letters is a ring buffer that grows up to the capacity.  Once it is full, head is
+	// the index of the oldest dead letter, which is the next to be overwritten.
+	lock        sync.Mutex
+	nextID      uint64
+	letters     []deadLetter
+	head        int
+	file        *os.File
+	fileRecords int
+}
+
+// newDeadLetterStore creates the dead letter store described by the Outbounder, loading
+// any dead letters persisted by a previous process.  If the store is not enabled, this
+// function returns a nil store and no error.
+func newDeadLetterStore(om OutboundMeasures, o *Outbounder) (*deadLetterStore, error) {
+	if o == nil || o.DeadLetter.Capacity < 1 {
+		return nil, nil
+	}
+
+	ds := &deadLetterStore{
+		logger:   o.logger(),
+		capacity: o.DeadLetter.Capacity,
+		path:     o.DeadLetter.File,
+		stored:   om.DeadLetters,
+		size:     om.DeadLetterSize,
+		now:      time.Now,
+		nextID:   1,
+	}
+
+	if len(ds.path) > 0 {
+		if err := ds.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	ds.size.Set(float64(len(ds.letters)))
+	return ds, nil
+}
+
+func (ds *deadLetterStore) load() error {
+	if err := os.MkdirAll(filepath.Dir(ds.path), 0700); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(ds.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		var dl deadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &dl); err != nil {
+			ds.logger.Error("Ignoring corrupt dead letter", zap.String("file", ds.path), zap.Error(err))
+			continue
+		}
+
+		ds.append(dl)
+		if dl.ID >= ds.nextID {
+			ds.nextID = dl.ID + 1
+		}
+	}
+
+	if len(ds.letters) > 0 {
+		ds.logger.Info("Recovered outbound dead letters", zap.Int("count", len(ds.letters)))
+	}
+
+	return ds.rewriteLocked()
+}
+
+// append adds a dead letter, discarding the oldest if the store is full.  The lock must be held.
+func (ds *deadLetterStore) append(dl deadLetter) {
+	if len(ds.letters) < ds.capacity {
+		ds.letters = append(ds.letters, dl)
+		return
+	}
+
+	ds.letters[ds.head] = dl
+	ds.head = (ds.head + 1) % len(ds.letters)
+}
+
+// at returns the i-th oldest dead letter.  The lock must be held.
+func (ds *deadLetterStore) at(i int) deadLetter {
+	return ds.letters[(ds.head+i)%len(ds.letters)]
+}
+
+// rewriteLocked replaces the file with the current dead letters.  The lock must be held.
+func (ds *deadLetterStore) rewriteLocked() error {
+	if len(ds.path) == 0 {
+		return nil
+	}
+
+	if ds.file != nil {
+		ds.file.Close()
+		ds.file = nil
+	}
+
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for i := range ds.letters {
+		if err := encoder.Encode(ds.at(i)); err != nil {
+			return err
+		}
+	}
+
+	temp := ds.path + ".tmp"
+	if err := os.WriteFile(temp, buffer.Bytes(), 0600); err != nil {
+		return err
+	}
+
+	if err := os.Rename(temp, ds.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(ds.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	ds.file = file
+	ds.fileRecords = len(ds.letters)
+	return nil
+}
+
+// add stores the given request as a dead letter.  The request's body must be re-readable
+// via GetBody, which is the case for requests created by eventDispatcher.  A nil store
+// discards the request.
+func (ds *deadLetterStore) add(request *http.Request, reason error, attempts int) {
+	if ds == nil {
+		return
+	}
+
+	var body []byte
+	if request.GetBody != nil {
+		if rc, err := request.GetBody(); err == nil {
+			body, _ = io.ReadAll(rc)
+			rc.Close()
+		}
+	}
+
+	ctx := request.Context()
+	dl := deadLetter{
+		Method:   request.Method,
+		URL:      request.URL.String(),
+		Header:   request.Header.Clone(),
+		Body:     body,
+		Reason:   reason.Error(),
+		Attempts: attempts,
+		FailedAt: ds.now(),
+	}
+
+	dl.EventType, _ = ctx.Value(eventTypeContextKey{}).(string)
+	dl.PartnerID, _ = ctx.Value(partnerIDContextKey{}).(string)
+	dl.DeviceID, _ = ctx.Value(deviceIDContextKey{}).(string)
+
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	dl.ID = ds.nextID
+	ds.nextID++
+	ds.append(dl)
+	ds.stored.Add(1.0)
+	ds.size.Set(float64(len(ds.letters)))
+
+	if ds.file != nil {
+		var err error
+		if ds.fileRecords >= 2*ds.capacity {
+			err = ds.rewriteLocked()
+		} else if err = json.NewEncoder(ds.file).Encode(dl); err == nil {
+			ds.fileRecords++
+		}
+
+		if err != nil {
+			ds.logger.Error("Unable to persist outbound dead letter", zap.String("file", ds.path), zap.Error(err))
+		}
+	}
+}
+
+// list returns the dead letters that match the given filter, oldest first
+func (ds *deadLetterStore) list(f deadLetterFilter) []deadLetter {
+	matched := []deadLetter{}
+	if ds == nil {
+		return matched
+	}
+
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	for i := range ds.letters {
+		if dl := ds.at(i); f.matches(dl) {
+			matched = append(matched, dl)
+		}
+	}
+
+	return matched
+}
+
+// remove deletes the dead letters that match the given filter, returning how many were deleted
+func (ds *deadLetterStore) remove(f deadLetterFilter) (int, error) {
+	if ds == nil {
+		return 0, nil
+	}
+
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	kept := make([]deadLetter, 0, len(ds.letters))
+	for i := range ds.letters {
+		if dl := ds.at(i); !f.matches(dl) {
+			kept = append(kept, dl)
+		}
+	}
+
+	removed := len(ds.letters) - len(kept)
+	if removed == 0 {
+		return 0, nil
+	}
+
+	ds.letters, ds.head = kept, 0
+	ds.size.Set(float64(len(ds.letters)))
+	return removed, ds.rewriteLocked()
+}
+
+// newRequest recreates the outbound request of a dead letter, with a context carrying
+// its original event type, partner and device
+func (dl deadLetter) newRequest() (*http.Request, context.Context, error) {
+	request, err := http.NewRequest(dl.Method, dl.URL, bytes.NewReader(dl.Body))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if dl.Header != nil {
+		request.Header = dl.Header.Clone()
+	}
+
+	ctx := context.WithValue(context.Background(), eventTypeContextKey{}, dl.EventType)
+	if len(dl.PartnerID) > 0 {
+		ctx = context.WithValue(ctx, partnerIDContextKey{}, dl.PartnerID)
+	}
+
+	if len(dl.DeviceID) > 0 {
+		ctx = context.WithValue(ctx, deviceIDContextKey{}, dl.DeviceID)
+	}
+
+	return request, ctx, nil
+}
+
+// deadLetterReplay is the outcome of replaying dead letters
+type deadLetterReplay struct {
+	Replayed int `json:"replayed"`
+	Failed   int `json:"failed"`
+}
+
+// replayDeadLetters queues the dead letters that match the given filter for delivery again,
+// removing each one that was queued.  A replayed request that fails again becomes a new
+// dead letter.
+func (ob *Outbound) replayDeadLetters(f deadLetterFilter) (deadLetterReplay, error) {
+	var (
+		result   deadLetterReplay
+		replayed = deadLetterFilter{ids: make(map[uint64]bool)}
+	)
+
+	for _, dl := range ob.deadLetters.list(f) {
+		request, ctx, err := dl.newRequest()
+		if err == nil {
+			ob.dispatcher.lock.RLock()
+			err = ob.dispatcher.send(ctx, request)
+			ob.dispatcher.lock.RUnlock()
+		}
+
+		if err != nil {
+			ob.logger.Error("Unable to replay outbound dead letter", zap.Uint64("id", dl.ID), zap.Error(err))
+			result.Failed++
+			continue
+		}
+
+		replayed.ids[dl.ID] = true
+		result.Replayed++
+	}
+
+	if result.Replayed == 0 {
+		return result, nil
+	}
+
+	_, err := ob.deadLetters.remove(replayed)
+	return result, err
+}
+
+// deadLetterHandler serves the control server API for dead letters.  Each endpoint accepts
+// the "id", "eventType" and "endpoint" query parameters to select dead letters.
+type deadLetterHandler struct {
+	outbound *Outbound
+}
+
+func (h deadLetterHandler) writeJSON(response http.ResponseWriter, status int, body interface{}) {
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+	json.NewEncoder(response).Encode(body)
+}
+
+func (h deadLetterHandler) writeError(response http.ResponseWriter, status int, err error) {
+	h.writeJSON(response, status, map[string]string{"error": err.Error()})
+}
+
+// List writes the selected dead letters as a JSON array.
+func (h deadLetterHandler) List(response http.ResponseWriter, request *http.Request) {
+	f, err := newDeadLetterFilter(request)
+	if err != nil {
+		h.writeError(response, http.StatusBadRequest, err)
+		return
+	}
+
+	h.writeJSON(response, http.StatusOK, h.outbound.deadLetters.list(f))
+}
+
+// Replay queues the selected dead letters for delivery again.
+func (h deadLetterHandler) Replay(response http.ResponseWriter, request *http.Request) {
+	f, err := newDeadLetterFilter(request)
+	if err != nil {
+		h.writeError(response, http.StatusBadRequest, err)
+		return
+	}
+
+	result, err := h.outbound.replayDeadLetters(f)
+	if err != nil {
+		h.writeError(response, http.StatusInternalServerError, err)
+		return
+	}
+
+	h.writeJSON(response, http.StatusOK, result)
+}
+
+// Purge deletes the selected dead letters.
+func (h deadLetterHandler) Purge(response http.ResponseWriter, request *http.Request) {
+	f, err := newDeadLetterFilter(request)
+	if err != nil {
+		h.writeError(response, http.StatusBadRequest, err)
+		return
+	}
+
+	purged, err := h.outbound.deadLetters.remove(f)
+	if err != nil {
+		h.writeError(response, http.StatusInternalServerError, err)
+		return
+	}
+
+	h.writeJSON(response, http.StatusOK, map[string]int{"purged": purged})
+}
@@ -0,0 +1,322 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func newDeadLetterTestRequest(t *testing.T, url, eventType string) *http.Request {
+	request, err := http.NewRequest("POST", url, strings.NewReader("contents"))
+	require.NoError(t, err)
+	request.Header.Set("Content-Type", "application/msgpack")
+
+	ctx := context.WithValue(context.Background(), eventTypeContextKey{}, eventType)
+	ctx = context.WithValue(ctx, deviceIDContextKey{}, "mac:112233445566")
+	return request.WithContext(ctx)
+}
+
+func testDeadLetterStoreDisabled(t *testing.T) {
+	assert := assert.New(t)
+	ds, err := newDeadLetterStore(NewTestOutboundMeasures(), &Outbounder{})
+	assert.NoError(err)
+	assert.Nil(ds)
+
+	ds.add(newDeadLetterTestRequest(t, "http://endpoint.com", "iot"), errors.New("expected"), 1)
+	assert.Empty(ds.list(deadLetterFilter{}))
+
+	removed, err := ds.remove(deadLetterFilter{})
+	assert.Zero(removed)
+	assert.NoError(err)
+}
+
+func testDeadLetterStoreCapacity(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		stored  = new(mockCounter)
+		om      = NewTestOutboundMeasures()
+	)
+
+	om.DeadLetters = stored
+	stored.On("Add", 1.0).Times(3)
+	ds, err := newDeadLetterStore(om, &Outbounder{DeadLetter: DeadLetterConfig{Capacity: 2}})
+	require.NoError(err)
+	require.NotNil(ds)
+
+	for _, eventType := range []string{"first", "second", "third"} {
+		ds.add(newDeadLetterTestRequest(t, "http://endpoint.com", eventType), errors.New("expected"), 2)
+	}
+
+	letters := ds.list(deadLetterFilter{})
+	require.Len(letters, 2)
+	assert.Equal(uint64(2), letters[0].ID)
+	assert.Equal("second", letters[0].EventType)
+	assert.Equal("third", letters[1].EventType)
+
+	dl := letters[1]
+	assert.Equal("POST", dl.Method)
+	assert.Equal("http://endpoint.com", dl.URL)
+	assert.Equal("application/msgpack", dl.Header.Get("Content-Type"))
+	assert.Equal([]byte("contents"), dl.Body)
+	assert.Equal("mac:112233445566", dl.DeviceID)
+	assert.Equal("expected", dl.Reason)
+	assert.Equal(2, dl.Attempts)
+	stored.AssertExpectations(t)
+}
+
+func testDeadLetterStoreWrap(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+	)
+
+	ds, err := newDeadLetterStore(NewTestOutboundMeasures(), &Outbounder{DeadLetter: DeadLetterConfig{Capacity: 3}})
+	require.NoError(err)
+
+	ids := func() (ids []uint64) {
+		for _, dl := range ds.list(deadLetterFilter{}) {
+			ids = append(ids, dl.ID)
+		}
+
+		return
+	}
+
+	for i := 0; i < 7; i++ {
+		ds.add(newDeadLetterTestRequest(t, "http://endpoint.com", "iot"), errors.New("expected"), 1)
+	}
+
+	assert.Equal([]uint64{5, 6, 7}, ids())
+
+	removed, err := ds.remove(deadLetterFilter{ids: map[uint64]bool{6: true}})
+	assert.NoError(err)
+	assert.Equal(1, removed)
+	assert.Equal([]uint64{5, 7}, ids())
+
+	for i := 0; i < 2; i++ {
+		ds.add(newDeadLetterTestRequest(t, "http://endpoint.com", "iot"), errors.New("expected"), 1)
+	}
+
+	assert.Equal([]uint64{7, 8, 9}, ids())
+}
+
+func testDeadLetterStoreFilter(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+	)
+
+	ds, err := newDeadLetterStore(NewTestOutboundMeasures(), &Outbounder{DeadLetter: DeadLetterConfig{Capacity: 10}})
+	require.NoError(err)
+
+	ds.add(newDeadLetterTestRequest(t, "http://first.com", "iot"), errors.New("expected"), 1)
+	ds.add(newDeadLetterTestRequest(t, "http://second.com", "iot"), errors.New("expected"), 1)
+	ds.add(newDeadLetterTestRequest(t, "http://first.com", "status"), errors.New("expected"), 1)
+
+	testData := []struct {
+		query    string
+		expected []uint64
+	}{
+		{"", []uint64{1, 2, 3}},
+		{"?id=2&id=3", []uint64{2, 3}},
+		{"?eventType=iot", []uint64{1, 2}},
+		{"?endpoint=http://first.com", []uint64{1, 3}},
+		{"?eventType=iot&endpoint=http://first.com", []uint64{1}},
+		{"?eventType=other", nil},
+	}
+
+	for _, record := range testData {
+		f, err := newDeadLetterFilter(httptest.NewRequest("GET", deadLettersPath+record.query, nil))
+		require.NoError(err)
+
+		var ids []uint64
+		for _, dl := range ds.list(f) {
+			ids = append(ids, dl.ID)
+		}
+
+		assert.Equal(record.expected, ids, record.query)
+	}
+
+	_, err = newDeadLetterFilter(httptest.NewRequest("GET", deadLettersPath+"?id=abc", nil))
+	assert.Error(err)
+
+	removed, err := ds.remove(deadLetterFilter{eventType: "iot"})
+	assert.NoError(err)
+	assert.Equal(2, removed)
+	assert.Len(ds.list(deadLetterFilter{}), 1)
+}
+
+func testDeadLetterStoreFile(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		o       = &Outbounder{
+			Logger:     zaptest.NewLogger(t),
+			DeadLetter: DeadLetterConfig{Capacity: 2, File: filepath.Join(t.TempDir(), "deadletters", "outbound.jsonl")},
+		}
+	)
+
+	ds, err := newDeadLetterStore(NewTestOutboundMeasures(), o)
+	require.NoError(err)
+
+	// the file is compacted as it grows, so it never holds much more than the capacity
+	for i := 0; i < 6; i++ {
+		ds.add(newDeadLetterTestRequest(t, "http://endpoint.com", "iot"), errors.New("expected"), 1)
+	}
+
+	removed, err := ds.remove(deadLetterFilter{ids: map[uint64]bool{5: true}})
+	require.NoError(err)
+	assert.Equal(1, removed)
+
+	ds, err = newDeadLetterStore(NewTestOutboundMeasures(), o)
+	require.NoError(err)
+
+	letters := ds.list(deadLetterFilter{})
+	require.Len(letters, 1)
+	assert.Equal(uint64(6), letters[0].ID)
+	assert.Equal([]byte("contents"), letters[0].Body)
+
+	// identifiers continue from those persisted
+	ds.add(newDeadLetterTestRequest(t, "http://endpoint.com", "iot"), errors.New("expected"), 1)
+	letters = ds.list(deadLetterFilter{})
+	require.Len(letters, 2)
+	assert.Equal(uint64(7), letters[1].ID)
+}
+
+func testDeadLetterWorkerPool(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		server  = httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, _ *http.Request) {
+			response.WriteHeader(http.StatusServiceUnavailable)
+		}))
+
+		ob, err = (&Outbounder{
+			Logger:               zaptest.NewLogger(t),
+			AllowedSchemes:       []string{"http"},
+			DefaultScheme:        "http",
+			WorkerPoolSize:       1,
+			Retries:              2,
+			RetryableStatusCodes: []int{http.StatusServiceUnavailable},
+			EventEndpoints:       map[string]interface{}{"default": []string{server.URL}},
+			DeadLetter:           DeadLetterConfig{Capacity: 10},
+		}).Start(NewTestOutboundMeasures())
+	)
+
+	defer server.Close()
+	require.NoError(err)
+	defer ob.Shutdown()
+	sendReloadTestEvent(ob)
+
+	var letters []deadLetter
+	require.Eventually(func() bool {
+		letters = ob.deadLetters.list(deadLetterFilter{})
+		return len(letters) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal(server.URL, letters[0].URL)
+	assert.Equal("iot", letters[0].EventType)
+	assert.Equal(3, letters[0].Attempts)
+	assert.Contains(letters[0].Reason, "503")
+}
+
+func testDeadLetterHandler(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		require  = require.New(t)
+		received = make(chan string, 10)
+		fail     atomic.Bool
+		server   = httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			if fail.Load() {
+				response.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			received <- request.URL.Path
+		}))
+
+		ob, err = (&Outbounder{
+			Logger:         zaptest.NewLogger(t),
+			AllowedSchemes: []string{"http"},
+			DefaultScheme:  "http",
+			WorkerPoolSize: 1,
+			EventEndpoints: map[string]interface{}{"default": []string{server.URL + "/events"}},
+			DeadLetter:     DeadLetterConfig{Capacity: 10},
+		}).Start(NewTestOutboundMeasures())
+
+		handler = deadLetterHandler{outbound: ob}
+	)
+
+	defer server.Close()
+	require.NoError(err)
+	defer ob.Shutdown()
+	fail.Store(true)
+	sendReloadTestEvent(ob)
+	sendReloadTestEvent(ob)
+
+	require.Eventually(func() bool {
+		return len(ob.deadLetters.list(deadLetterFilter{})) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	response := httptest.NewRecorder()
+	handler.List(response, httptest.NewRequest("GET", deadLettersPath, nil))
+	assert.Equal(http.StatusOK, response.Code)
+
+	var letters []deadLetter
+	require.NoError(json.Unmarshal(response.Body.Bytes(), &letters))
+	require.Len(letters, 2)
+
+	response = httptest.NewRecorder()
+	handler.List(response, httptest.NewRequest("GET", deadLettersPath+"?id=x", nil))
+	assert.Equal(http.StatusBadRequest, response.Code)
+
+	fail.Store(false)
+	response = httptest.NewRecorder()
+	handler.Replay(response, httptest.NewRequest("POST", replayPath+"?id=1", nil))
+	assert.Equal(http.StatusOK, response.Code)
+	assert.JSONEq(`{"replayed": 1, "failed": 0}`, response.Body.String())
+	expectPath(t, received, "/events")
+
+	response = httptest.NewRecorder()
+	handler.Purge(response, httptest.NewRequest("DELETE", deadLettersPath, nil))
+	assert.Equal(http.StatusOK, response.Code)
+	assert.JSONEq(`{"purged": 1}`, response.Body.String())
+	assert.Empty(ob.deadLetters.list(deadLetterFilter{}))
+}
+
+func TestDeadLetter(t *testing.T) {
+	t.Run("Disabled", testDeadLetterStoreDisabled)
+	t.Run("Capacity", testDeadLetterStoreCapacity)
+	t.Run("Wrap", testDeadLetterStoreWrap)
+	t.Run("Filter", testDeadLetterStoreFilter)
+	t.Run("File", testDeadLetterStoreFile)
+	t.Run("WorkerPool", testDeadLetterWorkerPool)
+	t.Run("Handler", testDeadLetterHandler)
+}
@@ -0,0 +1,122 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const DefaultDedupeTTL = time.Minute
+
+// DedupeConfig describes the window in which QoS messages resent by a device are
+// recognized by their transaction UUID and not forwarded again.
+type DedupeConfig struct {
+	// Size is the number of messages remembered, after which the least recently seen are
+	// forgotten.  Duplicate suppression is disabled unless this is positive.
+	Size int `json:"size"`
+
+	// TTL is how long a message is remembered after it was first received.
+	TTL time.Duration `json:"ttl"`
+}
+
+// dedupeKey identifies a message sent by a device
+type dedupeKey struct {
+	deviceID        string
+	transactionUUID string
+}
+
+type dedupeEntry struct {
+	key      dedupeKey
+	delivery *delivery
+	expires  time.Time
+}
+
+// dedupeCache is a time-bounded LRU of the messages received recently, each with the
+// delivery started for it, if any
+type dedupeCache struct {
+	size int
+	ttl  time.Duration
+	now  func() time.Time
+
+	lock    sync.Mutex
+	entries map[dedupeKey]*list.Element
+	order   *list.List
+}
+
+// newDedupeCache creates the dedupeCache described by the Outbounder, returning nil if
+// duplicate suppression is not enabled
+func newDedupeCache(o *Outbounder) *dedupeCache {
+	if o == nil || o.Dedupe.Size < 1 {
+		return nil
+	}
+
+	return &dedupeCache{
+		size:    o.Dedupe.Size,
+		ttl:     o.dedupeTTL(),
+		now:     time.Now,
+		entries: make(map[dedupeKey]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// check tests whether a message with the given key was received within the window, in
+// which case the delivery of that original message is returned.  Otherwise, the message
+// is remembered along with its delivery.  An original message that is known to have not
+// been delivered does not make a later one a duplicate, so that a device may resend it.
+func (dc *dedupeCache) check(key dedupeKey, dv *delivery) (*delivery, bool) {
+	if dc == nil {
+		return nil, false
+	}
+
+	now := dc.now()
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	if element, ok := dc.entries[key]; ok {
+		entry := element.Value.(*dedupeEntry)
+		if now.Before(entry.expires) && !entry.delivery.undelivered() {
+			dc.order.MoveToFront(element)
+			return entry.delivery, true
+		}
+
+		dc.remove(element)
+	}
+
+	for back := dc.order.Back(); back != nil; back = dc.order.Back() {
+		if dc.order.Len() < dc.size && now.Before(back.Value.(*dedupeEntry).expires) {
+			break
+		}
+
+		dc.remove(back)
+	}
+
+	dc.entries[key] = dc.order.PushFront(&dedupeEntry{
+		key:      key,
+		delivery: dv,
+		expires:  now.Add(dc.ttl),
+	})
+
+	return nil, false
+}
+
+// remove forgets the message in the given element.  The lock must be held.
+func (dc *dedupeCache) remove(element *list.Element) {
+	dc.order.Remove(element)
+	delete(dc.entries, element.Value.(*dedupeEntry).key)
+}
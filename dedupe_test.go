@@ -0,0 +1,157 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func newTestDedupeCache(size int, now *time.Time) *dedupeCache {
+	dc := newDedupeCache(&Outbounder{Dedupe: DedupeConfig{Size: size, TTL: time.Minute}})
+	dc.now = func() time.Time { return *now }
+	return dc
+}
+
+func testDedupeCacheDisabled(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(newDedupeCache(nil))
+	assert.Nil(newDedupeCache(&Outbounder{}))
+
+	var dc *dedupeCache
+	_, duplicate := dc.check(dedupeKey{"mac:112233445566", "1"}, nil)
+	assert.False(duplicate)
+}
+
+func testDedupeCacheWindow(t *testing.T) {
+	var (
+		assert = assert.New(t)
+		now    = time.Now()
+		dc     = newTestDedupeCache(2, &now)
+		dv     = newDelivery()
+	)
+
+	assert.Equal(DefaultDedupeTTL, newDedupeCache(&Outbounder{Dedupe: DedupeConfig{Size: 1}}).ttl)
+
+	_, duplicate := dc.check(dedupeKey{"mac:112233445566", "1"}, dv)
+	assert.False(duplicate)
+
+	original, duplicate := dc.check(dedupeKey{"mac:112233445566", "1"}, newDelivery())
+	assert.True(duplicate)
+	assert.Equal(dv, original)
+
+	// the same transaction from another device is not a duplicate
+	_, duplicate = dc.check(dedupeKey{"mac:665544332211", "1"}, nil)
+	assert.False(duplicate)
+
+	// the least recently seen message is forgotten once the cache is full
+	_, duplicate = dc.check(dedupeKey{"mac:112233445566", "2"}, nil)
+	assert.False(duplicate)
+	_, duplicate = dc.check(dedupeKey{"mac:112233445566", "1"}, nil)
+	assert.False(duplicate)
+
+	// as are messages past their ttl
+	now = now.Add(time.Minute)
+	_, duplicate = dc.check(dedupeKey{"mac:112233445566", "2"}, nil)
+	assert.False(duplicate)
+}
+
+func testDedupeCacheUndelivered(t *testing.T) {
+	var (
+		assert = assert.New(t)
+		now    = time.Now()
+		dc     = newTestDedupeCache(10, &now)
+		dv     = newDelivery()
+	)
+
+	dv.add()
+	dv.dispatched()
+	_, duplicate := dc.check(dedupeKey{"mac:112233445566", "1"}, dv)
+	assert.False(duplicate)
+
+	// while the outcome is unknown, a resent message is a duplicate
+	_, duplicate = dc.check(dedupeKey{"mac:112233445566", "1"}, nil)
+	assert.True(duplicate)
+
+	// but once the original is known to have failed, the device may resend it
+	dv.complete(rdrQueueFull)
+	_, duplicate = dc.check(dedupeKey{"mac:112233445566", "1"}, nil)
+	assert.False(duplicate)
+}
+
+func testDedupeEventDispatcher(t *testing.T) {
+	var (
+		assert     = assert.New(t)
+		require    = require.New(t)
+		om         = NewTestOutboundMeasures()
+		duplicates = new(mockCounter)
+		d, rdrs    = newQOSTestDevice()
+		deliveries = newDeliveryTracker(nil)
+		o          = &Outbounder{
+			EventEndpoints: map[string]interface{}{"default": []string{"http://endpoint.com"}},
+			Dedupe:         DedupeConfig{Size: 10},
+		}
+	)
+
+	om.DuplicatesSuppressed = duplicates
+	duplicates.On("With", []string{partnerIDLabel, "partner-1"}).Once()
+	duplicates.On("Add", 1.0).Once()
+
+	dispatcher, outbounds, err := NewEventDispatcher(om, o, nil, nil, deliveries)
+	require.NoError(err)
+	acks, err := NewAckDispatcher(om, o, deliveries)
+	require.NoError(err)
+
+	for i := 0; i < 2; i++ {
+		event := newQOSTestEvent(d, "event:iot")
+		dispatcher.OnDeviceEvent(event)
+		acks.OnDeviceEvent(event)
+	}
+
+	// a message without a transaction UUID is never a duplicate
+	event := newQOSTestEvent(d, "event:iot")
+	event.Message.(*wrp.Message).TransactionUUID = ""
+	dispatcher.OnDeviceEvent(event)
+	acks.OnDeviceEvent(event)
+
+	// both acks for the resent message report the outcome of the original
+	require.Equal(2, outbounds.len())
+	for i := 0; i < 2; i++ {
+		e, ok := outbounds.pop()
+		require.True(ok)
+		deliveryFrom(e.request.Context()).complete(rdrDelivered)
+		e.cancel()
+	}
+
+	for i := 0; i < 3; i++ {
+		expectRDR(t, rdrs, rdrDelivered)
+	}
+
+	assert.Empty(rdrs)
+	duplicates.AssertExpectations(t)
+}
+
+func TestDedupe(t *testing.T) {
+	t.Run("Disabled", testDedupeCacheDisabled)
+	t.Run("Window", testDedupeCacheWindow)
+	t.Run("Undelivered", testDedupeCacheUndelivered)
+	t.Run("EventDispatcher", testDedupeEventDispatcher)
+}
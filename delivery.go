@@ -0,0 +1,236 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/xmidt-org/webpa-common/v2/device"
+
+	// nolint:staticcheck
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+// Request delivery response (rdr) codes sent in QoS acks.
+// See https://xmidt.io/docs/wrp/basics/#request-delivery-response-rdr-codes
+const (
+	rdrDelivered      int64 = 0
+	rdrPartialSuccess int64 = 1
+	rdrNoEndpoint     int64 = 100
+	rdrQueueFull      int64 = 101
+	rdrEndpointError  int64 = 102
+	rdrTimeout        int64 = 103
+)
+
+// deliveryContextKey is the context key for the *delivery of the message an outbound
+// request was created from
+type deliveryContextKey struct{}
+
+// delivery collects the outcome of sending a message to each of its endpoints.  Each
+// request for the message is added before it is queued and completed once it has been
+// sent or given up on.  The outcome is known once the message has been dispatched and
+// all of its requests are complete.
+type delivery struct {
+	lock        sync.Mutex
+	dispatching bool
+	settled     bool
+	pending     int
+	delivered   int
+	failed      int
+	failure     int64
+	done        chan struct{}
+}
+
+func newDelivery() *delivery {
+	return &delivery{
+		dispatching: true,
+		done:        make(chan struct{}),
+	}
+}
+
+// deliveryFrom returns the delivery carried by the given context, which may be nil
+func deliveryFrom(ctx context.Context) *delivery {
+	dv, _ := ctx.Value(deliveryContextKey{}).(*delivery)
+	return dv
+}
+
+// add records that a request for the message is being sent
+func (dv *delivery) add() {
+	if dv == nil {
+		return
+	}
+
+	dv.lock.Lock()
+	defer dv.lock.Unlock()
+	dv.pending++
+}
+
+// complete records the outcome of a request previously added
+func (dv *delivery) complete(rdr int64) {
+	if dv == nil {
+		return
+	}
+
+	dv.lock.Lock()
+	defer dv.lock.Unlock()
+	if dv.pending == 0 {
+		// the request was already completed, e.g. abandoned on shutdown
+		return
+	}
+
+	dv.pending--
+	switch {
+	case rdr == rdrDelivered:
+		dv.delivered++
+	case dv.failed == 0:
+		dv.failure = rdr
+		fallthrough
+	default:
+		dv.failed++
+	}
+
+	dv.settle()
+}
+
+// dispatched records that no more requests will be added for the message
+func (dv *delivery) dispatched() {
+	if dv == nil {
+		return
+	}
+
+	dv.lock.Lock()
+	defer dv.lock.Unlock()
+	dv.dispatching = false
+	dv.settle()
+}
+
+// settle signals that the outcome is known, if it is.  The lock must be held.
+func (dv *delivery) settle() {
+	if !dv.settled && !dv.dispatching && dv.pending == 0 {
+		dv.settled = true
+		close(dv.done)
+	}
+}
+
+// wait blocks until the outcome is known or the timeout elapses, returning the rdr code
+// that describes it
+func (dv *delivery) wait(timeout time.Duration) int64 {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-dv.done:
+	case <-timer.C:
+		return rdrTimeout
+	}
+
+	rdr, _ := dv.outcome()
+	return rdr
+}
+
+// outcome returns the rdr code that describes the delivery so far, and whether the
+// outcome is known
+func (dv *delivery) outcome() (int64, bool) {
+	dv.lock.Lock()
+	defer dv.lock.Unlock()
+	switch {
+	case dv.failed == 0 && dv.delivered > 0:
+		return rdrDelivered, dv.settled
+	case dv.failed > 0 && dv.delivered > 0:
+		return rdrPartialSuccess, dv.settled
+	case dv.failed > 0:
+		return dv.failure, dv.settled
+	default:
+		return rdrNoEndpoint, dv.settled
+	}
+}
+
+// undelivered tests whether the message is known not to have reached any endpoint
+func (dv *delivery) undelivered() bool {
+	if dv == nil {
+		return false
+	}
+
+	rdr, settled := dv.outcome()
+	return settled && rdr != rdrDelivered && rdr != rdrPartialSuccess
+}
+
+// deliveryTracker hands deliveries from the eventDispatcher, which sends a message, to the
+// ackDispatcher, which acks it.  Only messages that require a QoS ack are tracked.  The
+// eventDispatcher must receive each event before the ackDispatcher.
+type deliveryTracker struct {
+	timeout time.Duration
+
+	lock    sync.Mutex
+	pending map[*wrp.Message]*delivery
+}
+
+// newDeliveryTracker creates the deliveryTracker used to delay QoS acks until the message
+// has been delivered, for at most the Outbounder's ackTimeout
+func newDeliveryTracker(o *Outbounder) *deliveryTracker {
+	return &deliveryTracker{
+		timeout: o.ackTimeout(),
+		pending: make(map[*wrp.Message]*delivery),
+	}
+}
+
+// start begins tracking the delivery of the event's message, returning nil if its QoS level
+// does not require an ack or deliveries are not tracked.  Messages of every type are
+// tracked, since the ackDispatcher decides which types are acked.
+func (dt *deliveryTracker) start(event *device.Event) *delivery {
+	if dt == nil || event.Type != device.MessageReceived || event.Device == nil {
+		return nil
+	}
+
+	m, ok := event.Message.(*wrp.Message)
+	if !ok || !requiresQOSAck(m) {
+		return nil
+	}
+
+	dv := newDelivery()
+	dt.lock.Lock()
+	defer dt.lock.Unlock()
+	dt.pending[m] = dv
+	return dv
+}
+
+// replace tracks the given delivery, started for an earlier message, for the message m
+// instead of the delivery started for m
+func (dt *deliveryTracker) replace(m *wrp.Message, dv *delivery) {
+	if dt == nil || dv == nil {
+		return
+	}
+
+	dt.lock.Lock()
+	defer dt.lock.Unlock()
+	dt.pending[m] = dv
+}
+
+// take stops tracking the delivery of the given message, returning nil if it was not tracked
+func (dt *deliveryTracker) take(m *wrp.Message) *delivery {
+	if dt == nil {
+		return nil
+	}
+
+	dt.lock.Lock()
+	defer dt.lock.Unlock()
+	dv := dt.pending[m]
+	delete(dt.pending, m)
+	return dv
+}
@@ -0,0 +1,249 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/webpa-common/v2/device"
+	"github.com/xmidt-org/wrp-go/v3"
+	"go.uber.org/zap/zaptest"
+)
+
+func newQOSTestEvent(d device.Interface, destination string) *device.Event {
+	return &device.Event{
+		Type:   device.MessageReceived,
+		Device: d,
+		Message: &wrp.Message{
+			Type:             wrp.SimpleEventMessageType,
+			Source:           "mac:112233445566/service",
+			Destination:      destination,
+			TransactionUUID:  "DEADBEEF",
+			QualityOfService: wrp.QOSHighValue,
+		},
+		Format:   wrp.Msgpack,
+		Contents: []byte("contents"),
+	}
+}
+
+// newQOSTestDevice returns a device that reports the rdr of every ack sent to it
+func newQOSTestDevice() (*device.MockDevice, <-chan int64) {
+	var (
+		d    = new(device.MockDevice)
+		rdrs = make(chan int64, 10)
+	)
+
+	d.On("ID").Return(device.ID("mac:112233445566"))
+	d.On("Metadata").Return(genTestMetadata())
+	d.On("Send", mock.AnythingOfType("*device.Request")).Run(func(args mock.Arguments) {
+		ack := args.Get(0).(*device.Request).Message.(*wrp.Message)
+		rdrs <- *ack.RequestDeliveryResponse
+	}).Return(nil, error(nil))
+
+	return d, rdrs
+}
+
+func expectRDR(t *testing.T, rdrs <-chan int64, expected int64) {
+	select {
+	case actual := <-rdrs:
+		assert.Equal(t, expected, actual)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "no ack sent", expected)
+	}
+}
+
+func testDeliveryOutcome(t *testing.T) {
+	testData := []struct {
+		description string
+		outcomes    []int64
+		expected    int64
+	}{
+		{"Delivered", []int64{rdrDelivered, rdrDelivered}, rdrDelivered},
+		{"PartialSuccess", []int64{rdrEndpointError, rdrDelivered}, rdrPartialSuccess},
+		{"Failed", []int64{rdrQueueFull, rdrEndpointError}, rdrQueueFull},
+		{"NoEndpoint", nil, rdrNoEndpoint},
+	}
+
+	for _, record := range testData {
+		t.Run(record.description, func(t *testing.T) {
+			dv := newDelivery()
+			for range record.outcomes {
+				dv.add()
+			}
+
+			dv.dispatched()
+			for _, rdr := range record.outcomes {
+				dv.complete(rdr)
+			}
+
+			assert.Equal(t, record.expected, dv.wait(time.Second))
+		})
+	}
+
+	t.Run("Timeout", func(t *testing.T) {
+		dv := newDelivery()
+		dv.add()
+		dv.dispatched()
+		assert.Equal(t, rdrTimeout, dv.wait(10*time.Millisecond))
+
+		// a request completed twice, e.g. abandoned and then sent, is only counted once
+		dv.complete(rdrDelivered)
+		dv.complete(rdrEndpointError)
+		assert.Equal(t, rdrDelivered, dv.wait(time.Second))
+	})
+
+	t.Run("Nil", func(t *testing.T) {
+		var dv *delivery
+		assert.NotPanics(t, func() {
+			dv.add()
+			dv.complete(rdrDelivered)
+			dv.dispatched()
+		})
+	})
+}
+
+func testDeliveryTracker(t *testing.T) {
+	var (
+		assert = assert.New(t)
+		d, _   = newQOSTestDevice()
+		dt     = newDeliveryTracker(nil)
+		event  = newQOSTestEvent(d, "event:iot")
+	)
+
+	assert.Equal(DefaultAckTimeout, dt.timeout)
+	dv := dt.start(event)
+	assert.NotNil(dv)
+	assert.Equal(dv, dt.take(event.Message.(*wrp.Message)))
+	assert.Nil(dt.take(event.Message.(*wrp.Message)))
+
+	low := newQOSTestEvent(d, "event:iot")
+	low.Message.(*wrp.Message).QualityOfService = wrp.QOSLowValue
+	assert.Nil(dt.start(low))
+	assert.Nil(dt.start(newQOSTestEvent(nil, "event:iot")))
+
+	var nilTracker *deliveryTracker
+	assert.Nil(nilTracker.start(event))
+	assert.Nil(nilTracker.take(event.Message.(*wrp.Message)))
+}
+
+func testDeliveryQueueFull(t *testing.T) {
+	var (
+		require = require.New(t)
+		d, _    = newQOSTestDevice()
+		dt      = newDeliveryTracker(nil)
+		o       = &Outbounder{
+			OutboundQueueSize: 1,
+			EventEndpoints:    map[string]interface{}{"default": []string{"http://endpoint.com"}},
+		}
+	)
+
+	dispatcher, _, err := NewEventDispatcher(NewTestOutboundMeasures(), o, nil, nil, dt)
+	require.NoError(err)
+
+	queued, dropped := newQOSTestEvent(d, "event:iot"), newQOSTestEvent(d, "event:iot")
+	dispatcher.OnDeviceEvent(queued)
+	dispatcher.OnDeviceEvent(dropped)
+
+	assert.Equal(t, rdrQueueFull, dt.take(dropped.Message.(*wrp.Message)).wait(time.Second))
+	assert.Equal(t, rdrTimeout, dt.take(queued.Message.(*wrp.Message)).wait(10*time.Millisecond))
+}
+
+func testDeliveryPendingLimit(t *testing.T) {
+	var (
+		require = require.New(t)
+		d, rdrs = newQOSTestDevice()
+		dt      = newDeliveryTracker(nil)
+		held    = newQOSTestEvent(d, "event:iot")
+		full    = newQOSTestEvent(d, "event:iot")
+		settled = newQOSTestEvent(d, "event:iot")
+	)
+
+	dp, err := NewAckDispatcher(NewTestOutboundMeasures(), &Outbounder{MaxPendingAcks: 1}, dt)
+	require.NoError(err)
+
+	heldDelivery := dt.start(held)
+	dt.start(full)
+	dp.OnDeviceEvent(held)
+
+	// only one ack may wait for its delivery outcome at a time, and the outcome of the
+	// other is not known yet
+	dp.OnDeviceEvent(full)
+	expectRDR(t, rdrs, rdrDelivered)
+
+	// an outcome that is already known is still reported
+	dt.start(settled).dispatched()
+	dp.OnDeviceEvent(settled)
+	expectRDR(t, rdrs, rdrNoEndpoint)
+
+	heldDelivery.dispatched()
+	expectRDR(t, rdrs, rdrNoEndpoint)
+}
+
+func testDeliveryAck(t *testing.T) {
+	var (
+		require = require.New(t)
+		status  = make(chan int, 10)
+		server  = httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, _ *http.Request) {
+			response.WriteHeader(<-status)
+		}))
+
+		d, rdrs = newQOSTestDevice()
+	)
+
+	defer server.Close()
+	ob, err := (&Outbounder{
+		Logger:         zaptest.NewLogger(t),
+		AllowedSchemes: []string{"http"},
+		DefaultScheme:  "http",
+		WorkerPoolSize: 1,
+		EventEndpoints: map[string]interface{}{"iot": []string{server.URL}},
+	}).Start(NewTestOutboundMeasures())
+
+	require.NoError(err)
+	defer ob.Shutdown()
+	dispatch := func(destination string) {
+		event := newQOSTestEvent(d, destination)
+		for _, l := range ob.Listeners() {
+			l(event)
+		}
+	}
+
+	status <- http.StatusOK
+	dispatch("event:iot")
+	expectRDR(t, rdrs, rdrDelivered)
+
+	status <- http.StatusBadRequest
+	dispatch("event:iot")
+	expectRDR(t, rdrs, rdrEndpointError)
+
+	dispatch("event:unknown")
+	expectRDR(t, rdrs, rdrNoEndpoint)
+}
+
+func TestDelivery(t *testing.T) {
+	t.Run("Outcome", testDeliveryOutcome)
+	t.Run("Tracker", testDeliveryTracker)
+	t.Run("QueueFull", testDeliveryQueueFull)
+	t.Run("PendingLimit", testDeliveryPendingLimit)
+	t.Run("Ack", testDeliveryAck)
+}
@@ -3,9 +3,12 @@ package main
 import (
 	"context"
 	"net/http"
+	"sync"
 
 	"github.com/fatih/structs"
 	"github.com/go-kit/kit/metrics"
+	gokithttp "github.com/go-kit/kit/transport/http"
+	"github.com/segmentio/ksuid"
 	"github.com/thedevsaddam/gojsonq/v2"
 	"github.com/xmidt-org/webpa-common/v2/device"
 	"go.uber.org/zap"
@@ -26,6 +29,51 @@ var (
 	errDeniedDeviceAccess      = &xhttp.Error{Code: http.StatusForbidden, Text: "Denied Access to Device"}
 )
 
+// deviceAccessDenial is the error returned for messages that device access checks reject.
+// It wraps one of the errors above, and its JSON form is the body of the response.
+type deviceAccessDenial struct {
+	err   error
+	asWRP bool
+
+	Code          int    `json:"code"`
+	Message       string `json:"message"`
+	Reason        string `json:"reason"`
+	Check         string `json:"check,omitempty"`
+	Policy        string `json:"policy"`
+	CorrelationID string `json:"correlationID"`
+}
+
+func newDeviceAccessDenial(correlationID string, d accessDecision, asWRP bool) *deviceAccessDenial {
+	code := http.StatusForbidden
+	// nolint errorlint
+	if sc, ok := d.err.(gokithttp.StatusCoder); ok {
+		code = sc.StatusCode()
+	}
+
+	return &deviceAccessDenial{
+		err:           d.err,
+		asWRP:         asWRP,
+		Code:          code,
+		Message:       d.err.Error(),
+		Reason:        d.reason,
+		Check:         d.branch,
+		Policy:        d.policy.name,
+		CorrelationID: correlationID,
+	}
+}
+
+func (e *deviceAccessDenial) Error() string {
+	return e.err.Error()
+}
+
+func (e *deviceAccessDenial) StatusCode() int {
+	return e.Code
+}
+
+func (e *deviceAccessDenial) Unwrap() error {
+	return e.err
+}
+
 // deviceAccessCheck describes a single unit of assertion check against a
 // device's credentials.
 type deviceAccessCheck struct {
@@ -67,28 +115,95 @@ type deviceAccessCheckConfig struct {
 
 	// Checks is the list of checks that will be run against inbound WRP messages.
 	Checks []deviceAccessCheck
+
+	// Rule combines the Checks, referenced by name, into a tree of allOf, anyOf and not
+	// branches.
+	// (Optional. Defaults to allOf every check, in order).
+	Rule *deviceAccessRule
+
+	// Policies are policy sets selected by the caller or the destination device, each
+	// with its own Type and Checks.  The first policy that selects a message applies,
+	// and the Type, Checks and Rule above apply if none does.
+	// (Optional).
+	Policies []deviceAccessPolicy
+
+	// WRPDenials writes the body of rejections as a WRP message, in the format the
+	// caller accepts, whose payload is the JSON body.
+	// (Optional. Defaults to a JSON body).
+	WRPDenials bool
+
+	// Audit configures where an audit event is sent for every enforce or monitor decision.
+	// (Optional).
+	Audit *deviceAccessAuditConfig
+}
+
+// deviceAccessRule is a branch of the rule tree run against inbound WRP messages.
+// Exactly one of Check, AllOf, AnyOf and Not must be set.
+type deviceAccessRule struct {
+	// Name labels this branch in rejection reasons and metrics.
+	// (Optional. Defaults to the check name, or a description of the branch
+	// such as anyOf(partnerID,trust)).
+	Name string
+
+	// Check is the name of the check this branch runs.
+	Check string
+
+	// AllOf succeeds if every one of its rules succeeds.  Rules run in order,
+	// and the first one that fails is the failing branch.
+	AllOf []deviceAccessRule
+
+	// AnyOf succeeds if at least one of its rules succeeds.  If none do, it is
+	// the failing branch and fails for the reason its first rule did.
+	AnyOf []deviceAccessRule
+
+	// Not succeeds if its rule is denied.  A rule that cannot be completed,
+	// e.g. because of a missing credential, fails Not as well.
+	Not *deviceAccessRule
 }
 
 type deviceAccess interface {
 	authorizeWRP(context.Context, *wrp.Message) error
 }
 
+// talariaDeviceAccess runs the device access policies against inbound WRP messages.  The
+// policies may be reloaded while it runs.
 type talariaDeviceAccess struct {
-	strict             bool
 	wrpMessagesCounter metrics.Counter
+	reloads            metrics.Counter
 	deviceRegistry     device.Registry
-	checks             []*parsedCheck
-	sep                string
 	logger             *zap.Logger
+	events             eventSender
+
+	// lock guards the policies, separator, denial format and audit sinks, which are
+	// replaced by reloads
+	lock          sync.RWMutex
+	policies      []*accessPolicy
+	defaultPolicy *accessPolicy
+	sep           string
+	wrpDenials    bool
+	auditors      *accessAuditors
 }
 
-func (t *talariaDeviceAccess) withFailure(labelValues ...string) metrics.Counter {
-	if !t.strict {
+func (t *talariaDeviceAccess) withFailure(strict bool, labelValues ...string) metrics.Counter {
+	if !strict {
 		return t.withSuccess(labelValues...)
 	}
 	return t.wrpMessagesCounter.With(append(labelValues, outcomeLabel, rejected)...)
 }
 
+// policy returns the policy that applies to a message sent by the given principal, on
+// behalf of the given partner, to the device with the given ID, which is empty if the
+// destination is not a device
+func (t *talariaDeviceAccess) policy(principal, partnerID string, id device.ID) *accessPolicy {
+	for _, policy := range t.policies {
+		if policy.selects(principal, partnerID, id) {
+			return policy
+		}
+	}
+
+	return t.defaultPolicy
+}
+
 func (t *talariaDeviceAccess) withFatal(labelValues ...string) metrics.Counter {
 	return t.wrpMessagesCounter.With(append(labelValues, outcomeLabel, rejected)...)
 }
@@ -107,70 +222,206 @@ func getRight(check *parsedCheck, wrpCredentials *gojsonq.JSONQ) interface{} {
 
 // authorizeWRP returns true if the talaria partners access policy checks succeed. Otherwise, false
 // alongside an appropriate error that's friendly to go-kit's HTTP error response encoder.
-func (t *talariaDeviceAccess) authorizeWRP(_ context.Context, message *wrp.Message) error {
+// Rejections are returned as a *deviceAccessDenial, and every decision is audited.
+func (t *talariaDeviceAccess) authorizeWRP(ctx context.Context, message *wrp.Message) error {
+	t.lock.RLock()
+	var (
+		p       = principal(ctx)
+		d       = t.decide(p, tokenPartnerID(ctx), message, nil)
+		outcome = accepted
+	)
+
+	switch {
+	case d.fatal:
+		t.withFatal(policyLabel, d.policy.name, reasonLabel, d.reason, checkLabel, "").Add(1)
+		outcome = rejected
+
+	case d.err != nil:
+		t.logger.Debug("WRP failed device access rule", zap.String("policy", d.policy.name), zap.String("check", d.branch), zap.String("reason", d.reason))
+		t.withFailure(d.policy.strict, policyLabel, d.policy.name, reasonLabel, d.reason, checkLabel, d.branch).Add(1)
+		if d.policy.strict {
+			outcome = rejected
+		}
+
+	default:
+		t.withSuccess(policyLabel, d.policy.name, reasonLabel, authorized, checkLabel, "").Add(1)
+	}
+
+	correlationID := message.TransactionUUID
+	if len(correlationID) == 0 {
+		correlationID = ksuid.New().String()
+	}
+
+	var (
+		event    = newAccessAuditEvent(correlationID, p, message, d, outcome)
+		auditors = t.auditors
+		denial   error
+	)
+
+	if outcome != accepted {
+		denial = newDeviceAccessDenial(correlationID, d, t.wrpDenials)
+	}
+
+	auditors.begin()
+	t.lock.RUnlock()
+
+	// the sinks may be slow, so the event is audited without holding up reloads
+	auditors.audit(event)
+	return denial
+}
+
+// accessDecision is the outcome of running the policy that applies to a message.  A fatal
+// decision is one where the policy could not be run at all.
+type accessDecision struct {
+	accessResult
+	policy *accessPolicy
+	fatal  bool
+}
+
+// decide selects the policy for the message and runs it, recording each step taken in
+// steps if it is not nil.  The lock must be held.
+func (t *talariaDeviceAccess) decide(principal, partnerID string, message *wrp.Message, steps *[]accessStep) accessDecision {
 	ID, err := device.ParseID(message.Destination)
 	if err != nil {
-		t.withFatal(reasonLabel, invalidWRPDest).Add(1)
-		return errInvalidWRPDestination
+		return accessDecision{
+			accessResult: accessResult{reason: invalidWRPDest, err: errInvalidWRPDestination},
+			policy:       t.policy(principal, partnerID, ""),
+			fatal:        true,
+		}
 	}
 
+	policy := t.policy(principal, partnerID, ID)
 	d, ok := t.deviceRegistry.Get(ID)
 	if !ok {
-		t.withFatal(reasonLabel, deviceNotFound).Add(1)
-		return errDeviceNotFound
+		return accessDecision{
+			accessResult: accessResult{reason: deviceNotFound, err: errDeviceNotFound},
+			policy:       policy,
+			fatal:        true,
+		}
 	}
-	deviceCredentials := gojsonq.New(gojsonq.WithSeparator(t.sep)).FromInterface(d.Metadata().Claims())
+
+	deviceCredentials := gojsonq.New(gojsonq.WithSeparator(t.sep)).FromInterface(deviceFacts(d, policy.facts, t.logger))
 	wrpCredentials := gojsonq.New(gojsonq.WithSeparator(t.sep)).FromInterface(structs.Map(message))
+	return accessDecision{
+		accessResult: t.evaluate(policy.rule, deviceCredentials, wrpCredentials, steps),
+		policy:       policy,
+	}
+}
 
-	for _, c := range t.checks {
-		left := deviceCredentials.Reset().Find(c.deviceCredentialPath)
+// accessResult is the outcome of running a branch of the rule tree.  For a failure,
+// reason is the metric reason, err the HTTP response aware error and branch the name
+// of the failing branch.
+type accessResult struct {
+	reason string
+	err    error
+	branch string
+}
+
+var accessAuthorized = accessResult{reason: authorized}
+
+// accessStep describes a branch of the rule tree that was run, for dry runs.  Left and
+// Right are only set for checks.
+type accessStep struct {
+	Check     string      `json:"check"`
+	Operation string      `json:"operation"`
+	Left      interface{} `json:"left,omitempty"`
+	Right     interface{} `json:"right,omitempty"`
+	Result    bool        `json:"result"`
+	Reason    string      `json:"reason,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// record appends the step for the given branch, if steps are recorded
+func record(steps *[]accessStep, step accessStep, result accessResult) accessResult {
+	if steps != nil {
+		step.Result = result.err == nil
+		if !step.Result {
+			step.Reason = result.reason
+		}
+
+		*steps = append(*steps, step)
+	}
 
-		if left == nil {
-			t.withFailure(reasonLabel, missingDeviceCredential).Add(1)
-			if t.strict {
-				return errDeviceCredentialMissing
+	return result
+}
+
+// evaluate runs the branch of the rule tree rooted at rule
+func (t *talariaDeviceAccess) evaluate(rule *parsedRule, deviceCredentials, wrpCredentials *gojsonq.JSONQ, steps *[]accessStep) accessResult {
+	step := accessStep{Check: rule.name, Operation: rule.operation}
+	switch rule.operation {
+	case allOfRule:
+		for _, r := range rule.rules {
+			if result := t.evaluate(r, deviceCredentials, wrpCredentials, steps); result.err != nil {
+				return record(steps, step, result)
 			}
-			return nil
 		}
 
-		right := getRight(c, wrpCredentials)
-		if right == nil {
-			t.withFailure(reasonLabel, missingWRPCredential).Add(1)
-			if t.strict {
-				return errWRPCredentialsMissing
+		return record(steps, step, accessAuthorized)
+
+	case anyOfRule:
+		var first accessResult
+		for i, r := range rule.rules {
+			result := t.evaluate(r, deviceCredentials, wrpCredentials, steps)
+			if result.err == nil {
+				return record(steps, step, result)
+			}
+
+			if i == 0 {
+				first = result
 			}
-			return nil
 		}
 
-		if c.inversed {
-			left, right = right, left
+		first.branch = rule.name
+		return record(steps, step, first)
+
+	case notRule:
+		result := t.evaluate(rule.rules[0], deviceCredentials, wrpCredentials, steps)
+		switch {
+		case result.err == nil:
+			return record(steps, step, accessResult{reason: denied, err: errDeniedDeviceAccess, branch: rule.name})
+		case result.reason == denied:
+			return record(steps, step, accessAuthorized)
+		default:
+			return record(steps, step, result)
 		}
 
-		t.logger.Debug("Performing check with operation applied from left to right", zap.String("check", c.name), zap.Any("lefts", left), zap.String("operation", c.assertion.name()), zap.Any("right", right))
+	default:
+		return t.evaluateCheck(rule.check, deviceCredentials, wrpCredentials, steps)
+	}
+}
 
-		ok, err := c.assertion.evaluate(left, right)
-		if err != nil {
-			t.logger.Debug("Check failed to complete", zap.String("check", c.name), zap.Error(err))
-			t.withFailure(reasonLabel, incompleteCheck).Add(1)
+// evaluateCheck runs a single check, the leaf of a rule tree
+func (t *talariaDeviceAccess) evaluateCheck(c *parsedCheck, deviceCredentials, wrpCredentials *gojsonq.JSONQ, steps *[]accessStep) accessResult {
+	step := accessStep{Check: c.name, Operation: c.assertion.name()}
+	left := deviceCredentials.Reset().Find(c.deviceCredentialPath)
+	if left == nil {
+		return record(steps, step, accessResult{reason: missingDeviceCredential, err: errDeviceCredentialMissing, branch: c.name})
+	}
 
-			if t.strict {
-				return errIncompleteCheck
-			}
-			return nil
-		}
+	right := getRight(c, wrpCredentials)
+	if right == nil {
+		step.Left = left
+		return record(steps, step, accessResult{reason: missingWRPCredential, err: errWRPCredentialsMissing, branch: c.name})
+	}
 
-		if !ok {
-			t.logger.Debug("WRP is unauthorized to reach device", zap.String("check", c.name))
-			t.withFailure(reasonLabel, denied).Add(1)
+	if c.inversed {
+		left, right = right, left
+	}
 
-			if t.strict {
-				return errDeniedDeviceAccess
-			}
+	step.Left, step.Right = left, right
+	t.logger.Debug("Performing check with operation applied from left to right", zap.String("check", c.name), zap.Any("lefts", left), zap.String("operation", c.assertion.name()), zap.Any("right", right))
 
-			return nil
-		}
+	ok, err := c.assertion.evaluate(left, right)
+	if err != nil {
+		t.logger.Debug("Check failed to complete", zap.String("check", c.name), zap.Error(err))
+		step.Error = err.Error()
+		return record(steps, step, accessResult{reason: incompleteCheck, err: errIncompleteCheck, branch: c.name})
+	}
+
+	if !ok {
+		t.logger.Debug("WRP is unauthorized to reach device", zap.String("check", c.name))
+		return record(steps, step, accessResult{reason: denied, err: errDeniedDeviceAccess, branch: c.name})
 	}
 
-	t.withSuccess(reasonLabel, authorized).Add(1)
-	return nil
+	return record(steps, step, accessAuthorized)
 }
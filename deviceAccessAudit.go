@@ -0,0 +1,240 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	// nolint:staticcheck
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+// DefaultAuditEventType is the event type of the device access audit events sent through
+// the outbound event dispatcher
+const DefaultAuditEventType = "device-access"
+
+var errAuditSinkRequired = errors.New("Audit requires Event or File to be set")
+
+// deviceAccessAuditConfig configures where device access audit events are sent.  At least
+// one of Event and File must be set.
+type deviceAccessAuditConfig struct {
+	// Event sends audit events as WRP events through the outbound event dispatcher, to the
+	// endpoints configured for EventType.
+	Event bool
+
+	// EventType is the event type of the audit events.
+	// (Optional. Defaults to device-access).
+	EventType string
+
+	// File is the path of a local file audit events are appended to, one JSON object per line.
+	File string
+}
+
+// accessAuditEvent is the audit record of a single device access decision
+type accessAuditEvent struct {
+	Time          time.Time `json:"ts"`
+	CorrelationID string    `json:"correlationID"`
+	Policy        string    `json:"policy"`
+	Type          string    `json:"type"`
+	Outcome       string    `json:"outcome"`
+	Reason        string    `json:"reason"`
+	Check         string    `json:"check,omitempty"`
+	Principal     string    `json:"principal,omitempty"`
+	Source        string    `json:"source,omitempty"`
+	Destination   string    `json:"destination"`
+	MessageType   string    `json:"messageType"`
+	PartnerIDs    []string  `json:"partnerIDs,omitempty"`
+}
+
+func newAccessAuditEvent(correlationID, principal string, message *wrp.Message, d accessDecision, outcome string) accessAuditEvent {
+	e := accessAuditEvent{
+		Time:          time.Now(),
+		CorrelationID: correlationID,
+		Policy:        d.policy.name,
+		Type:          "monitor",
+		Outcome:       outcome,
+		Reason:        d.reason,
+		Check:         d.branch,
+		Principal:     principal,
+		Source:        message.Source,
+		Destination:   message.Destination,
+		MessageType:   message.Type.FriendlyName(),
+		PartnerIDs:    message.PartnerIDs,
+	}
+
+	if d.policy.strict {
+		e.Type = "enforce"
+	}
+
+	return e
+}
+
+// accessAuditSink receives the audit event of every device access decision
+type accessAuditSink interface {
+	audit(accessAuditEvent)
+	close()
+}
+
+// eventSender dispatches the WRP events that talaria itself generates.  *Outbound is
+// the production implementation.
+type eventSender interface {
+	sendEvent(eventType string, message *wrp.Message) error
+}
+
+// eventAuditSink sends audit events through the outbound event dispatcher
+type eventAuditSink struct {
+	events    eventSender
+	eventType string
+	logger    *zap.Logger
+}
+
+func (s *eventAuditSink) audit(e accessAuditEvent) {
+	payload, err := json.Marshal(e)
+	if err == nil {
+		err = s.events.sendEvent(s.eventType, &wrp.Message{
+			Type:        wrp.SimpleEventMessageType,
+			ContentType: wrp.MimeTypeJson,
+			PartnerIDs:  e.PartnerIDs,
+			Payload:     payload,
+		})
+	}
+
+	if err != nil {
+		s.logger.Error("Unable to send device access audit event", zap.String("correlationID", e.CorrelationID), zap.Error(err))
+	}
+}
+
+func (s *eventAuditSink) close() {}
+
+// fileAuditSink appends audit events to a local file
+type fileAuditSink struct {
+	lock    sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+	logger  *zap.Logger
+}
+
+func newFileAuditSink(path string, logger *zap.Logger) (*fileAuditSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileAuditSink{
+		file:    file,
+		encoder: json.NewEncoder(file),
+		logger:  logger,
+	}, nil
+}
+
+func (s *fileAuditSink) audit(e accessAuditEvent) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.encoder.Encode(e); err != nil {
+		s.logger.Error("Unable to write device access audit event", zap.String("correlationID", e.CorrelationID), zap.Error(err))
+	}
+}
+
+func (s *fileAuditSink) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.file.Close(); err != nil {
+		s.logger.Error("Unable to close device access audit file", zap.Error(err))
+	}
+}
+
+// newAccessAuditSinks creates the sinks the given configuration describes, which may be nil
+func newAccessAuditSinks(config *deviceAccessAuditConfig, events eventSender, logger *zap.Logger) ([]accessAuditSink, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	if !config.Event && len(config.File) == 0 {
+		return nil, errAuditSinkRequired
+	}
+
+	var sinks []accessAuditSink
+	if config.Event {
+		if events == nil {
+			return nil, errOutboundNotRunning
+		}
+
+		eventType := config.EventType
+		if len(eventType) == 0 {
+			eventType = DefaultAuditEventType
+		}
+
+		sinks = append(sinks, &eventAuditSink{events: events, eventType: eventType, logger: logger})
+	}
+
+	if len(config.File) > 0 {
+		sink, err := newFileAuditSink(config.File, logger)
+		if err != nil {
+			return nil, err
+		}
+
+		sinks = append(sinks, sink)
+	}
+
+	return sinks, nil
+}
+
+// accessAuditors are the audit sinks of one configuration.  Events are audited outside of
+// the talariaDeviceAccess lock, so a reload only closes the sinks it replaces once the
+// events already being audited to them have been written.
+type accessAuditors struct {
+	sinks    []accessAuditSink
+	auditing sync.WaitGroup
+}
+
+// begin announces an event that is about to be audited.  The talariaDeviceAccess lock must
+// be held, so that a reload cannot close the sinks in between.
+func (a *accessAuditors) begin() {
+	if a != nil {
+		a.auditing.Add(1)
+	}
+}
+
+// audit sends an event announced by begin to every audit sink
+func (a *accessAuditors) audit(e accessAuditEvent) {
+	if a == nil {
+		return
+	}
+
+	defer a.auditing.Done()
+	for _, sink := range a.sinks {
+		sink.audit(e)
+	}
+}
+
+// close closes every audit sink once the events being audited have been written
+func (a *accessAuditors) close() {
+	if a == nil {
+		return
+	}
+
+	a.auditing.Wait()
+	for _, sink := range a.sinks {
+		sink.close()
+	}
+}
@@ -0,0 +1,232 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/webpa-common/v2/device"
+	"go.uber.org/zap/zaptest"
+
+	// nolint:staticcheck
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func newAuditTestDeviceAccess(t *testing.T, config *deviceAccessCheckConfig, events eventSender) *talariaDeviceAccess {
+	var (
+		mockDeviceRegistry = new(device.MockRegistry)
+		mockDevice         = new(device.MockDevice)
+	)
+
+	mockDeviceRegistry.On("Get", device.ID("mac:112233445566")).Return(mockDevice, true)
+	mockDevice.On("Metadata").Return(getTestDeviceMetadata())
+
+	da, err := buildDeviceAccessCheck(config, zaptest.NewLogger(t), newTestCounter(), mockDeviceRegistry, events)
+	require.NoError(t, err)
+	return da
+}
+
+func readAuditTestEvents(t *testing.T, file string) []accessAuditEvent {
+	f, err := os.Open(file)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var events []accessAuditEvent
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		var e accessAuditEvent
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		events = append(events, e)
+	}
+
+	return events
+}
+
+func testDeviceAccessAuditFile(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		file    = filepath.Join(t.TempDir(), "audit.json")
+		da      = newAuditTestDeviceAccess(t, &deviceAccessCheckConfig{
+			Type:   "enforce",
+			Checks: newTestPolicyChecks(),
+			Audit:  &deviceAccessAuditConfig{File: file},
+		}, nil)
+	)
+
+	assert.NoError(da.authorizeWRP(context.Background(), &wrp.Message{
+		Type:            wrp.SimpleRequestResponseMessageType,
+		Source:          "dns:caller.com",
+		Destination:     "mac:112233445566",
+		TransactionUUID: "DEADBEEF",
+		PartnerIDs:      []string{"sky"},
+	}))
+
+	err := da.authorizeWRP(context.Background(), &wrp.Message{
+		Type:        wrp.SimpleRequestResponseMessageType,
+		Destination: "mac:112233445566",
+		PartnerIDs:  []string{"comcast"},
+	})
+
+	var denial *deviceAccessDenial
+	require.True(errors.As(err, &denial))
+
+	events := readAuditTestEvents(t, file)
+	require.Len(events, 2)
+	assert.Equal("DEADBEEF", events[0].CorrelationID)
+	assert.Equal(defaultPolicyName, events[0].Policy)
+	assert.Equal("enforce", events[0].Type)
+	assert.Equal(accepted, events[0].Outcome)
+	assert.Equal(authorized, events[0].Reason)
+	assert.Equal("dns:caller.com", events[0].Source)
+	assert.Equal("mac:112233445566", events[0].Destination)
+	assert.Equal(wrp.SimpleRequestResponseMessageType.FriendlyName(), events[0].MessageType)
+
+	// the generated correlation ID is shared by the denial and its audit event
+	assert.NotEmpty(events[1].CorrelationID)
+	assert.Equal(denial.CorrelationID, events[1].CorrelationID)
+	assert.Equal(rejected, events[1].Outcome)
+	assert.Equal(denied, events[1].Reason)
+	assert.Equal("partner", events[1].Check)
+
+	// a reload closes the file, and audits stop once the Audit section is removed
+	require.NoError(da.configure(&deviceAccessCheckConfig{Type: "monitor", Checks: newTestPolicyChecks()}))
+	assert.NoError(da.authorizeWRP(context.Background(), &wrp.Message{Destination: "mac:112233445566", PartnerIDs: []string{"comcast"}}))
+	assert.Len(readAuditTestEvents(t, file), 2)
+}
+
+func testDeviceAccessAuditEvent(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		events  = new(mockEventSender)
+		sent    *wrp.Message
+		da      = newAuditTestDeviceAccess(t, &deviceAccessCheckConfig{
+			Type:   "monitor",
+			Checks: newTestPolicyChecks(),
+			Audit:  &deviceAccessAuditConfig{Event: true},
+		}, events)
+	)
+
+	events.On("sendEvent", DefaultAuditEventType, mock.AnythingOfType("*wrp.Message")).Run(func(args mock.Arguments) {
+		sent = args.Get(1).(*wrp.Message)
+	}).Return(error(nil)).Once()
+
+	// monitored denials are accepted, but audited as such
+	assert.NoError(da.authorizeWRP(context.Background(), &wrp.Message{
+		Destination:     "mac:112233445566",
+		TransactionUUID: "DEADBEEF",
+		PartnerIDs:      []string{"comcast"},
+	}))
+
+	events.AssertExpectations(t)
+	require.NotNil(sent)
+	assert.Equal(wrp.SimpleEventMessageType, sent.Type)
+	assert.Equal(wrp.MimeTypeJson, sent.ContentType)
+	assert.Equal([]string{"comcast"}, sent.PartnerIDs)
+
+	var e accessAuditEvent
+	require.NoError(json.Unmarshal(sent.Payload, &e))
+	assert.Equal("DEADBEEF", e.CorrelationID)
+	assert.Equal("monitor", e.Type)
+	assert.Equal(accepted, e.Outcome)
+	assert.Equal(denied, e.Reason)
+	assert.Equal("partner", e.Check)
+}
+
+func testDeviceAccessAuditInvalid(t *testing.T) {
+	testData := []struct {
+		description string
+		audit       *deviceAccessAuditConfig
+	}{
+		{"No sink", &deviceAccessAuditConfig{EventType: "audit"}},
+		{"No outbound", &deviceAccessAuditConfig{Event: true}},
+		{"Bad file", &deviceAccessAuditConfig{File: filepath.Join(t.TempDir(), "missing", "audit.json")}},
+	}
+
+	for _, record := range testData {
+		t.Run(record.description, func(t *testing.T) {
+			da, err := buildDeviceAccessCheck(&deviceAccessCheckConfig{
+				Type:   "enforce",
+				Checks: newTestPolicyChecks(),
+				Audit:  record.audit,
+			}, zaptest.NewLogger(t), newTestCounter(), new(device.MockRegistry), nil)
+
+			assert.Nil(t, da)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func testDeviceAccessAuditUnlocked(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		events   = new(mockEventSender)
+		auditing = make(chan struct{})
+		release  = make(chan struct{})
+		done     = make(chan error)
+		da       = newAuditTestDeviceAccess(t, &deviceAccessCheckConfig{
+			Type:   "monitor",
+			Checks: newTestPolicyChecks(),
+			Audit:  &deviceAccessAuditConfig{Event: true},
+		}, events)
+	)
+
+	events.On("sendEvent", DefaultAuditEventType, mock.AnythingOfType("*wrp.Message")).Run(func(mock.Arguments) {
+		close(auditing)
+		<-release
+	}).Return(error(nil)).Once()
+
+	go func() {
+		done <- da.authorizeWRP(context.Background(), &wrp.Message{Destination: "mac:112233445566", PartnerIDs: []string{"comcast"}})
+	}()
+
+	// a slow sink does not hold the lock that reloads need
+	<-auditing
+	locked := make(chan struct{})
+	go func() {
+		da.lock.Lock()
+		da.lock.Unlock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		assert.Fail("the lock is held while auditing")
+	}
+
+	close(release)
+	assert.NoError(<-done)
+	events.AssertExpectations(t)
+}
+
+func TestDeviceAccessAudit(t *testing.T) {
+	t.Run("File", testDeviceAccessAuditFile)
+	t.Run("Event", testDeviceAccessAuditEvent)
+	t.Run("Unlocked", testDeviceAccessAuditUnlocked)
+	t.Run("Invalid", testDeviceAccessAuditInvalid)
+}
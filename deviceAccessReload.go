@@ -0,0 +1,272 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/spf13/viper"
+	"github.com/xmidt-org/webpa-common/v2/device"
+	"go.uber.org/zap"
+
+	// nolint:staticcheck
+	"github.com/xmidt-org/webpa-common/v2/xmetrics"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+var (
+	errDeviceAccessNotEnabled = errors.New("Device access checks are not enabled")
+	errDryRunDeviceIDRequired = errors.New("A deviceID or a message destination is required")
+)
+
+// NewDeviceAccess builds the device access checks configured in the given Viper
+// environment, returning nil if they are not configured.  Audit events are sent through
+// the given Outbound.
+func NewDeviceAccess(logger *zap.Logger, registry xmetrics.Registry, deviceRegistry device.Registry, outbound *Outbound, v *viper.Viper) (*talariaDeviceAccess, error) {
+	if !v.IsSet(DeviceAccessCheckConfigKey) {
+		return nil, nil
+	}
+
+	config := new(deviceAccessCheckConfig)
+	if err := v.UnmarshalKey(DeviceAccessCheckConfigKey, config); err != nil {
+		logger.Error("Could not unmarshall wrpCheck config for api access to device.")
+		return nil, err
+	}
+
+	var events eventSender
+	if outbound != nil {
+		events = outbound
+	}
+
+	t, err := buildDeviceAccessCheck(config, logger, registry.NewCounter(InboundWRPMessageCounter), deviceRegistry, events)
+	if err != nil {
+		return nil, err
+	}
+
+	t.reloads = registry.NewCounter(DeviceAccessReloadCounter)
+	return t, nil
+}
+
+// configure replaces the running policies and audit sinks with those of the given
+// configuration.  Nothing is changed if the configuration is invalid.
+func (t *talariaDeviceAccess) configure(config *deviceAccessCheckConfig) error {
+	defaultPolicy, err := newAccessPolicy(defaultPolicyName, config.Type, config.Checks, config.Rule, t.logger)
+	if err != nil {
+		return err
+	}
+
+	// nolint:prealloc
+	var policies []*accessPolicy
+	for i, pc := range config.Policies {
+		policy, err := parseDeviceAccessPolicy(i, pc, t.logger)
+		if err != nil {
+			return err
+		}
+		policies = append(policies, policy)
+	}
+
+	sep := config.Sep
+	if sep == "" {
+		sep = "."
+	}
+
+	defaultPolicy.facts = factNamespaces(defaultPolicy.rule, sep)
+	for _, policy := range policies {
+		policy.facts = factNamespaces(policy.rule, sep)
+	}
+
+	auditSinks, err := newAccessAuditSinks(config.Audit, t.events, t.logger)
+	if err != nil {
+		return err
+	}
+
+	t.lock.Lock()
+	previous := t.auditors
+	t.policies, t.defaultPolicy, t.sep = policies, defaultPolicy, sep
+	t.wrpDenials, t.auditors = config.WRPDenials, &accessAuditors{sinks: auditSinks}
+	t.lock.Unlock()
+
+	previous.close()
+
+	return nil
+}
+
+// Reload replaces the running device access policies with those of the given configuration.
+// Device access checks can only be enabled or disabled on restart.  Every reload is logged
+// and counted.
+func (t *talariaDeviceAccess) Reload(config *deviceAccessCheckConfig) error {
+	if t == nil {
+		return errDeviceAccessNotEnabled
+	}
+
+	err := t.configure(config)
+	t.recordReload(err)
+	return err
+}
+
+func (t *talariaDeviceAccess) recordReload(err error) {
+	if err != nil {
+		t.logger.Error("Unable to reload device access policies", zap.Error(err))
+		t.reloads.With(outcomeLabel, failure).Add(1.0)
+		return
+	}
+
+	t.lock.RLock()
+	policies := len(t.policies)
+	t.lock.RUnlock()
+	t.logger.Info("Reloaded device access policies", zap.Int("policies", policies))
+	t.reloads.With(outcomeLabel, success).Add(1.0)
+}
+
+// deviceAccessHandler is the control server handler that reloads the device access
+// policies and dry runs candidate ones
+type deviceAccessHandler struct {
+	access   *talariaDeviceAccess
+	reloader *configReloader
+}
+
+// deviceAccessReloadResponse is the body written by Reload and Update
+type deviceAccessReloadResponse struct {
+	Reloaded bool   `json:"reloaded"`
+	Error    string `json:"error,omitempty"`
+}
+
+// deviceAccessDryRunRequest is the body read by DryRun.  The device is the one
+// connected with the given ID, which defaults to the message's destination.  Principal
+// and PartnerID stand in for the caller's token.
+type deviceAccessDryRunRequest struct {
+	Policy    deviceAccessCheckConfig `json:"policy"`
+	Message   wrp.Message             `json:"message"`
+	DeviceID  string                  `json:"deviceID"`
+	Principal string                  `json:"principal"`
+	PartnerID string                  `json:"partnerID"`
+}
+
+// deviceAccessDryRunResponse is the body written by DryRun.  Outcome is whether the
+// message would have been accepted or rejected.
+type deviceAccessDryRunResponse struct {
+	Policy  string       `json:"policy"`
+	Type    string       `json:"type"`
+	Outcome string       `json:"outcome"`
+	Reason  string       `json:"reason"`
+	Check   string       `json:"check,omitempty"`
+	Steps   []accessStep `json:"steps"`
+}
+
+// Reload rereads the device access policies from the configuration file
+func (h deviceAccessHandler) Reload(response http.ResponseWriter, _ *http.Request) {
+	h.writeReload(response, h.reloader.ReloadDeviceAccess())
+}
+
+// Update replaces the device access policies with those in the request body, which has
+// the same form as the deviceAccessCheck configuration
+func (h deviceAccessHandler) Update(response http.ResponseWriter, request *http.Request) {
+	config := new(deviceAccessCheckConfig)
+	if err := json.NewDecoder(request.Body).Decode(config); err != nil {
+		h.writeReload(response, err)
+		return
+	}
+
+	h.writeReload(response, h.access.Reload(config))
+}
+
+func (h deviceAccessHandler) writeReload(response http.ResponseWriter, err error) {
+	var (
+		status = http.StatusOK
+		body   = deviceAccessReloadResponse{Reloaded: true}
+	)
+
+	if err != nil {
+		status = http.StatusBadRequest
+		body = deviceAccessReloadResponse{Error: err.Error()}
+	}
+
+	h.writeJSON(response, status, body)
+}
+
+// DryRun validates the candidate policy in the request body and runs it against the sample
+// message and device, returning each step of the evaluation.  The running policies are
+// left untouched and nothing is counted.
+func (h deviceAccessHandler) DryRun(response http.ResponseWriter, request *http.Request) {
+	var dr deviceAccessDryRunRequest
+	if err := json.NewDecoder(request.Body).Decode(&dr); err != nil {
+		h.writeError(response, http.StatusBadRequest, err)
+		return
+	}
+
+	if len(dr.DeviceID) > 0 {
+		dr.Message.Destination = dr.DeviceID
+	}
+
+	if len(dr.Message.Destination) == 0 {
+		h.writeError(response, http.StatusBadRequest, errDryRunDeviceIDRequired)
+		return
+	}
+
+	if h.access == nil {
+		h.writeError(response, http.StatusServiceUnavailable, errDeviceAccessNotEnabled)
+		return
+	}
+
+	candidate := &talariaDeviceAccess{
+		deviceRegistry: h.access.deviceRegistry,
+		logger:         h.access.logger,
+	}
+
+	// dry runs are never audited
+	dr.Policy.Audit = nil
+
+	if err := candidate.configure(&dr.Policy); err != nil {
+		h.writeError(response, http.StatusBadRequest, err)
+		return
+	}
+
+	var (
+		steps = []accessStep{}
+		d     = candidate.decide(dr.Principal, dr.PartnerID, &dr.Message, &steps)
+		body  = deviceAccessDryRunResponse{
+			Policy:  d.policy.name,
+			Type:    "monitor",
+			Outcome: accepted,
+			Reason:  d.reason,
+			Check:   d.branch,
+			Steps:   steps,
+		}
+	)
+
+	if d.policy.strict {
+		body.Type = "enforce"
+	}
+
+	if d.fatal || (d.err != nil && d.policy.strict) {
+		body.Outcome = rejected
+	}
+
+	h.writeJSON(response, http.StatusOK, body)
+}
+
+func (h deviceAccessHandler) writeJSON(response http.ResponseWriter, status int, body interface{}) {
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+	json.NewEncoder(response).Encode(body)
+}
+
+func (h deviceAccessHandler) writeError(response http.ResponseWriter, status int, err error) {
+	h.writeJSON(response, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,234 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/webpa-common/v2/device"
+	"go.uber.org/zap/zaptest"
+
+	// nolint:staticcheck
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func newReloadTestDeviceAccess(t *testing.T, reloads *mockCounter) *talariaDeviceAccess {
+	var (
+		mockDeviceRegistry = new(device.MockRegistry)
+		mockDevice         = new(device.MockDevice)
+	)
+
+	mockDeviceRegistry.On("Get", device.ID("mac:112233445566")).Return(mockDevice, true)
+	mockDeviceRegistry.On("Get", device.ID("mac:665544332211")).Return(nil, false)
+	mockDevice.On("Metadata").Return(getTestDeviceMetadata())
+
+	da, err := buildDeviceAccessCheck(&deviceAccessCheckConfig{
+		Type:   "enforce",
+		Checks: newTestPolicyChecks(),
+	}, zaptest.NewLogger(t), newTestCounter(), mockDeviceRegistry, nil)
+
+	require.NoError(t, err)
+	da.reloads = reloads
+	return da
+}
+
+func testDeviceAccessReload(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		reloads = new(mockCounter)
+		da      = newReloadTestDeviceAccess(t, reloads)
+		message = &wrp.Message{PartnerIDs: []string{"comcast"}, Destination: "mac:112233445566"}
+	)
+
+	require.ErrorIs(da.authorizeWRP(context.Background(), message), errDeniedDeviceAccess)
+
+	reloads.On("With", []string{outcomeLabel, success}).Once()
+	reloads.On("Add", 1.0).Twice()
+	require.NoError(da.Reload(&deviceAccessCheckConfig{
+		Type:   "monitor",
+		Checks: newTestPolicyChecks(),
+	}))
+
+	assert.NoError(da.authorizeWRP(context.Background(), message))
+
+	// an invalid configuration leaves the running policies in place
+	reloads.On("With", []string{outcomeLabel, failure}).Once()
+	assert.Error(da.Reload(&deviceAccessCheckConfig{Type: "enforce"}))
+	assert.NoError(da.authorizeWRP(context.Background(), message))
+	reloads.AssertExpectations(t)
+
+	var nilDeviceAccess *talariaDeviceAccess
+	assert.Equal(errDeviceAccessNotEnabled, nilDeviceAccess.Reload(&deviceAccessCheckConfig{}))
+}
+
+func testDeviceAccessReloadFile(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		reloads = new(mockCounter)
+		da      = newReloadTestDeviceAccess(t, reloads)
+		file    = filepath.Join(t.TempDir(), "talaria.yaml")
+		v       = viper.New()
+	)
+
+	require.NoError(os.WriteFile(file, []byte(strings.Join([]string{
+		"deviceAccessCheck:",
+		"  type: monitor",
+		"  checks:",
+		"    - name: partner",
+		"      deviceCredentialPath: partner-id",
+		"      wrpCredentialPath: PartnerIDs",
+		"      op: contains",
+		"      inversed: true",
+	}, "\n")), 0o600))
+
+	v.SetConfigFile(file)
+	reloads.On("With", []string{outcomeLabel, success}).Once()
+	reloads.On("Add", 1.0).Twice()
+
+	response := httptest.NewRecorder()
+	deviceAccessHandler{access: da, reloader: newConfigReloader(v, nil, da)}.Reload(response, httptest.NewRequest("POST", deviceAccessReloadPath, nil))
+	assert.Equal(http.StatusOK, response.Code)
+	assert.JSONEq(`{"reloaded": true}`, response.Body.String())
+	assert.False(da.defaultPolicy.strict)
+
+	reloads.On("With", []string{outcomeLabel, failure}).Once()
+	response = httptest.NewRecorder()
+	deviceAccessHandler{access: da, reloader: newConfigReloader(v, nil, da)}.Update(response, httptest.NewRequest("PUT", deviceAccessPolicyPath, strings.NewReader(`{"type": "strict"}`)))
+	assert.Equal(http.StatusBadRequest, response.Code)
+	assert.Contains(response.Body.String(), `"reloaded":false`)
+	reloads.AssertExpectations(t)
+}
+
+func testDeviceAccessDryRun(t *testing.T) {
+	var (
+		reloads = new(mockCounter)
+		da      = newReloadTestDeviceAccess(t, reloads)
+	)
+
+	testData := []struct {
+		description     string
+		body            string
+		expectedStatus  int
+		expectedOutcome string
+		expectedReason  string
+		expectedSteps   []accessStep
+	}{
+		{
+			description: "Denied",
+			body: `{
+				"policy": {"type": "enforce", "checks": [{"name": "partner", "deviceCredentialPath": "partner-id", "wrpCredentialPath": "PartnerIDs", "op": "contains", "inversed": true}]},
+				"message": {"msg_type": 3, "partner_ids": ["comcast"]},
+				"deviceID": "mac:112233445566"
+			}`,
+			expectedStatus:  http.StatusOK,
+			expectedOutcome: rejected,
+			expectedReason:  denied,
+			expectedSteps: []accessStep{
+				{Check: "partner", Operation: ContainsOp, Left: []interface{}{"comcast"}, Right: "sky", Reason: denied},
+				{Check: "allOf(partner)", Operation: allOfRule, Reason: denied},
+			},
+		},
+		{
+			description: "Authorized",
+			body: `{
+				"policy": {"type": "enforce", "checks": [{"name": "partner", "deviceCredentialPath": "partner-id", "wrpCredentialPath": "PartnerIDs", "op": "contains", "inversed": true}]},
+				"message": {"msg_type": 3, "partner_ids": ["sky"], "dest": "mac:112233445566"}
+			}`,
+			expectedStatus:  http.StatusOK,
+			expectedOutcome: accepted,
+			expectedReason:  authorized,
+			expectedSteps: []accessStep{
+				{Check: "partner", Operation: ContainsOp, Left: []interface{}{"sky"}, Right: "sky", Result: true},
+				{Check: "allOf(partner)", Operation: allOfRule, Result: true},
+			},
+		},
+		{
+			description: "Device not found",
+			body: `{
+				"policy": {"type": "enforce", "checks": [{"name": "partner", "deviceCredentialPath": "partner-id", "wrpCredentialPath": "PartnerIDs", "op": "contains", "inversed": true}]},
+				"message": {"msg_type": 3, "partner_ids": ["sky"]},
+				"deviceID": "mac:665544332211"
+			}`,
+			expectedStatus:  http.StatusOK,
+			expectedOutcome: rejected,
+			expectedReason:  deviceNotFound,
+			expectedSteps:   []accessStep{},
+		},
+		{
+			description:    "Invalid policy",
+			body:           `{"policy": {"type": "enforce"}, "deviceID": "mac:112233445566"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			description:    "No device",
+			body:           `{"policy": {"type": "enforce"}}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			description:    "Invalid body",
+			body:           `{`,
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, record := range testData {
+		t.Run(record.description, func(t *testing.T) {
+			var (
+				assert   = assert.New(t)
+				require  = require.New(t)
+				response = httptest.NewRecorder()
+			)
+
+			deviceAccessHandler{access: da}.DryRun(response, httptest.NewRequest("POST", deviceAccessDryRunPath, strings.NewReader(record.body)))
+			require.Equal(record.expectedStatus, response.Code)
+			if record.expectedStatus != http.StatusOK {
+				assert.Contains(response.Body.String(), `"error"`)
+				return
+			}
+
+			var body deviceAccessDryRunResponse
+			require.NoError(json.Unmarshal(response.Body.Bytes(), &body))
+			assert.Equal(defaultPolicyName, body.Policy)
+			assert.Equal("enforce", body.Type)
+			assert.Equal(record.expectedOutcome, body.Outcome)
+			assert.Equal(record.expectedReason, body.Reason)
+			assert.Equal(record.expectedSteps, body.Steps)
+		})
+	}
+
+	// the running policies are untouched and nothing is counted
+	reloads.AssertExpectations(t)
+	assert.ErrorIs(t, da.authorizeWRP(context.Background(), &wrp.Message{PartnerIDs: []string{"comcast"}, Destination: "mac:112233445566"}), errDeniedDeviceAccess)
+}
+
+func TestDeviceAccessReload(t *testing.T) {
+	t.Run("Reload", testDeviceAccessReload)
+	t.Run("File", testDeviceAccessReloadFile)
+	t.Run("DryRun", testDeviceAccessDryRun)
+}
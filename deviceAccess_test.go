@@ -10,6 +10,7 @@ import (
 	"github.com/go-kit/kit/metrics"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	"github.com/xmidt-org/webpa-common/v2/device"
 	"go.uber.org/zap/zaptest"
 
@@ -68,17 +69,16 @@ func testAuthorizeWRP(t *testing.T, testCases []deviceAccessTestCase, strict boo
 			}
 
 			deviceAccessAuthority := &talariaDeviceAccess{
-				strict:             strict,
 				wrpMessagesCounter: counter,
 				deviceRegistry:     mockDeviceRegistry,
 				sep:                ">",
 				logger:        testLogger,
-				checks:             checks,
+				defaultPolicy:      &accessPolicy{name: defaultPolicyName, strict: strict, rule: newAllOfRule(checks)},
 			}
 
 			err := deviceAccessAuthority.authorizeWRP(context.Background(), wrpMsg)
 			if strict || testCase.IsFatal {
-				assert.Equal(testCase.ExpectedError, err)
+				assert.ErrorIs(err, testCase.ExpectedError)
 			} else {
 				assert.Nil(err)
 			}
@@ -95,6 +95,7 @@ func TestAuthorizeWRP(t *testing.T) {
 			DeviceID: "McD's:1122334455",
 			BaseLabelPairs: map[string]string{
 				reasonLabel: invalidWRPDest,
+				checkLabel:  "",
 			},
 			ExpectedError: errInvalidWRPDestination,
 			IsFatal:       true,
@@ -105,6 +106,7 @@ func TestAuthorizeWRP(t *testing.T) {
 			MissingDevice: true,
 			BaseLabelPairs: map[string]string{
 				reasonLabel: deviceNotFound,
+				checkLabel:  "",
 			},
 			ExpectedError: errDeviceNotFound,
 			IsFatal:       true,
@@ -114,6 +116,7 @@ func TestAuthorizeWRP(t *testing.T) {
 			DeviceID: "mac:112233445566",
 			BaseLabelPairs: map[string]string{
 				reasonLabel: missingDeviceCredential,
+				checkLabel:  "trustedDevice",
 			},
 			MissingDeviceCredential: true,
 			ExpectedError:           errDeviceCredentialMissing,
@@ -124,6 +127,7 @@ func TestAuthorizeWRP(t *testing.T) {
 			DeviceID: "mac:112233445566",
 			BaseLabelPairs: map[string]string{
 				reasonLabel: missingWRPCredential,
+				checkLabel:  "partnerID",
 			},
 			MissingWRPCredential: true,
 			ExpectedError:        errWRPCredentialsMissing,
@@ -134,6 +138,7 @@ func TestAuthorizeWRP(t *testing.T) {
 			DeviceID: "mac:112233445566",
 			BaseLabelPairs: map[string]string{
 				reasonLabel: incompleteCheck,
+				checkLabel:  "partnerID",
 			},
 			IncompleteCheck: true,
 			ExpectedError:   errIncompleteCheck,
@@ -143,6 +148,7 @@ func TestAuthorizeWRP(t *testing.T) {
 			DeviceID: "mac:112233445566",
 			BaseLabelPairs: map[string]string{
 				reasonLabel: denied,
+				checkLabel:  "happyDevice",
 			},
 			Authorized:    false,
 			ExpectedError: errDeniedDeviceAccess,
@@ -153,6 +159,7 @@ func TestAuthorizeWRP(t *testing.T) {
 			DeviceID: "mac:112233445566",
 			BaseLabelPairs: map[string]string{
 				reasonLabel: authorized,
+				checkLabel:  "",
 			},
 			Authorized: true,
 		},
@@ -178,6 +185,7 @@ func getLabelMaps(err error, isFatal, strict bool, baseLabelPairs map[string]str
 		outcome = rejected
 	}
 	out[outcomeLabel] = outcome
+	out[policyLabel] = defaultPolicyName
 
 	return out
 }
@@ -281,3 +289,96 @@ func getBaseChecks(m *mockBinOp) []*parsedCheck {
 		},
 	}
 }
+
+func TestAuthorizeWRPRule(t *testing.T) {
+	newCheck := func(config deviceAccessCheck) *parsedCheck {
+		c, err := parseDeviceAccessCheck(config)
+		require.NoError(t, err)
+		return c
+	}
+
+	checks := []*parsedCheck{
+		newCheck(deviceAccessCheck{Name: "partner", DeviceCredentialPath: device.PartnerIDClaimKey, WRPCredentialPath: "PartnerIDs", Op: ContainsOp, Inversed: true}),
+		newCheck(deviceAccessCheck{Name: "trust", DeviceCredentialPath: device.TrustClaimKey, InputValue: 1000, Op: GreaterThanOp}),
+		newCheck(deviceAccessCheck{Name: "happy", DeviceCredentialPath: "nested>happy", InputValue: true, Op: EqualsOp}),
+		newCheck(deviceAccessCheck{Name: "missing", DeviceCredentialPath: "path>not>found", InputValue: true, Op: EqualsOp}),
+	}
+
+	partnerOrTrusted := deviceAccessRule{AnyOf: []deviceAccessRule{{Check: "partner"}, {Check: "trust"}}}
+	testCases := []struct {
+		name           string
+		rule           deviceAccessRule
+		partnerIDs     []string
+		expectedErr    error
+		expectedReason string
+		expectedCheck  string
+	}{
+		{
+			name:           "AnyOf authorized",
+			rule:           partnerOrTrusted,
+			partnerIDs:     []string{"comcast", "sky"},
+			expectedReason: authorized,
+		},
+		{
+			name:           "AnyOf denied",
+			rule:           partnerOrTrusted,
+			partnerIDs:     []string{"comcast"},
+			expectedErr:    errDeniedDeviceAccess,
+			expectedReason: denied,
+			expectedCheck:  "anyOf(partner,trust)",
+		},
+		{
+			name:           "Not denied",
+			rule:           deviceAccessRule{AllOf: []deviceAccessRule{partnerOrTrusted, {Name: "unhappy", Not: &deviceAccessRule{Check: "happy"}}}},
+			partnerIDs:     []string{"sky"},
+			expectedErr:    errDeniedDeviceAccess,
+			expectedReason: denied,
+			expectedCheck:  "unhappy",
+		},
+		{
+			name:           "Not authorized",
+			rule:           deviceAccessRule{Not: &deviceAccessRule{Check: "trust"}},
+			expectedReason: authorized,
+		},
+		{
+			name:           "Not incomplete",
+			rule:           deviceAccessRule{Not: &deviceAccessRule{Check: "missing"}},
+			expectedErr:    errDeviceCredentialMissing,
+			expectedReason: missingDeviceCredential,
+			expectedCheck:  "missing",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var (
+				assert             = assert.New(t)
+				mockDeviceRegistry = new(device.MockRegistry)
+				mockDevice         = new(device.MockDevice)
+				counter            = newTestCounter()
+			)
+
+			rule, err := parseDeviceAccessRule(testCase.rule, checks)
+			require.NoError(t, err)
+
+			mockDeviceRegistry.On("Get", device.ID("mac:112233445566")).Return(mockDevice, true).Once()
+			mockDevice.On("Metadata").Return(getTestDeviceMetadata()).Once()
+			deviceAccessAuthority := &talariaDeviceAccess{
+				wrpMessagesCounter: counter,
+				deviceRegistry:     mockDeviceRegistry,
+				sep:                ">",
+				logger:             zaptest.NewLogger(t),
+				defaultPolicy:      &accessPolicy{name: defaultPolicyName, strict: true, rule: rule},
+			}
+
+			err = deviceAccessAuthority.authorizeWRP(context.Background(), &wrp.Message{
+				PartnerIDs:  testCase.partnerIDs,
+				Destination: "mac:112233445566",
+			})
+
+			assert.ErrorIs(err, testCase.expectedErr)
+			assert.Equal(testCase.expectedReason, counter.labelPairs[reasonLabel])
+			assert.Equal(testCase.expectedCheck, counter.labelPairs[checkLabel])
+		})
+	}
+}
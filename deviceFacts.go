@@ -0,0 +1,143 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"strings"
+
+	"github.com/xmidt-org/webpa-common/v2/convey"
+	"github.com/xmidt-org/webpa-common/v2/device"
+	"go.uber.org/zap"
+)
+
+// Device fact namespaces.  A check's DeviceCredentialPath that starts with one of these,
+// e.g. convey.fw-name or stats.connectedAt, refers to that part of the device facts.
+const (
+	claimsFacts  = "claims"
+	conveyFacts  = "convey"
+	statsFacts   = "stats"
+	sessionFacts = "session"
+)
+
+// factNamespaces returns the namespaces that the checks of the rule tree refer to, which
+// is nil if they only refer to top level claims
+func factNamespaces(rule *parsedRule, sep string) map[string]bool {
+	var namespaces map[string]bool
+	var walk func(*parsedRule)
+	walk = func(r *parsedRule) {
+		if r.check != nil {
+			switch namespace := strings.SplitN(r.check.deviceCredentialPath, sep, 2)[0]; namespace {
+			case claimsFacts, conveyFacts, statsFacts, sessionFacts:
+				if namespaces == nil {
+					namespaces = make(map[string]bool)
+				}
+
+				namespaces[namespace] = true
+			}
+		}
+
+		for _, child := range r.rules {
+			walk(child)
+		}
+	}
+
+	walk(rule)
+	return namespaces
+}
+
+// deviceFacts builds the document that device credential paths are resolved against.  The
+// device's claims are at the top level, for paths that predate the namespaces, and each
+// of the given namespaces is added alongside them:
+//
+//	claims:  the device's JWT claims
+//	convey:  the convey metadata the device connected with, e.g. fw-name and hw-model
+//	stats:   bytesReceived, bytesSent, messagesReceived, messagesSent, duplications,
+//	         connectedAt (unix seconds) and upTime (seconds)
+//	session: id, deviceID, partnerID, trust and age (seconds since the device connected)
+//
+// A namespace hides a top level claim of the same name.  Since this runs for every message
+// that is checked, that is only logged at debug level.  Such a claim is still available under
+// the claims namespace, e.g. as claims.convey, unless it is itself named claims.
+func deviceFacts(d device.Interface, namespaces map[string]bool, logger *zap.Logger) map[string]interface{} {
+	metadata := d.Metadata()
+	if len(namespaces) == 0 {
+		return metadata.Claims()
+	}
+
+	facts := metadata.ClaimsCopy()
+	if facts == nil {
+		facts = make(map[string]interface{})
+	}
+
+	for namespace := range namespaces {
+		if _, ok := facts[namespace]; ok {
+			logger.Debug("Device claim hidden by fact namespace", zap.String("deviceID", string(d.ID())), zap.String("namespace", namespace))
+		}
+	}
+
+	if namespaces[claimsFacts] {
+		facts[claimsFacts] = metadata.Claims()
+	}
+
+	if namespaces[conveyFacts] {
+		conveyed := make(map[string]interface{})
+		if c, ok := d.Convey().(convey.C); ok {
+			for k, v := range c {
+				conveyed[k] = v
+			}
+		}
+
+		facts[conveyFacts] = conveyed
+	}
+
+	var statistics device.Statistics
+	if namespaces[statsFacts] || namespaces[sessionFacts] {
+		statistics = d.Statistics()
+	}
+
+	if namespaces[statsFacts] {
+		stats := make(map[string]interface{})
+		if statistics != nil {
+			stats["bytesReceived"] = statistics.BytesReceived()
+			stats["bytesSent"] = statistics.BytesSent()
+			stats["messagesReceived"] = statistics.MessagesReceived()
+			stats["messagesSent"] = statistics.MessagesSent()
+			stats["duplications"] = statistics.Duplications()
+			stats["connectedAt"] = statistics.ConnectedAt().Unix()
+			stats["upTime"] = int64(statistics.UpTime().Seconds())
+		}
+
+		facts[statsFacts] = stats
+	}
+
+	if namespaces[sessionFacts] {
+		session := map[string]interface{}{
+			"id":        metadata.SessionID(),
+			"deviceID":  string(d.ID()),
+			"partnerID": metadata.PartnerIDClaim(),
+			"trust":     metadata.TrustClaim(),
+		}
+
+		if statistics != nil {
+			session["age"] = int64(statistics.UpTime().Seconds())
+		}
+
+		facts[sessionFacts] = session
+	}
+
+	return facts
+}
@@ -0,0 +1,188 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/webpa-common/v2/convey"
+	"github.com/xmidt-org/webpa-common/v2/device"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
+
+	// nolint:staticcheck
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func newFactsTestDevice() *device.MockDevice {
+	var (
+		connectedAt = time.Unix(1600000000, 0)
+		metadata    = getTestDeviceMetadata()
+		d           = new(device.MockDevice)
+	)
+
+	metadata.SetSessionID("session-1")
+	d.On("ID").Return(device.ID("mac:112233445566"))
+	d.On("Metadata").Return(metadata)
+	d.On("Convey").Return(convey.C{"fw-name": "fw-2.1", "hw-model": "XB7"})
+	d.On("Statistics").Return(device.NewStatistics(func() time.Time { return connectedAt.Add(time.Hour) }, connectedAt))
+	return d
+}
+
+func testFactNamespaces(t *testing.T) {
+	assert := assert.New(t)
+	checks := []*parsedCheck{
+		{name: "partner", deviceCredentialPath: device.PartnerIDClaimKey},
+		{name: "firmware", deviceCredentialPath: "convey>fw-name"},
+		{name: "age", deviceCredentialPath: "session>age"},
+		{name: "nested", deviceCredentialPath: "nested>happy"},
+	}
+
+	assert.Nil(factNamespaces(newAllOfRule(checks[:1]), ">"))
+	assert.Equal(map[string]bool{conveyFacts: true, sessionFacts: true}, factNamespaces(newAllOfRule(checks), ">"))
+
+	// the separator decides what the first segment is
+	assert.Nil(factNamespaces(newAllOfRule(checks), "."))
+}
+
+func testDeviceFacts(t *testing.T) {
+	var (
+		assert = assert.New(t)
+		d      = newFactsTestDevice()
+	)
+
+	assert.Equal(getTestDeviceMetadata().Claims(), deviceFacts(d, nil, zaptest.NewLogger(t)))
+	d.AssertNotCalled(t, "Convey")
+	d.AssertNotCalled(t, "Statistics")
+
+	facts := deviceFacts(d, map[string]bool{claimsFacts: true, conveyFacts: true, statsFacts: true, sessionFacts: true}, zaptest.NewLogger(t))
+	assert.Equal("sky", facts[device.PartnerIDClaimKey])
+	assert.Equal(getTestDeviceMetadata().Claims(), facts[claimsFacts])
+	assert.Equal(map[string]interface{}{"fw-name": "fw-2.1", "hw-model": "XB7"}, facts[conveyFacts])
+	assert.Equal(map[string]interface{}{
+		"bytesReceived":    0,
+		"bytesSent":        0,
+		"messagesReceived": 0,
+		"messagesSent":     0,
+		"duplications":     0,
+		"connectedAt":      int64(1600000000),
+		"upTime":           int64(3600),
+	}, facts[statsFacts])
+	assert.Equal(map[string]interface{}{
+		"id":        "session-1",
+		"deviceID":  "mac:112233445566",
+		"partnerID": "sky",
+		"trust":     100,
+		"age":       int64(3600),
+	}, facts[sessionFacts])
+
+	// the device's own claims are left untouched
+	assert.NotContains(d.Metadata().Claims(), conveyFacts)
+}
+
+func testDeviceFactsHiddenClaim(t *testing.T) {
+	var (
+		assert        = assert.New(t)
+		core, logs    = observer.New(zap.DebugLevel)
+		metadata      = new(device.Metadata)
+		d             = new(device.MockDevice)
+		conveyedFacts = map[string]interface{}{"fw-name": "fw-2.1"}
+	)
+
+	metadata.SetClaims(map[string]interface{}{conveyFacts: "claimed"})
+	d.On("ID").Return(device.ID("mac:112233445566"))
+	d.On("Metadata").Return(metadata)
+	d.On("Convey").Return(convey.C(conveyedFacts))
+
+	// the namespace wins, the claim stays under the claims namespace and the conflict is logged
+	facts := deviceFacts(d, map[string]bool{claimsFacts: true, conveyFacts: true}, zap.New(core))
+	assert.Equal(conveyedFacts, facts[conveyFacts])
+	assert.Equal(map[string]interface{}{conveyFacts: "claimed"}, facts[claimsFacts])
+	if assert.Equal(1, logs.Len()) {
+		assert.Equal(zap.DebugLevel, logs.All()[0].Level)
+		assert.Equal(conveyFacts, logs.All()[0].ContextMap()["namespace"])
+	}
+}
+
+func testAuthorizeWRPDeviceFacts(t *testing.T) {
+	testData := []struct {
+		description string
+		checks      []deviceAccessCheck
+		expectedErr error
+	}{
+		{
+			description: "Convey",
+			checks: []deviceAccessCheck{
+				{Name: "firmware", DeviceCredentialPath: "convey.fw-name", InputValue: "fw-2", Op: StartsWithOp},
+			},
+		},
+		{
+			description: "Session age",
+			checks: []deviceAccessCheck{
+				{Name: "age", DeviceCredentialPath: "session.age", InputValue: 7200, Op: GreaterThanOrEqualOp},
+			},
+			expectedErr: errDeniedDeviceAccess,
+		},
+		{
+			description: "Stats and legacy claims",
+			checks: []deviceAccessCheck{
+				{Name: "connected", DeviceCredentialPath: "stats.connectedAt", InputValue: 1700000000, Op: LessThanOp},
+				{Name: "partner", DeviceCredentialPath: device.PartnerIDClaimKey, WRPCredentialPath: "PartnerIDs", Op: ContainsOp, Inversed: true},
+				{Name: "trust", DeviceCredentialPath: "claims.trust", InputValue: 99, Op: GreaterThanOp},
+			},
+		},
+		{
+			description: "Missing convey field",
+			checks: []deviceAccessCheck{
+				{Name: "reason", DeviceCredentialPath: "convey.last-reconnect-reason", InputValue: "ping-miss", Op: EqualsOp},
+			},
+			expectedErr: errDeviceCredentialMissing,
+		},
+	}
+
+	for _, record := range testData {
+		t.Run(record.description, func(t *testing.T) {
+			mockDeviceRegistry := new(device.MockRegistry)
+			mockDeviceRegistry.On("Get", device.ID("mac:112233445566")).Return(newFactsTestDevice(), true)
+
+			da, err := buildDeviceAccessCheck(&deviceAccessCheckConfig{
+				Type:   "enforce",
+				Checks: record.checks,
+			}, zaptest.NewLogger(t), newTestCounter(), mockDeviceRegistry, nil)
+
+			require.NoError(t, err)
+			err = da.authorizeWRP(context.Background(), &wrp.Message{PartnerIDs: []string{"sky"}, Destination: "mac:112233445566"})
+			if record.expectedErr == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, record.expectedErr)
+			}
+		})
+	}
+}
+
+func TestDeviceFacts(t *testing.T) {
+	t.Run("Namespaces", testFactNamespaces)
+	t.Run("Facts", testDeviceFacts)
+	t.Run("HiddenClaim", testDeviceFactsHiddenClaim)
+	t.Run("AuthorizeWRP", testAuthorizeWRPDeviceFacts)
+}
@@ -0,0 +1,363 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"container/heap"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/thedevsaddam/gojsonq/v2"
+	"github.com/xmidt-org/webpa-common/v2/convey"
+	"github.com/xmidt-org/webpa-common/v2/device"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultDeviceQueryLimit is the number of devices in a page of query results, unless
+	// the query asks for another
+	DefaultDeviceQueryLimit = 100
+
+	// MaxDeviceQueryLimit is the most devices in a page of query results
+	MaxDeviceQueryLimit = 1000
+)
+
+// defaultDeviceQueryFields are the device facts projected when a query does not choose any
+var defaultDeviceQueryFields = []string{
+	"session.partnerID",
+	"session.trust",
+	"session.id",
+	"stats.connectedAt",
+	"convey.fw-name",
+	"convey.hw-model",
+}
+
+// deviceQueryFacts are the session and stats facts that queries may return or group by.
+// Any convey field may be used as well, but the device's claims may not.
+var deviceQueryFacts = map[string]bool{
+	"session.id":             true,
+	"session.deviceID":       true,
+	"session.partnerID":      true,
+	"session.trust":          true,
+	"session.age":            true,
+	"stats.bytesReceived":    true,
+	"stats.bytesSent":        true,
+	"stats.messagesReceived": true,
+	"stats.messagesSent":     true,
+	"stats.duplications":     true,
+	"stats.connectedAt":      true,
+	"stats.upTime":           true,
+}
+
+var errInvalidDeviceQueryCursor = errors.New("Invalid cursor")
+
+// deviceQueryFact tests whether a query may return or group by the device fact at path
+func deviceQueryFact(path string) bool {
+	return deviceQueryFacts[path] || (strings.HasPrefix(path, conveyFacts+".") && len(path) > len(conveyFacts)+1)
+}
+
+// deviceQuery selects connected devices and describes the page of results to return.
+// Devices are ordered by ID, and a page starts after the device ID in its cursor.
+type deviceQuery struct {
+	partnerIDs     map[string]bool
+	minTrust       int
+	hasMinTrust    bool
+	convey         map[string]string
+	connectedSince time.Time
+	sessionID      string
+
+	after      device.ID
+	limit      int
+	fields     []string
+	groupBy    string
+	namespaces map[string]bool
+}
+
+// parseDeviceQuery reads a deviceQuery from the query parameters:
+//
+//	partnerID:      the device's partner ID is one of those given, which may be repeated
+//	minTrust:       the device's trust is at least this
+//	convey.<field>: the device's convey field, e.g. convey.fw-name, has this value
+//	connectedSince: the device connected at or after this, in RFC3339 or unix seconds
+//	sessionID:      the device's session has this ID
+//	cursor:         the next value of a previous page of results
+//	limit:          the most devices in the page, up to 1000
+//	fields:         the comma separated device facts to return, e.g. session.trust,stats.upTime
+//	groupBy:        the device fact to count matching devices by
+//
+// Unknown parameters are rejected, so that mistyped filters do not select every device.
+// Only the session, stats and convey facts may be returned or grouped by.
+func parseDeviceQuery(values url.Values) (*deviceQuery, error) {
+	q := &deviceQuery{
+		limit:  DefaultDeviceQueryLimit,
+		fields: defaultDeviceQueryFields,
+	}
+
+	for name, vs := range values {
+		value := vs[0]
+		switch {
+		case name == "partnerID":
+			q.partnerIDs = make(map[string]bool, len(vs))
+			for _, v := range vs {
+				q.partnerIDs[v] = true
+			}
+
+		case name == "minTrust":
+			trust, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid minTrust: %w", err)
+			}
+
+			q.minTrust, q.hasMinTrust = trust, true
+
+		case strings.HasPrefix(name, conveyFacts+"."):
+			if q.convey == nil {
+				q.convey = make(map[string]string)
+			}
+
+			q.convey[strings.TrimPrefix(name, conveyFacts+".")] = value
+
+		case name == "connectedSince":
+			since, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				seconds, parseErr := strconv.ParseInt(value, 10, 64)
+				if parseErr != nil {
+					return nil, fmt.Errorf("Invalid connectedSince: %w", err)
+				}
+
+				since = time.Unix(seconds, 0)
+			}
+
+			q.connectedSince = since
+
+		case name == "sessionID":
+			q.sessionID = value
+
+		case name == "cursor":
+			after, err := base64.RawURLEncoding.DecodeString(value)
+			if err != nil || len(after) == 0 {
+				return nil, errInvalidDeviceQueryCursor
+			}
+
+			q.after = device.ID(after)
+
+		case name == "limit":
+			limit, err := strconv.Atoi(value)
+			if err != nil || limit < 1 || limit > MaxDeviceQueryLimit {
+				return nil, fmt.Errorf("Invalid limit: must be between 1 and %d", MaxDeviceQueryLimit)
+			}
+
+			q.limit = limit
+
+		case name == "fields":
+			q.fields = nil
+			for _, field := range strings.Split(value, ",") {
+				if field = strings.TrimSpace(field); len(field) > 0 {
+					if !deviceQueryFact(field) {
+						return nil, fmt.Errorf("Invalid field: %s", field)
+					}
+
+					q.fields = append(q.fields, field)
+				}
+			}
+
+		case name == "groupBy":
+			if !deviceQueryFact(value) {
+				return nil, fmt.Errorf("Invalid groupBy: %s", value)
+			}
+
+			q.groupBy = value
+
+		default:
+			return nil, fmt.Errorf("Unknown query parameter: %s", name)
+		}
+	}
+
+	// only the namespaces of facts that are returned or grouped by are gathered
+	for _, path := range append([]string{q.groupBy}, q.fields...) {
+		switch namespace := strings.SplitN(path, ".", 2)[0]; namespace {
+		case conveyFacts, statsFacts, sessionFacts:
+			if q.namespaces == nil {
+				q.namespaces = make(map[string]bool)
+			}
+
+			q.namespaces[namespace] = true
+		}
+	}
+
+	return q, nil
+}
+
+// matches tests a connected device against the query's filters
+func (q *deviceQuery) matches(d device.Interface) bool {
+	metadata := d.Metadata()
+	if q.partnerIDs != nil && !q.partnerIDs[metadata.PartnerIDClaim()] {
+		return false
+	}
+
+	if q.hasMinTrust && metadata.TrustClaim() < q.minTrust {
+		return false
+	}
+
+	if len(q.sessionID) > 0 && metadata.SessionID() != q.sessionID {
+		return false
+	}
+
+	if len(q.convey) > 0 {
+		c, _ := d.Convey().(convey.C)
+		for field, value := range q.convey {
+			if v, ok := c[field]; !ok || fmt.Sprint(v) != value {
+				return false
+			}
+		}
+	}
+
+	if !q.connectedSince.IsZero() {
+		if statistics := d.Statistics(); statistics == nil || statistics.ConnectedAt().Before(q.connectedSince) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// project returns the query's fields of a device's facts, along with its ID
+func (q *deviceQuery) project(d device.Interface, logger *zap.Logger) map[string]interface{} {
+	var (
+		facts      = gojsonq.New(gojsonq.WithSeparator(".")).FromInterface(deviceFacts(d, q.namespaces, logger))
+		projection = map[string]interface{}{"id": string(d.ID())}
+	)
+
+	for _, field := range q.fields {
+		projection[field] = facts.Reset().Find(field)
+	}
+
+	return projection
+}
+
+// group returns the value of a device's groupBy fact that it is counted under.  Devices
+// without the fact are counted under the empty string.
+func (q *deviceQuery) group(d device.Interface, logger *zap.Logger) string {
+	facts := gojsonq.New(gojsonq.WithSeparator(".")).FromInterface(deviceFacts(d, q.namespaces, logger))
+	if v := facts.Find(q.groupBy); v != nil {
+		return fmt.Sprint(v)
+	}
+
+	return ""
+}
+
+// devicePage is a max-heap of the devices with the lowest IDs seen so far
+type devicePage []device.Interface
+
+func (p devicePage) Len() int            { return len(p) }
+func (p devicePage) Less(i, j int) bool  { return p[i].ID() > p[j].ID() }
+func (p devicePage) Swap(i, j int)       { p[i], p[j] = p[j], p[i] }
+func (p *devicePage) Push(x interface{}) { *p = append(*p, x.(device.Interface)) }
+
+func (p *devicePage) Pop() interface{} {
+	old := *p
+	d := old[len(old)-1]
+	*p = old[:len(old)-1]
+	return d
+}
+
+// deviceQueryResponse is the body written by the device query endpoint.  Count and Groups
+// cover every matching device, while Devices is the page of them after the cursor.  Next
+// is the cursor of the following page, if there is one.
+type deviceQueryResponse struct {
+	Count   int                      `json:"count"`
+	Devices []map[string]interface{} `json:"devices"`
+	Next    string                   `json:"next,omitempty"`
+	Groups  map[string]int           `json:"groups,omitempty"`
+}
+
+// deviceQueryHandler serves queries over the connected devices, which unlike
+// device.ListHandler return a page of the matching devices at a time
+type deviceQueryHandler struct {
+	logger   *zap.Logger
+	registry device.Registry
+}
+
+func (h deviceQueryHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	q, err := parseDeviceQuery(request.URL.Query())
+	if err != nil {
+		h.writeError(response, http.StatusBadRequest, err)
+		return
+	}
+
+	var (
+		body = deviceQueryResponse{Devices: []map[string]interface{}{}}
+		page = make(devicePage, 0, q.limit+1)
+	)
+
+	if len(q.groupBy) > 0 {
+		body.Groups = make(map[string]int)
+	}
+
+	h.registry.VisitAll(func(d device.Interface) bool {
+		if !q.matches(d) {
+			return true
+		}
+
+		body.Count++
+		if body.Groups != nil {
+			body.Groups[q.group(d, h.logger)]++
+		}
+
+		// one device more than the limit is kept to tell whether there is another page
+		if d.ID() > q.after {
+			heap.Push(&page, d)
+			if page.Len() > q.limit+1 {
+				heap.Pop(&page)
+			}
+		}
+
+		return true
+	})
+
+	sort.Slice(page, func(i, j int) bool { return page[i].ID() < page[j].ID() })
+	if len(page) > q.limit {
+		page = page[:q.limit]
+		body.Next = base64.RawURLEncoding.EncodeToString([]byte(page[q.limit-1].ID()))
+	}
+
+	for _, d := range page {
+		body.Devices = append(body.Devices, q.project(d, h.logger))
+	}
+
+	h.writeJSON(response, http.StatusOK, body)
+}
+
+func (h deviceQueryHandler) writeJSON(response http.ResponseWriter, status int, body interface{}) {
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+	if err := json.NewEncoder(response).Encode(body); err != nil {
+		h.logger.Error("Error while writing device query results", zap.Error(err))
+	}
+}
+
+func (h deviceQueryHandler) writeError(response http.ResponseWriter, status int, err error) {
+	h.writeJSON(response, status, map[string]string{"error": err.Error()})
+}
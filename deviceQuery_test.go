@@ -0,0 +1,205 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/webpa-common/v2/convey"
+	"github.com/xmidt-org/webpa-common/v2/device"
+	"go.uber.org/zap/zaptest"
+)
+
+func newQueryTestDevice(id device.ID, partnerID string, trust int, firmware string, connectedAt time.Time) *device.MockDevice {
+	var (
+		d        = new(device.MockDevice)
+		metadata = new(device.Metadata)
+	)
+
+	metadata.SetClaims(map[string]interface{}{
+		device.PartnerIDClaimKey: partnerID,
+		device.TrustClaimKey:     trust,
+	})
+
+	metadata.SetSessionID("session-" + string(id))
+	d.On("ID").Return(id)
+	d.On("Metadata").Return(metadata)
+	d.On("Convey").Return(convey.C{"fw-name": firmware, "hw-model": "XB7"})
+	d.On("Statistics").Return(device.NewStatistics(time.Now, connectedAt))
+	return d
+}
+
+func newQueryTestRegistry() *device.MockRegistry {
+	var (
+		registry = new(device.MockRegistry)
+		start    = time.Unix(1600000000, 0)
+		devices  = []device.Interface{
+			newQueryTestDevice("mac:000000000004", "sky", 100, "fw-2.1", start),
+			newQueryTestDevice("mac:000000000001", "sky", 1000, "fw-2.1", start.Add(time.Hour)),
+			newQueryTestDevice("mac:000000000003", "comcast", 1000, "fw-1.9", start),
+			newQueryTestDevice("mac:000000000002", "sky", 1000, "fw-1.9", start.Add(2*time.Hour)),
+			newQueryTestDevice("mac:000000000005", "nbc", 0, "fw-2.1", start.Add(time.Hour)),
+		}
+	)
+
+	registry.On("VisitAll", mock.Anything).Run(func(args mock.Arguments) {
+		visit := args.Get(0).(func(device.Interface) bool)
+		for _, d := range devices {
+			if !visit(d) {
+				return
+			}
+		}
+	}).Return(len(devices))
+
+	return registry
+}
+
+func serveDeviceQuery(t *testing.T, query string) (*httptest.ResponseRecorder, deviceQueryResponse) {
+	var (
+		h        = deviceQueryHandler{logger: zaptest.NewLogger(t), registry: newQueryTestRegistry()}
+		response = httptest.NewRecorder()
+		body     deviceQueryResponse
+	)
+
+	h.ServeHTTP(response, httptest.NewRequest("GET", "/api/v3/devices/query"+query, nil))
+	if response.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(response.Body.Bytes(), &body))
+	}
+
+	return response, body
+}
+
+func deviceQueryIDs(body deviceQueryResponse) []interface{} {
+	ids := make([]interface{}, 0, len(body.Devices))
+	for _, d := range body.Devices {
+		ids = append(ids, d["id"])
+	}
+
+	return ids
+}
+
+func testDeviceQueryFilters(t *testing.T) {
+	testData := []struct {
+		description string
+		query       string
+		expectedIDs []interface{}
+	}{
+		{"All", "", []interface{}{"mac:000000000001", "mac:000000000002", "mac:000000000003", "mac:000000000004", "mac:000000000005"}},
+		{"Partner", "?partnerID=sky&partnerID=nbc", []interface{}{"mac:000000000001", "mac:000000000002", "mac:000000000004", "mac:000000000005"}},
+		{"Trust", "?minTrust=1000", []interface{}{"mac:000000000001", "mac:000000000002", "mac:000000000003"}},
+		{"Convey", "?convey.fw-name=fw-2.1&convey.hw-model=XB7", []interface{}{"mac:000000000001", "mac:000000000004", "mac:000000000005"}},
+		{"Connected since", "?connectedSince=2020-09-13T13:26:40Z", []interface{}{"mac:000000000001", "mac:000000000002", "mac:000000000005"}},
+		{"Connected since unix", "?connectedSince=1600003600&partnerID=sky", []interface{}{"mac:000000000001", "mac:000000000002"}},
+		{"Session", "?sessionID=session-mac:000000000003", []interface{}{"mac:000000000003"}},
+		{"None", "?partnerID=nobody", []interface{}{}},
+	}
+
+	for _, record := range testData {
+		t.Run(record.description, func(t *testing.T) {
+			response, body := serveDeviceQuery(t, record.query)
+			assert.Equal(t, http.StatusOK, response.Code)
+			assert.Equal(t, len(record.expectedIDs), body.Count)
+			assert.Equal(t, record.expectedIDs, deviceQueryIDs(body))
+			assert.Empty(t, body.Next)
+		})
+	}
+}
+
+func testDeviceQueryPagination(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		ids     []interface{}
+		query   = "?limit=2&fields=session.partnerID,convey.fw-name&groupBy=session.partnerID"
+	)
+
+	for pages := 0; pages < 3; pages++ {
+		response, body := serveDeviceQuery(t, query)
+		require.Equal(http.StatusOK, response.Code)
+		assert.Equal(5, body.Count)
+		assert.Equal(map[string]int{"sky": 3, "comcast": 1, "nbc": 1}, body.Groups)
+		assert.LessOrEqual(len(body.Devices), 2)
+		for _, d := range body.Devices {
+			assert.Len(d, 3)
+			assert.Contains(d, "session.partnerID")
+			assert.Contains(d, "convey.fw-name")
+		}
+
+		ids = append(ids, deviceQueryIDs(body)...)
+		if len(body.Next) == 0 {
+			assert.Equal(2, pages)
+			break
+		}
+
+		query = "?limit=2&fields=session.partnerID,convey.fw-name&groupBy=session.partnerID&cursor=" + body.Next
+	}
+
+	assert.Equal([]interface{}{"mac:000000000001", "mac:000000000002", "mac:000000000003", "mac:000000000004", "mac:000000000005"}, ids)
+
+	// the default projection
+	_, body := serveDeviceQuery(t, "?limit=1")
+	require.Len(body.Devices, 1)
+	assert.Equal(map[string]interface{}{
+		"id":                "mac:000000000001",
+		"session.partnerID": "sky",
+		"session.trust":     float64(1000),
+		"session.id":        "session-mac:000000000001",
+		"stats.connectedAt": float64(1600003600),
+		"convey.fw-name":    "fw-2.1",
+		"convey.hw-model":   "XB7",
+	}, body.Devices[0])
+}
+
+func testDeviceQueryInvalid(t *testing.T) {
+	testData := []struct {
+		description string
+		query       string
+	}{
+		{"Unknown parameter", "?partner=sky"},
+		{"Trust", "?minTrust=high"},
+		{"Connected since", "?connectedSince=yesterday"},
+		{"Cursor", "?cursor=***"},
+		{"Limit", "?limit=0"},
+		{"Large limit", "?limit=1001"},
+		{"Claim field", "?fields=session.trust,claims.secret"},
+		{"Top level claim field", "?fields=partner-id"},
+		{"Unknown field", "?fields=session.password"},
+		{"Empty convey field", "?fields=convey."},
+		{"Claim groupBy", "?groupBy=claims.partner-id"},
+	}
+
+	for _, record := range testData {
+		t.Run(record.description, func(t *testing.T) {
+			response, _ := serveDeviceQuery(t, record.query)
+			assert.Equal(t, http.StatusBadRequest, response.Code)
+			assert.Contains(t, response.Body.String(), "error")
+		})
+	}
+}
+
+func TestDeviceQuery(t *testing.T) {
+	t.Run("Filters", testDeviceQueryFilters)
+	t.Run("Pagination", testDeviceQueryPagination)
+	t.Run("Invalid", testDeviceQueryInvalid)
+}
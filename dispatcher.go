@@ -23,7 +23,10 @@ import (
 	"github.com/xmidt-org/webpa-common/v2/device"
 )
 
-var ErrOutboundQueueFull = errors.New("outbound message queue full")
+var (
+	ErrOutboundQueueFull = errors.New("outbound message queue full")
+	ErrPartnerQueueFull  = errors.New("outbound message queue full for partner")
+)
 
 // Dispatcher handles the creation and routing of HTTP requests in response to device events.
 // A Dispatcher represents the send side for enqueuing HTTP requests.
@@ -41,3 +44,19 @@ type outboundEnvelope struct {
 
 // eventTypeContextKey is the internal key type for storing the event type
 type eventTypeContextKey struct{}
+
+// partnerIDContextKey is the internal key type for storing the partner id of the
+// device that originated an outbound request
+type partnerIDContextKey struct{}
+
+// deviceIDContextKey is the internal key type for storing the id of the device
+// that originated an outbound request
+type deviceIDContextKey struct{}
+
+// attemptsContextKey is the internal key type for storing an *int that RetryTransactor
+// sets to the number of attempts made to send an outbound request
+type attemptsContextKey struct{}
+
+// qosLevelContextKey is the internal key type for storing the wrp.QOSLevel of the
+// message an outbound request was created from
+type qosLevelContextKey struct{}
@@ -23,6 +23,7 @@ import (
 	"io"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"go.uber.org/zap"
@@ -36,54 +37,89 @@ import (
 )
 
 // eventDispatcher is an internal Dispatcher implementation that sends envelopes
-// via the returned channel. The channel may be used to spawn one or more workers
+// via the returned queue. The queue may be used to spawn one or more workers
 // to process the envelopes
 type eventDispatcher struct {
-	errorLog         *zap.Logger
-	urlFilter        URLFilter
-	method           string
-	timeout          time.Duration
-	authorizationKey string
-	source           string
-	eventMap         event.MultiMap
-	queueSize        metrics.Gauge
-	droppedMessages  metrics.Counter
-	outbounds        chan<- outboundEnvelope
+	errorLog        *zap.Logger
+	droppedMessages metrics.Counter
+	outbounds       *outboundQueue
+	spill           *spillQueue
+	deliveries      *deliveryTracker
+	dedupe          *dedupeCache
+	duplicates      metrics.Counter
+
+	// lock guards the fields below, which may be reloaded while events are dispatched
+	lock      sync.RWMutex
+	urlFilter URLFilter
+	method    string
+	timeout   time.Duration
+	source    string
+	eventMap  event.MultiMap
+	router    *eventRouter
 }
 
 // NewEventDispatcher is an eventDispatcher factory which sends envelopes via
-// the returned channel. The channel may be used to spawn one or more workers
-// to process the envelopes.
-func NewEventDispatcher(om OutboundMeasures, o *Outbounder, urlFilter URLFilter) (Dispatcher, <-chan outboundEnvelope, error) {
+// the returned queue. The queue may be used to spawn one or more workers
+// to process the envelopes.  If spill is non-nil, envelopes that do not fit
+// on the queue are written to it instead of being dropped.  If deliveries is
+// non-nil, the delivery of messages that require a QoS ack is tracked for the
+// ackDispatcher.
+func NewEventDispatcher(om OutboundMeasures, o *Outbounder, urlFilter URLFilter, spill *spillQueue, deliveries *deliveryTracker) (Dispatcher, *outboundQueue, error) {
+	outbounds, err := newOutboundQueue(om, o)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	d := &eventDispatcher{
+		errorLog:        o.logger(),
+		droppedMessages: om.DroppedMessages,
+		outbounds:       outbounds,
+		spill:           spill,
+		deliveries:      deliveries,
+		dedupe:          newDedupeCache(o),
+		duplicates:      om.DuplicatesSuppressed,
+	}
+
+	if err := d.configure(om, o, urlFilter); err != nil {
+		return nil, nil, err
+	}
+
+	return d, outbounds, nil
+}
+
+// configure applies the Outbounder's routing settings to this dispatcher, creating a
+// URLFilter from the Outbounder if urlFilter is nil.  Nothing is changed if any of the
+// settings are invalid.
+func (d *eventDispatcher) configure(om OutboundMeasures, o *Outbounder, urlFilter URLFilter) error {
 	if urlFilter == nil {
 		var err error
 		urlFilter, err = NewURLFilter(o)
 		if err != nil {
-			return nil, nil, err
+			return err
 		}
 	}
 
-	outbounds := make(chan outboundEnvelope, o.outboundQueueSize())
-	logger := o.logger()
 	eventMap, err := o.eventMap()
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
 
-	logger.Info("eventMap created", zap.Any("eventMap", eventMap))
-
-	return &eventDispatcher{
-		errorLog:         logger,
-		urlFilter:        urlFilter,
-		method:           o.method(),
-		timeout:          o.requestTimeout(),
-		authorizationKey: o.authKey(),
-		eventMap:         eventMap,
-		queueSize:        om.QueueSize,
-		source:           o.source(),
-		droppedMessages:  om.DroppedMessages,
-		outbounds:        outbounds,
-	}, outbounds, nil
+	router, err := newEventRouter(om, o)
+	if err != nil {
+		return err
+	}
+
+	d.errorLog.Info("eventMap created", zap.Any("eventMap", eventMap))
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.urlFilter = urlFilter
+	d.method = o.method()
+	d.timeout = o.requestTimeout()
+	d.source = o.source()
+	d.eventMap = eventMap
+	d.router = router
+	return nil
 }
 
 // OnDeviceEvent is the device.Listener function that processes outbound events.
@@ -94,31 +130,57 @@ func (d *eventDispatcher) OnDeviceEvent(event *device.Event) {
 		return
 	}
 
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	ctx := context.Background()
+	if event.Device != nil {
+		ctx = context.WithValue(ctx, deviceIDContextKey{}, string(event.Device.ID()))
+		if partnerID := event.Device.Metadata().PartnerIDClaim(); len(partnerID) > 0 {
+			ctx = context.WithValue(ctx, partnerIDContextKey{}, partnerID)
+		}
+	}
+
 	switch event.Type {
 	case device.Connect:
 		eventType, message := newOnlineMessage(d.source, event.Device)
-		if err := d.encodeAndDispatchEvent(eventType, wrp.Msgpack, message); err != nil {
+		if err := d.encodeAndDispatchEvent(ctx, eventType, wrp.Msgpack, message); err != nil {
 			d.errorLog.Error("Error dispatching online event", zap.Any("eventType", eventType), zap.Any("destination", message.Destination), zap.Error(err))
 		}
 
 	case device.Disconnect:
 		eventType, message := newOfflineMessage(d.source, event.Device)
-		if err := d.encodeAndDispatchEvent(eventType, wrp.Msgpack, message); err != nil {
+		if err := d.encodeAndDispatchEvent(ctx, eventType, wrp.Msgpack, message); err != nil {
 			d.errorLog.Error("Error dispatching offline event", zap.Any("eventType", eventType), zap.Any("destination", message.Destination), zap.Error(err))
 		}
 
 	case device.MessageReceived:
+		dv := d.deliveries.start(event)
+		if d.suppress(ctx, event, dv) {
+			return
+		}
+
+		if dv != nil {
+			defer dv.dispatched()
+			ctx = context.WithValue(ctx, deliveryContextKey{}, dv)
+		}
+
+		if message, ok := event.Message.(*wrp.Message); ok {
+			ctx = context.WithValue(ctx, qosLevelContextKey{}, message.QualityOfService.Level())
+		}
+
 		if routable, ok := event.Message.(wrp.Routable); ok {
 			destination := routable.To()
 			contentType := event.Format.ContentType()
 			if strings.HasPrefix(destination, EventPrefix) {
 				eventType := destination[len(EventPrefix):]
-				if err := d.dispatchEvent(eventType, contentType, event.Contents); err != nil {
+				message, _ := event.Message.(*wrp.Message)
+				if err := d.dispatchEvent(ctx, eventType, contentType, message, event.Contents); err != nil {
 					d.errorLog.Error("Error dispatching event", zap.Any("eventType", eventType), zap.Any("destination", destination), zap.Error(err))
 				}
 			} else if strings.HasPrefix(destination, DNSPrefix) {
 				unfilteredURL := destination[len(DNSPrefix):]
-				if err := d.dispatchTo(unfilteredURL, contentType, event.Contents); err != nil {
+				if err := d.dispatchTo(ctx, unfilteredURL, contentType, event.Contents); err != nil {
 					d.errorLog.Error("Error dispatching to endpoint", zap.Any("destination", destination), zap.Error(err))
 				}
 			} else {
@@ -128,52 +190,111 @@ func (d *eventDispatcher) OnDeviceEvent(event *device.Event) {
 	}
 }
 
+// suppress tests whether the event's message is a QoS message that the device resent within
+// the dedupe window.  A suppressed message is not forwarded, but is acked again with the
+// outcome of the original.
+func (d *eventDispatcher) suppress(ctx context.Context, event *device.Event, dv *delivery) bool {
+	m, ok := event.Message.(*wrp.Message)
+	if d.dedupe == nil || !ok || event.Device == nil || len(m.TransactionUUID) == 0 ||
+		m.Type != wrp.SimpleEventMessageType || !m.IsQOSAckPart() {
+		return false
+	}
+
+	original, duplicate := d.dedupe.check(dedupeKey{deviceID: string(event.Device.ID()), transactionUUID: m.TransactionUUID}, dv)
+	if !duplicate {
+		return false
+	}
+
+	partnerID, _ := ctx.Value(partnerIDContextKey{}).(string)
+	d.duplicates.With(partnerIDLabel, partnerID).Add(1.0)
+	d.deliveries.replace(m, original)
+	return true
+}
+
 // send wraps the given request in an outboundEnvelope together with a cancellable context,
-// then asynchronously sends that request to the outbounds channel.  This method will
-// block on the outbound channel only as long as the context is not canceled, i.e. does not time out.
-// If the context is canceled before the envelope can be queued, this method drops the message
-// and returns an error.
+// then places that envelope on the outbounds queue.  This method does not block.  If the
+// queue is full, the message is written to the spill queue if one is configured.  Once
+// anything has spilled, messages keep spilling until it has been replayed, so that they are
+// delivered in the order they were dispatched.  If the originating partner's share of the
+// queue is full, the message is dropped rather than spilled, so that a partner cannot use the
+// spill queue to get around its share.  A dropped message results in an error.  The delivery
+// of a spilled message stays pending until it is replayed, so the QoS ack of the message, if
+// any, reflects the replay.
 func (d *eventDispatcher) send(parent context.Context, request *http.Request) error {
-	// increment the queue size first, so that we always keep a positive queue size
-	d.queueSize.Add(1.0)
-	ctx, cancel := context.WithTimeout(parent, d.timeout)
+	ctx, cancel := context.WithTimeout(context.WithValue(parent, attemptsContextKey{}, new(int)), d.timeout)
+	dv := deliveryFrom(parent)
+	dv.add()
 
-	select {
-	case d.outbounds <- outboundEnvelope{request.WithContext(ctx), cancel}:
+	var (
+		e        = outboundEnvelope{request.WithContext(ctx), cancel}
+		spilling = d.spill != nil && !d.spill.empty()
+		err      error
+	)
+
+	if spilling {
+		err = d.outbounds.admit(e)
+	} else if err = d.outbounds.push(e); err == nil {
 		return nil
+	}
 
-	default:
-		d.queueSize.Add(-1.0) // the message never made it to the queue
+	if err == ErrPartnerQueueFull {
+		cancel()
 		d.droppedMessages.Add(1.0)
-		return ErrOutboundQueueFull
+		dv.complete(rdrQueueFull)
+		return err
 	}
+
+	if d.spill != nil {
+		err := d.spill.push(parent, request)
+		if err == nil {
+			cancel()
+			return nil
+		}
+
+		d.errorLog.Error("Unable to spill outbound message", zap.Error(err))
+	}
+
+	// a message that cannot be spilled is still queued if there is room, even out of order
+	if spilling && d.outbounds.push(e) == nil {
+		return nil
+	}
+
+	cancel()
+	d.droppedMessages.Add(1.0)
+	dv.complete(rdrQueueFull)
+	return ErrOutboundQueueFull
 }
 
 // newRequest creates a basic HTTP request appropriate for this eventDispatcher.
 func (d *eventDispatcher) newRequest(url, contentType string, body io.Reader) (*http.Request, error) {
 	request, err := http.NewRequest(d.method, url, body)
 	if err == nil {
+		// authorization is added at send time, since it may depend on the final body
 		request.Header.Set("Content-Type", contentType)
-
-		// TODO: Need to work out how to handle authorization better, without basic auth
-		if len(d.authorizationKey) > 0 {
-			request.Header.Set("Authorization", "Basic "+d.authorizationKey)
-		}
 	}
 
 	return request, err
 }
 
-func (d *eventDispatcher) dispatchEvent(eventType, contentType string, contents []byte) error {
-	endpoints, ok := d.eventMap.Get(eventType, DefaultEventType)
-	if !ok {
-		// allow no endpoints, but log an error since this means that we're dropping
-		// traffic explicitly because of configuration
-		return fmt.Errorf("no endpoints configured for event: %s", eventType)
+// dispatchEvent sends an event to the endpoints selected by the routing rules, which by
+// default are the eventEndpoints configured for its event type.  The message may be nil
+// if the event's WRP message is not available.
+func (d *eventDispatcher) dispatchEvent(ctx context.Context, eventType, contentType string, message *wrp.Message, contents []byte) error {
+	partnerID, _ := ctx.Value(partnerIDContextKey{}).(string)
+	endpoints, useDefault := d.router.route(routeEvent{eventType: eventType, partnerID: partnerID, message: message})
+	if useDefault {
+		defaults, ok := d.eventMap.Get(eventType, DefaultEventType)
+		if !ok && len(endpoints) == 0 {
+			// allow no endpoints, but log an error since this means that we're dropping
+			// traffic explicitly because of configuration
+			return fmt.Errorf("no endpoints configured for event: %s", eventType)
+		}
+
+		endpoints = appendEndpoints(endpoints, defaults)
 	}
 
-	ctx := context.WithValue(
-		context.Background(), eventTypeContextKey{},
+	ctx = context.WithValue(
+		ctx, eventTypeContextKey{},
 		eventType,
 	)
 
@@ -191,7 +312,25 @@ func (d *eventDispatcher) dispatchEvent(eventType, contentType string, contents
 	return nil
 }
 
-func (d *eventDispatcher) encodeAndDispatchEvent(eventType string, format wrp.Format, message *wrp.Message) error {
+// filterURL applies the URL filter of the current configuration
+func (d *eventDispatcher) filterURL(u string) (string, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.urlFilter.Filter(u)
+}
+
+// sendEvent dispatches an event generated by talaria itself, rather than by a device,
+// with the configured source
+func (d *eventDispatcher) sendEvent(eventType string, message *wrp.Message) error {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	message.Source = d.source
+	message.Destination = EventPrefix + eventType
+	return d.encodeAndDispatchEvent(context.Background(), eventType, wrp.Msgpack, message)
+}
+
+func (d *eventDispatcher) encodeAndDispatchEvent(ctx context.Context, eventType string, format wrp.Format, message *wrp.Message) error {
 	var (
 		contents []byte
 		encoder  = wrp.NewEncoderBytes(&contents, format)
@@ -201,14 +340,14 @@ func (d *eventDispatcher) encodeAndDispatchEvent(eventType string, format wrp.Fo
 		return err
 	}
 
-	if err := d.dispatchEvent(eventType, format.ContentType(), contents); err != nil {
+	if err := d.dispatchEvent(ctx, eventType, format.ContentType(), message, contents); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (d *eventDispatcher) dispatchTo(unfiltered string, contentType string, contents []byte) error {
+func (d *eventDispatcher) dispatchTo(ctx context.Context, unfiltered string, contentType string, contents []byte) error {
 	url, err := d.urlFilter.Filter(unfiltered)
 	if err != nil {
 		return err
@@ -220,7 +359,7 @@ func (d *eventDispatcher) dispatchTo(unfiltered string, contentType string, cont
 	}
 
 	return d.send(
-		context.WithValue(context.Background(), eventTypeContextKey{}, DNSPrefix),
+		context.WithValue(ctx, eventTypeContextKey{}, DNSPrefix),
 		request,
 	)
 }
@@ -49,7 +49,7 @@ func testEventDispatcherOnDeviceEventConnectEvent(t *testing.T) {
 		assert                     = assert.New(t)
 		require                    = require.New(t)
 		d                          = new(device.MockDevice)
-		dispatcher, outbounds, err = NewEventDispatcher(NewTestOutboundMeasures(), nil, nil)
+		dispatcher, outbounds, err = NewEventDispatcher(NewTestOutboundMeasures(), nil, nil, nil, nil)
 	)
 
 	require.NotNil(dispatcher)
@@ -63,7 +63,7 @@ func testEventDispatcherOnDeviceEventConnectEvent(t *testing.T) {
 	d.On("Convey").Return(convey.C(nil))
 
 	dispatcher.OnDeviceEvent(&device.Event{Type: device.Connect, Device: d})
-	assert.Equal(0, len(outbounds))
+	assert.Equal(0, outbounds.len())
 	d.AssertExpectations(t)
 }
 
@@ -72,7 +72,7 @@ func testEventDispatcherOnDeviceEventDisconnectEvent(t *testing.T) {
 		assert                     = assert.New(t)
 		require                    = require.New(t)
 		d                          = new(device.MockDevice)
-		dispatcher, outbounds, err = NewEventDispatcher(NewTestOutboundMeasures(), nil, nil)
+		dispatcher, outbounds, err = NewEventDispatcher(NewTestOutboundMeasures(), nil, nil, nil, nil)
 	)
 
 	require.NotNil(dispatcher)
@@ -89,7 +89,7 @@ func testEventDispatcherOnDeviceEventDisconnectEvent(t *testing.T) {
 	d.On("CloseReason").Return(device.CloseReason{})
 
 	dispatcher.OnDeviceEvent(&device.Event{Type: device.Disconnect, Device: d})
-	assert.Equal(0, len(outbounds))
+	assert.Equal(0, outbounds.len())
 	d.AssertExpectations(t)
 }
 
@@ -97,7 +97,7 @@ func testEventDispatcherOnDeviceEventUnroutable(t *testing.T) {
 	var (
 		assert                     = assert.New(t)
 		require                    = require.New(t)
-		dispatcher, outbounds, err = NewEventDispatcher(NewTestOutboundMeasures(), nil, nil)
+		dispatcher, outbounds, err = NewEventDispatcher(NewTestOutboundMeasures(), nil, nil, nil, nil)
 	)
 
 	require.NotNil(dispatcher)
@@ -109,13 +109,13 @@ func testEventDispatcherOnDeviceEventUnroutable(t *testing.T) {
 		Message: &wrp.Message{Destination: "this is not a routable destination"},
 	})
 
-	assert.Equal(0, len(outbounds))
+	assert.Equal(0, outbounds.len())
 }
 
 func testEventDispatcherOnDeviceEventBadURLFilter(t *testing.T) {
 	var (
 		assert                     = assert.New(t)
-		dispatcher, outbounds, err = NewEventDispatcher(NewTestOutboundMeasures(), &Outbounder{DefaultScheme: "bad"}, nil)
+		dispatcher, outbounds, err = NewEventDispatcher(NewTestOutboundMeasures(), &Outbounder{DefaultScheme: "bad"}, nil, nil, nil)
 	)
 
 	assert.Nil(dispatcher)
@@ -202,7 +202,7 @@ func testEventDispatcherOnDeviceEventDispatchEvent(t *testing.T) {
 			var (
 				expectedContents           = []byte{1, 2, 3, 4}
 				urlFilter                  = new(mockURLFilter)
-				dispatcher, outbounds, err = NewEventDispatcher(NewTestOutboundMeasures(), record.outbounder, urlFilter)
+				dispatcher, outbounds, err = NewEventDispatcher(NewTestOutboundMeasures(), record.outbounder, urlFilter, nil, nil)
 			)
 
 			require.NotNil(dispatcher)
@@ -216,27 +216,22 @@ func testEventDispatcherOnDeviceEventDispatchEvent(t *testing.T) {
 				Contents: expectedContents,
 			})
 
-			assert.Equal(len(record.expectedEndpoints), len(outbounds), "incorrect envelope count")
+			assert.Equal(len(record.expectedEndpoints), outbounds.len(), "incorrect envelope count")
 			actualEndpoints := make(map[string]bool, len(record.expectedEndpoints))
-			for len(outbounds) > 0 {
-				select {
-				case e := <-outbounds:
-					e.cancel()
-					<-e.request.Context().Done()
+			for e, ok := outbounds.pop(); ok; e, ok = outbounds.pop() {
+				e.cancel()
+				<-e.request.Context().Done()
 
-					assert.Equal(record.outbounder.method(), e.request.Method)
-					assert.Equal(format.ContentType(), e.request.Header.Get("Content-Type"))
+				assert.Equal(record.outbounder.method(), e.request.Method)
+				assert.Equal(format.ContentType(), e.request.Header.Get("Content-Type"))
 
-					urlString := e.request.URL.String()
-					assert.False(actualEndpoints[urlString])
-					actualEndpoints[urlString] = true
+				urlString := e.request.URL.String()
+				assert.False(actualEndpoints[urlString])
+				actualEndpoints[urlString] = true
 
-					actualContents, err := io.ReadAll(e.request.Body)
-					assert.NoError(err)
-					assert.Equal(expectedContents, actualContents)
-
-				default:
-				}
+				actualContents, err := io.ReadAll(e.request.Body)
+				assert.NoError(err)
+				assert.Equal(expectedContents, actualContents)
 			}
 
 			assert.Equal(record.expectedEndpoints, actualEndpoints)
@@ -253,13 +248,14 @@ func testEventDispatcherOnDeviceEventEventTimeout(t *testing.T) {
 			EventEndpoints: map[string]interface{}{"default": []string{"nowhere.com"}},
 		}
 
-		d, _, err = NewEventDispatcher(NewTestOutboundMeasures(), outbounder, nil)
+		d, _, err = NewEventDispatcher(NewTestOutboundMeasures(), outbounder, nil, nil, nil)
 	)
 
 	require.NotNil(d)
 	require.NoError(err)
 
-	d.(*eventDispatcher).outbounds = make(chan outboundEnvelope)
+	// simulate a queue with no room left
+	d.(*eventDispatcher).outbounds.capacity = 0
 	// TODO verify logger's buffer isn't empty
 	d.OnDeviceEvent(&device.Event{
 		Type:     device.MessageReceived,
@@ -275,7 +271,7 @@ func testEventDispatcherOnDeviceEventFilterError(t *testing.T) {
 		urlFilter     = new(mockURLFilter)
 		expectedError = errors.New("expected")
 
-		dispatcher, outbounds, err = NewEventDispatcher(NewTestOutboundMeasures(), nil, urlFilter)
+		dispatcher, outbounds, err = NewEventDispatcher(NewTestOutboundMeasures(), nil, urlFilter, nil, nil)
 	)
 
 	require.NotNil(dispatcher)
@@ -291,7 +287,7 @@ func testEventDispatcherOnDeviceEventFilterError(t *testing.T) {
 	})
 
 	// TODO verify logger's buffer isn't empty
-	assert.Equal(0, len(outbounds))
+	assert.Equal(0, outbounds.len())
 	urlFilter.AssertExpectations(t)
 }
 
@@ -359,7 +355,7 @@ func testEventDispatcherOnDeviceEventDispatchTo(t *testing.T) {
 			var (
 				expectedContents           = []byte{4, 7, 8, 1}
 				urlFilter                  = new(mockURLFilter)
-				dispatcher, outbounds, err = NewEventDispatcher(NewTestOutboundMeasures(), record.outbounder, urlFilter)
+				dispatcher, outbounds, err = NewEventDispatcher(NewTestOutboundMeasures(), record.outbounder, urlFilter, nil, nil)
 			)
 
 			require.NotNil(dispatcher)
@@ -377,11 +373,12 @@ func testEventDispatcherOnDeviceEventDispatchTo(t *testing.T) {
 			})
 
 			if !record.expectsEnvelope {
-				assert.Equal(0, len(outbounds))
+				assert.Equal(0, outbounds.len())
 				continue
 			}
 
-			e := <-outbounds
+			e, ok := outbounds.pop()
+			require.True(ok)
 			e.cancel()
 			<-e.request.Context().Done()
 
@@ -414,7 +411,7 @@ func testEventDispatcherOnDeviceEventNilEventError(t *testing.T) {
 			}), zapcore.AddSync(&b), zapcore.ErrorLevel),
 	)
 	o.Logger = logger
-	dp, _, err := NewEventDispatcher(NewTestOutboundMeasures(), o, nil)
+	dp, _, err := NewEventDispatcher(NewTestOutboundMeasures(), o, nil, nil, nil)
 	require.NotNil(dp)
 	require.NoError(err)
 	// Purge init logs
@@ -428,7 +425,7 @@ func testEventDispatcherOnDeviceEventNilEventError(t *testing.T) {
 func testEventDispatcherOnDeviceEventEventMapError(t *testing.T) {
 	assert := assert.New(t)
 	o := &Outbounder{EventEndpoints: map[string]interface{}{"bad": -17.6}}
-	dp, _, err := NewEventDispatcher(NewTestOutboundMeasures(), o, nil)
+	dp, _, err := NewEventDispatcher(NewTestOutboundMeasures(), o, nil, nil, nil)
 	assert.Nil(dp)
 	assert.Error(err)
 }
@@ -0,0 +1,335 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+// Supported routing rule actions
+const (
+	// RouteAction sends matching events to the rule's endpoints and stops evaluating rules
+	RouteAction = "route"
+
+	// FanOutAction sends matching events to the rule's endpoints in addition to the
+	// endpoints selected by any later rules
+	FanOutAction = "fanout"
+
+	// DropAction discards matching events and stops evaluating rules
+	DropAction = "drop"
+
+	// DefaultAction sends matching events to the eventEndpoints for their event type and
+	// stops evaluating rules
+	DefaultAction = "default"
+)
+
+var (
+	errRouteActionNotSupported = errors.New("Routing rule action must be one of route, fanout, drop or default")
+	errRouteNoEndpoints        = errors.New("Routing rule requires at least one endpoint")
+)
+
+// RouteMatch holds the predicates of a routing rule.  Every predicate that is set must hold
+// for an event to match, so an empty RouteMatch matches every event.
+type RouteMatch struct {
+	// EventType is a regular expression that must match the whole event type.
+	EventType string `json:"eventType"`
+
+	// Source is a regular expression that must match the whole WRP source.
+	Source string `json:"source"`
+
+	// PartnerIDs matches events whose device partner or WRP partner IDs include any of these.
+	PartnerIDs []string `json:"partnerIDs"`
+
+	// ContentType must equal the WRP content type.
+	ContentType string `json:"contentType"`
+
+	// Metadata maps WRP metadata keys to regular expressions that must match their whole
+	// values.  An empty expression only requires the key to be present.
+	Metadata map[string]string `json:"metadata"`
+
+	// Headers are regular expressions of which each must match the whole of at least one
+	// WRP header.
+	Headers []string `json:"headers"`
+}
+
+// RouteRule is a single routing rule.  Rules are evaluated in the order they are configured.
+type RouteRule struct {
+	// Name identifies the rule in metrics and logs.
+	Name string `json:"name"`
+
+	// Match selects the events this rule applies to.
+	Match RouteMatch `json:"match"`
+
+	// Action is one of "route", "fanout", "drop" or "default", and defaults to "route".
+	Action string `json:"action"`
+
+	// Endpoints are the URLs that events are sent to by the "route" and "fanout" actions.
+	Endpoints []string `json:"endpoints"`
+}
+
+// anchored compiles the given expression so that it must match the whole of a value
+func anchored(expr string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+// routeEvent holds the attributes of an event that routing rules are evaluated against
+type routeEvent struct {
+	eventType string
+	partnerID string
+	message   *wrp.Message
+}
+
+// routeRule is the compiled form of a RouteRule
+type routeRule struct {
+	name        string
+	action      string
+	endpoints   []string
+	eventType   *regexp.Regexp
+	source      *regexp.Regexp
+	partnerIDs  map[string]bool
+	contentType string
+	metadata    map[string]*regexp.Regexp
+	headers     []*regexp.Regexp
+}
+
+func newRouteRule(index int, rule RouteRule) (*routeRule, error) {
+	rr := &routeRule{
+		name:        rule.Name,
+		action:      rule.Action,
+		endpoints:   rule.Endpoints,
+		contentType: rule.Match.ContentType,
+	}
+
+	if len(rr.name) == 0 {
+		rr.name = fmt.Sprintf("rule%d", index)
+	}
+
+	if len(rr.action) == 0 {
+		rr.action = RouteAction
+	}
+
+	switch rr.action {
+	case RouteAction, FanOutAction:
+		if len(rr.endpoints) == 0 {
+			return nil, errRouteNoEndpoints
+		}
+
+	case DropAction, DefaultAction:
+
+	default:
+		return nil, errRouteActionNotSupported
+	}
+
+	var err error
+	if len(rule.Match.EventType) > 0 {
+		if rr.eventType, err = anchored(rule.Match.EventType); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(rule.Match.Source) > 0 {
+		if rr.source, err = anchored(rule.Match.Source); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(rule.Match.PartnerIDs) > 0 {
+		rr.partnerIDs = make(map[string]bool, len(rule.Match.PartnerIDs))
+		for _, partnerID := range rule.Match.PartnerIDs {
+			rr.partnerIDs[partnerID] = true
+		}
+	}
+
+	if len(rule.Match.Metadata) > 0 {
+		rr.metadata = make(map[string]*regexp.Regexp, len(rule.Match.Metadata))
+		for key, expr := range rule.Match.Metadata {
+			if len(expr) > 0 {
+				if rr.metadata[key], err = anchored(expr); err != nil {
+					return nil, err
+				}
+			} else {
+				rr.metadata[key] = nil
+			}
+		}
+	}
+
+	for _, expr := range rule.Match.Headers {
+		header, err := anchored(expr)
+		if err != nil {
+			return nil, err
+		}
+
+		rr.headers = append(rr.headers, header)
+	}
+
+	return rr, nil
+}
+
+func (rr *routeRule) matches(e routeEvent) bool {
+	if rr.eventType != nil && !rr.eventType.MatchString(e.eventType) {
+		return false
+	}
+
+	// an event without a WRP message, e.g. one that could not be decoded, only matches
+	// rules that do not look at the message
+	m := e.message
+	if m == nil {
+		m = new(wrp.Message)
+	}
+
+	if rr.source != nil && !rr.source.MatchString(m.Source) {
+		return false
+	}
+
+	if len(rr.contentType) > 0 && rr.contentType != m.ContentType {
+		return false
+	}
+
+	if rr.partnerIDs != nil && !rr.matchesPartner(e.partnerID, m.PartnerIDs) {
+		return false
+	}
+
+	for key, value := range rr.metadata {
+		actual, ok := m.Metadata[key]
+		if !ok || (value != nil && !value.MatchString(actual)) {
+			return false
+		}
+	}
+
+	for _, header := range rr.headers {
+		if !matchesAny(header, m.Headers) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (rr *routeRule) matchesPartner(partnerID string, partnerIDs []string) bool {
+	if rr.partnerIDs[partnerID] {
+		return true
+	}
+
+	for _, p := range partnerIDs {
+		if rr.partnerIDs[strings.TrimSpace(p)] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchesAny(expr *regexp.Regexp, values []string) bool {
+	for _, v := range values {
+		if expr.MatchString(v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// eventRouter selects the endpoints of events using the configured routing rules
+type eventRouter struct {
+	rules   []*routeRule
+	matches metrics.Counter
+}
+
+// newEventRouter compiles the Outbounder's routing rules.  If no rules are configured,
+// this function returns nil, which routes every event by its event type.
+func newEventRouter(om OutboundMeasures, o *Outbounder) (*eventRouter, error) {
+	routes := o.routes()
+	if len(routes) == 0 {
+		return nil, nil
+	}
+
+	er := &eventRouter{
+		rules:   make([]*routeRule, 0, len(routes)),
+		matches: om.RouteMatches,
+	}
+
+	for i, route := range routes {
+		rule, err := newRouteRule(i, route)
+		if err != nil {
+			return nil, fmt.Errorf("routing rule %d: %w", i, err)
+		}
+
+		er.rules = append(er.rules, rule)
+	}
+
+	return er, nil
+}
+
+// route evaluates the rules in order against the given event.  The returned endpoints are
+// those selected by the matching "route" and "fanout" rules, and useDefault reports whether
+// the event should also be sent to the eventEndpoints for its event type, which happens when
+// a "default" rule matches or no terminating rule matches at all.  A "drop" rule discards the
+// endpoints of any earlier "fanout" rules.
+func (er *eventRouter) route(e routeEvent) (endpoints []string, useDefault bool) {
+	if er == nil {
+		return nil, true
+	}
+
+	for _, rule := range er.rules {
+		if !rule.matches(e) {
+			continue
+		}
+
+		er.matches.With(ruleLabel, rule.name, actionLabel, rule.action).Add(1.0)
+		switch rule.action {
+		case FanOutAction:
+			endpoints = appendEndpoints(endpoints, rule.endpoints)
+
+		case RouteAction:
+			return appendEndpoints(endpoints, rule.endpoints), false
+
+		case DropAction:
+			return nil, false
+
+		case DefaultAction:
+			return endpoints, true
+		}
+	}
+
+	// when only fan out rules matched, the event still goes to its usual endpoints
+	return endpoints, true
+}
+
+// appendEndpoints appends the endpoints in more that are not already present in endpoints
+func appendEndpoints(endpoints, more []string) []string {
+	for _, m := range more {
+		found := false
+		for _, e := range endpoints {
+			if e == m {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			endpoints = append(endpoints, m)
+		}
+	}
+
+	return endpoints
+}
@@ -0,0 +1,212 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/webpa-common/v2/device"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func newTestEventRouter(t *testing.T, routes ...RouteRule) *eventRouter {
+	er, err := newEventRouter(NewTestOutboundMeasures(), &Outbounder{Routes: routes})
+	require.NoError(t, err)
+	return er
+}
+
+func testEventRouterNone(t *testing.T) {
+	assert := assert.New(t)
+	er, err := newEventRouter(NewTestOutboundMeasures(), nil)
+	assert.NoError(err)
+	assert.Nil(er)
+
+	endpoints, useDefault := er.route(routeEvent{eventType: "iot"})
+	assert.Empty(endpoints)
+	assert.True(useDefault)
+}
+
+func testEventRouterInvalid(t *testing.T) {
+	testData := []struct {
+		route    RouteRule
+		expected error
+	}{
+		{RouteRule{Action: "unsupported"}, errRouteActionNotSupported},
+		{RouteRule{Action: FanOutAction}, errRouteNoEndpoints},
+		{RouteRule{}, errRouteNoEndpoints},
+	}
+
+	for _, record := range testData {
+		_, err := newEventRouter(NewTestOutboundMeasures(), &Outbounder{Routes: []RouteRule{record.route}})
+		assert.ErrorIs(t, err, record.expected)
+	}
+
+	_, err := newEventRouter(NewTestOutboundMeasures(), &Outbounder{Routes: []RouteRule{
+		{Match: RouteMatch{EventType: "("}, Action: DropAction},
+	}})
+
+	assert.Error(t, err)
+}
+
+func testEventRouterMatch(t *testing.T) {
+	message := &wrp.Message{
+		Source:      "mac:112233445566/service",
+		ContentType: "application/json",
+		PartnerIDs:  []string{"sky"},
+		Metadata:    map[string]string{"/trust": "1000", "/boot-time": "1611700028"},
+		Headers:     []string{"X-Telemetry: true"},
+	}
+
+	testData := []struct {
+		match    RouteMatch
+		expected bool
+	}{
+		{RouteMatch{}, true},
+		{RouteMatch{EventType: "device-status/.*"}, true},
+		{RouteMatch{EventType: "device-status"}, false},
+		{RouteMatch{Source: "mac:[0-9a-f]+/service"}, true},
+		{RouteMatch{Source: "mac:112233445566"}, false},
+		{RouteMatch{ContentType: "application/json"}, true},
+		{RouteMatch{ContentType: "application/msgpack"}, false},
+		{RouteMatch{PartnerIDs: []string{"comcast"}}, true},
+		{RouteMatch{PartnerIDs: []string{"sky", "other"}}, true},
+		{RouteMatch{PartnerIDs: []string{"other"}}, false},
+		{RouteMatch{Metadata: map[string]string{"/trust": "1000"}}, true},
+		{RouteMatch{Metadata: map[string]string{"/boot-time": ""}}, true},
+		{RouteMatch{Metadata: map[string]string{"/trust": "0"}}, false},
+		{RouteMatch{Metadata: map[string]string{"/missing": ""}}, false},
+		{RouteMatch{Headers: []string{"X-Telemetry: .*"}}, true},
+		{RouteMatch{Headers: []string{"X-Other: .*"}}, false},
+		{RouteMatch{EventType: "device-status/.*", PartnerIDs: []string{"other"}}, false},
+	}
+
+	for i, record := range testData {
+		rule, err := newRouteRule(i, RouteRule{Match: record.match, Action: DropAction})
+		require.NoError(t, err)
+		assert.Equal(t, record.expected, rule.matches(routeEvent{
+			eventType: "device-status/mac:112233445566/online",
+			partnerID: "comcast",
+			message:   message,
+		}), "match %d", i)
+	}
+
+	// predicates on the message never hold without one
+	rule, err := newRouteRule(0, RouteRule{Match: RouteMatch{Source: ".*"}, Action: DropAction})
+	require.NoError(t, err)
+	assert.True(t, rule.matches(routeEvent{eventType: "iot"}))
+
+	rule, err = newRouteRule(0, RouteRule{Match: RouteMatch{Metadata: map[string]string{"/trust": ""}}, Action: DropAction})
+	require.NoError(t, err)
+	assert.False(t, rule.matches(routeEvent{eventType: "iot"}))
+}
+
+func testEventRouterActions(t *testing.T) {
+	var (
+		assert = assert.New(t)
+		er     = newTestEventRouter(t,
+			RouteRule{Name: "audit", Match: RouteMatch{EventType: "iot"}, Action: FanOutAction, Endpoints: []string{"http://audit.com"}},
+			RouteRule{Name: "noisy", Match: RouteMatch{PartnerIDs: []string{"noisy"}}, Action: DropAction},
+			RouteRule{Name: "sky", Match: RouteMatch{PartnerIDs: []string{"sky"}}, Endpoints: []string{"http://sky.com", "http://audit.com"}},
+			RouteRule{Name: "legacy", Match: RouteMatch{EventType: "online|offline"}, Action: DefaultAction},
+			RouteRule{Name: "telemetry", Endpoints: []string{"http://telemetry.com"}},
+		)
+	)
+
+	testData := []struct {
+		event              routeEvent
+		expectedEndpoints  []string
+		expectedUseDefault bool
+	}{
+		{routeEvent{eventType: "iot", partnerID: "comcast"}, []string{"http://audit.com", "http://telemetry.com"}, false},
+		{routeEvent{eventType: "iot", partnerID: "noisy"}, nil, false},
+		{routeEvent{eventType: "iot", partnerID: "sky"}, []string{"http://audit.com", "http://sky.com"}, false},
+		{routeEvent{eventType: "online", partnerID: "comcast"}, nil, true},
+		{routeEvent{eventType: "other", partnerID: "comcast"}, []string{"http://telemetry.com"}, false},
+	}
+
+	for _, record := range testData {
+		endpoints, useDefault := er.route(record.event)
+		assert.Equal(record.expectedEndpoints, endpoints, record.event)
+		assert.Equal(record.expectedUseDefault, useDefault, record.event)
+	}
+
+	// when only fan out rules match, the default endpoints are used as well
+	er = newTestEventRouter(t, RouteRule{Action: FanOutAction, Endpoints: []string{"http://audit.com"}})
+	endpoints, useDefault := er.route(routeEvent{eventType: "iot"})
+	assert.Equal([]string{"http://audit.com"}, endpoints)
+	assert.True(useDefault)
+}
+
+func testEventRouterEventDispatcher(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		o       = &Outbounder{
+			EventEndpoints: map[string]interface{}{"default": []string{"http://default.com"}},
+			Routes: []RouteRule{
+				{Match: RouteMatch{PartnerIDs: []string{"sky"}, EventType: "iot"}, Endpoints: []string{"http://sky.com"}},
+				{Match: RouteMatch{Source: "dns:.*"}, Action: DropAction},
+			},
+		}
+
+		d        = new(device.MockDevice)
+		metadata = new(device.Metadata)
+	)
+
+	metadata.SetClaims(map[string]interface{}{device.PartnerIDClaimKey: "sky"})
+	d.On("ID").Return(device.ID("mac:112233445566"))
+	d.On("Metadata").Return(metadata)
+
+	dispatcher, outbounds, err := NewEventDispatcher(NewTestOutboundMeasures(), o, nil, nil, nil)
+	require.NoError(err)
+
+	for _, message := range []*wrp.Message{
+		{Destination: "event:iot", Source: "mac:112233445566"},
+		{Destination: "event:status", Source: "mac:112233445566"},
+		{Destination: "event:status", Source: "dns:scytale.example.com"},
+	} {
+		dispatcher.OnDeviceEvent(&device.Event{
+			Type:     device.MessageReceived,
+			Device:   d,
+			Message:  message,
+			Format:   wrp.Msgpack,
+			Contents: []byte("contents"),
+		})
+	}
+
+	var urls []string
+	for e, ok := outbounds.pop(); ok; e, ok = outbounds.pop() {
+		urls = append(urls, e.request.URL.String())
+		e.cancel()
+	}
+
+	assert.Equal([]string{"http://sky.com", "http://default.com"}, urls)
+
+	o.Routes = []RouteRule{{Action: "unsupported"}}
+	_, _, err = NewEventDispatcher(NewTestOutboundMeasures(), o, nil, nil, nil)
+	assert.ErrorIs(err, errRouteActionNotSupported)
+}
+
+func TestEventRouter(t *testing.T) {
+	t.Run("None", testEventRouterNone)
+	t.Run("Invalid", testEventRouterInvalid)
+	t.Run("Match", testEventRouterMatch)
+	t.Run("Actions", testEventRouterActions)
+	t.Run("EventDispatcher", testEventRouterEventDispatcher)
+}
@@ -0,0 +1,506 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Kafka API keys and versions used by the producer.  Produce v3 is the oldest version
+// that carries v2 record batches, which every broker since 0.11 understands.
+const (
+	kafkaProduceKey       int16 = 0
+	kafkaMetadataKey      int16 = 3
+	kafkaProduceVersion   int16 = 3
+	kafkaMetadataVersion  int16 = 4
+	kafkaRecordBatchMagic int8  = 2
+
+	// kafkaMaxResponseSize guards against allocating absurd buffers for a corrupt size prefix
+	kafkaMaxResponseSize = 64 * 1024 * 1024
+)
+
+// Kafka error codes that indicate stale metadata
+const (
+	kafkaNoError                 int16 = 0
+	kafkaUnknownTopicOrPartition int16 = 3
+	kafkaLeaderNotAvailable      int16 = 5
+	kafkaNotLeaderForPartition   int16 = 6
+)
+
+var (
+	errKafkaMalformed           = errors.New("malformed kafka response")
+	errKafkaCorrelationMismatch = errors.New("kafka response correlation id mismatch")
+
+	kafkaCRC32C = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// kafkaError is a non-zero error code returned by a broker
+type kafkaError int16
+
+func (e kafkaError) Error() string {
+	return fmt.Sprintf("kafka error code %d", int16(e))
+}
+
+// staleMetadata returns true if the error means the producer's view of the cluster is out of date
+func (e kafkaError) staleMetadata() bool {
+	switch int16(e) {
+	case kafkaUnknownTopicOrPartition, kafkaLeaderNotAvailable, kafkaNotLeaderForPartition:
+		return true
+	default:
+		return false
+	}
+}
+
+// kafkaEncoder appends Kafka protocol primitives to a byte slice
+type kafkaEncoder struct {
+	buf []byte
+}
+
+func (e *kafkaEncoder) int8(v int8) {
+	e.buf = append(e.buf, byte(v))
+}
+
+func (e *kafkaEncoder) int16(v int16) {
+	e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(v))
+}
+
+func (e *kafkaEncoder) int32(v int32) {
+	e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(v))
+}
+
+func (e *kafkaEncoder) int64(v int64) {
+	e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(v))
+}
+
+func (e *kafkaEncoder) bool(v bool) {
+	if v {
+		e.int8(1)
+	} else {
+		e.int8(0)
+	}
+}
+
+func (e *kafkaEncoder) string(v string) {
+	e.int16(int16(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+// nullableString encodes the empty string as null
+func (e *kafkaEncoder) nullableString(v string) {
+	if len(v) == 0 {
+		e.int16(-1)
+		return
+	}
+
+	e.string(v)
+}
+
+func (e *kafkaEncoder) bytes(v []byte) {
+	e.int32(int32(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+// varint encodes a zig-zag variable length integer, as used within record batches
+func (e *kafkaEncoder) varint(v int64) {
+	e.buf = binary.AppendVarint(e.buf, v)
+}
+
+// varbytes encodes a varint length followed by the bytes, with nil encoded as length -1
+func (e *kafkaEncoder) varbytes(v []byte) {
+	if v == nil {
+		e.varint(-1)
+		return
+	}
+
+	e.varint(int64(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+// kafkaDecoder reads Kafka protocol primitives.  The first error is sticky, so callers
+// may decode an entire structure and check err once at the end.
+type kafkaDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *kafkaDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	if n < 0 || n > len(d.buf) {
+		d.err = errKafkaMalformed
+		return nil
+	}
+
+	v := d.buf[:n]
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	if v := d.next(1); v != nil {
+		return int8(v[0])
+	}
+
+	return 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if v := d.next(2); v != nil {
+		return int16(binary.BigEndian.Uint16(v))
+	}
+
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if v := d.next(4); v != nil {
+		return int32(binary.BigEndian.Uint32(v))
+	}
+
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if v := d.next(8); v != nil {
+		return int64(binary.BigEndian.Uint64(v))
+	}
+
+	return 0
+}
+
+func (d *kafkaDecoder) bool() bool {
+	return d.int8() != 0
+}
+
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+
+	return string(d.next(int(n)))
+}
+
+func (d *kafkaDecoder) bytes() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+
+	return d.next(int(n))
+}
+
+// arrayLength returns the element count of an array, treating a null array as empty
+func (d *kafkaDecoder) arrayLength() int {
+	n := d.int32()
+	if n < 0 {
+		return 0
+	}
+
+	if int(n) > len(d.buf) {
+		// every element takes at least one byte
+		d.err = errKafkaMalformed
+		return 0
+	}
+
+	return int(n)
+}
+
+func (d *kafkaDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = errKafkaMalformed
+		return 0
+	}
+
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *kafkaDecoder) varbytes() []byte {
+	n := d.varint()
+	if n < 0 {
+		return nil
+	}
+
+	return d.next(int(n))
+}
+
+// kafkaRequestHeader encodes a v1 request header
+func kafkaRequestHeader(e *kafkaEncoder, apiKey, apiVersion int16, correlationID int32, clientID string) {
+	e.int16(apiKey)
+	e.int16(apiVersion)
+	e.int32(correlationID)
+	e.nullableString(clientID)
+}
+
+// writeKafkaFrame writes the given payload preceded by its length
+func writeKafkaFrame(w io.Writer, payload []byte) error {
+	frame := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	_, err := w.Write(append(frame, payload...))
+	return err
+}
+
+// readKafkaFrame reads a single length-prefixed payload
+func readKafkaFrame(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(size[:])
+	if n > kafkaMaxResponseSize {
+		return nil, errKafkaMalformed
+	}
+
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
+
+// kafkaHeader is a record header
+type kafkaHeader struct {
+	key   string
+	value []byte
+}
+
+// kafkaMessage is a single record to be produced
+type kafkaMessage struct {
+	key       []byte
+	value     []byte
+	headers   []kafkaHeader
+	timestamp int64
+}
+
+// encodeKafkaRecordBatch encodes messages as an uncompressed v2 record batch
+func encodeKafkaRecordBatch(messages []kafkaMessage) []byte {
+	var (
+		base    = messages[0].timestamp
+		latest  = base
+		records kafkaEncoder
+	)
+
+	for i, m := range messages {
+		if m.timestamp > latest {
+			latest = m.timestamp
+		}
+
+		var record kafkaEncoder
+		record.int8(0) // attributes
+		record.varint(m.timestamp - base)
+		record.varint(int64(i))
+		record.varbytes(m.key)
+		record.varbytes(m.value)
+		record.varint(int64(len(m.headers)))
+		for _, h := range m.headers {
+			record.varbytes([]byte(h.key))
+			record.varbytes(h.value)
+		}
+
+		records.varint(int64(len(record.buf)))
+		records.buf = append(records.buf, record.buf...)
+	}
+
+	// everything from attributes onward is covered by the CRC
+	var body kafkaEncoder
+	body.int16(0) // attributes: no compression, CreateTime
+	body.int32(int32(len(messages) - 1))
+	body.int64(base)
+	body.int64(latest)
+	body.int64(-1) // producer id
+	body.int16(-1) // producer epoch
+	body.int32(-1) // base sequence
+	body.int32(int32(len(messages)))
+	body.buf = append(body.buf, records.buf...)
+
+	var batch kafkaEncoder
+	batch.int64(0) // base offset, assigned by the broker
+	batch.int32(int32(4 + 1 + 4 + len(body.buf)))
+	batch.int32(-1) // partition leader epoch
+	batch.int8(kafkaRecordBatchMagic)
+	batch.int32(int32(crc32.Checksum(body.buf, kafkaCRC32C)))
+	batch.buf = append(batch.buf, body.buf...)
+	return batch.buf
+}
+
+// kafkaPartitionMetadata describes a single partition of a topic
+type kafkaPartitionMetadata struct {
+	errorCode int16
+	partition int32
+	leader    int32
+}
+
+// kafkaTopicMetadata describes a single topic
+type kafkaTopicMetadata struct {
+	errorCode  int16
+	name       string
+	partitions []kafkaPartitionMetadata
+}
+
+// kafkaMetadata is the decoded portion of a metadata response the producer cares about
+type kafkaMetadata struct {
+	brokers map[int32]string
+	topics  []kafkaTopicMetadata
+}
+
+func encodeKafkaMetadataRequest(correlationID int32, clientID string, topics []string) []byte {
+	var e kafkaEncoder
+	kafkaRequestHeader(&e, kafkaMetadataKey, kafkaMetadataVersion, correlationID, clientID)
+	e.int32(int32(len(topics)))
+	for _, topic := range topics {
+		e.string(topic)
+	}
+
+	e.bool(true) // allow auto topic creation
+	return e.buf
+}
+
+func decodeKafkaMetadataResponse(d *kafkaDecoder) (kafkaMetadata, error) {
+	m := kafkaMetadata{brokers: make(map[int32]string)}
+	d.int32() // throttle time
+
+	for i, n := 0, d.arrayLength(); i < n; i++ {
+		var (
+			nodeID = d.int32()
+			host   = d.string()
+			port   = d.int32()
+		)
+
+		d.string() // rack
+		m.brokers[nodeID] = fmt.Sprintf("%s:%d", host, port)
+	}
+
+	d.string() // cluster id
+	d.int32()  // controller id
+
+	for i, n := 0, d.arrayLength(); i < n; i++ {
+		t := kafkaTopicMetadata{errorCode: d.int16(), name: d.string()}
+		d.bool() // is internal
+		for j, pn := 0, d.arrayLength(); j < pn; j++ {
+			p := kafkaPartitionMetadata{errorCode: d.int16(), partition: d.int32(), leader: d.int32()}
+			for k, rn := 0, d.arrayLength(); k < rn; k++ {
+				d.int32() // replicas
+			}
+
+			for k, in := 0, d.arrayLength(); k < in; k++ {
+				d.int32() // in-sync replicas
+			}
+
+			t.partitions = append(t.partitions, p)
+		}
+
+		m.topics = append(m.topics, t)
+	}
+
+	return m, d.err
+}
+
+func encodeKafkaProduceRequest(correlationID int32, clientID string, acks int16, timeoutMillis int32, topic string, partition int32, batch []byte) []byte {
+	var e kafkaEncoder
+	kafkaRequestHeader(&e, kafkaProduceKey, kafkaProduceVersion, correlationID, clientID)
+	e.nullableString("") // transactional id
+	e.int16(acks)
+	e.int32(timeoutMillis)
+	e.int32(1)
+	e.string(topic)
+	e.int32(1)
+	e.int32(partition)
+	e.bytes(batch)
+	return e.buf
+}
+
+// decodeKafkaProduceResponse returns the error, if any, reported for the single
+// partition that was produced to
+func decodeKafkaProduceResponse(d *kafkaDecoder) error {
+	var errorCode int16
+	for i, n := 0, d.arrayLength(); i < n; i++ {
+		d.string() // topic
+		for j, pn := 0, d.arrayLength(); j < pn; j++ {
+			d.int32() // partition
+			if code := d.int16(); code != kafkaNoError {
+				errorCode = code
+			}
+
+			d.int64() // base offset
+			d.int64() // log append time
+		}
+	}
+
+	d.int32() // throttle time
+	if d.err != nil {
+		return d.err
+	}
+
+	if errorCode != kafkaNoError {
+		return kafkaError(errorCode)
+	}
+
+	return nil
+}
+
+// murmur2 is the hash used by Kafka's default partitioner, so that keyed messages land
+// on the same partitions they would if produced by the reference client
+func murmur2(data []byte) int32 {
+	const (
+		seed uint32 = 0x9747b28c
+		m    uint32 = 0x5bd1e995
+		r           = 24
+	)
+
+	length := len(data)
+	h := seed ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	tail := data[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
@@ -0,0 +1,612 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"go.uber.org/zap"
+)
+
+// KafkaScheme is the URL scheme of event endpoints that are produced to Kafka, e.g.
+// kafka://broker1:9092,broker2:9092/topic?acks=1
+const KafkaScheme = "kafka"
+
+const (
+	DefaultKafkaClientID   = "talaria"
+	DefaultKafkaAcks       = "all"
+	DefaultKafkaBatchSize  = 100
+	DefaultKafkaBatchBytes = 1024 * 1024
+	DefaultKafkaLinger     = 10 * time.Millisecond
+	DefaultKafkaTimeout    = 10 * time.Second
+
+	kafkaAcksParameter     = "acks"
+	kafkaContentTypeHeader = "content-type"
+	kafkaEventTypeHeader   = "event-type"
+)
+
+var (
+	errKafkaAcksNotSupported = errors.New("Kafka acks must be one of 0, 1 or all")
+	errKafkaTopicMissing     = errors.New("Kafka endpoint has no topic")
+	errKafkaNoBrokers        = errors.New("Kafka endpoint has no brokers")
+)
+
+// KafkaConfig configures the producer used for kafka:// event endpoints.
+type KafkaConfig struct {
+	// ClientID identifies this producer to the brokers.
+	ClientID string `json:"clientID"`
+
+	// Acks is the number of acknowledgements the partition leader must receive before
+	// a batch is considered sent: "0", "1" or "all".  An endpoint may override this with
+	// an acks query parameter.
+	Acks string `json:"acks"`
+
+	// BatchSize is the number of messages that triggers sending a batch.
+	BatchSize int `json:"batchSize"`
+
+	// BatchBytes is the number of key and value bytes that triggers sending a batch.
+	BatchBytes int `json:"batchBytes"`
+
+	// Linger is how long a batch waits for more messages before being sent.
+	Linger time.Duration `json:"linger"`
+
+	// Timeout bounds connecting to and awaiting a response from a broker.
+	Timeout time.Duration `json:"timeout"`
+}
+
+// parseKafkaAcks converts the textual acks setting into its wire value
+func parseKafkaAcks(v string) (int16, error) {
+	switch v {
+	case "0":
+		return 0, nil
+	case "1":
+		return 1, nil
+	case "all", "-1":
+		return -1, nil
+	default:
+		return 0, errKafkaAcksNotSupported
+	}
+}
+
+// kafkaSinks is the OutboundSink for kafka:// endpoints.  A producer is created on demand
+// for each distinct broker list and acks setting.
+type kafkaSinks struct {
+	logger     *zap.Logger
+	clientID   string
+	acks       int16
+	batchSize  int
+	batchBytes int
+	linger     time.Duration
+	timeout    time.Duration
+	messages   metrics.Counter
+
+	lock      sync.Mutex
+	producers map[string]*kafkaProducer
+}
+
+// NewKafkaSinks creates the OutboundSink used for kafka:// event endpoints
+func NewKafkaSinks(om OutboundMeasures, o *Outbounder) (*kafkaSinks, error) {
+	acks, err := parseKafkaAcks(o.kafkaAcks())
+	if err != nil {
+		return nil, err
+	}
+
+	return &kafkaSinks{
+		logger:     o.logger(),
+		clientID:   o.kafkaClientID(),
+		acks:       acks,
+		batchSize:  o.kafkaBatchSize(),
+		batchBytes: o.kafkaBatchBytes(),
+		linger:     o.kafkaLinger(),
+		timeout:    o.kafkaTimeout(),
+		messages:   om.KafkaMessages,
+		producers:  make(map[string]*kafkaProducer),
+	}, nil
+}
+
+func (ks *kafkaSinks) Send(request *http.Request) error {
+	acks := ks.acks
+	if v := request.URL.Query().Get(kafkaAcksParameter); len(v) > 0 {
+		var err error
+		if acks, err = parseKafkaAcks(v); err != nil {
+			return err
+		}
+	}
+
+	producer, err := ks.producer(request.URL.Host, acks)
+	if err != nil {
+		return err
+	}
+
+	return producer.Send(request)
+}
+
+func (ks *kafkaSinks) producer(brokers string, acks int16) (*kafkaProducer, error) {
+	var bootstrap []string
+	for _, broker := range strings.Split(brokers, ",") {
+		if broker = strings.TrimSpace(broker); len(broker) > 0 {
+			bootstrap = append(bootstrap, broker)
+		}
+	}
+
+	if len(bootstrap) == 0 {
+		return nil, errKafkaNoBrokers
+	}
+
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+
+	key := strings.Join(bootstrap, ",") + "?" + kafkaAcksParameter + "=" + strconv.Itoa(int(acks))
+	p, ok := ks.producers[key]
+	if !ok {
+		p = &kafkaProducer{
+			logger:     ks.logger,
+			bootstrap:  bootstrap,
+			clientID:   ks.clientID,
+			acks:       acks,
+			batchSize:  ks.batchSize,
+			batchBytes: ks.batchBytes,
+			linger:     ks.linger,
+			timeout:    ks.timeout,
+			messages:   ks.messages,
+			now:        time.Now,
+			dialer:     &net.Dialer{Timeout: ks.timeout},
+			leaders:    make(map[string][]int32),
+			brokers:    make(map[int32]string),
+			conns:      make(map[string]*kafkaConn),
+			batches:    make(map[kafkaTopicPartition]*kafkaBatch),
+		}
+
+		ks.producers[key] = p
+	}
+
+	return p, nil
+}
+
+// Close closes every producer created so far
+func (ks *kafkaSinks) Close() error {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+
+	var err error
+	for key, p := range ks.producers {
+		if closeErr := p.Close(); err == nil {
+			err = closeErr
+		}
+
+		delete(ks.producers, key)
+	}
+
+	return err
+}
+
+// kafkaTopicPartition identifies a single partition of a topic
+type kafkaTopicPartition struct {
+	topic     string
+	partition int32
+}
+
+// kafkaBatch accumulates messages bound for the same partition
+type kafkaBatch struct {
+	kafkaTopicPartition
+	messages []kafkaMessage
+	results  []chan<- error
+	size     int
+	timer    *time.Timer
+}
+
+// kafkaConn is a connection to a single broker.  Requests are sent one at a time.
+type kafkaConn struct {
+	lock sync.Mutex
+	conn net.Conn
+}
+
+// roundTrip sends a request and, if one is expected, returns a decoder positioned
+// just after the response header
+func (c *kafkaConn) roundTrip(correlationID int32, request []byte, expectResponse bool, timeout time.Duration) (*kafkaDecoder, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	if err := writeKafkaFrame(c.conn, request); err != nil {
+		return nil, err
+	}
+
+	if !expectResponse {
+		return nil, nil
+	}
+
+	payload, err := readKafkaFrame(c.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &kafkaDecoder{buf: payload}
+	if d.int32() != correlationID {
+		return nil, errKafkaCorrelationMismatch
+	}
+
+	return d, d.err
+}
+
+// kafkaProducer produces messages to a single Kafka cluster.  Messages are keyed by
+// device id, so that all the events of a device land on the same partition, and are
+// batched per partition.
+type kafkaProducer struct {
+	logger     *zap.Logger
+	bootstrap  []string
+	clientID   string
+	acks       int16
+	batchSize  int
+	batchBytes int
+	linger     time.Duration
+	timeout    time.Duration
+	messages   metrics.Counter
+	now        func() time.Time
+	dialer     *net.Dialer
+
+	correlationID int32
+	roundRobin    uint32
+
+	lock    sync.Mutex
+	leaders map[string][]int32
+	brokers map[int32]string
+	conns   map[string]*kafkaConn
+	batches map[kafkaTopicPartition]*kafkaBatch
+}
+
+// Send produces the request's body to the topic named by its URL path, blocking until
+// the batch containing it has been sent or the request's context is done.
+func (p *kafkaProducer) Send(request *http.Request) (err error) {
+	topic := strings.TrimPrefix(request.URL.Path, "/")
+	defer func() {
+		outcome := accepted
+		if err != nil {
+			outcome = rejected
+		}
+
+		p.messages.With(topicLabel, topic, outcomeLabel, outcome).Add(1.0)
+	}()
+
+	if len(topic) == 0 {
+		return errKafkaTopicMissing
+	}
+
+	ctx := request.Context()
+	message := kafkaMessage{timestamp: p.now().UnixMilli()}
+	if request.Body != nil {
+		if message.value, err = io.ReadAll(request.Body); err != nil {
+			return err
+		}
+	}
+
+	if deviceID, ok := ctx.Value(deviceIDContextKey{}).(string); ok && len(deviceID) > 0 {
+		message.key = []byte(deviceID)
+	}
+
+	if contentType := request.Header.Get("Content-Type"); len(contentType) > 0 {
+		message.headers = append(message.headers, kafkaHeader{kafkaContentTypeHeader, []byte(contentType)})
+	}
+
+	if eventType, ok := ctx.Value(eventTypeContextKey{}).(string); ok && len(eventType) > 0 {
+		message.headers = append(message.headers, kafkaHeader{kafkaEventTypeHeader, []byte(eventType)})
+	}
+
+	partition, err := p.partition(ctx, topic, message.key)
+	if err != nil {
+		return err
+	}
+
+	result := make(chan error, 1)
+	if full := p.enqueue(kafkaTopicPartition{topic, partition}, message, result); full != nil {
+		p.flush(full)
+	}
+
+	select {
+	case err = <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// partition chooses the partition for a message the same way Kafka's default
+// partitioner does for keyed messages, and round-robin for unkeyed ones.
+func (p *kafkaProducer) partition(ctx context.Context, topic string, key []byte) (int32, error) {
+	p.lock.Lock()
+	leaders, ok := p.leaders[topic]
+	p.lock.Unlock()
+
+	if !ok {
+		var err error
+		if leaders, err = p.refreshMetadata(ctx, topic); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(leaders) == 0 {
+		return 0, kafkaError(kafkaLeaderNotAvailable)
+	}
+
+	if key != nil {
+		return (murmur2(key) & 0x7fffffff) % int32(len(leaders)), nil
+	}
+
+	return int32(atomic.AddUint32(&p.roundRobin, 1) % uint32(len(leaders))), nil
+}
+
+// refreshMetadata fetches the partition leaders of the given topic from the first
+// broker that answers
+func (p *kafkaProducer) refreshMetadata(ctx context.Context, topic string) ([]int32, error) {
+	var lastErr error
+	for _, address := range p.addresses() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		conn, err := p.conn(address)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		correlationID := atomic.AddInt32(&p.correlationID, 1)
+		d, err := conn.roundTrip(correlationID, encodeKafkaMetadataRequest(correlationID, p.clientID, []string{topic}), true, p.timeout)
+		if err != nil {
+			p.closeConn(address, conn)
+			lastErr = err
+			continue
+		}
+
+		metadata, err := decodeKafkaMetadataResponse(d)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		return p.updateMetadata(topic, metadata)
+	}
+
+	p.logger.Error("Unable to fetch Kafka metadata", zap.String("topic", topic), zap.Error(lastErr))
+	return nil, lastErr
+}
+
+// addresses returns the bootstrap brokers followed by any other known brokers
+func (p *kafkaProducer) addresses() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	addresses := append([]string{}, p.bootstrap...)
+	for _, address := range p.brokers {
+		addresses = append(addresses, address)
+	}
+
+	return addresses
+}
+
+func (p *kafkaProducer) updateMetadata(topic string, metadata kafkaMetadata) ([]int32, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for nodeID, address := range metadata.brokers {
+		p.brokers[nodeID] = address
+	}
+
+	for _, t := range metadata.topics {
+		if t.name != topic {
+			continue
+		}
+
+		if t.errorCode != kafkaNoError {
+			return nil, kafkaError(t.errorCode)
+		}
+
+		leaders := make([]int32, len(t.partitions))
+		for i := range leaders {
+			leaders[i] = -1
+		}
+
+		for _, partition := range t.partitions {
+			if partition.partition >= 0 && int(partition.partition) < len(leaders) && partition.errorCode == kafkaNoError {
+				leaders[partition.partition] = partition.leader
+			}
+		}
+
+		p.leaders[topic] = leaders
+		return leaders, nil
+	}
+
+	return nil, kafkaError(kafkaUnknownTopicOrPartition)
+}
+
+// invalidate forgets the partition leaders of a topic, so they are fetched again on the next send
+func (p *kafkaProducer) invalidate(topic string) {
+	p.lock.Lock()
+	delete(p.leaders, topic)
+	p.lock.Unlock()
+}
+
+func (p *kafkaProducer) conn(address string) (*kafkaConn, error) {
+	p.lock.Lock()
+	c, ok := p.conns[address]
+	p.lock.Unlock()
+	if ok {
+		return c, nil
+	}
+
+	conn, err := p.dialer.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if c, ok := p.conns[address]; ok {
+		// another goroutine connected first
+		conn.Close()
+		return c, nil
+	}
+
+	c = &kafkaConn{conn: conn}
+	p.conns[address] = c
+	return c, nil
+}
+
+// Close sends the batches still lingering, then closes the producer's broker connections
+func (p *kafkaProducer) Close() error {
+	p.lock.Lock()
+	batches := make([]*kafkaBatch, 0, len(p.batches))
+	for _, b := range p.batches {
+		batches = append(batches, b)
+	}
+
+	p.lock.Unlock()
+	for _, b := range batches {
+		p.flush(b)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var err error
+	for address, c := range p.conns {
+		if closeErr := c.conn.Close(); err == nil {
+			err = closeErr
+		}
+
+		delete(p.conns, address)
+	}
+
+	return err
+}
+
+func (p *kafkaProducer) closeConn(address string, c *kafkaConn) {
+	p.lock.Lock()
+	if p.conns[address] == c {
+		delete(p.conns, address)
+	}
+
+	p.lock.Unlock()
+	c.conn.Close()
+}
+
+// enqueue adds a message to its partition's batch, returning the batch if it is now full
+func (p *kafkaProducer) enqueue(tp kafkaTopicPartition, message kafkaMessage, result chan<- error) *kafkaBatch {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	b, ok := p.batches[tp]
+	if !ok {
+		b = &kafkaBatch{kafkaTopicPartition: tp}
+		b.timer = time.AfterFunc(p.linger, func() { p.flush(b) })
+		p.batches[tp] = b
+	}
+
+	b.messages = append(b.messages, message)
+	b.results = append(b.results, result)
+	b.size += len(message.key) + len(message.value)
+	if len(b.messages) >= p.batchSize || b.size >= p.batchBytes {
+		return b
+	}
+
+	return nil
+}
+
+// flush sends the given batch, unless it has already been sent, and reports the
+// outcome to each of its messages
+func (p *kafkaProducer) flush(b *kafkaBatch) {
+	p.lock.Lock()
+	if p.batches[b.kafkaTopicPartition] != b {
+		p.lock.Unlock()
+		return
+	}
+
+	delete(p.batches, b.kafkaTopicPartition)
+	b.timer.Stop()
+	p.lock.Unlock()
+
+	err := p.produce(b)
+	if err != nil {
+		p.logger.Error("Unable to produce Kafka batch", zap.String("topic", b.topic), zap.Int32("partition", b.partition), zap.Int("messages", len(b.messages)), zap.Error(err))
+	}
+
+	for _, result := range b.results {
+		result <- err
+	}
+}
+
+func (p *kafkaProducer) produce(b *kafkaBatch) error {
+	p.lock.Lock()
+	var address string
+	if leaders := p.leaders[b.topic]; int(b.partition) < len(leaders) {
+		address = p.brokers[leaders[b.partition]]
+	}
+
+	p.lock.Unlock()
+
+	if len(address) == 0 {
+		p.invalidate(b.topic)
+		return kafkaError(kafkaLeaderNotAvailable)
+	}
+
+	conn, err := p.conn(address)
+	if err != nil {
+		p.invalidate(b.topic)
+		return err
+	}
+
+	var (
+		correlationID = atomic.AddInt32(&p.correlationID, 1)
+		request       = encodeKafkaProduceRequest(
+			correlationID, p.clientID, p.acks, int32(p.timeout/time.Millisecond),
+			b.topic, b.partition, encodeKafkaRecordBatch(b.messages),
+		)
+	)
+
+	d, err := conn.roundTrip(correlationID, request, p.acks != 0, p.timeout)
+	if err != nil {
+		p.closeConn(address, conn)
+		p.invalidate(b.topic)
+		return err
+	}
+
+	if d == nil {
+		// acks=0, so the broker sends no response
+		return nil
+	}
+
+	err = decodeKafkaProduceResponse(d)
+	var kerr kafkaError
+	if errors.As(err, &kerr) && kerr.staleMetadata() {
+		p.invalidate(b.topic)
+	}
+
+	return err
+}
@@ -0,0 +1,495 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/webpa-common/v2/device"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+// fakeKafkaRecord is a record received by fakeKafkaBroker
+type fakeKafkaRecord struct {
+	topic     string
+	partition int32
+	key       string
+	value     string
+	headers   map[string]string
+}
+
+// fakeKafkaBroker is an in-process, single node Kafka cluster which understands just
+// enough of the protocol to serve the producer's metadata and produce requests
+type fakeKafkaBroker struct {
+	t          *testing.T
+	listener   net.Listener
+	partitions int32
+
+	lock             sync.Mutex
+	conns            int
+	errorCode        int16
+	metadataRequests int
+	batches          int
+	acks             []int16
+	records          []fakeKafkaRecord
+}
+
+func newFakeKafkaBroker(t *testing.T, partitions int32) *fakeKafkaBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	b := &fakeKafkaBroker{t: t, listener: listener, partitions: partitions}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go b.serve(conn)
+		}
+	}()
+
+	return b
+}
+
+func (b *fakeKafkaBroker) address() string {
+	return b.listener.Addr().String()
+}
+
+func (b *fakeKafkaBroker) setErrorCode(code int16) {
+	b.lock.Lock()
+	b.errorCode = code
+	b.lock.Unlock()
+}
+
+// openConns returns the number of connections the broker has not seen closed
+func (b *fakeKafkaBroker) openConns() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.conns
+}
+
+func (b *fakeKafkaBroker) serve(conn net.Conn) {
+	b.lock.Lock()
+	b.conns++
+	b.lock.Unlock()
+
+	defer func() {
+		conn.Close()
+		b.lock.Lock()
+		b.conns--
+		b.lock.Unlock()
+	}()
+
+	for {
+		request, err := readKafkaFrame(conn)
+		if err != nil {
+			return
+		}
+
+		var (
+			d             = &kafkaDecoder{buf: request}
+			apiKey        = d.int16()
+			apiVersion    = d.int16()
+			correlationID = d.int32()
+			response      kafkaEncoder
+		)
+
+		d.string() // client id
+		response.int32(correlationID)
+
+		switch apiKey {
+		case kafkaMetadataKey:
+			assert.Equal(b.t, kafkaMetadataVersion, apiVersion)
+			if !b.metadata(d, &response) {
+				continue
+			}
+
+		case kafkaProduceKey:
+			assert.Equal(b.t, kafkaProduceVersion, apiVersion)
+			if !b.produce(d, &response) {
+				continue
+			}
+
+		default:
+			b.t.Errorf("unexpected api key %d", apiKey)
+			return
+		}
+
+		assert.NoError(b.t, d.err)
+		if err := writeKafkaFrame(conn, response.buf); err != nil {
+			return
+		}
+	}
+}
+
+func (b *fakeKafkaBroker) metadata(d *kafkaDecoder, response *kafkaEncoder) bool {
+	var topics []string
+	for i, n := 0, d.arrayLength(); i < n; i++ {
+		topics = append(topics, d.string())
+	}
+
+	d.bool() // allow auto topic creation
+
+	b.lock.Lock()
+	b.metadataRequests++
+	b.lock.Unlock()
+
+	host, port, _ := net.SplitHostPort(b.address())
+	var portNumber int32
+	fmt.Sscan(port, &portNumber)
+
+	response.int32(0) // throttle time
+	response.int32(1)
+	response.int32(1) // node id
+	response.string(host)
+	response.int32(portNumber)
+	response.int16(-1) // rack
+	response.int16(-1) // cluster id
+	response.int32(1)  // controller id
+	response.int32(int32(len(topics)))
+	for _, topic := range topics {
+		response.int16(kafkaNoError)
+		response.string(topic)
+		response.bool(false)
+		response.int32(b.partitions)
+		for p := int32(0); p < b.partitions; p++ {
+			response.int16(kafkaNoError)
+			response.int32(p)
+			response.int32(1) // leader
+			response.int32(1)
+			response.int32(1) // replicas
+			response.int32(1)
+			response.int32(1) // in-sync replicas
+		}
+	}
+
+	return true
+}
+
+func (b *fakeKafkaBroker) produce(d *kafkaDecoder, response *kafkaEncoder) bool {
+	d.string() // transactional id
+	acks := d.int16()
+	d.int32() // timeout
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.acks = append(b.acks, acks)
+	b.batches++
+
+	response.int32(1)
+	d.arrayLength()
+	topic := d.string()
+	response.string(topic)
+
+	response.int32(1)
+	d.arrayLength()
+	partition := d.int32()
+	b.records = append(b.records, decodeFakeKafkaRecordBatch(b.t, topic, partition, d.bytes())...)
+	response.int32(partition)
+	response.int16(b.errorCode)
+	response.int64(0)  // base offset
+	response.int64(-1) // log append time
+	response.int32(0)  // throttle time
+
+	return acks != 0
+}
+
+func decodeFakeKafkaRecordBatch(t *testing.T, topic string, partition int32, batch []byte) []fakeKafkaRecord {
+	d := &kafkaDecoder{buf: batch}
+	d.int64() // base offset
+	assert.Equal(t, int32(len(batch)-12), d.int32())
+	d.int32() // partition leader epoch
+	assert.Equal(t, kafkaRecordBatchMagic, d.int8())
+	assert.Equal(t, crc32.Checksum(d.buf[4:], kafkaCRC32C), uint32(d.int32()))
+
+	d.int16() // attributes
+	d.int32() // last offset delta
+	d.int64() // base timestamp
+	d.int64() // max timestamp
+	d.int64() // producer id
+	d.int16() // producer epoch
+	d.int32() // base sequence
+
+	var records []fakeKafkaRecord
+	for i, n := int32(0), d.int32(); i < n; i++ {
+		d.varint() // length
+		d.int8()   // attributes
+		d.varint() // timestamp delta
+		d.varint() // offset delta
+
+		record := fakeKafkaRecord{
+			topic:     topic,
+			partition: partition,
+			key:       string(d.varbytes()),
+			value:     string(d.varbytes()),
+			headers:   make(map[string]string),
+		}
+
+		for h, hn := int64(0), d.varint(); h < hn; h++ {
+			key := string(d.varbytes())
+			record.headers[key] = string(d.varbytes())
+		}
+
+		records = append(records, record)
+	}
+
+	assert.NoError(t, d.err)
+	return records
+}
+
+func newTestKafkaRequest(t *testing.T, url, deviceID, body string) *http.Request {
+	request, err := http.NewRequest("POST", url, strings.NewReader(body))
+	require.NoError(t, err)
+	request.Header.Set("Content-Type", wrp.Msgpack.ContentType())
+
+	ctx := context.WithValue(context.Background(), eventTypeContextKey{}, "iot")
+	if len(deviceID) > 0 {
+		ctx = context.WithValue(ctx, deviceIDContextKey{}, deviceID)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	t.Cleanup(cancel)
+	return request.WithContext(ctx)
+}
+
+func testKafkaSinksBatching(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		broker  = newFakeKafkaBroker(t, 4)
+		ks, err = NewKafkaSinks(NewTestOutboundMeasures(), &Outbounder{
+			Kafka: KafkaConfig{BatchSize: 3, Linger: time.Hour},
+		})
+
+		wg sync.WaitGroup
+	)
+
+	require.NoError(err)
+	for i := 0; i < 3; i++ {
+		request := newTestKafkaRequest(t, "kafka://"+broker.address()+"/events", "mac:112233445566", fmt.Sprint(i))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(ks.Send(request))
+		}()
+	}
+
+	// nothing is sent until the batch is full
+	wg.Wait()
+	assert.Equal(1, broker.batches)
+	assert.Equal([]int16{-1}, broker.acks)
+	require.Len(broker.records, 3)
+
+	expectedPartition := (murmur2([]byte("mac:112233445566")) & 0x7fffffff) % 4
+	for _, record := range broker.records {
+		assert.Equal("events", record.topic)
+		assert.Equal(expectedPartition, record.partition)
+		assert.Equal("mac:112233445566", record.key)
+		assert.Equal(wrp.Msgpack.ContentType(), record.headers[kafkaContentTypeHeader])
+		assert.Equal("iot", record.headers[kafkaEventTypeHeader])
+	}
+}
+
+func testKafkaSinksLinger(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		broker  = newFakeKafkaBroker(t, 1)
+		ks, err = NewKafkaSinks(NewTestOutboundMeasures(), &Outbounder{
+			Kafka: KafkaConfig{Acks: "1", Linger: 10 * time.Millisecond},
+		})
+	)
+
+	require.NoError(err)
+	require.NoError(ks.Send(newTestKafkaRequest(t, "kafka://"+broker.address()+"/events", "", "unkeyed")))
+
+	require.Len(broker.records, 1)
+	assert.Equal("", broker.records[0].key)
+	assert.Equal("unkeyed", broker.records[0].value)
+	assert.Equal([]int16{1}, broker.acks)
+}
+
+func testKafkaSinksAcks(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		broker  = newFakeKafkaBroker(t, 1)
+		ks, err = NewKafkaSinks(NewTestOutboundMeasures(), &Outbounder{
+			Kafka: KafkaConfig{Linger: time.Millisecond},
+		})
+	)
+
+	require.NoError(err)
+	require.NoError(ks.Send(newTestKafkaRequest(t, "kafka://"+broker.address()+"/events?acks=0", "mac:112233445566", "fire and forget")))
+	assert.Equal(errKafkaAcksNotSupported, ks.Send(newTestKafkaRequest(t, "kafka://"+broker.address()+"/events?acks=2", "", "")))
+	assert.Equal(errKafkaTopicMissing, ks.Send(newTestKafkaRequest(t, "kafka://"+broker.address(), "", "")))
+
+	// the producer does not wait for a response, so wait for the broker to see the batch
+	assert.Eventually(func() bool {
+		broker.lock.Lock()
+		defer broker.lock.Unlock()
+		return len(broker.acks) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Equal(int16(0), broker.acks[0])
+
+	_, err = NewKafkaSinks(NewTestOutboundMeasures(), &Outbounder{Kafka: KafkaConfig{Acks: "some"}})
+	assert.Equal(errKafkaAcksNotSupported, err)
+}
+
+func testKafkaSinksBrokerError(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		broker  = newFakeKafkaBroker(t, 1)
+		ks, err = NewKafkaSinks(NewTestOutboundMeasures(), &Outbounder{
+			Kafka: KafkaConfig{Linger: time.Millisecond},
+		})
+
+		url = "kafka://" + broker.address() + "/events"
+	)
+
+	require.NoError(err)
+	broker.setErrorCode(kafkaNotLeaderForPartition)
+	assert.Equal(kafkaError(kafkaNotLeaderForPartition), ks.Send(newTestKafkaRequest(t, url, "", "first")))
+
+	// the stale leader is forgotten, so the next send fetches metadata again
+	broker.setErrorCode(kafkaNoError)
+	assert.NoError(ks.Send(newTestKafkaRequest(t, url, "", "second")))
+	assert.Equal(2, broker.metadataRequests)
+}
+
+func testKafkaSinksClose(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		broker  = newFakeKafkaBroker(t, 1)
+		ks, err = NewKafkaSinks(NewTestOutboundMeasures(), &Outbounder{
+			Kafka: KafkaConfig{BatchSize: 10, Linger: time.Hour},
+		})
+
+		sent = make(chan error, 1)
+	)
+
+	require.NoError(err)
+	go func() {
+		sent <- ks.Send(newTestKafkaRequest(t, "kafka://"+broker.address()+"/events", "", "lingering"))
+	}()
+
+	assert.Eventually(func() bool {
+		ks.lock.Lock()
+		defer ks.lock.Unlock()
+		for _, p := range ks.producers {
+			p.lock.Lock()
+			defer p.lock.Unlock()
+			return len(p.batches) == 1
+		}
+
+		return false
+	}, time.Second, 10*time.Millisecond)
+
+	// closing sends the lingering batch, then disconnects from the broker
+	require.NoError(ks.Close())
+	assert.NoError(<-sent)
+	require.Len(broker.records, 1)
+	assert.Equal("lingering", broker.records[0].value)
+	assert.Eventually(func() bool { return broker.openConns() == 0 }, time.Second, 10*time.Millisecond)
+	assert.Empty(ks.producers)
+}
+
+func testKafkaSinksWorkerPool(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		broker  = newFakeKafkaBroker(t, 2)
+		om      = NewTestOutboundMeasures()
+		o       = &Outbounder{
+			EventEndpoints: map[string]interface{}{"default": []string{"kafka://" + broker.address() + "/device-events"}},
+			Kafka:          KafkaConfig{Linger: time.Millisecond},
+		}
+
+		d = new(device.MockDevice)
+	)
+
+	d.On("ID").Return(device.ID("mac:112233445566"))
+	d.On("Metadata").Return(new(device.Metadata))
+
+	dispatcher, outbounds, err := NewEventDispatcher(om, o, nil, nil, nil)
+	require.NoError(err)
+
+	dispatcher.OnDeviceEvent(&device.Event{
+		Type:     device.MessageReceived,
+		Device:   d,
+		Message:  &wrp.Message{Destination: "event:online"},
+		Format:   wrp.Msgpack,
+		Contents: []byte("contents"),
+	})
+
+	wp, err := NewWorkerPool(om, o, outbounds, nil, nil, nil)
+	require.NoError(err)
+
+	e, ok := wp.next()
+	require.True(ok)
+	wp.transact(e)
+
+	require.Len(broker.records, 1)
+	assert.Equal("device-events", broker.records[0].topic)
+	assert.Equal("mac:112233445566", broker.records[0].key)
+	assert.Equal("contents", broker.records[0].value)
+	assert.Equal("online", broker.records[0].headers[kafkaEventTypeHeader])
+}
+
+func testMurmur2(t *testing.T) {
+	assert := assert.New(t)
+
+	// these are the expectations of Kafka's own partitioner tests
+	for input, expected := range map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	} {
+		assert.Equal(expected, murmur2([]byte(input)), input)
+	}
+}
+
+func TestKafkaSinks(t *testing.T) {
+	t.Run("Batching", testKafkaSinksBatching)
+	t.Run("Linger", testKafkaSinksLinger)
+	t.Run("Acks", testKafkaSinksAcks)
+	t.Run("BrokerError", testKafkaSinksBrokerError)
+	t.Run("Close", testKafkaSinksClose)
+	t.Run("WorkerPool", testKafkaSinksWorkerPool)
+	t.Run("Murmur2", testMurmur2)
+}
@@ -73,31 +73,31 @@ func setupDefaultConfigValues(v *viper.Viper) {
 	v.SetDefault(RehasherServicesConfigKey, []string{applicationName})
 }
 
-func newDeviceManager(logger *zap.Logger, r xmetrics.Registry, v *viper.Viper) (device.Manager, devicegate.Interface, *consul.ConsulWatcher, error) {
+func newDeviceManager(logger *zap.Logger, r xmetrics.Registry, v *viper.Viper) (device.Manager, devicegate.Interface, *Outbound, *consul.ConsulWatcher, error) {
 	deviceOptions, err := device.NewOptions(logger, v.Sub(device.DeviceManagerKey))
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, nil, err
 	}
 
 	outbounder, watcher, err := NewOutbounder(logger, v.Sub(OutbounderKey))
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, nil, err
 	}
 
-	outboundListeners, err := outbounder.Start(NewOutboundMeasures(r))
+	outbound, err := outbounder.Start(NewOutboundMeasures(r))
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, nil, err
 	}
 
 	deviceOptions.MetricsProvider = r
-	deviceOptions.Listeners = append(deviceOptions.Listeners, outboundListeners...)
+	deviceOptions.Listeners = append(deviceOptions.Listeners, outbound.Listeners()...)
 
 	g := &devicegate.FilterGate{
 		FilterStore: make(devicegate.FilterStore),
 	}
 
 	deviceOptions.Filter = g
-	return device.NewManager(deviceOptions), g, watcher, nil
+	return device.NewManager(deviceOptions), g, outbound, watcher, nil
 }
 
 func loadTracing(v *viper.Viper, appName string) (candlelight.Tracing, error) {
@@ -154,11 +154,20 @@ func talaria(arguments []string) int {
 	}
 	logger.Info("tracing status", zap.Bool("enabled", !tracing.IsNoop()))
 
-	manager, filterGate, watcher, err := newDeviceManager(logger, metricsRegistry, v)
+	manager, filterGate, outbound, watcher, err := newDeviceManager(logger, metricsRegistry, v)
 	if err != nil {
 		logger.Error("unable to create device manager", zap.Error(err))
 		return 2
 	}
+
+	deviceAccess, err := NewDeviceAccess(logger, metricsRegistry, manager, outbound, v)
+	if err != nil {
+		logger.Error("unable to create device access checks", zap.Error(err))
+		return 2
+	}
+
+	reloader := newConfigReloader(v, outbound, deviceAccess)
+
 	var log = &adapter.Logger{
 		Logger: logger,
 	}
@@ -168,7 +177,7 @@ func talaria(arguments []string) int {
 		return 4
 	}
 
-	controlConstructor, err := StartControlServer(logger, manager, filterGate, metricsRegistry, v, tracing)
+	controlConstructor, connectionGate, err := StartControlServer(logger, manager, filterGate, outbound, deviceAccess, reloader, metricsRegistry, v, tracing)
 	if err != nil {
 		logger.Error("unable to create control server", zap.Error(err))
 		return 3
@@ -188,7 +197,7 @@ func talaria(arguments []string) int {
 	}
 	rootRouter.Use(otelmux.Middleware("primary", otelMuxOptions...), candlelight.EchoFirstTraceNodeInfo(tracing.Propagator(), true))
 
-	primaryHandler, err := NewPrimaryHandler(logger, manager, v, a, e, controlConstructor, metricsRegistry, rootRouter)
+	primaryHandler, err := NewPrimaryHandler(logger, manager, v, a, e, controlConstructor, metricsRegistry, rootRouter, deviceAccess, outbound)
 	if err != nil {
 		logger.Error("unable to start device management", zap.Error(err))
 		return 4
@@ -239,10 +248,16 @@ func talaria(arguments []string) int {
 	}
 
 	signals := make(chan os.Signal, 10)
-	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt, syscall.SIGHUP)
 	for exit := false; !exit; {
 		select {
 		case s := <-signals:
+			if s == syscall.SIGHUP {
+				// failures are logged and counted by the reload itself
+				reloader.Reload()
+				continue
+			}
+
 			logger.Error("exiting due to signal", zap.Any("signal", s))
 			exit = true
 		case <-done:
@@ -251,6 +266,13 @@ func talaria(arguments []string) int {
 		}
 	}
 
+	// refuse new device connections, then deliver whatever is still queued before the
+	// servers, and with them the remaining device connections, are closed
+	if connectionGate != nil {
+		connectionGate.Lower()
+	}
+
+	outbound.Shutdown()
 	close(shutdown)
 	waitGroup.Wait()
 	return 0
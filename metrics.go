@@ -8,7 +8,6 @@ import (
 	"github.com/go-kit/kit/metrics"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/xmidt-org/webpa-common/v2/xhttp"
 
 	// nolint:staticcheck
 	"github.com/xmidt-org/webpa-common/v2/xmetrics"
@@ -20,18 +19,42 @@ const (
 	OutboundRequestDuration            = "outbound_request_duration_seconds"
 	OutboundRequestCounter             = "outbound_requests"
 	OutboundQueueSize                  = "outbound_queue_size"
+	OutboundPartnerQueueSize           = "outbound_partner_queue_size"
+	OutboundPartnerDroppedMessages     = "outbound_partner_dropped_messages"
+	OutboundLaneQueueSize              = "outbound_lane_queue_size"
+	OutboundLaneDroppedMessages        = "outbound_lane_dropped_messages"
+	OutboundDuplicatesSuppressed       = "outbound_duplicates_suppressed"
+	OutboundKafkaMessages              = "outbound_kafka_messages"
+	OutboundBatchSizeHistogram         = "outbound_batch_size"
+	OutboundBatchLingerHistogram       = "outbound_batch_linger_seconds"
+	OutboundTokenRefreshFailures       = "outbound_token_refresh_failures"
+	OutboundRouteMatches               = "outbound_route_matches"
+	OutboundReloadCounter              = "outbound_reloads"
+	OutboundDeadLetterCounter          = "outbound_dead_letters"
+	OutboundDeadLetterSizeGauge        = "outbound_dead_letter_size"
 	OutboundDroppedMessageCounter      = "outbound_dropped_messages"
 	OutboundRetries                    = "outbound_retries"
 	OutboundAckSuccessCounter          = "outbound_ack_success"
 	OutboundAckFailureCounter          = "outbound_ack_failure"
 	OutboundAckSuccessLatencyHistogram = "outbound_ack_success_latency_seconds"
 	OutboundAckFailureLatencyHistogram = "outbound_ack_failure_latency_seconds"
+	OutboundSpillOverflowCounter       = "outbound_spill_overflow"
+	OutboundSpillReplayedCounter       = "outbound_spill_replayed"
+	OutboundSpillExpiredCounter        = "outbound_spill_expired"
+	OutboundSpillDiskUsageGauge        = "outbound_spill_disk_usage_bytes"
+	OutboundCircuitBreakerStateGauge   = "outbound_circuit_breaker_state"
+	OutboundCircuitBreakerRejected     = "outbound_circuit_breaker_rejected"
 
 	GateStatus   = "gate_status"
 	DrainStatus  = "drain_status"
 	DrainCounter = "drain_count"
 
-	InboundWRPMessageCounter = "inbound_wrp_messages"
+	InboundWRPMessageCounter  = "inbound_wrp_messages"
+	DeviceAccessReloadCounter = "device_access_reloads"
+	RateLimitedRequestCounter = "rate_limited_requests"
+	MulticastMessageCounter   = "multicast_messages"
+	AsyncRequestCounter       = "async_requests"
+	AsyncCallbackCounter      = "async_callbacks"
 )
 
 // Metric label names
@@ -41,6 +64,14 @@ const (
 	qosLevelLabel  = "qos_level"
 	partnerIDLabel = "partner_id"
 	messageType    = "message_type"
+	hostLabel      = "host"
+	topicLabel     = "topic"
+	tokenURLLabel  = "token_url"
+	ruleLabel      = "rule"
+	actionLabel    = "action"
+	checkLabel     = "check"
+	policyLabel    = "policy"
+	limitLabel     = "limit"
 )
 
 // label values
@@ -48,6 +79,9 @@ const (
 	accepted = "accepted"
 	rejected = "rejected"
 
+	success = "success"
+	failure = "failure"
+
 	deviceNotFound = "device_not_found"
 	invalidWRPDest = "invalid_wrp_dest"
 
@@ -83,6 +117,36 @@ func Metrics() []xmetrics.Metric {
 			Type: xmetrics.GaugeType,
 			Help: "The current number of requests waiting to be sent outbound",
 		},
+		{
+			Name:       OutboundPartnerQueueSize,
+			Type:       xmetrics.GaugeType,
+			Help:       "The current number of requests waiting to be sent outbound for each partner",
+			LabelNames: []string{partnerIDLabel},
+		},
+		{
+			Name:       OutboundPartnerDroppedMessages,
+			Type:       xmetrics.CounterType,
+			Help:       "The total count of messages dropped because a partner's share of the outbound queue was full",
+			LabelNames: []string{partnerIDLabel},
+		},
+		{
+			Name:       OutboundLaneQueueSize,
+			Type:       xmetrics.GaugeType,
+			Help:       "The current number of requests waiting to be sent outbound for each QoS level",
+			LabelNames: []string{qosLevelLabel},
+		},
+		{
+			Name:       OutboundLaneDroppedMessages,
+			Type:       xmetrics.CounterType,
+			Help:       "The total count of messages refused or evicted by the outbound queue for each QoS level",
+			LabelNames: []string{qosLevelLabel},
+		},
+		{
+			Name:       OutboundDuplicatesSuppressed,
+			Type:       xmetrics.CounterType,
+			Help:       "The total count of QoS messages resent by devices that were not forwarded again",
+			LabelNames: []string{partnerIDLabel},
+		},
 		{
 			Name: OutboundDroppedMessageCounter,
 			Type: xmetrics.CounterType,
@@ -119,6 +183,84 @@ func Metrics() []xmetrics.Metric {
 			LabelNames: []string{qosLevelLabel, partnerIDLabel, messageType},
 			Buckets:    []float64{0.0625, 0.125, .25, .5, 1, 5, 10, 20, 40, 80, 160},
 		},
+		{
+			Name: OutboundSpillOverflowCounter,
+			Type: xmetrics.CounterType,
+			Help: "The total count of messages written to the outbound spill queue because the outbound queue was full",
+		},
+		{
+			Name: OutboundSpillReplayedCounter,
+			Type: xmetrics.CounterType,
+			Help: "The total count of messages read back from the outbound spill queue",
+		},
+		{
+			Name: OutboundSpillExpiredCounter,
+			Type: xmetrics.CounterType,
+			Help: "The total count of spilled messages discarded because they exceeded the maximum spill age",
+		},
+		{
+			Name: OutboundSpillDiskUsageGauge,
+			Type: xmetrics.GaugeType,
+			Help: "The number of bytes currently used by outbound spill queue segment files",
+		},
+		{
+			Name:       OutboundCircuitBreakerStateGauge,
+			Type:       xmetrics.GaugeType,
+			Help:       "The state of the outbound circuit breaker for each host: closed (0.0), half-open (1.0) or open (2.0)",
+			LabelNames: []string{hostLabel},
+		},
+		{
+			Name:       OutboundCircuitBreakerRejected,
+			Type:       xmetrics.CounterType,
+			Help:       "The total count of outbound requests failed fast by an open circuit breaker",
+			LabelNames: []string{hostLabel},
+		},
+		{
+			Name:       OutboundKafkaMessages,
+			Type:       xmetrics.CounterType,
+			Help:       "The total count of messages produced to kafka:// event endpoints, by whether the broker accepted them",
+			LabelNames: []string{topicLabel, outcomeLabel},
+		},
+		{
+			Name:    OutboundBatchSizeHistogram,
+			Type:    xmetrics.HistogramType,
+			Help:    "A histogram of the number of messages in each outbound batch",
+			Buckets: []float64{1, 2, 5, 10, 25, 50, 100, 250, 500},
+		},
+		{
+			Name:    OutboundBatchLingerHistogram,
+			Type:    xmetrics.HistogramType,
+			Help:    "A histogram of how long outbound batches waited for messages before being sent",
+			Buckets: []float64{0.001, 0.005, .01, .025, .05, .1, .25, .5, 1},
+		},
+		{
+			Name:       OutboundTokenRefreshFailures,
+			Type:       xmetrics.CounterType,
+			Help:       "The total count of failures to obtain an OAuth2 token for outbound requests",
+			LabelNames: []string{tokenURLLabel},
+		},
+		{
+			Name:       OutboundRouteMatches,
+			Type:       xmetrics.CounterType,
+			Help:       "The total count of events matched by each outbound routing rule",
+			LabelNames: []string{ruleLabel, actionLabel},
+		},
+		{
+			Name:       OutboundReloadCounter,
+			Type:       xmetrics.CounterType,
+			Help:       "The total count of outbound configuration reloads",
+			LabelNames: []string{outcomeLabel},
+		},
+		{
+			Name: OutboundDeadLetterCounter,
+			Type: xmetrics.CounterType,
+			Help: "The total count of undeliverable outbound requests written to the dead letter store",
+		},
+		{
+			Name: OutboundDeadLetterSizeGauge,
+			Type: xmetrics.GaugeType,
+			Help: "The number of requests in the outbound dead letter store",
+		},
 		{
 			Name: GateStatus,
 			Type: xmetrics.GaugeType,
@@ -138,7 +280,37 @@ func Metrics() []xmetrics.Metric {
 			Name:       InboundWRPMessageCounter,
 			Type:       xmetrics.CounterType,
 			Help:       "Number of inbound WRP Messages successfully decoded and ready to route to device",
-			LabelNames: []string{outcomeLabel, reasonLabel},
+			LabelNames: []string{outcomeLabel, reasonLabel, checkLabel, policyLabel},
+		},
+		{
+			Name:       DeviceAccessReloadCounter,
+			Type:       xmetrics.CounterType,
+			Help:       "The total count of device access policy reloads",
+			LabelNames: []string{outcomeLabel},
+		},
+		{
+			Name:       RateLimitedRequestCounter,
+			Type:       xmetrics.CounterType,
+			Help:       "The total count of requests to devices rejected by rate limits",
+			LabelNames: []string{limitLabel, partnerIDLabel},
+		},
+		{
+			Name:       MulticastMessageCounter,
+			Type:       xmetrics.CounterType,
+			Help:       "The total count of messages sent to devices through /device/multicast",
+			LabelNames: []string{outcomeLabel},
+		},
+		{
+			Name:       AsyncRequestCounter,
+			Type:       xmetrics.CounterType,
+			Help:       "The total count of asynchronous requests to devices, by whether they were accepted",
+			LabelNames: []string{outcomeLabel},
+		},
+		{
+			Name:       AsyncCallbackCounter,
+			Type:       xmetrics.CounterType,
+			Help:       "The total count of asynchronous request results posted to callback URLs",
+			LabelNames: []string{outcomeLabel},
 		},
 	}
 }
@@ -154,6 +326,35 @@ type OutboundMeasures struct {
 	AckFailure        metrics.Counter
 	AckSuccessLatency metrics.Histogram
 	AckFailureLatency metrics.Histogram
+	SpillOverflow     metrics.Counter
+	SpillReplayed     metrics.Counter
+	SpillExpired      metrics.Counter
+	SpillDiskUsage    metrics.Gauge
+
+	CircuitBreakerState    metrics.Gauge
+	CircuitBreakerRejected metrics.Counter
+
+	PartnerQueueSize       metrics.Gauge
+	PartnerDroppedMessages metrics.Counter
+
+	LaneQueueSize       metrics.Gauge
+	LaneDroppedMessages metrics.Counter
+
+	DuplicatesSuppressed metrics.Counter
+
+	KafkaMessages metrics.Counter
+
+	BatchSize   metrics.Histogram
+	BatchLinger metrics.Histogram
+
+	TokenRefreshFailures metrics.Counter
+
+	RouteMatches metrics.Counter
+
+	Reloads metrics.Counter
+
+	DeadLetters    metrics.Counter
+	DeadLetterSize metrics.Gauge
 }
 
 func NewOutboundMeasures(r xmetrics.Registry) OutboundMeasures {
@@ -170,6 +371,37 @@ func NewOutboundMeasures(r xmetrics.Registry) OutboundMeasures {
 		AckSuccessLatency: r.NewHistogram(OutboundAckSuccessLatencyHistogram, 0),
 		// 0 is for the unused `buckets` argument in xmetrics.Registry.NewHistogram
 		AckFailureLatency: r.NewHistogram(OutboundAckFailureLatencyHistogram, 0),
+		SpillOverflow:     r.NewCounter(OutboundSpillOverflowCounter),
+		SpillReplayed:     r.NewCounter(OutboundSpillReplayedCounter),
+		SpillExpired:      r.NewCounter(OutboundSpillExpiredCounter),
+		SpillDiskUsage:    r.NewGauge(OutboundSpillDiskUsageGauge),
+
+		CircuitBreakerState:    r.NewGauge(OutboundCircuitBreakerStateGauge),
+		CircuitBreakerRejected: r.NewCounter(OutboundCircuitBreakerRejected),
+
+		PartnerQueueSize:       r.NewGauge(OutboundPartnerQueueSize),
+		PartnerDroppedMessages: r.NewCounter(OutboundPartnerDroppedMessages),
+
+		LaneQueueSize:       r.NewGauge(OutboundLaneQueueSize),
+		LaneDroppedMessages: r.NewCounter(OutboundLaneDroppedMessages),
+
+		DuplicatesSuppressed: r.NewCounter(OutboundDuplicatesSuppressed),
+
+		KafkaMessages: r.NewCounter(OutboundKafkaMessages),
+
+		// 0 is for the unused `buckets` argument in xmetrics.Registry.NewHistogram
+		BatchSize: r.NewHistogram(OutboundBatchSizeHistogram, 0),
+		// 0 is for the unused `buckets` argument in xmetrics.Registry.NewHistogram
+		BatchLinger: r.NewHistogram(OutboundBatchLingerHistogram, 0),
+
+		TokenRefreshFailures: r.NewCounter(OutboundTokenRefreshFailures),
+
+		RouteMatches: r.NewCounter(OutboundRouteMatches),
+
+		Reloads: r.NewCounter(OutboundReloadCounter),
+
+		DeadLetters:    r.NewCounter(OutboundDeadLetterCounter),
+		DeadLetterSize: r.NewGauge(OutboundDeadLetterSizeGauge),
 	}
 }
 
@@ -203,22 +435,39 @@ func InstrumentOutboundCounter(counter *prometheus.CounterVec, next http.RoundTr
 }
 
 // NewOutboundRoundTripper produces an http.RoundTripper from the configured Outbounder
-// that is also decorated with appropriate metrics.
-func NewOutboundRoundTripper(om OutboundMeasures, o *Outbounder) http.RoundTripper {
+// that is also decorated with appropriate metrics.  Each retry attempt passes through
+// the circuit breakers, if any are configured.
+func NewOutboundRoundTripper(om OutboundMeasures, o *Outbounder, breakers *circuitBreakers) (http.RoundTripper, error) {
+	backoff, err := newBackoffPolicy(o)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := NewOutboundAuth(om, o)
+	if err != nil {
+		return nil, err
+	}
+
 	// nolint:bodyclose
-	return promhttp.RoundTripperFunc(xhttp.RetryTransactor(
-		// use the default should retry predicate ...
-		xhttp.RetryOptions{
-			Logger:  o.logger(),
-			Retries: o.retries(),
-			Counter: om.Retries,
-		},
-		InstrumentOutboundCounter(
-			om.RequestCounter,
-			InstrumentOutboundDuration(
-				om.RequestDuration,
-				promhttp.InstrumentRoundTripperInFlight(om.InFlight, o.transport()),
+	return promhttp.RoundTripperFunc(RetryTransactor(
+		RetryOptions{
+			Logger:    o.logger(),
+			Retries:   o.retries(),
+			Priority:  o.priorityExtraRetries(),
+			Backoff:   backoff,
+			Retryable: o.retryableStatusCodes(),
+			Counter:   om.Retries,
+		},
+		auth.RoundTripper(
+			breakers.RoundTripper(
+				InstrumentOutboundCounter(
+					om.RequestCounter,
+					InstrumentOutboundDuration(
+						om.RequestDuration,
+						promhttp.InstrumentRoundTripperInFlight(om.InFlight, o.transport()),
+					),
+				),
 			),
-		),
-	))
+		).RoundTrip,
+	)), nil
 }
@@ -19,6 +19,7 @@ package main
 import (
 	"context"
 	"crypto"
+	"net/http"
 	"unicode/utf8"
 
 	"github.com/go-kit/kit/metrics"
@@ -71,6 +72,29 @@ func (m *mockDeviceAccess) authorizeWRP(ctx context.Context, message *wrp.Messag
 	return arguments.Error(0)
 }
 
+type mockEventSender struct {
+	mock.Mock
+}
+
+func (m *mockEventSender) sendEvent(eventType string, message *wrp.Message) error {
+	arguments := m.Called(eventType, message)
+	return arguments.Error(0)
+}
+
+type mockOutboundSink struct {
+	mock.Mock
+}
+
+func (m *mockOutboundSink) Send(request *http.Request) error {
+	arguments := m.Called(request)
+	return arguments.Error(0)
+}
+
+func (m *mockOutboundSink) Close() error {
+	arguments := m.Called()
+	return arguments.Error(0)
+}
+
 type mockJWTParser struct {
 	mock.Mock
 }
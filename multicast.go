@@ -0,0 +1,444 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	gokithttp "github.com/go-kit/kit/transport/http"
+	"github.com/spf13/viper"
+	"github.com/thedevsaddam/gojsonq/v2"
+	"github.com/xmidt-org/webpa-common/v2/device"
+	"go.uber.org/zap"
+
+	// nolint:staticcheck
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+const (
+	// DefaultMulticastConcurrency is the default for the most messages sent to devices at
+	// once for a single multicast request
+	DefaultMulticastConcurrency = 10
+
+	// DefaultMulticastMaxDevices is the default for the most devices a single multicast
+	// request may reach
+	DefaultMulticastMaxDevices = 10000
+
+	// ndjsonContentType is the content type of streamed multicast results
+	ndjsonContentType = "application/x-ndjson"
+)
+
+var (
+	errMulticastSelectorRequired = errors.New("One of devices, filter or all is required")
+	errMulticastTypeRequired     = errors.New("The message type is required")
+)
+
+// MulticastConfig bounds the requests made through /device/multicast
+type MulticastConfig struct {
+	// Concurrency is the most messages sent to devices at once for a single request.
+	// Requests may ask for less.
+	// (Optional. Defaults to 10).
+	Concurrency int
+
+	// MaxDevices is the most devices a single request may reach.  Requests that select
+	// more are rejected.
+	// (Optional. Defaults to 10000).
+	MaxDevices int
+}
+
+// multicastFilter is a condition on the facts of a connected device, with the same paths
+// and operations as device access checks, e.g. {"path": "convey.fw-name", "op":
+// "startsWith", "value": "fw-2"}
+type multicastFilter struct {
+	Path     string      `json:"path"`
+	Op       string      `json:"op"`
+	Value    interface{} `json:"value"`
+	Inversed bool        `json:"inversed"`
+}
+
+// multicastRequest is the body read by /device/multicast.  The message is sent to each
+// device selected by Devices, Filter and All: the listed devices, the connected devices
+// matching every filter, or every connected device.  Filters narrow the listed devices
+// when both are given.
+type multicastRequest struct {
+	Message     wrp.Message       `json:"message"`
+	Devices     []string          `json:"devices"`
+	Filter      []multicastFilter `json:"filter"`
+	All         bool              `json:"all"`
+	Concurrency int               `json:"concurrency"`
+}
+
+// multicastResult is the outcome of sending the message to one device.  Response is the
+// device's reply to a request-response message, and Denial the body of a device access
+// rejection.
+type multicastResult struct {
+	DeviceID string              `json:"deviceID"`
+	Status   int                 `json:"status"`
+	Error    string              `json:"error,omitempty"`
+	Denial   *deviceAccessDenial `json:"denial,omitempty"`
+	Response *wrp.Message        `json:"response,omitempty"`
+
+	index int
+}
+
+// multicastResponse is the body written by /device/multicast, unless results are streamed
+type multicastResponse struct {
+	Devices   int               `json:"devices"`
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+	Results   []multicastResult `json:"results"`
+}
+
+// multicastTarget is a selected device, or the reason a listed one could not be used
+type multicastTarget struct {
+	id  string
+	err error
+}
+
+// multicastHandler fans a WRP message out to many devices.  Each message is subject to
+// the same device access checks and rate limits as those sent through /device/send.
+type multicastHandler struct {
+	logger   *zap.Logger
+	router   device.Router
+	registry device.Registry
+	access   deviceAccess
+	limiter  *rateLimiter
+	counter  metrics.Counter
+	timeout  time.Duration
+	config   MulticastConfig
+}
+
+// newMulticastConfig reads the MulticastConfig from the Viper environment, applying defaults
+func newMulticastConfig(v *viper.Viper) (MulticastConfig, error) {
+	var config MulticastConfig
+	if err := v.UnmarshalKey(InboundMulticastConfigKey, &config); err != nil {
+		return config, err
+	}
+
+	if config.Concurrency < 1 {
+		config.Concurrency = DefaultMulticastConcurrency
+	}
+
+	if config.MaxDevices < 1 {
+		config.MaxDevices = DefaultMulticastMaxDevices
+	}
+
+	return config, nil
+}
+
+// ServeHTTP sends the message to every selected device, writing a summary of the results.
+// The results are instead streamed as newline delimited JSON, in the order they complete,
+// if the stream query parameter is true or the caller accepts application/x-ndjson.
+func (h *multicastHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	var mr multicastRequest
+	if err := json.NewDecoder(request.Body).Decode(&mr); err != nil {
+		h.writeError(response, http.StatusBadRequest, err)
+		return
+	}
+
+	if mr.Message.Type == wrp.Invalid0MessageType {
+		h.writeError(response, http.StatusBadRequest, errMulticastTypeRequired)
+		return
+	}
+
+	targets, err := h.targets(&mr)
+	if err != nil {
+		h.writeError(response, http.StatusBadRequest, err)
+		return
+	}
+
+	concurrency := h.config.Concurrency
+	if mr.Concurrency > 0 && mr.Concurrency < concurrency {
+		concurrency = mr.Concurrency
+	}
+
+	ctx := request.Context()
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+
+	results := make(chan multicastResult, concurrency)
+	go h.send(ctx, &mr.Message, targets, concurrency, results)
+
+	if stream, _ := strconv.ParseBool(request.URL.Query().Get("stream")); stream || strings.Contains(request.Header.Get("Accept"), ndjsonContentType) {
+		h.stream(response, results)
+		return
+	}
+
+	body := multicastResponse{
+		Devices: len(targets),
+		Results: make([]multicastResult, len(targets)),
+	}
+
+	for result := range results {
+		body.Results[result.index] = result
+		if result.Status == http.StatusOK {
+			body.Succeeded++
+		} else {
+			body.Failed++
+		}
+	}
+
+	h.writeJSON(response, http.StatusOK, body)
+}
+
+// targets returns the devices selected by the request
+func (h *multicastHandler) targets(mr *multicastRequest) ([]multicastTarget, error) {
+	if len(mr.Devices) == 0 && len(mr.Filter) == 0 && !mr.All {
+		return nil, errMulticastSelectorRequired
+	}
+
+	matches, err := h.newMatcher(mr.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []multicastTarget
+	if len(mr.Devices) > 0 {
+		seen := make(map[device.ID]bool, len(mr.Devices))
+		for _, name := range mr.Devices {
+			id, err := device.ParseID(name)
+			if err != nil {
+				targets = append(targets, multicastTarget{id: name, err: err})
+				continue
+			}
+
+			if seen[id] {
+				continue
+			}
+
+			seen[id] = true
+			if len(mr.Filter) > 0 {
+				// devices that are not connected are reported as such by the router
+				if d, ok := h.registry.Get(id); ok && !matches(d) {
+					continue
+				}
+			}
+
+			targets = append(targets, multicastTarget{id: string(id)})
+		}
+	} else {
+		h.registry.VisitAll(func(d device.Interface) bool {
+			if matches(d) {
+				targets = append(targets, multicastTarget{id: string(d.ID())})
+			}
+
+			return len(targets) <= h.config.MaxDevices
+		})
+	}
+
+	if len(targets) > h.config.MaxDevices {
+		return nil, fmt.Errorf("The request selects more than %d devices", h.config.MaxDevices)
+	}
+
+	return targets, nil
+}
+
+// newMatcher parses the filters into a predicate over connected devices.  The facts of a
+// device are those that device access checks refer to, with paths delimited by '.'.
+func (h *multicastHandler) newMatcher(filters []multicastFilter) (func(device.Interface) bool, error) {
+	checks := make([]*parsedCheck, 0, len(filters))
+	for _, f := range filters {
+		c, err := parseDeviceAccessCheck(deviceAccessCheck{
+			Name:                 f.Path,
+			DeviceCredentialPath: f.Path,
+			InputValue:           f.Value,
+			Op:                   f.Op,
+			Inversed:             f.Inversed,
+		})
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid filter %q: %w", f.Path, err)
+		}
+
+		checks = append(checks, c)
+	}
+
+	var (
+		rule       = newAllOfRule(checks)
+		namespaces = factNamespaces(rule, ".")
+		matcher    = &talariaDeviceAccess{logger: h.logger, sep: "."}
+	)
+
+	return func(d device.Interface) bool {
+		facts := gojsonq.New(gojsonq.WithSeparator(".")).FromInterface(deviceFacts(d, namespaces, h.logger))
+		return matcher.evaluate(rule, facts, nil, nil).err == nil
+	}, nil
+}
+
+// send sends the message to each target, using at most concurrency goroutines, and closes
+// results once every result has been written to it
+func (h *multicastHandler) send(ctx context.Context, template *wrp.Message, targets []multicastTarget, concurrency int, results chan<- multicastResult) {
+	var (
+		indexes = make(chan int)
+		wg      sync.WaitGroup
+	)
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				result := h.sendTo(ctx, template, targets[index])
+				result.index = index
+				results <- result
+			}
+		}()
+	}
+
+	for i := range targets {
+		indexes <- i
+	}
+
+	close(indexes)
+	wg.Wait()
+	close(results)
+}
+
+// sendTo sends a copy of the message to a single device.  The copy's destination is the
+// device, keeping any service and path of the message's destination, e.g. a destination
+// of "*/config" is sent to "mac:112233445566/config".
+func (h *multicastHandler) sendTo(ctx context.Context, template *wrp.Message, target multicastTarget) multicastResult {
+	result := multicastResult{DeviceID: target.id}
+	if target.err != nil {
+		return h.fail(result, http.StatusBadRequest, target.err, failure)
+	}
+
+	message := copyMulticastMessage(template, target.id)
+	if h.access != nil {
+		if err := h.access.authorizeWRP(ctx, &message); err != nil {
+			code := http.StatusForbidden
+			// nolint:errorlint
+			if sc, ok := err.(gokithttp.StatusCoder); ok {
+				code = sc.StatusCode()
+			}
+
+			errors.As(err, &result.Denial)
+			return h.fail(result, code, err, denied)
+		}
+	}
+
+	if h.limiter != nil {
+		if kind, _, ok := h.limiter.allowMessage(ctx, &message); !ok {
+			return h.fail(result, http.StatusTooManyRequests, fmt.Errorf("%s rate limit exceeded", kind), failure)
+		}
+	}
+
+	deviceResponse, err := h.router.Route((&device.Request{Message: &message, Format: wrp.Msgpack}).WithContext(ctx))
+	if err != nil {
+		return h.fail(result, routeErrorCode(err), err, failure)
+	}
+
+	if deviceResponse != nil {
+		result.Response = deviceResponse.Message
+	}
+
+	h.counter.With(outcomeLabel, success).Add(1.0)
+	result.Status = http.StatusOK
+	return result
+}
+
+// copyMulticastMessage returns the message sent to the given device.  The device ID replaces
+// the device part of the template's destination and is appended to its transaction UUID, so
+// that each device's response is told apart, and the template's maps and slices are copied
+// so that nothing done to one device's message affects another's.
+func copyMulticastMessage(template *wrp.Message, id string) wrp.Message {
+	message := *template
+	message.Destination = id
+	if i := strings.IndexByte(template.Destination, '/'); i >= 0 {
+		message.Destination += template.Destination[i:]
+	}
+
+	if len(template.TransactionUUID) > 0 {
+		message.TransactionUUID = template.TransactionUUID + ":" + id
+	}
+
+	if template.Headers != nil {
+		message.Headers = append([]string(nil), template.Headers...)
+	}
+
+	if template.PartnerIDs != nil {
+		message.PartnerIDs = append([]string(nil), template.PartnerIDs...)
+	}
+
+	if template.Metadata != nil {
+		message.Metadata = make(map[string]string, len(template.Metadata))
+		for k, v := range template.Metadata {
+			message.Metadata[k] = v
+		}
+	}
+
+	return message
+}
+
+func (h *multicastHandler) fail(result multicastResult, code int, err error, outcome string) multicastResult {
+	h.logger.Debug("Could not multicast to device", zap.String("deviceID", result.DeviceID), zap.Int("code", code), zap.Error(err))
+	h.counter.With(outcomeLabel, outcome).Add(1.0)
+	result.Status = code
+	result.Error = err.Error()
+	return result
+}
+
+// stream writes each result as a line of JSON as soon as it is available
+func (h *multicastHandler) stream(response http.ResponseWriter, results <-chan multicastResult) {
+	response.Header().Set("Content-Type", ndjsonContentType)
+	response.WriteHeader(http.StatusOK)
+
+	var (
+		encoder    = json.NewEncoder(response)
+		flusher, _ = response.(http.Flusher)
+		failed     bool
+	)
+
+	for result := range results {
+		// keep draining so that the senders are not blocked
+		if failed {
+			continue
+		}
+
+		if err := encoder.Encode(result); err != nil {
+			h.logger.Error("Error while streaming multicast results", zap.Error(err))
+			failed = true
+			continue
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+func (h *multicastHandler) writeJSON(response http.ResponseWriter, status int, body interface{}) {
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+	json.NewEncoder(response).Encode(body)
+}
+
+func (h *multicastHandler) writeError(response http.ResponseWriter, status int, err error) {
+	h.writeJSON(response, status, map[string]string{"error": err.Error()})
+}
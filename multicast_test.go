@@ -0,0 +1,267 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/webpa-common/v2/convey"
+	"github.com/xmidt-org/webpa-common/v2/device"
+	"github.com/xmidt-org/webpa-common/v2/xmetrics"
+	"go.uber.org/zap/zaptest"
+
+	// nolint:staticcheck
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func newTestMulticastHandler(t *testing.T, router device.Router, registry device.Registry) *multicastHandler {
+	return &multicastHandler{
+		logger:   zaptest.NewLogger(t),
+		router:   router,
+		registry: registry,
+		counter:  xmetrics.MustNewRegistry(nil, Metrics).NewCounter(MulticastMessageCounter),
+		config:   MulticastConfig{Concurrency: DefaultMulticastConcurrency, MaxDevices: 3},
+	}
+}
+
+func newMulticastTestDevice(id device.ID, firmware string) *device.MockDevice {
+	d := new(device.MockDevice)
+	d.On("ID").Return(id)
+	d.On("Metadata").Return(getTestDeviceMetadata())
+	d.On("Convey").Return(convey.C{"fw-name": firmware})
+	return d
+}
+
+// routeTo matches the device requests sent to the given destination
+func routeTo(destination string) interface{} {
+	return mock.MatchedBy(func(r *device.Request) bool {
+		return r.Message.(*wrp.Message).Destination == destination
+	})
+}
+
+func serveMulticast(h http.Handler, body string, header ...string) *httptest.ResponseRecorder {
+	var (
+		response = httptest.NewRecorder()
+		request  = httptest.NewRequest("POST", "/api/v3/device/multicast", strings.NewReader(body))
+	)
+
+	for i := 0; i < len(header)-1; i += 2 {
+		request.Header.Set(header[i], header[i+1])
+	}
+
+	h.ServeHTTP(response, request)
+	return response
+}
+
+func testMulticastDevices(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		require  = require.New(t)
+		router   = new(mockRouter)
+		access   = new(mockDeviceAccess)
+		registry = new(device.MockRegistry)
+		h        = newTestMulticastHandler(t, router, registry)
+		reply    = &wrp.Message{Type: wrp.SimpleRequestResponseMessageType, Source: "mac:112233445566/config", Payload: []byte("ok")}
+	)
+
+	h.access = access
+	h.config.MaxDevices = 4
+	access.On("authorizeWRP", mock.Anything, mock.MatchedBy(func(m *wrp.Message) bool {
+		return m.Destination != "mac:665544332211/config"
+	})).Return(nil)
+	access.On("authorizeWRP", mock.Anything, mock.Anything).Return(&deviceAccessDenial{
+		err:     errDeniedDeviceAccess,
+		Code:    http.StatusForbidden,
+		Message: errDeniedDeviceAccess.Error(),
+		Reason:  denied,
+		Check:   "partner",
+	})
+
+	router.On("Route", routeTo("mac:112233445566/config")).Return(&device.Response{Message: reply}, nil).Once()
+	router.On("Route", routeTo("mac:aabbccddeeff/config")).Return(nil, device.ErrorDeviceNotFound).Once()
+
+	response := serveMulticast(h, `{
+		"message": {"msg_type": 3, "source": "dns:caller.com", "dest": "*/config", "transaction_uuid": "DEADBEEF"},
+		"devices": ["mac:112233445566", "mac:665544332211", "mac:11:22:33:44:55:66", "nonsense", "mac:aabbccddeeff"],
+		"concurrency": 1
+	}`)
+
+	assert.Equal(http.StatusOK, response.Code)
+	router.AssertExpectations(t)
+
+	var body multicastResponse
+	require.NoError(json.Unmarshal(response.Body.Bytes(), &body))
+	assert.Equal(4, body.Devices)
+	assert.Equal(1, body.Succeeded)
+	assert.Equal(3, body.Failed)
+	require.Len(body.Results, 4)
+
+	assert.Equal("mac:112233445566", body.Results[0].DeviceID)
+	assert.Equal(http.StatusOK, body.Results[0].Status)
+	require.NotNil(body.Results[0].Response)
+	assert.Equal([]byte("ok"), body.Results[0].Response.Payload)
+
+	assert.Equal(http.StatusForbidden, body.Results[1].Status)
+	require.NotNil(body.Results[1].Denial)
+	assert.Equal("partner", body.Results[1].Denial.Check)
+
+	assert.Equal("nonsense", body.Results[2].DeviceID)
+	assert.Equal(http.StatusBadRequest, body.Results[2].Status)
+	assert.NotEmpty(body.Results[2].Error)
+
+	assert.Equal(http.StatusNotFound, body.Results[3].Status)
+	assert.Equal(device.ErrorDeviceNotFound.Error(), body.Results[3].Error)
+}
+
+func testMulticastFilter(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		require  = require.New(t)
+		router   = new(mockRouter)
+		registry = new(device.MockRegistry)
+		h        = newTestMulticastHandler(t, router, registry)
+		devices  = []device.Interface{
+			newMulticastTestDevice("mac:112233445566", "fw-2.1"),
+			newMulticastTestDevice("mac:665544332211", "fw-1.9"),
+			newMulticastTestDevice("mac:aabbccddeeff", "fw-2.0"),
+		}
+	)
+
+	registry.On("VisitAll", mock.Anything).Run(func(args mock.Arguments) {
+		visit := args.Get(0).(func(device.Interface) bool)
+		for _, d := range devices {
+			if !visit(d) {
+				return
+			}
+		}
+	}).Return(len(devices))
+
+	router.On("Route", routeTo("mac:112233445566")).Return(nil, nil).Once()
+	router.On("Route", routeTo("mac:aabbccddeeff")).Return(nil, nil).Once()
+
+	response := serveMulticast(h, `{
+		"message": {"msg_type": 4, "source": "dns:caller.com"},
+		"filter": [
+			{"path": "convey.fw-name", "op": "startsWith", "value": "fw-2"},
+			{"path": "partner-id", "op": "eq", "value": "sky"}
+		]
+	}`, "Accept", ndjsonContentType)
+
+	assert.Equal(http.StatusOK, response.Code)
+	assert.Equal(ndjsonContentType, response.Header().Get("Content-Type"))
+	router.AssertExpectations(t)
+
+	var results []multicastResult
+	for scanner := bufio.NewScanner(response.Body); scanner.Scan(); {
+		var result multicastResult
+		require.NoError(json.Unmarshal(scanner.Bytes(), &result))
+		assert.Equal(http.StatusOK, result.Status)
+		assert.Nil(result.Response)
+		results = append(results, result)
+	}
+
+	assert.Len(results, 2)
+
+	// a broadcast to every connected device is over the limit
+	h.config.MaxDevices = 2
+	response = serveMulticast(h, `{"message": {"msg_type": 4}, "all": true}`)
+	assert.Equal(http.StatusBadRequest, response.Code)
+}
+
+func testMulticastInvalid(t *testing.T) {
+	testData := []struct {
+		description string
+		body        string
+	}{
+		{"Bad JSON", `{"message":`},
+		{"No type", `{"message": {"source": "dns:caller.com"}, "all": true}`},
+		{"No selector", `{"message": {"msg_type": 4}}`},
+		{"Bad filter", `{"message": {"msg_type": 4}, "filter": [{"path": "partner-id", "op": "nonsense", "value": "sky"}]}`},
+		{"Filter without value", `{"message": {"msg_type": 4}, "filter": [{"path": "partner-id", "op": "eq"}]}`},
+		{"Too many devices", `{"message": {"msg_type": 4}, "devices": ["mac:000000000001", "mac:000000000002", "mac:000000000003", "mac:000000000004"]}`},
+	}
+
+	for _, record := range testData {
+		t.Run(record.description, func(t *testing.T) {
+			var (
+				router = new(mockRouter)
+				h      = newTestMulticastHandler(t, router, new(device.MockRegistry))
+			)
+
+			response := serveMulticast(h, record.body)
+			assert.Equal(t, http.StatusBadRequest, response.Code)
+			assert.Contains(t, response.Body.String(), "error")
+			router.AssertNotCalled(t, "Route", mock.Anything)
+		})
+	}
+}
+
+func testMulticastCopies(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		require  = require.New(t)
+		router   = new(mockRouter)
+		h        = newTestMulticastHandler(t, router, new(device.MockRegistry))
+		lock     sync.Mutex
+		messages = make(map[string]*wrp.Message)
+	)
+
+	router.On("Route", mock.Anything).Run(func(arguments mock.Arguments) {
+		m := arguments.Get(0).(*device.Request).Message.(*wrp.Message)
+		lock.Lock()
+		defer lock.Unlock()
+		messages[m.Destination] = m
+	}).Return(nil, nil)
+
+	response := serveMulticast(h, `{
+		"message": {"msg_type": 4, "source": "dns:caller.com", "dest": "*/config", "transaction_uuid": "DEADBEEF",
+			"partner_ids": ["comcast"], "metadata": {"/key": "value"}},
+		"devices": ["mac:112233445566", "mac:aabbccddeeff"]
+	}`)
+
+	assert.Equal(http.StatusOK, response.Code)
+	require.Len(messages, 2)
+
+	first, second := messages["mac:112233445566/config"], messages["mac:aabbccddeeff/config"]
+	require.NotNil(first)
+	require.NotNil(second)
+
+	// each device has its own transaction UUID, partner IDs and metadata
+	assert.Equal("DEADBEEF:mac:112233445566", first.TransactionUUID)
+	assert.Equal("DEADBEEF:mac:aabbccddeeff", second.TransactionUUID)
+
+	first.PartnerIDs[0] = "changed"
+	first.Metadata["/key"] = "changed"
+	assert.Equal([]string{"comcast"}, second.PartnerIDs)
+	assert.Equal(map[string]string{"/key": "value"}, second.Metadata)
+}
+
+func TestMulticast(t *testing.T) {
+	t.Run("Devices", testMulticastDevices)
+	t.Run("Filter", testMulticastFilter)
+	t.Run("Copies", testMulticastCopies)
+	t.Run("Invalid", testMulticastInvalid)
+}
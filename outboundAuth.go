@@ -0,0 +1,351 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Supported outbound authentication types
+const (
+	BasicAuth             = "basic"
+	BearerAuth            = "bearer"
+	ClientCredentialsAuth = "clientCredentials"
+	HMACAuth              = "hmac"
+)
+
+const (
+	DefaultHMACHeader = "X-Webpa-Signature"
+
+	// tokenExpiryMargin is how long before its expiry a cached token is refreshed.  Tokens
+	// that expire sooner are refreshed halfway through their lifetime.
+	tokenExpiryMargin = 30 * time.Second
+
+	// defaultTokenLifetime is how long a token is assumed to be valid when the token
+	// response does not include expires_in
+	defaultTokenLifetime = 5 * time.Minute
+)
+
+var (
+	errAuthTypeNotSupported  = errors.New("Outbound auth type not supported")
+	errAuthMissingCredential = errors.New("Outbound auth is missing a required credential")
+)
+
+// AuthConfig describes how outbound requests authenticate to an endpoint.
+type AuthConfig struct {
+	// Type is one of "basic", "bearer", "clientCredentials" or "hmac".
+	Type string `json:"type"`
+
+	// Key is the base64 encoded user:password of "basic" auth.
+	Key string `json:"key"`
+
+	// Token is the static token of "bearer" auth.
+	Token string `json:"token"`
+
+	// TokenURL, ClientID, ClientSecret and Scopes configure the OAuth2 client credentials
+	// grant of "clientCredentials" auth.
+	TokenURL     string   `json:"tokenURL"`
+	ClientID     string   `json:"clientID"`
+	ClientSecret string   `json:"clientSecret"`
+	Scopes       []string `json:"scopes"`
+
+	// Secret is the key used to sign request bodies with HMAC-SHA256 under "hmac" auth.
+	Secret string `json:"secret"`
+
+	// Header is the request header that carries the "hmac" signature.
+	Header string `json:"header"`
+}
+
+// outboundAuthenticator adds credentials to outbound requests
+type outboundAuthenticator interface {
+	authenticate(*http.Request) error
+}
+
+type basicAuthenticator struct {
+	key string
+}
+
+func (a basicAuthenticator) authenticate(request *http.Request) error {
+	request.Header.Set("Authorization", "Basic "+a.key)
+	return nil
+}
+
+type bearerAuthenticator struct {
+	token string
+}
+
+func (a bearerAuthenticator) authenticate(request *http.Request) error {
+	request.Header.Set("Authorization", "Bearer "+a.token)
+	return nil
+}
+
+// hmacAuthenticator signs request bodies the same way Caduceus signs webhook deliveries
+type hmacAuthenticator struct {
+	secret []byte
+	header string
+}
+
+func (a hmacAuthenticator) authenticate(request *http.Request) error {
+	var body io.ReadCloser = http.NoBody
+	if request.GetBody != nil {
+		var err error
+		if body, err = request.GetBody(); err != nil {
+			return err
+		}
+	} else if request.Body != nil {
+		contents, err := io.ReadAll(request.Body)
+		request.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		request.Body = io.NopCloser(bytes.NewReader(contents))
+		body = io.NopCloser(bytes.NewReader(contents))
+	}
+
+	defer body.Close()
+	mac := hmac.New(sha256.New, a.secret)
+	if _, err := io.Copy(mac, body); err != nil {
+		return err
+	}
+
+	request.Header.Set(a.header, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
+
+// tokenResponse is the successful response of an OAuth2 token endpoint
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// clientCredentialsAuthenticator obtains bearer tokens with the OAuth2 client credentials
+// grant, caching each token until shortly before it expires
+type clientCredentialsAuthenticator struct {
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	scopes       []string
+	client       *http.Client
+	failures     metrics.Counter
+	now          func() time.Time
+
+	lock    sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (a *clientCredentialsAuthenticator) authenticate(request *http.Request) error {
+	token, err := a.currentToken(request)
+	if err != nil {
+		a.failures.With(tokenURLLabel, a.tokenURL).Add(1.0)
+		return err
+	}
+
+	request.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+func (a *clientCredentialsAuthenticator) currentToken(request *http.Request) (string, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if len(a.token) > 0 && a.now().Before(a.expires) {
+		return a.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(a.scopes) > 0 {
+		form.Set("scope", strings.Join(a.scopes, " "))
+	}
+
+	tokenRequest, err := http.NewRequestWithContext(request.Context(), "POST", a.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+
+	tokenRequest.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	tokenRequest.SetBasicAuth(url.QueryEscape(a.clientID), url.QueryEscape(a.clientSecret))
+
+	response, err := a.client.Do(tokenRequest)
+	if err != nil {
+		return "", err
+	}
+
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, response.Body)
+		return "", fmt.Errorf("token request failed: %s", response.Status)
+	}
+
+	var tr tokenResponse
+	if err := json.NewDecoder(response.Body).Decode(&tr); err != nil {
+		return "", err
+	}
+
+	if len(tr.AccessToken) == 0 {
+		return "", errors.New("token response has no access_token")
+	}
+
+	a.token = tr.AccessToken
+	a.expires = a.now().Add(tokenCacheTime(tr.ExpiresIn))
+	return a.token, nil
+}
+
+// tokenCacheTime returns how long a token that expires in the given number of seconds
+// is cached before it is refreshed
+func tokenCacheTime(expiresIn int64) time.Duration {
+	lifetime := defaultTokenLifetime
+	if expiresIn > 0 {
+		lifetime = time.Duration(expiresIn) * time.Second
+	}
+
+	margin := tokenExpiryMargin
+	if margin > lifetime/2 {
+		margin = lifetime / 2
+	}
+
+	return lifetime - margin
+}
+
+func newOutboundAuthenticator(om OutboundMeasures, o *Outbounder, config AuthConfig) (outboundAuthenticator, error) {
+	switch config.Type {
+	case BasicAuth:
+		if len(config.Key) == 0 {
+			return nil, errAuthMissingCredential
+		}
+
+		return basicAuthenticator{config.Key}, nil
+
+	case BearerAuth:
+		if len(config.Token) == 0 {
+			return nil, errAuthMissingCredential
+		}
+
+		return bearerAuthenticator{config.Token}, nil
+
+	case ClientCredentialsAuth:
+		if len(config.TokenURL) == 0 || len(config.ClientID) == 0 {
+			return nil, errAuthMissingCredential
+		}
+
+		return &clientCredentialsAuthenticator{
+			tokenURL:     config.TokenURL,
+			clientID:     config.ClientID,
+			clientSecret: config.ClientSecret,
+			scopes:       config.Scopes,
+			client:       &http.Client{Transport: o.transport(), Timeout: o.clientTimeout()},
+			failures:     om.TokenRefreshFailures,
+			now:          time.Now,
+		}, nil
+
+	case HMACAuth:
+		if len(config.Secret) == 0 {
+			return nil, errAuthMissingCredential
+		}
+
+		header := config.Header
+		if len(header) == 0 {
+			header = DefaultHMACHeader
+		}
+
+		return hmacAuthenticator{secret: []byte(config.Secret), header: header}, nil
+
+	default:
+		return nil, errAuthTypeNotSupported
+	}
+}
+
+// outboundAuth authenticates each outbound request with the authenticator configured for
+// its endpoint, falling back to the default authenticator
+type outboundAuth struct {
+	fallback  outboundAuthenticator
+	endpoints map[string]outboundAuthenticator
+}
+
+// NewOutboundAuth creates the outbound authentication described by the Outbounder.  The
+// legacy AuthKey is used as "basic" auth when no default auth is configured.  This function
+// returns nil if no outbound authentication is configured at all.
+func NewOutboundAuth(om OutboundMeasures, o *Outbounder) (*outboundAuth, error) {
+	var (
+		oa  = &outboundAuth{endpoints: make(map[string]outboundAuthenticator)}
+		err error
+	)
+
+	if config := o.auth(); len(config.Type) > 0 {
+		if oa.fallback, err = newOutboundAuthenticator(om, o, config); err != nil {
+			return nil, err
+		}
+	} else if key := o.authKey(); len(key) > 0 {
+		oa.fallback = basicAuthenticator{key}
+	}
+
+	for endpoint, config := range o.endpointAuth() {
+		if oa.endpoints[endpoint], err = newOutboundAuthenticator(om, o, config); err != nil {
+			return nil, fmt.Errorf("endpoint %s: %w", endpoint, err)
+		}
+	}
+
+	if oa.fallback == nil && len(oa.endpoints) == 0 {
+		return nil, nil
+	}
+
+	return oa, nil
+}
+
+// RoundTripper decorates next so that each request carries its endpoint's credentials.
+// If oa is nil, next is returned undecorated.
+func (oa *outboundAuth) RoundTripper(next http.RoundTripper) http.RoundTripper {
+	if oa == nil {
+		return next
+	}
+
+	return promhttp.RoundTripperFunc(func(request *http.Request) (*http.Response, error) {
+		a, ok := oa.endpoints[request.URL.String()]
+		if !ok {
+			a = oa.fallback
+		}
+
+		if a == nil {
+			return next.RoundTrip(request)
+		}
+
+		// RoundTrippers must not modify the caller's request
+		authenticated := request.Clone(request.Context())
+		if err := a.authenticate(authenticated); err != nil {
+			return nil, err
+		}
+
+		return next.RoundTrip(authenticated)
+	})
+}
@@ -0,0 +1,209 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// authenticatedHeaders sends a request for the given URL through the Outbounder's outbound
+// auth, returning the headers that reached the transport
+func authenticatedHeaders(t *testing.T, o *Outbounder, url, body string) http.Header {
+	oa, err := NewOutboundAuth(NewTestOutboundMeasures(), o)
+	require.NoError(t, err)
+
+	var header http.Header
+	rt := oa.RoundTripper(promhttp.RoundTripperFunc(func(request *http.Request) (*http.Response, error) {
+		header = request.Header
+		contents, err := io.ReadAll(request.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, body, string(contents))
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	}))
+
+	request := httptest.NewRequest("POST", url, strings.NewReader(body))
+	_, err = rt.RoundTrip(request)
+	require.NoError(t, err)
+	return header
+}
+
+func testOutboundAuthNone(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		oa, err = NewOutboundAuth(NewTestOutboundMeasures(), nil)
+	)
+
+	assert.NoError(err)
+	assert.Nil(oa)
+	assert.Equal(http.DefaultTransport, oa.RoundTripper(http.DefaultTransport))
+
+	_, err = NewOutboundAuth(NewTestOutboundMeasures(), &Outbounder{Auth: AuthConfig{Type: "unsupported"}})
+	assert.Equal(errAuthTypeNotSupported, err)
+
+	_, err = NewOutboundAuth(NewTestOutboundMeasures(), &Outbounder{Auth: AuthConfig{Type: BearerAuth}})
+	assert.Equal(errAuthMissingCredential, err)
+}
+
+func testOutboundAuthStatic(t *testing.T) {
+	assert := assert.New(t)
+
+	// the legacy AuthKey is still sent as basic auth
+	header := authenticatedHeaders(t, &Outbounder{AuthKey: "Zm9vOmJhcg=="}, "http://endpoint.com", "")
+	assert.Equal("Basic Zm9vOmJhcg==", header.Get("Authorization"))
+
+	o := &Outbounder{
+		AuthKey: "Zm9vOmJhcg==",
+		Auth:    AuthConfig{Type: BearerAuth, Token: "default-token"},
+		EndpointAuth: map[string]AuthConfig{
+			"http://special.com/events": {Type: BearerAuth, Token: "special-token"},
+		},
+	}
+
+	assert.Equal("Bearer default-token", authenticatedHeaders(t, o, "http://endpoint.com", "").Get("Authorization"))
+	assert.Equal("Bearer special-token", authenticatedHeaders(t, o, "http://special.com/events", "").Get("Authorization"))
+}
+
+func testOutboundAuthHMAC(t *testing.T) {
+	var (
+		assert = assert.New(t)
+		body   = `{"msg_type": 4}`
+		o      = &Outbounder{Auth: AuthConfig{Type: HMACAuth, Secret: "secret"}}
+
+		mac = hmac.New(sha256.New, []byte("secret"))
+	)
+
+	mac.Write([]byte(body))
+	header := authenticatedHeaders(t, o, "http://endpoint.com", body)
+	assert.Equal("sha256="+hex.EncodeToString(mac.Sum(nil)), header.Get(DefaultHMACHeader))
+	assert.Empty(header.Get("Authorization"))
+
+	o.Auth.Header = "X-Signature"
+	assert.NotEmpty(authenticatedHeaders(t, o, "http://endpoint.com", body).Get("X-Signature"))
+}
+
+func testOutboundAuthClientCredentials(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		tokenRequests int32
+		server        = httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			atomic.AddInt32(&tokenRequests, 1)
+			clientID, clientSecret, _ := request.BasicAuth()
+			assert.Equal("client", clientID)
+			assert.Equal("secret", clientSecret)
+			assert.NoError(request.ParseForm())
+			assert.Equal("client_credentials", request.PostForm.Get("grant_type"))
+			assert.Equal("read write", request.PostForm.Get("scope"))
+
+			response.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(response).Encode(tokenResponse{AccessToken: "token", TokenType: "bearer", ExpiresIn: 60})
+		}))
+	)
+
+	defer server.Close()
+	a, err := newOutboundAuthenticator(NewTestOutboundMeasures(), nil, AuthConfig{
+		Type:         ClientCredentialsAuth,
+		TokenURL:     server.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		Scopes:       []string{"read", "write"},
+	})
+
+	require.NoError(err)
+	var (
+		authenticator = a.(*clientCredentialsAuthenticator)
+		now           = time.Now()
+	)
+
+	authenticator.now = func() time.Time { return now }
+	for i := 0; i < 3; i++ {
+		request := httptest.NewRequest("POST", "http://endpoint.com", nil)
+		require.NoError(authenticator.authenticate(request))
+		assert.Equal("Bearer token", request.Header.Get("Authorization"))
+	}
+
+	// the token is cached until shortly before it expires
+	assert.Equal(int32(1), atomic.LoadInt32(&tokenRequests))
+
+	now = now.Add(time.Minute - tokenExpiryMargin)
+	require.NoError(authenticator.authenticate(httptest.NewRequest("POST", "http://endpoint.com", nil)))
+	assert.Equal(int32(2), atomic.LoadInt32(&tokenRequests))
+}
+
+func testTokenCacheTime(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(defaultTokenLifetime-tokenExpiryMargin, tokenCacheTime(0))
+	assert.Equal(defaultTokenLifetime-tokenExpiryMargin, tokenCacheTime(-1))
+	assert.Equal(time.Hour-tokenExpiryMargin, tokenCacheTime(3600))
+
+	// short-lived tokens are cached for half their lifetime
+	assert.Equal(30*time.Second, tokenCacheTime(60))
+	assert.Equal(10*time.Second, tokenCacheTime(20))
+	assert.Equal(500*time.Millisecond, tokenCacheTime(1))
+}
+
+func testOutboundAuthClientCredentialsFailure(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		server  = httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, _ *http.Request) {
+			response.WriteHeader(http.StatusUnauthorized)
+		}))
+
+		failures = new(mockCounter)
+	)
+
+	defer server.Close()
+	failures.On("With", []string{tokenURLLabel, server.URL}).Once()
+	failures.On("Add", 1.0).Once()
+
+	a, err := newOutboundAuthenticator(OutboundMeasures{TokenRefreshFailures: failures}, nil, AuthConfig{
+		Type:     ClientCredentialsAuth,
+		TokenURL: server.URL,
+		ClientID: "client",
+	})
+
+	require.NoError(err)
+	request := httptest.NewRequest("POST", "http://endpoint.com", nil)
+	assert.Error(a.authenticate(request))
+	assert.Empty(request.Header.Get("Authorization"))
+	failures.AssertExpectations(t)
+}
+
+func TestOutboundAuth(t *testing.T) {
+	t.Run("None", testOutboundAuthNone)
+	t.Run("Static", testOutboundAuthStatic)
+	t.Run("HMAC", testOutboundAuthHMAC)
+	t.Run("ClientCredentials", testOutboundAuthClientCredentials)
+	t.Run("TokenCacheTime", testTokenCacheTime)
+	t.Run("ClientCredentialsFailure", testOutboundAuthClientCredentialsFailure)
+}
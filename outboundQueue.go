@@ -0,0 +1,428 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/go-kit/kit/metrics"
+
+	// nolint:staticcheck
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+// Supported partner schedulers
+const (
+	WeightedRoundRobin = "wrr"
+	DeficitRoundRobin  = "drr"
+)
+
+const (
+	DefaultScheduler                    = WeightedRoundRobin
+	DefaultPartnerWeight        uint    = 1
+	DefaultDeficitQuantum       uint64  = 4096
+	DefaultPriorityShedRatio    float64 = 1.0
+	DefaultPriorityExtraRetries         = 1
+)
+
+var (
+	errSchedulerNotSupported = errors.New("Scheduler not supported")
+	errOutboundQueueClosed   = errors.New("outbound message queue closed")
+)
+
+// FairQueueConfig describes how outbound envelopes from different partners share the
+// outbound queue.
+type FairQueueConfig struct {
+	// Scheduler is either "wrr" (weighted round-robin, where each partner's turn is its
+	// weight in envelopes) or "drr" (deficit round-robin, where each partner's turn is
+	// its weight times Quantum in bytes).
+	Scheduler string `json:"scheduler"`
+
+	// PartnerQueueSize caps the number of envelopes any single partner may have queued.
+	PartnerQueueSize uint `json:"partnerQueueSize"`
+
+	// DefaultWeight is the weight of partners not listed in Weights.
+	DefaultWeight uint `json:"defaultWeight"`
+
+	// Weights overrides the weight of specific partners.
+	Weights map[string]uint `json:"weights"`
+
+	// Quantum is the number of bytes a partner of weight 1 may send per turn under "drr".
+	Quantum uint64 `json:"quantum"`
+}
+
+// PriorityConfig describes how the outbound queue favors messages by QoS level.  Each QoS
+// level has its own lane, and lanes are always dequeued from critical down to low.  When the
+// queue is full, a message evicts the newest message of the lowest lane below its own.
+type PriorityConfig struct {
+	// ShedRatio is the fraction of the outbound queue that low QoS messages may fill before
+	// further low QoS messages are dropped.
+	ShedRatio float64 `json:"shedRatio"`
+
+	// ExtraRetries is the number of retries, beyond the configured retries, given to high
+	// and critical QoS messages.
+	ExtraRetries int `json:"extraRetries"`
+}
+
+// partnerQueue is the sub-queue of a single partner within a lane
+type partnerQueue struct {
+	partnerID string
+	weight    uint
+	envelopes []outboundEnvelope
+	credits   uint
+	deficit   uint64
+	inTurn    bool
+}
+
+// lane holds the queued envelopes of a single QoS level
+type lane struct {
+	level    wrp.QOSLevel
+	size     int
+	partners map[string]*partnerQueue
+	active   []*partnerQueue
+	current  int
+}
+
+// outboundQueue holds outbound envelopes waiting for a worker.  Envelopes are placed in
+// the lane of their QoS level, and each lane has a FIFO sub-queue per partner.  Higher
+// lanes are always dequeued first, and within a lane partners take turns according to the
+// configured scheduler so that a single partner cannot starve the others.
+type outboundQueue struct {
+	scheduler        string
+	capacity         int
+	shedCapacity     int
+	partnerCapacity  int
+	defaultWeight    uint
+	weights          map[string]uint
+	quantum          uint64
+	queueSize        metrics.Gauge
+	partnerQueueSize metrics.Gauge
+	partnerDropped   metrics.Counter
+	laneQueueSize    metrics.Gauge
+	laneDropped      metrics.Counter
+
+	lock         sync.Mutex
+	size         int
+	lanes        []*lane
+	partnerSizes map[string]int
+	signal       chan struct{}
+	closed       chan struct{}
+	closeOnce    sync.Once
+}
+
+func newOutboundQueue(om OutboundMeasures, o *Outbounder) (*outboundQueue, error) {
+	oq := &outboundQueue{
+		scheduler:        o.fairQueueScheduler(),
+		capacity:         int(o.outboundQueueSize()),
+		partnerCapacity:  int(o.partnerQueueSize()),
+		defaultWeight:    o.fairQueueDefaultWeight(),
+		weights:          o.fairQueueWeights(),
+		quantum:          o.fairQueueQuantum(),
+		queueSize:        om.QueueSize,
+		partnerQueueSize: om.PartnerQueueSize,
+		partnerDropped:   om.PartnerDroppedMessages,
+		laneQueueSize:    om.LaneQueueSize,
+		laneDropped:      om.LaneDroppedMessages,
+		partnerSizes:     make(map[string]int),
+		signal:           make(chan struct{}, 1),
+		closed:           make(chan struct{}),
+	}
+
+	oq.shedCapacity = int(o.priorityShedRatio() * float64(oq.capacity))
+	for level := wrp.QOSLow; level <= wrp.QOSCritical; level++ {
+		oq.lanes = append(oq.lanes, &lane{level: level, partners: make(map[string]*partnerQueue)})
+	}
+
+	switch oq.scheduler {
+	case WeightedRoundRobin, DeficitRoundRobin:
+		return oq, nil
+	default:
+		return nil, errSchedulerNotSupported
+	}
+}
+
+// notify wakes up at most one waiting consumer
+func (oq *outboundQueue) notify() {
+	select {
+	case oq.signal <- struct{}{}:
+	default:
+	}
+}
+
+// ready returns a channel that receives a value whenever envelopes may be available.
+func (oq *outboundQueue) ready() <-chan struct{} {
+	return oq.signal
+}
+
+// done returns a channel that is closed once shutdown has been called.
+func (oq *outboundQueue) done() <-chan struct{} {
+	return oq.closed
+}
+
+// shutdown marks this queue as closed, after which no more envelopes are accepted.
+// Envelopes already queued may still be popped.  This method is idempotent.
+func (oq *outboundQueue) shutdown() {
+	oq.closeOnce.Do(func() {
+		close(oq.closed)
+	})
+}
+
+// len returns the total number of queued envelopes
+func (oq *outboundQueue) len() int {
+	oq.lock.Lock()
+	defer oq.lock.Unlock()
+	return oq.size
+}
+
+// push adds an envelope to the lane of the QoS level and the sub-queue of the partner found
+// in its request's context.  ErrOutboundQueueFull is returned if the queue as a whole is at
+// capacity and holds nothing of a lower QoS level to evict, or if a low QoS envelope arrives
+// once the queue is past its shed capacity.  ErrPartnerQueueFull is returned if only the
+// partner's sub-queues are at capacity.
+func (oq *outboundQueue) push(e outboundEnvelope) error {
+	partnerID, _ := e.request.Context().Value(partnerIDContextKey{}).(string)
+	level := envelopeLevel(e)
+
+	oq.lock.Lock()
+	defer oq.lock.Unlock()
+
+	victim, err := oq.checkLocked(partnerID, level)
+	if err != nil {
+		return err
+	}
+
+	if victim != nil {
+		oq.evict(victim)
+	}
+
+	l := oq.lanes[level]
+	pq, ok := l.partners[partnerID]
+	if !ok {
+		weight, ok := oq.weights[partnerID]
+		if !ok {
+			weight = oq.defaultWeight
+		}
+
+		pq = &partnerQueue{partnerID: partnerID, weight: weight}
+		l.partners[partnerID] = pq
+		l.active = append(l.active, pq)
+	}
+
+	pq.envelopes = append(pq.envelopes, e)
+	l.size++
+	oq.size++
+	oq.partnerSizes[partnerID]++
+	oq.queueSize.Add(1.0)
+	oq.partnerQueueSize.With(partnerIDLabel, partnerID).Set(float64(oq.partnerSizes[partnerID]))
+	oq.laneQueueSize.With(qosLevelLabel, level.String()).Set(float64(l.size))
+	oq.notify()
+	return nil
+}
+
+// admit returns the error push would return for the envelope, without queueing it or
+// evicting anything.  This lets an envelope that goes elsewhere, such as to the spill queue,
+// still be held to the capacity rules of this queue.
+func (oq *outboundQueue) admit(e outboundEnvelope) error {
+	partnerID, _ := e.request.Context().Value(partnerIDContextKey{}).(string)
+
+	oq.lock.Lock()
+	defer oq.lock.Unlock()
+
+	_, err := oq.checkLocked(partnerID, envelopeLevel(e))
+	return err
+}
+
+// checkLocked applies the capacity rules of push to an envelope of the given partner and QoS
+// level.  If the queue is at capacity, the lane to evict from is returned.  The lock must be held.
+func (oq *outboundQueue) checkLocked(partnerID string, level wrp.QOSLevel) (*lane, error) {
+	select {
+	case <-oq.closed:
+		return nil, errOutboundQueueClosed
+	default:
+	}
+
+	var victim *lane
+	if level == wrp.QOSLow && oq.size >= oq.shedCapacity {
+		oq.laneDropped.With(qosLevelLabel, level.String()).Add(1.0)
+		return nil, ErrOutboundQueueFull
+	} else if oq.size >= oq.capacity {
+		if victim = oq.victim(level); victim == nil {
+			oq.laneDropped.With(qosLevelLabel, level.String()).Add(1.0)
+			return nil, ErrOutboundQueueFull
+		}
+	}
+
+	if oq.partnerSizes[partnerID] >= oq.partnerCapacity {
+		oq.partnerDropped.With(partnerIDLabel, partnerID).Add(1.0)
+		return nil, ErrPartnerQueueFull
+	}
+
+	return victim, nil
+}
+
+// victim returns the lowest non-empty lane below the given level, or nil if there is none.
+// The lock must be held.
+func (oq *outboundQueue) victim(level wrp.QOSLevel) *lane {
+	for _, l := range oq.lanes[:level] {
+		if l.size > 0 {
+			return l
+		}
+	}
+
+	return nil
+}
+
+// evict sheds the newest envelope of the partner with the most envelopes in the given lane,
+// cancelling it.  The lock must be held.
+func (oq *outboundQueue) evict(l *lane) {
+	var (
+		index   int
+		longest = l.active[0]
+	)
+
+	for i, pq := range l.active {
+		if len(pq.envelopes) > len(longest.envelopes) {
+			index, longest = i, pq
+		}
+	}
+
+	last := len(longest.envelopes) - 1
+	e := longest.envelopes[last]
+	longest.envelopes[last] = outboundEnvelope{}
+	longest.envelopes = longest.envelopes[:last]
+	oq.removed(l, longest, index)
+
+	e.cancel()
+	deliveryFrom(e.request.Context()).complete(rdrQueueFull)
+	oq.laneDropped.With(qosLevelLabel, l.level.String()).Add(1.0)
+}
+
+// pop removes the next envelope as chosen by the scheduler from the highest non-empty
+// lane.  This method does not block.
+func (oq *outboundQueue) pop() (outboundEnvelope, bool) {
+	oq.lock.Lock()
+	defer oq.lock.Unlock()
+
+	for level := len(oq.lanes) - 1; level >= 0; level-- {
+		if e, ok := oq.popLane(oq.lanes[level]); ok {
+			return e, true
+		}
+	}
+
+	return outboundEnvelope{}, false
+}
+
+// popLane removes the next envelope from the given lane.  The lock must be held.
+func (oq *outboundQueue) popLane(l *lane) (outboundEnvelope, bool) {
+	for len(l.active) > 0 {
+		if l.current >= len(l.active) {
+			l.current = 0
+		}
+
+		pq := l.active[l.current]
+		if oq.scheduler == DeficitRoundRobin {
+			if !pq.inTurn {
+				pq.inTurn = true
+				pq.deficit += oq.quantum * uint64(pq.weight)
+			}
+
+			size := envelopeSize(pq.envelopes[0])
+			if size > pq.deficit {
+				// not enough credit left for this partner's next envelope, so move on
+				pq.inTurn = false
+				l.current++
+				continue
+			}
+
+			pq.deficit -= size
+			return oq.dequeue(l, pq), true
+		}
+
+		if pq.credits == 0 {
+			pq.credits = pq.weight
+		}
+
+		pq.credits--
+		e := oq.dequeue(l, pq)
+		if pq.credits == 0 && len(pq.envelopes) > 0 {
+			l.current++
+		}
+
+		return e, true
+	}
+
+	return outboundEnvelope{}, false
+}
+
+// dequeue removes the head of the given partner's sub-queue, which must be the lane's
+// current one.
+func (oq *outboundQueue) dequeue(l *lane, pq *partnerQueue) outboundEnvelope {
+	e := pq.envelopes[0]
+	pq.envelopes[0] = outboundEnvelope{}
+	pq.envelopes = pq.envelopes[1:]
+	oq.removed(l, pq, l.current)
+
+	if oq.size > 0 {
+		oq.notify()
+	}
+
+	return e
+}
+
+// removed accounts for an envelope taken from the partner's sub-queue at the given index of
+// the lane's active sub-queues, retiring the sub-queue once it is empty.
+func (oq *outboundQueue) removed(l *lane, pq *partnerQueue, index int) {
+	l.size--
+	oq.size--
+	oq.partnerSizes[pq.partnerID]--
+	oq.queueSize.Add(-1.0)
+	oq.partnerQueueSize.With(partnerIDLabel, pq.partnerID).Set(float64(oq.partnerSizes[pq.partnerID]))
+	oq.laneQueueSize.With(qosLevelLabel, l.level.String()).Set(float64(l.size))
+
+	if oq.partnerSizes[pq.partnerID] == 0 {
+		delete(oq.partnerSizes, pq.partnerID)
+	}
+
+	if len(pq.envelopes) == 0 {
+		delete(l.partners, pq.partnerID)
+		l.active = append(l.active[:index], l.active[index+1:]...)
+		if index < l.current {
+			l.current--
+		}
+	}
+}
+
+// envelopeLevel is the QoS level of the message an envelope was created from.  Envelopes
+// without one, such as online and offline events, are low QoS.
+func envelopeLevel(e outboundEnvelope) wrp.QOSLevel {
+	level, _ := e.request.Context().Value(qosLevelContextKey{}).(wrp.QOSLevel)
+	if level < wrp.QOSLow || level > wrp.QOSCritical {
+		return wrp.QOSLow
+	}
+
+	return level
+}
+
+// envelopeSize is the cost of an envelope under deficit round-robin
+func envelopeSize(e outboundEnvelope) uint64 {
+	if e.request.ContentLength > 0 {
+		return uint64(e.request.ContentLength)
+	}
+
+	return 1
+}
@@ -0,0 +1,265 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/webpa-common/v2/device"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func newTestOutboundEnvelope(partnerID, body string) outboundEnvelope {
+	request := httptest.NewRequest("POST", "http://endpoint.com/"+partnerID, strings.NewReader(body))
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), partnerIDContextKey{}, partnerID))
+	return outboundEnvelope{request.WithContext(ctx), cancel}
+}
+
+// popPartners drains the given queue, returning the partner of each envelope in order
+func popPartners(oq *outboundQueue) []string {
+	var partners []string
+	for e, ok := oq.pop(); ok; e, ok = oq.pop() {
+		partners = append(partners, e.request.Context().Value(partnerIDContextKey{}).(string))
+		e.cancel()
+	}
+
+	return partners
+}
+
+func testOutboundQueueWeightedRoundRobin(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		oq, err = newOutboundQueue(NewTestOutboundMeasures(), &Outbounder{
+			FairQueue: FairQueueConfig{Weights: map[string]uint{"comcast": 2}},
+		})
+	)
+
+	require.NoError(err)
+	for i := 0; i < 4; i++ {
+		require.NoError(oq.push(newTestOutboundEnvelope("comcast", "")))
+	}
+
+	for i := 0; i < 2; i++ {
+		require.NoError(oq.push(newTestOutboundEnvelope("sky", "")))
+	}
+
+	assert.Equal(6, oq.len())
+	assert.Equal([]string{"comcast", "comcast", "sky", "comcast", "comcast", "sky"}, popPartners(oq))
+	assert.Equal(0, oq.len())
+}
+
+func testOutboundQueueDeficitRoundRobin(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		oq, err = newOutboundQueue(NewTestOutboundMeasures(), &Outbounder{
+			FairQueue: FairQueueConfig{Scheduler: DeficitRoundRobin, Quantum: 100},
+		})
+	)
+
+	require.NoError(err)
+
+	// a partner with large payloads gets far fewer turns than one with small payloads
+	for i := 0; i < 3; i++ {
+		require.NoError(oq.push(newTestOutboundEnvelope("large", strings.Repeat("x", 150))))
+	}
+
+	for i := 0; i < 4; i++ {
+		require.NoError(oq.push(newTestOutboundEnvelope("small", strings.Repeat("x", 50))))
+	}
+
+	assert.Equal([]string{"small", "small", "large", "small", "small", "large", "large"}, popPartners(oq))
+
+	_, err = newOutboundQueue(NewTestOutboundMeasures(), &Outbounder{FairQueue: FairQueueConfig{Scheduler: "unsupported"}})
+	assert.Equal(errSchedulerNotSupported, err)
+}
+
+func testOutboundQueueCapacity(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		oq, err = newOutboundQueue(NewTestOutboundMeasures(), &Outbounder{
+			OutboundQueueSize: 3,
+			FairQueue:         FairQueueConfig{PartnerQueueSize: 2},
+		})
+	)
+
+	require.NoError(err)
+	require.NoError(oq.push(newTestOutboundEnvelope("comcast", "")))
+	require.NoError(oq.push(newTestOutboundEnvelope("comcast", "")))
+	assert.Equal(ErrPartnerQueueFull, oq.push(newTestOutboundEnvelope("comcast", "")))
+
+	require.NoError(oq.push(newTestOutboundEnvelope("sky", "")))
+	assert.Equal(ErrOutboundQueueFull, oq.push(newTestOutboundEnvelope("sky", "")))
+
+	assert.Equal(3, oq.len())
+	assert.ElementsMatch([]string{"comcast", "comcast", "sky"}, popPartners(oq))
+}
+
+func testOutboundQueueShutdown(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		oq, err = newOutboundQueue(NewTestOutboundMeasures(), nil)
+	)
+
+	require.NoError(err)
+	require.NoError(oq.push(newTestOutboundEnvelope("comcast", "")))
+
+	oq.shutdown()
+	oq.shutdown()
+	assert.Equal(errOutboundQueueClosed, oq.push(newTestOutboundEnvelope("comcast", "")))
+
+	select {
+	case <-oq.done():
+	default:
+		assert.Fail("a shut down queue should signal done")
+	}
+
+	// envelopes queued before shutdown can still be popped
+	assert.Equal([]string{"comcast"}, popPartners(oq))
+}
+
+// newTestPriorityEnvelope returns an envelope whose partner is its QoS level
+func newTestPriorityEnvelope(level wrp.QOSLevel) outboundEnvelope {
+	e := newTestOutboundEnvelope(level.String(), "")
+	e.request = e.request.WithContext(context.WithValue(e.request.Context(), qosLevelContextKey{}, level))
+	return e
+}
+
+func testOutboundQueuePriority(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		oq, err = newOutboundQueue(NewTestOutboundMeasures(), &Outbounder{OutboundQueueSize: 4})
+	)
+
+	require.NoError(err)
+	for _, level := range []wrp.QOSLevel{wrp.QOSLow, wrp.QOSHigh, wrp.QOSMedium, wrp.QOSCritical} {
+		require.NoError(oq.push(newTestPriorityEnvelope(level)))
+	}
+
+	assert.Equal([]string{"Critical", "High", "Medium", "Low"}, popPartners(oq))
+}
+
+func testOutboundQueueShed(t *testing.T) {
+	var (
+		assert      = assert.New(t)
+		require     = require.New(t)
+		laneDropped = new(mockCounter)
+		om          = NewTestOutboundMeasures()
+	)
+
+	om.LaneDroppedMessages = laneDropped
+	oq, err := newOutboundQueue(om, &Outbounder{
+		OutboundQueueSize: 4,
+		Priority:          PriorityConfig{ShedRatio: 0.5},
+	})
+
+	require.NoError(err)
+	laneDropped.On("With", []string{qosLevelLabel, "Low"}).Times(3)
+	laneDropped.On("With", []string{qosLevelLabel, "Medium"}).Once()
+	laneDropped.On("Add", 1.0).Times(4)
+
+	// low QoS envelopes may only fill half of the queue
+	first, second := newTestPriorityEnvelope(wrp.QOSLow), newTestPriorityEnvelope(wrp.QOSLow)
+	require.NoError(oq.push(first))
+	require.NoError(oq.push(second))
+	assert.Equal(ErrOutboundQueueFull, oq.push(newTestPriorityEnvelope(wrp.QOSLow)))
+
+	require.NoError(oq.push(newTestPriorityEnvelope(wrp.QOSMedium)))
+	require.NoError(oq.push(newTestPriorityEnvelope(wrp.QOSMedium)))
+
+	// once full, the newest envelope of the lowest lane is evicted
+	require.NoError(oq.push(newTestPriorityEnvelope(wrp.QOSHigh)))
+	assert.NoError(first.request.Context().Err())
+	assert.Error(second.request.Context().Err())
+	assert.Equal(4, oq.len())
+
+	// nothing is evicted for an envelope of the lowest non-empty lane
+	require.NoError(oq.push(newTestPriorityEnvelope(wrp.QOSCritical)))
+	assert.Error(first.request.Context().Err())
+	assert.Equal(ErrOutboundQueueFull, oq.push(newTestPriorityEnvelope(wrp.QOSMedium)))
+
+	assert.Equal([]string{"Critical", "High", "Medium", "Medium"}, popPartners(oq))
+	laneDropped.AssertExpectations(t)
+}
+
+func testOutboundQueueEventDispatcher(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		om      = NewTestOutboundMeasures()
+		o       = &Outbounder{
+			EventEndpoints: map[string]interface{}{"default": []string{"http://endpoint1.com"}},
+			FairQueue:      FairQueueConfig{PartnerQueueSize: 1},
+		}
+
+		d        = new(device.MockDevice)
+		metadata = new(device.Metadata)
+	)
+
+	metadata.SetClaims(map[string]interface{}{device.PartnerIDClaimKey: "comcast"})
+	d.On("ID").Return(device.ID("mac:112233445566"))
+	d.On("Metadata").Return(metadata)
+
+	dispatcher, outbounds, err := NewEventDispatcher(om, o, nil, nil, nil)
+	require.NoError(err)
+
+	for i := 0; i < 2; i++ {
+		dispatcher.OnDeviceEvent(&device.Event{
+			Type:     device.MessageReceived,
+			Device:   d,
+			Message:  &wrp.Message{Destination: "event:iot"},
+			Format:   wrp.Msgpack,
+			Contents: []byte("contents"),
+		})
+	}
+
+	// the second event exceeds the partner's share of the queue
+	assert.Equal(1, outbounds.len())
+
+	wp, err := NewWorkerPool(om, o, outbounds, nil, nil, nil)
+	require.NoError(err)
+
+	e, ok := wp.next()
+	require.True(ok)
+	assert.Equal("comcast", e.request.Context().Value(partnerIDContextKey{}))
+	assert.Equal("iot", e.request.Context().Value(eventTypeContextKey{}))
+	e.cancel()
+
+	outbounds.shutdown()
+	_, ok = wp.next()
+	assert.False(ok)
+	d.AssertExpectations(t)
+}
+
+func TestOutboundQueue(t *testing.T) {
+	t.Run("WeightedRoundRobin", testOutboundQueueWeightedRoundRobin)
+	t.Run("DeficitRoundRobin", testOutboundQueueDeficitRoundRobin)
+	t.Run("Capacity", testOutboundQueueCapacity)
+	t.Run("Shutdown", testOutboundQueueShutdown)
+	t.Run("Priority", testOutboundQueuePriority)
+	t.Run("Shed", testOutboundQueueShed)
+	t.Run("EventDispatcher", testOutboundQueueEventDispatcher)
+}
@@ -0,0 +1,107 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+var errOutboundNotRunning = errors.New("Outbound is not running")
+
+// Reload applies the given configuration to the running outbound infrastructure.  The event
+// endpoints, routing rules, URL filter schemes, request method and timeout, retries, auth,
+// batching, transport, Kafka settings and worker pool size are reloaded, and the replaced
+// Kafka producers are closed.  Queue, spill and circuit breaker settings only take effect on
+// restart.  Nothing is changed if any of the reloadable settings are invalid.  Every reload
+// is logged and counted.
+func (ob *Outbound) Reload(o *Outbounder) error {
+	if ob == nil {
+		return errOutboundNotRunning
+	}
+
+	err := ob.reload(o)
+	ob.recordReload(err)
+	return err
+}
+
+func (ob *Outbound) reload(o *Outbounder) error {
+	ob.reloadLock.Lock()
+	defer ob.reloadLock.Unlock()
+
+	if o.Transport.DialContext == nil {
+		o.Transport.DialContext = ob.dialContext
+	}
+
+	// build everything before applying anything, so that a bad configuration leaves
+	// the running one untouched
+	sink, err := newOutboundSink(ob.om, o, ob.breakers)
+	if err != nil {
+		return err
+	}
+
+	if err := ob.dispatcher.configure(ob.om, o, nil); err != nil {
+		sink.Close()
+		return err
+	}
+
+	ob.workerPool.update(sink, o.workerPoolSize())
+	return nil
+}
+
+func (ob *Outbound) recordReload(err error) {
+	if err != nil {
+		ob.logger.Error("Unable to reload outbound configuration", zap.Error(err))
+		ob.om.Reloads.With(outcomeLabel, failure).Add(1.0)
+		return
+	}
+
+	workers, workerPoolSize := ob.workerPool.size()
+	ob.logger.Info("Reloaded outbound configuration", zap.Uint("workerPoolSize", workerPoolSize), zap.Uint("workers", workers))
+	ob.om.Reloads.With(outcomeLabel, success).Add(1.0)
+}
+
+// outboundReloadHandler is the control server handler that reloads the outbound
+// configuration from the configuration file
+type outboundReloadHandler struct {
+	reloader *configReloader
+}
+
+// outboundReloadResponse is the body written by outboundReloadHandler
+type outboundReloadResponse struct {
+	Reloaded bool   `json:"reloaded"`
+	Error    string `json:"error,omitempty"`
+}
+
+func (h outboundReloadHandler) ServeHTTP(response http.ResponseWriter, _ *http.Request) {
+	var (
+		status = http.StatusOK
+		body   = outboundReloadResponse{Reloaded: true}
+	)
+
+	if err := h.reloader.ReloadOutbound(); err != nil {
+		status = http.StatusBadRequest
+		body = outboundReloadResponse{Error: err.Error()}
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+	json.NewEncoder(response).Encode(body)
+}
@@ -0,0 +1,252 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/webpa-common/v2/device"
+	"github.com/xmidt-org/wrp-go/v3"
+	"go.uber.org/zap/zaptest"
+)
+
+// newReloadTestServer returns a server that reports the path of every request it receives
+func newReloadTestServer(t *testing.T) (*httptest.Server, <-chan string) {
+	paths := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, request *http.Request) {
+		paths <- request.URL.Path
+	}))
+
+	t.Cleanup(server.Close)
+	return server, paths
+}
+
+func sendReloadTestEvent(ob *Outbound) {
+	for _, l := range ob.Listeners() {
+		l(&device.Event{
+			Type:     device.MessageReceived,
+			Message:  &wrp.Message{Destination: "event:iot"},
+			Format:   wrp.Msgpack,
+			Contents: []byte("contents"),
+		})
+	}
+}
+
+func expectPath(t *testing.T, paths <-chan string, expected string) {
+	select {
+	case actual := <-paths:
+		assert.Equal(t, expected, actual)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "no request received", expected)
+	}
+}
+
+func testOutboundReload(t *testing.T) {
+	var (
+		assert        = assert.New(t)
+		require       = require.New(t)
+		server, paths = newReloadTestServer(t)
+		reloads       = new(mockCounter)
+		om            = NewTestOutboundMeasures()
+		initial       = &Outbounder{
+			Logger:         zaptest.NewLogger(t),
+			AllowedSchemes: []string{"http"},
+			DefaultScheme:  "http",
+			WorkerPoolSize: 4,
+			EventEndpoints: map[string]interface{}{"default": []string{server.URL + "/before"}},
+		}
+	)
+
+	om.Reloads = reloads
+	ob, err := initial.Start(om)
+	require.NoError(err)
+	defer ob.Shutdown()
+
+	sendReloadTestEvent(ob)
+	expectPath(t, paths, "/before")
+
+	reloads.On("With", []string{outcomeLabel, success}).Once()
+	reloads.On("Add", 1.0).Twice()
+	require.NoError(ob.Reload(&Outbounder{
+		Logger:         zaptest.NewLogger(t),
+		AllowedSchemes: []string{"http"},
+		DefaultScheme:  "http",
+		WorkerPoolSize: 1,
+		EventEndpoints: map[string]interface{}{"default": []string{server.URL + "/after"}},
+	}))
+
+	sendReloadTestEvent(ob)
+	expectPath(t, paths, "/after")
+
+	// surplus workers exit once they are woken up
+	assert.Eventually(func() bool {
+		workers, workerPoolSize := ob.workerPool.size()
+		return workers == 1 && workerPoolSize == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// an invalid configuration leaves the running one in place
+	reloads.On("With", []string{outcomeLabel, failure}).Once()
+	assert.Error(ob.Reload(&Outbounder{
+		AllowedSchemes: []string{"http"},
+		DefaultScheme:  "https",
+		EventEndpoints: map[string]interface{}{"default": []string{server.URL + "/invalid"}},
+	}))
+
+	sendReloadTestEvent(ob)
+	expectPath(t, paths, "/after")
+	reloads.AssertExpectations(t)
+
+	var nilOutbound *Outbound
+	assert.Equal(errOutboundNotRunning, nilOutbound.Reload(initial))
+}
+
+func testOutboundReloadWorkerPoolGrow(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		om      = NewTestOutboundMeasures()
+		o       = &Outbounder{WorkerPoolSize: 1}
+		oq, _   = newOutboundQueue(om, o)
+		wp, err = NewWorkerPool(om, o, oq, nil, nil, nil)
+	)
+
+	require.NoError(err)
+	sink, err := newHTTPOutboundSink(om, o, nil)
+	require.NoError(err)
+
+	// a pool that is not running does not spawn workers when resized
+	wp.update(sink, 3)
+	workers, workerPoolSize := wp.size()
+	assert.Equal(uint(0), workers)
+	assert.Equal(uint(3), workerPoolSize)
+
+	wp.Run()
+	workers, _ = wp.size()
+	assert.Equal(uint(3), workers)
+
+	wp.update(sink, 5)
+	workers, _ = wp.size()
+	assert.Equal(uint(5), workers)
+
+	oq.shutdown()
+	assert.Eventually(func() bool {
+		workers, _ := wp.size()
+		return workers == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func testOutboundReloadCloseSink(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		require  = require.New(t)
+		om       = NewTestOutboundMeasures()
+		o        = &Outbounder{}
+		oq, _    = newOutboundQueue(om, o)
+		wp, err  = NewWorkerPool(om, o, oq, nil, nil, nil)
+		previous = new(mockOutboundSink)
+		next     = new(mockOutboundSink)
+		closed   = make(chan struct{})
+	)
+
+	require.NoError(err)
+	wp.sink = &sinkGeneration{OutboundSink: previous}
+	previous.On("Close").Run(func(mock.Arguments) { close(closed) }).Return(nil).Once()
+
+	// a request still being sent through the previous sink holds off closing it
+	sending := wp.currentSink()
+	wp.update(next, 1)
+	select {
+	case <-closed:
+		assert.Fail("The previous sink was closed while a request was being sent")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	sending.sending.Done()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		assert.Fail("The previous sink was not closed")
+	}
+
+	next.On("Close").Return(nil).Once()
+	wp.closeSink()
+	previous.AssertExpectations(t)
+	next.AssertExpectations(t)
+}
+
+func testOutboundReloadFile(t *testing.T) {
+	var (
+		assert        = assert.New(t)
+		require       = require.New(t)
+		server, paths = newReloadTestServer(t)
+		file          = filepath.Join(t.TempDir(), "talaria.yaml")
+		v             = viper.New()
+	)
+
+	writeConfig := func(path string) {
+		require.NoError(os.WriteFile(file, []byte(strings.Join([]string{
+			"device:",
+			"  outbound:",
+			"    defaultScheme: http",
+			"    allowedSchemes: [http]",
+			"    eventEndpoints:",
+			"      default: " + server.URL + path,
+		}, "\n")), 0o600))
+	}
+
+	writeConfig("/before")
+	v.SetConfigFile(file)
+	require.NoError(v.ReadInConfig())
+
+	o, _, err := NewOutbounder(zaptest.NewLogger(t), v.Sub(OutbounderKey))
+	require.NoError(err)
+	ob, err := o.Start(NewTestOutboundMeasures())
+	require.NoError(err)
+	defer ob.Shutdown()
+
+	writeConfig("/after")
+	response := httptest.NewRecorder()
+	outboundReloadHandler{reloader: newConfigReloader(v, ob, nil)}.ServeHTTP(response, httptest.NewRequest("POST", reloadPath, nil))
+	assert.Equal(http.StatusOK, response.Code)
+	assert.JSONEq(`{"reloaded": true}`, response.Body.String())
+
+	sendReloadTestEvent(ob)
+	expectPath(t, paths, "/after")
+
+	require.NoError(os.WriteFile(file, []byte("device: ["), 0o600))
+	response = httptest.NewRecorder()
+	outboundReloadHandler{reloader: newConfigReloader(v, ob, nil)}.ServeHTTP(response, httptest.NewRequest("POST", reloadPath, nil))
+	assert.Equal(http.StatusBadRequest, response.Code)
+	assert.Contains(response.Body.String(), `"reloaded":false`)
+}
+
+func TestOutboundReload(t *testing.T) {
+	t.Run("Reload", testOutboundReload)
+	t.Run("WorkerPoolGrow", testOutboundReloadWorkerPoolGrow)
+	t.Run("CloseSink", testOutboundReloadCloseSink)
+	t.Run("File", testOutboundReloadFile)
+}
@@ -0,0 +1,117 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// shutdownGracePeriod is how long Shutdown waits for workers to exit once the envelopes
+// they are sending have been abandoned and cancelled, and then for the acks of those
+// envelopes to be sent
+const shutdownGracePeriod = time.Second
+
+// OutboundShutdownReport describes what happened to outbound traffic during Shutdown.
+type OutboundShutdownReport struct {
+	// Delivered is the number of envelopes sent successfully while draining.
+	Delivered int `json:"delivered"`
+
+	// Failed is the number of envelopes that could not be sent while draining.
+	Failed int `json:"failed"`
+
+	// Abandoned is the number of envelopes still queued or being sent at the deadline.
+	Abandoned int `json:"abandoned"`
+
+	// AbandonedAcks is the number of QoS acks still being sent at the deadline.
+	AbandonedAcks int `json:"abandonedAcks"`
+}
+
+// Shutdown stops accepting envelopes and waits, for at most the configured shutdownTimeout,
+// for the queued envelopes and in-flight acks to be sent.  Envelopes still queued or being
+// sent at the deadline are cancelled and reported as abandoned.  The outbound sinks are then
+// closed.  Envelopes dispatched after this method is called are spilled if a spill queue is
+// configured, and dropped otherwise.  The returned report is also logged.  This method should
+// only be called once.
+func (ob *Outbound) Shutdown() OutboundShutdownReport {
+	if ob == nil {
+		return OutboundShutdownReport{}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ob.shutdownTimeout)
+	defer cancel()
+
+	var (
+		delivered = ob.workerPool.delivered.Load()
+		failed    = ob.workerPool.failed.Load()
+		queued    = ob.workerPool.outbounds.len()
+	)
+
+	ob.logger.Info("Draining outbound queue", zap.Int("queued", queued), zap.Duration("timeout", ob.shutdownTimeout))
+	ob.workerPool.Stop()
+
+	var (
+		report OutboundShutdownReport
+		exited = true
+		acks   = ctx
+	)
+
+	if err := ob.workerPool.Wait(ctx); err != nil {
+		report.Abandoned = ob.workerPool.abandon()
+
+		grace, cancelGrace := context.WithTimeout(context.Background(), shutdownGracePeriod)
+		if err := ob.workerPool.Wait(grace); err != nil {
+			ob.logger.Warn("Outbound workers did not exit after abandoning their envelopes", zap.Error(err))
+			exited = false
+		}
+
+		cancelGrace()
+
+		// the deadline has passed, but the held acks of the abandoned envelopes are only
+		// now released, so they get a grace period of their own
+		var cancelAcks context.CancelFunc
+		acks, cancelAcks = context.WithTimeout(context.Background(), shutdownGracePeriod)
+		defer cancelAcks()
+	}
+
+	if exited {
+		ob.workerPool.closeSink()
+	} else {
+		// the sink is closed once the remaining workers are done with it
+		go ob.workerPool.closeSink()
+	}
+
+	report.AbandonedAcks = ob.acks.wait(acks)
+	report.Delivered = int(ob.workerPool.delivered.Load() - delivered)
+	report.Failed = int(ob.workerPool.failed.Load() - failed)
+
+	logger := ob.logger.Info
+	if report.Abandoned > 0 || report.AbandonedAcks > 0 {
+		logger = ob.logger.Warn
+	}
+
+	logger("Outbound shutdown complete",
+		zap.Int("delivered", report.Delivered),
+		zap.Int("failed", report.Failed),
+		zap.Int("abandoned", report.Abandoned),
+		zap.Int("abandonedAcks", report.AbandonedAcks),
+	)
+
+	return report
+}
@@ -0,0 +1,138 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func newShutdownTestOutbound(t *testing.T, url string, timeout time.Duration) *Outbound {
+	ob, err := (&Outbounder{
+		Logger:          zaptest.NewLogger(t),
+		AllowedSchemes:  []string{"http"},
+		DefaultScheme:   "http",
+		WorkerPoolSize:  1,
+		ShutdownTimeout: timeout,
+		EventEndpoints:  map[string]interface{}{"default": []string{url}},
+	}).Start(NewTestOutboundMeasures())
+
+	require.NoError(t, err)
+	return ob
+}
+
+func testOutboundShutdownDrain(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		release = make(chan struct{})
+		server  = httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			<-release
+		}))
+
+		ob = newShutdownTestOutbound(t, server.URL, 5*time.Second)
+	)
+
+	defer server.Close()
+	for i := 0; i < 3; i++ {
+		sendReloadTestEvent(ob)
+	}
+
+	// messages queued before shutdown are still delivered, but later ones are not accepted
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+
+	report := ob.Shutdown()
+	sendReloadTestEvent(ob)
+	assert.Equal(OutboundShutdownReport{Delivered: 3}, report)
+	assert.Equal(0, ob.workerPool.outbounds.len())
+}
+
+func testOutboundShutdownDeadline(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		received = make(chan struct{}, 3)
+		release  = make(chan struct{})
+		server   = httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			received <- struct{}{}
+			<-release
+		}))
+
+		ob = newShutdownTestOutbound(t, server.URL, 50*time.Millisecond)
+	)
+
+	defer server.Close()
+	defer close(release)
+	for i := 0; i < 3; i++ {
+		sendReloadTestEvent(ob)
+	}
+
+	// the single worker is stuck on the first message, so nothing else is sent in time
+	<-received
+	assert.Equal(OutboundShutdownReport{Abandoned: 3}, ob.Shutdown())
+	assert.Equal(0, ob.workerPool.outbounds.len())
+
+	// the envelope being sent is cancelled rather than left running
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.NoError(ob.workerPool.Wait(ctx))
+	assert.Equal(int64(0), ob.workerPool.failed.Load())
+
+	var nilOutbound *Outbound
+	assert.Equal(OutboundShutdownReport{}, nilOutbound.Shutdown())
+}
+
+func testOutboundShutdownDeadlineAcks(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		received = make(chan struct{}, 1)
+		release  = make(chan struct{})
+		server   = httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			received <- struct{}{}
+			<-release
+		}))
+
+		ob      = newShutdownTestOutbound(t, server.URL, 50*time.Millisecond)
+		d, rdrs = newQOSTestDevice()
+	)
+
+	defer server.Close()
+	defer close(release)
+	event := newQOSTestEvent(d, "event:iot")
+	for _, l := range ob.Listeners() {
+		l(event)
+	}
+
+	// the ack held back for the abandoned envelope is still sent once it has been cancelled
+	<-received
+	assert.Equal(OutboundShutdownReport{Abandoned: 1}, ob.Shutdown())
+	expectRDR(t, rdrs, rdrTimeout)
+}
+
+func TestOutboundShutdown(t *testing.T) {
+	t.Run("Drain", testOutboundShutdownDrain)
+	t.Run("Deadline", testOutboundShutdownDeadline)
+	t.Run("DeadlineAcks", testOutboundShutdownDeadlineAcks)
+}
@@ -0,0 +1,106 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// OutboundSink delivers outbound requests built by the event dispatcher to their destination.
+// Implementations must be safe for concurrent use by the WorkerPool's goroutines.
+type OutboundSink interface {
+	// Send delivers the given request, returning an error if delivery failed.  The request's
+	// context governs how long delivery may take.
+	Send(*http.Request) error
+
+	// Close sends anything the sink is holding back, then releases its connections.  No
+	// requests may be sent once Close has been called.
+	Close() error
+}
+
+// httpSink is the OutboundSink that POSTs requests using an HTTP transactor
+type httpSink struct {
+	logger     *zap.Logger
+	transactor func(*http.Request) (*http.Response, error)
+
+	// closeIdleConnections, if set, closes the transactor's idle connections
+	closeIdleConnections func()
+}
+
+// httpStatusError is returned by httpSink when the endpoint responds with an error status
+type httpStatusError struct {
+	status string
+}
+
+func (e httpStatusError) Error() string {
+	return fmt.Sprintf("HTTP response: %s", e.status)
+}
+
+func (s *httpSink) Send(request *http.Request) error {
+	response, err := s.transactor(request)
+	if err != nil {
+		return err
+	}
+
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+
+	if response.StatusCode >= 400 {
+		return httpStatusError{response.Status}
+	}
+
+	s.logger.Debug("HTTP response", zap.String("status", response.Status), zap.Any("url", request.URL))
+	return nil
+}
+
+func (s *httpSink) Close() error {
+	if s.closeIdleConnections != nil {
+		s.closeIdleConnections()
+	}
+
+	return nil
+}
+
+// outboundSinks routes each request to the sink registered for its URL scheme, falling
+// back to HTTP for any other scheme
+type outboundSinks struct {
+	http     OutboundSink
+	byScheme map[string]OutboundSink
+}
+
+func (s *outboundSinks) Send(request *http.Request) error {
+	if sink, ok := s.byScheme[request.URL.Scheme]; ok {
+		return sink.Send(request)
+	}
+
+	return s.http.Send(request)
+}
+
+func (s *outboundSinks) Close() error {
+	err := s.http.Close()
+	for _, sink := range s.byScheme {
+		if closeErr := sink.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
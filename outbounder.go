@@ -17,8 +17,11 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/spf13/viper"
@@ -30,6 +33,7 @@ import (
 	// nolint:staticcheck
 	"github.com/xmidt-org/webpa-common/v2/xresolver"
 	"github.com/xmidt-org/webpa-common/v2/xresolver/consul"
+	"github.com/xmidt-org/wrp-go/v3"
 )
 
 const (
@@ -56,6 +60,9 @@ const (
 	DefaultMaxIdleConns                      = 0
 	DefaultMaxIdleConnsPerHost               = 100
 	DefaultIdleConnTimeout     time.Duration = 0
+	DefaultShutdownTimeout     time.Duration = 15 * time.Second
+	DefaultAckTimeout          time.Duration = 30 * time.Second
+	DefaultMaxPendingAcks      uint          = 10000
 )
 
 // Outbounder encapsulates the configuration necessary for handling outbound traffic
@@ -63,17 +70,34 @@ const (
 type Outbounder struct {
 	Method                 string                 `json:"method"`
 	Retries                int                    `json:"retries"`
+	RetryableStatusCodes   []int                  `json:"retryableStatusCodes"`
+	Backoff                BackoffConfig          `json:"backoff"`
 	RequestTimeout         time.Duration          `json:"requestTimeout"`
 	DefaultScheme          string                 `json:"defaultScheme"`
 	AllowedSchemes         []string               `json:"allowedSchemes"`
 	EventEndpoints         map[string]interface{} `json:"eventEndpoints"`
+	Routes                 []RouteRule            `json:"routes"`
 	EnableConsulRoundRobin bool                   `json:"enableConsulRoundRobin"`
 	OutboundQueueSize      uint                   `json:"outboundQueueSize"`
+	FairQueue              FairQueueConfig        `json:"fairQueue"`
+	Priority               PriorityConfig         `json:"priority"`
+	Dedupe                 DedupeConfig           `json:"dedupe"`
 	WorkerPoolSize         uint                   `json:"workerPoolSize"`
 	Source                 string                 `json:"source"`
 	Transport              http.Transport         `json:"transport"`
 	ClientTimeout          time.Duration          `json:"clientTimeout"`
+	ShutdownTimeout        time.Duration          `json:"shutdownTimeout"`
+	AckTimeout             time.Duration          `json:"ackTimeout"`
+	MaxPendingAcks         uint                   `json:"maxPendingAcks"`
+	AckRules               []AckRule              `json:"ackRules"`
 	AuthKey                string                 `json:"authKey"`
+	Spill                  SpillConfig            `json:"spill"`
+	DeadLetter             DeadLetterConfig       `json:"deadLetter"`
+	CircuitBreaker         CircuitBreakerConfig   `json:"circuitBreaker"`
+	Kafka                  KafkaConfig            `json:"kafka"`
+	Batch                  BatchConfig            `json:"batch"`
+	Auth                   AuthConfig             `json:"auth"`
+	EndpointAuth           map[string]AuthConfig  `json:"endpointAuth"`
 	Logger                 *zap.Logger            `json:"-"`
 }
 
@@ -86,6 +110,21 @@ func NewOutbounder(logger *zap.Logger, v *viper.Viper) (o *Outbounder, watcher *
 		Logger: logger,
 	}
 
+	o, err = unmarshalOutbounder(logger, v)
+	if o.EnableConsulRoundRobin {
+		logger.Info("Using consul round robin on service discover", zap.String("service", "caduceus"))
+		for _, url := range o.EventEndpoints {
+			options.Watch[url.(string)] = "caduceus"
+		}
+		watcher = consul.NewConsulWatcher(options)
+		o.Transport.DialContext = xresolver.NewResolver(xresolver.DefaultDialer, logger.With(zap.String("component", "xresolver")), watcher).DialContext
+	}
+	return
+}
+
+// unmarshalOutbounder returns the default Outbounder overlaid with the given Viper
+// environment, which may be nil.
+func unmarshalOutbounder(logger *zap.Logger, v *viper.Viper) (o *Outbounder, err error) {
 	o = &Outbounder{
 		Method:            DefaultMethod,
 		RequestTimeout:    DefaultRequestTimeout,
@@ -105,14 +144,7 @@ func NewOutbounder(logger *zap.Logger, v *viper.Viper) (o *Outbounder, watcher *
 	if v != nil {
 		err = v.Unmarshal(o)
 	}
-	if o.EnableConsulRoundRobin {
-		logger.Info("Using consul round robin on service discover", zap.String("service", "caduceus"))
-		for _, url := range o.EventEndpoints {
-			options.Watch[url.(string)] = "caduceus"
-		}
-		watcher = consul.NewConsulWatcher(options)
-		o.Transport.DialContext = xresolver.NewResolver(xresolver.DefaultDialer, logger.With(zap.String("component", "xresolver")), watcher).DialContext
-	}
+
 	return
 }
 
@@ -150,6 +182,65 @@ func (o *Outbounder) retries() int {
 	return DefaultRetries
 }
 
+func (o *Outbounder) retryableStatusCodes() map[int]bool {
+	retryable := make(map[int]bool)
+	if o != nil {
+		for _, code := range o.RetryableStatusCodes {
+			retryable[code] = true
+		}
+	}
+
+	return retryable
+}
+
+func (o *Outbounder) backoffInitialInterval() time.Duration {
+	if o != nil && o.Backoff.InitialInterval > 0 {
+		return o.Backoff.InitialInterval
+	}
+
+	return 0
+}
+
+func (o *Outbounder) backoffMultiplier() float64 {
+	if o != nil && o.Backoff.Multiplier >= 1 {
+		return o.Backoff.Multiplier
+	}
+
+	return DefaultBackoffMultiplier
+}
+
+func (o *Outbounder) backoffMaxInterval() time.Duration {
+	if o != nil && o.Backoff.MaxInterval > 0 {
+		return o.Backoff.MaxInterval
+	}
+
+	return DefaultBackoffMaxInterval
+}
+
+func (o *Outbounder) backoffJitter() string {
+	if o != nil && len(o.Backoff.Jitter) > 0 {
+		return o.Backoff.Jitter
+	}
+
+	return DefaultBackoffJitter
+}
+
+func (o *Outbounder) backoffObeyRetryAfter() bool {
+	if o != nil {
+		return o.Backoff.ObeyRetryAfter
+	}
+
+	return false
+}
+
+func (o *Outbounder) backoffMaxRetryAfter() time.Duration {
+	if o != nil && o.Backoff.MaxRetryAfter > 0 {
+		return o.Backoff.MaxRetryAfter
+	}
+
+	return DefaultBackoffMaxRetryAfter
+}
+
 func (o *Outbounder) requestTimeout() time.Duration {
 	if o != nil && o.RequestTimeout > 0 {
 		return o.RequestTimeout
@@ -197,6 +288,75 @@ func (o *Outbounder) outboundQueueSize() uint {
 	return DefaultOutboundQueueSize
 }
 
+func (o *Outbounder) fairQueueScheduler() string {
+	if o != nil && len(o.FairQueue.Scheduler) > 0 {
+		return o.FairQueue.Scheduler
+	}
+
+	return DefaultScheduler
+}
+
+func (o *Outbounder) partnerQueueSize() uint {
+	if o != nil && o.FairQueue.PartnerQueueSize > 0 {
+		return o.FairQueue.PartnerQueueSize
+	}
+
+	return o.outboundQueueSize()
+}
+
+func (o *Outbounder) fairQueueDefaultWeight() uint {
+	if o != nil && o.FairQueue.DefaultWeight > 0 {
+		return o.FairQueue.DefaultWeight
+	}
+
+	return DefaultPartnerWeight
+}
+
+func (o *Outbounder) fairQueueWeights() map[string]uint {
+	weights := make(map[string]uint)
+	if o != nil {
+		for partnerID, weight := range o.FairQueue.Weights {
+			if weight > 0 {
+				weights[partnerID] = weight
+			}
+		}
+	}
+
+	return weights
+}
+
+func (o *Outbounder) fairQueueQuantum() uint64 {
+	if o != nil && o.FairQueue.Quantum > 0 {
+		return o.FairQueue.Quantum
+	}
+
+	return DefaultDeficitQuantum
+}
+
+func (o *Outbounder) priorityShedRatio() float64 {
+	if o != nil && o.Priority.ShedRatio > 0 && o.Priority.ShedRatio <= 1 {
+		return o.Priority.ShedRatio
+	}
+
+	return DefaultPriorityShedRatio
+}
+
+func (o *Outbounder) priorityExtraRetries() int {
+	if o != nil && o.Priority.ExtraRetries > 0 {
+		return o.Priority.ExtraRetries
+	}
+
+	return DefaultPriorityExtraRetries
+}
+
+func (o *Outbounder) dedupeTTL() time.Duration {
+	if o != nil && o.Dedupe.TTL > 0 {
+		return o.Dedupe.TTL
+	}
+
+	return DefaultDedupeTTL
+}
+
 func (o *Outbounder) source() string {
 	if o != nil && len(o.Source) > 0 {
 		return o.Source
@@ -241,6 +401,14 @@ func (o *Outbounder) transport() *http.Transport {
 	}
 }
 
+func (o *Outbounder) routes() []RouteRule {
+	if o != nil {
+		return o.Routes
+	}
+
+	return nil
+}
+
 func (o *Outbounder) authKey() string {
 	if o != nil {
 		return o.AuthKey
@@ -249,6 +417,166 @@ func (o *Outbounder) authKey() string {
 	return ""
 }
 
+func (o *Outbounder) auth() AuthConfig {
+	if o != nil {
+		return o.Auth
+	}
+
+	return AuthConfig{}
+}
+
+func (o *Outbounder) endpointAuth() map[string]AuthConfig {
+	if o != nil {
+		return o.EndpointAuth
+	}
+
+	return nil
+}
+
+func (o *Outbounder) spillMaxSegmentSize() int64 {
+	if o != nil && o.Spill.MaxSegmentSize > 0 {
+		return o.Spill.MaxSegmentSize
+	}
+
+	return DefaultSpillMaxSegmentSize
+}
+
+func (o *Outbounder) spillMaxSize() int64 {
+	if o != nil && o.Spill.MaxSize > 0 {
+		return o.Spill.MaxSize
+	}
+
+	return DefaultSpillMaxSize
+}
+
+func (o *Outbounder) spillMaxAge() time.Duration {
+	if o != nil && o.Spill.MaxAge > 0 {
+		return o.Spill.MaxAge
+	}
+
+	return DefaultSpillMaxAge
+}
+
+func (o *Outbounder) circuitBreakerMinRequests() uint {
+	if o != nil && o.CircuitBreaker.MinRequests > 0 {
+		return o.CircuitBreaker.MinRequests
+	}
+
+	return DefaultCircuitBreakerMinRequests
+}
+
+func (o *Outbounder) circuitBreakerWindow() time.Duration {
+	if o != nil && o.CircuitBreaker.Window > 0 {
+		return o.CircuitBreaker.Window
+	}
+
+	return DefaultCircuitBreakerWindow
+}
+
+func (o *Outbounder) circuitBreakerCoolDown() time.Duration {
+	if o != nil && o.CircuitBreaker.CoolDown > 0 {
+		return o.CircuitBreaker.CoolDown
+	}
+
+	return DefaultCircuitBreakerCoolDown
+}
+
+func (o *Outbounder) circuitBreakerHalfOpenRequests() uint {
+	if o != nil && o.CircuitBreaker.HalfOpenRequests > 0 {
+		return o.CircuitBreaker.HalfOpenRequests
+	}
+
+	return DefaultCircuitBreakerHalfOpenRequests
+}
+
+func (o *Outbounder) kafkaClientID() string {
+	if o != nil && len(o.Kafka.ClientID) > 0 {
+		return o.Kafka.ClientID
+	}
+
+	return DefaultKafkaClientID
+}
+
+func (o *Outbounder) kafkaAcks() string {
+	if o != nil && len(o.Kafka.Acks) > 0 {
+		return o.Kafka.Acks
+	}
+
+	return DefaultKafkaAcks
+}
+
+func (o *Outbounder) kafkaBatchSize() int {
+	if o != nil && o.Kafka.BatchSize > 0 {
+		return o.Kafka.BatchSize
+	}
+
+	return DefaultKafkaBatchSize
+}
+
+func (o *Outbounder) kafkaBatchBytes() int {
+	if o != nil && o.Kafka.BatchBytes > 0 {
+		return o.Kafka.BatchBytes
+	}
+
+	return DefaultKafkaBatchBytes
+}
+
+func (o *Outbounder) kafkaLinger() time.Duration {
+	if o != nil && o.Kafka.Linger > 0 {
+		return o.Kafka.Linger
+	}
+
+	return DefaultKafkaLinger
+}
+
+func (o *Outbounder) kafkaTimeout() time.Duration {
+	if o != nil && o.Kafka.Timeout > 0 {
+		return o.Kafka.Timeout
+	}
+
+	return DefaultKafkaTimeout
+}
+
+func (o *Outbounder) batchMaxCount() int {
+	if o != nil {
+		return o.Batch.MaxCount
+	}
+
+	return 0
+}
+
+func (o *Outbounder) batchMaxBytes() int {
+	if o != nil && o.Batch.MaxBytes > 0 {
+		return o.Batch.MaxBytes
+	}
+
+	return DefaultBatchMaxBytes
+}
+
+func (o *Outbounder) batchLinger() time.Duration {
+	if o != nil && o.Batch.Linger > 0 {
+		return o.Batch.Linger
+	}
+
+	return DefaultBatchLinger
+}
+
+func (o *Outbounder) batchContentType() string {
+	if o != nil && len(o.Batch.ContentType) > 0 {
+		return o.Batch.ContentType
+	}
+
+	return DefaultBatchContentType
+}
+
+func (o *Outbounder) batchContentTypes() map[string]string {
+	if o != nil {
+		return o.Batch.ContentTypes
+	}
+
+	return nil
+}
+
 func (o *Outbounder) clientTimeout() time.Duration {
 	if o != nil && o.ClientTimeout > 0 {
 		return o.ClientTimeout
@@ -257,24 +585,133 @@ func (o *Outbounder) clientTimeout() time.Duration {
 	return DefaultClientTimeout
 }
 
-// Start spawns all necessary goroutines and returns a device.Listener
-func (o *Outbounder) Start(om OutboundMeasures) ([]device.Listener, error) {
+func (o *Outbounder) shutdownTimeout() time.Duration {
+	if o != nil && o.ShutdownTimeout > 0 {
+		return o.ShutdownTimeout
+	}
+
+	return DefaultShutdownTimeout
+}
+
+func (o *Outbounder) ackTimeout() time.Duration {
+	if o != nil && o.AckTimeout > 0 {
+		return o.AckTimeout
+	}
+
+	return DefaultAckTimeout
+}
+
+func (o *Outbounder) maxPendingAcks() uint {
+	if o != nil && o.MaxPendingAcks > 0 {
+		return o.MaxPendingAcks
+	}
+
+	return DefaultMaxPendingAcks
+}
+
+// Outbound is the running outbound infrastructure created by Outbounder.Start.
+type Outbound struct {
+	logger      *zap.Logger
+	om          OutboundMeasures
+	listeners   []device.Listener
+	breakers    *circuitBreakers
+	dispatcher  *eventDispatcher
+	workerPool  *WorkerPool
+	acks        *ackDispatcher
+	deadLetters *deadLetterStore
+
+	shutdownTimeout time.Duration
+
+	// reloadLock serializes reloads.  dialContext is carried over from the original
+	// Outbounder, since it may resolve endpoints through consul.
+	reloadLock  sync.Mutex
+	dialContext func(context.Context, string, string) (net.Conn, error)
+}
+
+// Listeners returns the device.Listener functions that feed outbound traffic.
+func (ob *Outbound) Listeners() []device.Listener {
+	if ob != nil {
+		return ob.listeners
+	}
+
+	return nil
+}
+
+// sendEvent dispatches a WRP event that talaria itself generates to the endpoints
+// configured for the given event type.  The message's source and destination are set
+// by the event dispatcher.
+func (ob *Outbound) sendEvent(eventType string, message *wrp.Message) error {
+	if ob == nil {
+		return errOutboundNotRunning
+	}
+
+	return ob.dispatcher.sendEvent(eventType, message)
+}
+
+// Filter applies the URL filter of the current outbound configuration, which makes the
+// Outbound a URLFilter for URLs given by API callers
+func (ob *Outbound) Filter(u string) (string, error) {
+	if ob == nil {
+		return "", errOutboundNotRunning
+	}
+
+	return ob.dispatcher.filterURL(u)
+}
+
+// circuitBreakers returns the outbound circuit breakers, which will be nil if
+// circuit breaking is not configured.
+func (ob *Outbound) circuitBreakers() *circuitBreakers {
+	if ob != nil {
+		return ob.breakers
+	}
+
+	return nil
+}
+
+// Start spawns all necessary goroutines and returns the running Outbound infrastructure
+func (o *Outbounder) Start(om OutboundMeasures) (*Outbound, error) {
 	logger := o.logger()
 	logger.Info("Starting outbounder")
-	eventDispatcher, outbounds, err := NewEventDispatcher(om, o, nil)
+	spill, err := NewSpillQueue(om, o)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := newDeliveryTracker(o)
+	dispatcher, outbounds, err := NewEventDispatcher(om, o, nil, spill, deliveries)
+	if err != nil {
+		return nil, err
+	}
+
+	deadLetters, err := newDeadLetterStore(om, o)
+	if err != nil {
+		return nil, err
+	}
+
+	breakers := NewCircuitBreakers(om, o)
+	workerPool, err := NewWorkerPool(om, o, outbounds, spill, breakers, deadLetters)
 	if err != nil {
 		return nil, err
 	}
 
-	workerPool := NewWorkerPool(om, o, outbounds)
 	workerPool.Run()
 
-	ackDispatcher, err := NewAckDispatcher(om, o)
-	// Atm, NewAckDispatcher only returns nil err since there are no
-	// error triggering conditions in NewAckDispatcher
+	acks, err := NewAckDispatcher(om, o, deliveries)
 	if err != nil {
 		return nil, err
 	}
 
-	return []device.Listener{eventDispatcher.OnDeviceEvent, ackDispatcher.OnDeviceEvent}, nil
+	return &Outbound{
+		logger:      logger,
+		om:          om,
+		listeners:   []device.Listener{dispatcher.OnDeviceEvent, acks.OnDeviceEvent},
+		breakers:    breakers,
+		dispatcher:  dispatcher.(*eventDispatcher),
+		workerPool:  workerPool,
+		acks:        acks.(*ackDispatcher),
+		deadLetters: deadLetters,
+		dialContext: o.Transport.DialContext,
+
+		shutdownTimeout: o.shutdownTimeout(),
+	}, nil
 }
@@ -87,7 +87,7 @@ func ExampleOutbounder() {
 		return
 	}
 
-	listeners, err := o.Start(NewOutboundMeasures(metricsRegistry))
+	outbound, err := o.Start(NewOutboundMeasures(metricsRegistry))
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -95,7 +95,7 @@ func ExampleOutbounder() {
 
 	finish.Add(2)
 
-	for _, l := range listeners {
+	for _, l := range outbound.Listeners() {
 		l(&device.Event{
 			Type:     device.MessageReceived,
 			Message:  &wrp.Message{Destination: "event:iot"},
@@ -221,10 +221,10 @@ func testOutbounderStartError(t *testing.T) {
 			DefaultScheme: "ftp",
 		}
 
-		listener, err = badOutbounder.Start(OutboundMeasures{})
+		outbound, err = badOutbounder.Start(OutboundMeasures{})
 	)
 
-	assert.Nil(listener)
+	assert.Nil(outbound)
 	assert.Error(err)
 }
 
@@ -90,6 +90,18 @@ const (
 	// requests inbound to devices connected to talaria.
 	InboundTimeoutConfigKey = "inbound.timeout"
 
+	// InboundRateLimitConfigKey is the path to the rate limits applied to messages
+	// sent to devices through /device/send.
+	InboundRateLimitConfigKey = "inbound.rateLimit"
+
+	// InboundMulticastConfigKey is the path to the bounds on requests that send a
+	// message to many devices through /device/multicast.
+	InboundMulticastConfigKey = "inbound.multicast"
+
+	// InboundAsyncConfigKey is the path to the bounds on the results kept for asynchronous
+	// requests to /device/send.
+	InboundAsyncConfigKey = "inbound.async"
+
 	// RehasherServicesConfigKey is the path to the services for whose events talaria's
 	// rehasher should listen to.
 	RehasherServicesConfigKey = "device.rehasher.services"
@@ -138,7 +150,7 @@ func buildUserPassMap(logger *zap.Logger, encodedBasicAuthKeys []string) (userPa
 }
 
 func NewPrimaryHandler(logger *zap.Logger, manager device.Manager, v *viper.Viper, a service.Accessor, e service.Environment,
-	controlConstructor alice.Constructor, metricsRegistry xmetrics.Registry, r *mux.Router) (http.Handler, error) {
+	controlConstructor alice.Constructor, metricsRegistry xmetrics.Registry, r *mux.Router, deviceAccessCheck *talariaDeviceAccess, callbackFilter URLFilter) (http.Handler, error) {
 	var (
 		inboundTimeout = getInboundTimeout(v)
 		apiHandler     = r.PathPrefix(fmt.Sprintf("%s/{version:%s|%s}", baseURI, v2, version)).Subrouter()
@@ -241,23 +253,32 @@ func NewPrimaryHandler(logger *zap.Logger, manager device.Manager, v *viper.Vipe
 
 	wrpRouterHandler := wrpRouterHandler(logger, manager, getLogger)
 
-	if v.IsSet(DeviceAccessCheckConfigKey) {
-		config := new(deviceAccessCheckConfig)
-
-		if err := v.UnmarshalKey(DeviceAccessCheckConfigKey, config); err != nil {
-			logger.Error("Could not unmarshall wrpCheck config for api access to device.")
-			return nil, err
-		}
+	asyncResults, err := newAsyncResults(logger, v, metricsRegistry, callbackFilter, inboundTimeout)
+	if err != nil {
+		logger.Error("Could not unmarshall async config for api access to device.", zap.Error(err))
+		return nil, err
+	}
 
-		deviceAccessCheck, err := buildDeviceAccessCheck(config, logger, metricsRegistry.NewCounter(InboundWRPMessageCounter), manager)
-		if err != nil {
-			return nil, err
-		}
+	// requests run in the background only once they have passed the device access checks
+	// and rate limits
+	wrpRouterHandler = withAsync(logger, wrpRouterHandler, asyncResults)
 
+	if deviceAccessCheck != nil {
 		logger.Info("Enabling Device Access Validator.")
 		wrpRouterHandler = withDeviceAccessCheck(logger, wrpRouterHandler, deviceAccessCheck)
 	}
 
+	rateLimiter, err := newRateLimiter(v, metricsRegistry)
+	if err != nil {
+		logger.Error("Could not unmarshall rate limit config for api access to device.", zap.Error(err))
+		return nil, err
+	}
+
+	if rateLimiter != nil {
+		logger.Info("Enabling Device Request Rate Limits.")
+		wrpRouterHandler = withRateLimit(logger, wrpRouterHandler, rateLimiter)
+	}
+
 	authConstructor = basculehttp.NewConstructor(authConstructorOptions...)
 	authConstructorLegacy := basculehttp.NewConstructor(append([]basculehttp.COption{
 		basculehttp.WithCErrorHTTPResponseFunc(basculehttp.LegacyOnErrorHTTPResponse),
@@ -295,12 +316,48 @@ func NewPrimaryHandler(logger *zap.Logger, manager device.Manager, v *viper.Vipe
 			Then(wrphttp.NewHTTPHandler(wrpRouterHandler)),
 	).Methods("POST", "PATCH")
 
+	apiHandler.Handle("/device/send/{transactionID}",
+		versionCompatibleAuth.Then(asyncResultHandler{results: asyncResults}),
+	).Methods("GET")
+
+	multicastConfig, err := newMulticastConfig(v)
+	if err != nil {
+		logger.Error("Could not unmarshall multicast config for api access to devices.", zap.Error(err))
+		return nil, err
+	}
+
+	multicast := &multicastHandler{
+		logger:   logger,
+		router:   manager,
+		registry: manager,
+		counter:  metricsRegistry.NewCounter(MulticastMessageCounter),
+		timeout:  inboundTimeout,
+		config:   multicastConfig,
+		limiter:  rateLimiter,
+	}
+
+	if deviceAccessCheck != nil {
+		multicast.access = deviceAccessCheck
+	}
+
+	// the inbound timeout is applied by the handler rather than xtimeout, which buffers
+	// the response and so would prevent results from being streamed
+	apiHandler.Handle("/device/multicast",
+		versionCompatibleAuth.Then(multicast),
+	).Methods("POST")
+
 	apiHandler.Handle("/devices",
 		versionCompatibleAuth.Then(&device.ListHandler{
 			Logger:   logger,
 			Registry: manager,
 		})).Methods("GET")
 
+	apiHandler.Handle("/devices/query",
+		versionCompatibleAuth.Then(deviceQueryHandler{
+			logger:   logger,
+			registry: manager,
+		})).Methods("GET")
+
 	var (
 		// the basic decorator chain all device connect handlers use
 		deviceConnectChain = alice.New(
@@ -358,39 +415,17 @@ func NewPrimaryHandler(logger *zap.Logger, manager device.Manager, v *viper.Vipe
 	return r, nil
 }
 
-func buildDeviceAccessCheck(config *deviceAccessCheckConfig, logger *zap.Logger, counter metrics.Counter, deviceRegistry device.Registry) (deviceAccess, error) {
-
-	if len(config.Checks) < 1 {
-		logger.Error("Potential security misconfig. Include checks for deviceAccessCheck or disable it")
-		return nil, errors.New("failed enabling DeviceAccessCheck")
-	}
-
-	if config.Type != "enforce" && config.Type != "monitor" {
-		logger.Error("Unexpected type for deviceAccessCheck. Supported types are 'monitor' and 'enforce'")
-		return nil, errors.New("failed verifying DeviceAccessCheck type")
-	}
-
-	// nolint:prealloc
-	var parsedChecks []*parsedCheck
-	for _, check := range config.Checks {
-		parsedCheck, err := parseDeviceAccessCheck(check)
-		if err != nil {
-			logger.Error("deviceAccesscheck parse failure", zap.Error(err))
-			return nil, errors.New("failed parsing DeviceAccessCheck checks")
-		}
-		parsedChecks = append(parsedChecks, parsedCheck)
+func buildDeviceAccessCheck(config *deviceAccessCheckConfig, logger *zap.Logger, counter metrics.Counter, deviceRegistry device.Registry, events eventSender) (*talariaDeviceAccess, error) {
+	t := &talariaDeviceAccess{
+		wrpMessagesCounter: counter,
+		deviceRegistry:     deviceRegistry,
+		logger:             logger,
+		events:             events,
 	}
 
-	if config.Sep == "" {
-		config.Sep = "."
+	if err := t.configure(config); err != nil {
+		return nil, err
 	}
 
-	return &talariaDeviceAccess{
-		strict:             config.Type == "enforce",
-		wrpMessagesCounter: counter,
-		checks:             parsedChecks,
-		deviceRegistry:     deviceRegistry,
-		logger:             logger,
-		sep:                config.Sep,
-	}, nil
+	return t, nil
 }
@@ -0,0 +1,283 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/spf13/viper"
+	"github.com/xmidt-org/webpa-common/v2/device"
+	"go.uber.org/zap"
+
+	// nolint:staticcheck
+	"github.com/xmidt-org/webpa-common/v2/xhttp"
+	"github.com/xmidt-org/webpa-common/v2/xmetrics"
+	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/wrp-go/v3/wrphttp"
+)
+
+// Kinds of rate limit, which are the values of the limit label
+const (
+	principalLimit = "principal"
+	partnerLimit   = "partner"
+	deviceLimit    = "device"
+)
+
+// rateLimitSweepInterval is how often buckets that have refilled are forgotten
+const rateLimitSweepInterval = time.Minute
+
+// RateLimit is a token bucket limit on the messages sent through /device/send
+type RateLimit struct {
+	// Rate is the number of messages per second allowed on average.  The limit is disabled
+	// unless this is positive.
+	Rate float64
+
+	// Burst is the number of messages that may be sent at once.
+	// (Optional. Defaults to Rate rounded up).
+	Burst int
+}
+
+func (rl RateLimit) burst() float64 {
+	if rl.Burst > 0 {
+		return float64(rl.Burst)
+	}
+
+	return math.Max(1.0, math.Ceil(rl.Rate))
+}
+
+// PrincipalRateLimit overrides the Principal limit for one principal.  An override without
+// a positive Rate exempts the principal from rate limiting.
+type PrincipalRateLimit struct {
+	// Principal is the principal the limit applies to, as authenticated by bascule.
+	Principal string
+
+	// Rate and Burst are as for RateLimit.
+	Rate  float64
+	Burst int
+}
+
+// RateLimitConfig describes the rate limits applied to messages sent through /device/send.
+// A message must be within every limit that applies to it.
+type RateLimitConfig struct {
+	// Principal limits the messages each authenticated caller may send.
+	Principal RateLimit
+
+	// Principals overrides the Principal limit for specific callers.
+	Principals []PrincipalRateLimit
+
+	// Partner limits the messages sent by callers whose token claims each partner ID.  The
+	// partner IDs carried by the message itself are not considered, since the caller is
+	// free to set them.
+	Partner RateLimit
+
+	// Device limits the messages sent to each device.
+	Device RateLimit
+}
+
+// tokenBucket is the state of a single rate limit key
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// tokenBuckets are the buckets of one kind of rate limit, keyed by principal, partner
+// ID or device ID
+type tokenBuckets struct {
+	kind      string
+	limit     RateLimit
+	overrides map[string]RateLimit
+	buckets   map[string]*tokenBucket
+}
+
+func newTokenBuckets(kind string, limit RateLimit) *tokenBuckets {
+	return &tokenBuckets{
+		kind:    kind,
+		limit:   limit,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+func (tb *tokenBuckets) limitFor(key string) RateLimit {
+	if limit, ok := tb.overrides[key]; ok {
+		return limit
+	}
+
+	return tb.limit
+}
+
+// refill returns the key's bucket with the tokens added since it was last used, or nil
+// if the key is not limited
+func (tb *tokenBuckets) refill(key string, now time.Time) (*tokenBucket, RateLimit) {
+	limit := tb.limitFor(key)
+	if limit.Rate <= 0 {
+		return nil, limit
+	}
+
+	b, ok := tb.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: limit.burst(), last: now}
+		tb.buckets[key] = b
+		return b, limit
+	}
+
+	b.tokens = math.Min(limit.burst(), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	return b, limit
+}
+
+// sweep forgets the buckets that have refilled, which behave as new ones would
+func (tb *tokenBuckets) sweep(now time.Time) {
+	for key, b := range tb.buckets {
+		limit := tb.limitFor(key)
+		if b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= limit.burst() {
+			delete(tb.buckets, key)
+		}
+	}
+}
+
+// rateLimiter applies the RateLimitConfig to messages sent through /device/send
+type rateLimiter struct {
+	rejections metrics.Counter
+	now        func() time.Time
+
+	lock      sync.Mutex
+	kinds     []*tokenBuckets
+	lastSweep time.Time
+}
+
+// newRateLimiter creates the rateLimiter described by the Viper environment, returning
+// nil if rate limiting is not configured
+func newRateLimiter(v *viper.Viper, registry xmetrics.Registry) (*rateLimiter, error) {
+	if !v.IsSet(InboundRateLimitConfigKey) {
+		return nil, nil
+	}
+
+	var config RateLimitConfig
+	if err := v.UnmarshalKey(InboundRateLimitConfigKey, &config); err != nil {
+		return nil, err
+	}
+
+	principals := newTokenBuckets(principalLimit, config.Principal)
+	for _, o := range config.Principals {
+		if len(o.Principal) == 0 {
+			return nil, fmt.Errorf("a principal is required for each of the %s principal rate limits", InboundRateLimitConfigKey)
+		}
+
+		if principals.overrides == nil {
+			principals.overrides = make(map[string]RateLimit, len(config.Principals))
+		}
+
+		principals.overrides[o.Principal] = RateLimit{Rate: o.Rate, Burst: o.Burst}
+	}
+
+	return &rateLimiter{
+		rejections: registry.NewCounter(RateLimitedRequestCounter),
+		now:        time.Now,
+		kinds: []*tokenBuckets{
+			principals,
+			newTokenBuckets(partnerLimit, config.Partner),
+			newTokenBuckets(deviceLimit, config.Device),
+		},
+	}, nil
+}
+
+// allow takes a token for each of the keys from the buckets of the same kind, in the
+// order of rateLimiter.kinds.  An empty key is not limited.  Either every token is taken,
+// or none are and the kind of limit exceeded is returned along with how long until a
+// token is available.
+func (rl *rateLimiter) allow(keys []string) (string, time.Duration, bool) {
+	now := rl.now()
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	if now.Sub(rl.lastSweep) >= rateLimitSweepInterval {
+		for _, tb := range rl.kinds {
+			tb.sweep(now)
+		}
+
+		rl.lastSweep = now
+	}
+
+	var taken []*tokenBucket
+	for i, tb := range rl.kinds {
+		if len(keys[i]) == 0 {
+			continue
+		}
+
+		b, limit := tb.refill(keys[i], now)
+		if b == nil {
+			continue
+		}
+
+		if b.tokens < 1.0 {
+			return tb.kind, time.Duration((1.0 - b.tokens) / limit.Rate * float64(time.Second)), false
+		}
+
+		taken = append(taken, b)
+	}
+
+	for _, b := range taken {
+		b.tokens--
+	}
+
+	return "", 0, true
+}
+
+// withRateLimit rejects messages sent through /device/send that exceed the rate limits,
+// with a 429 and a Retry-After header
+func withRateLimit(errorLogger *zap.Logger, next wrphttp.HandlerFunc, rl *rateLimiter) wrphttp.HandlerFunc {
+	return func(w wrphttp.ResponseWriter, r *wrphttp.Request) {
+		kind, wait, ok := rl.allowMessage(r.Context(), &r.Entity.Message)
+		if !ok {
+			errorLogger.Debug("Rate limited device request", zap.String("limit", kind), zap.Duration("retryAfter", wait))
+
+			// Retry-After is in whole seconds, rounded up so that a retry is not rejected again
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			xhttp.WriteErrorf(w, http.StatusTooManyRequests, "Too many requests: %s rate limit exceeded", kind)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// allowMessage applies allow to the caller's principal and token partner ID and to the
+// destination of a message sent to a device, counting the message if it is rejected
+func (rl *rateLimiter) allowMessage(ctx context.Context, message *wrp.Message) (string, time.Duration, bool) {
+	var (
+		partnerID = tokenPartnerID(ctx)
+		deviceID  string
+	)
+
+	if id, err := device.ParseID(message.Destination); err == nil {
+		deviceID = string(id)
+	}
+
+	kind, wait, ok := rl.allow([]string{principal(ctx), partnerID, deviceID})
+	if !ok {
+		rl.rejections.With(limitLabel, kind, partnerIDLabel, partnerID).Add(1.0)
+	}
+
+	return kind, wait, ok
+}
@@ -0,0 +1,242 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/bascule"
+	"github.com/xmidt-org/webpa-common/v2/xmetrics"
+	"go.uber.org/zap/zaptest"
+
+	// nolint:staticcheck
+	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/wrp-go/v3/wrphttp"
+)
+
+// newTestRateLimiter returns a rateLimiter whose clock only moves when the returned
+// function is called
+func newTestRateLimiter(config RateLimitConfig) (*rateLimiter, *testCounter, func(time.Duration)) {
+	var (
+		now       = time.Unix(1600000000, 0)
+		counter   = newTestCounter()
+		limiter   = &rateLimiter{rejections: counter, now: func() time.Time { return now }, lastSweep: now}
+		advance   = func(d time.Duration) { now = now.Add(d) }
+		overrides map[string]RateLimit
+	)
+
+	for _, o := range config.Principals {
+		if overrides == nil {
+			overrides = make(map[string]RateLimit)
+		}
+
+		overrides[o.Principal] = RateLimit{Rate: o.Rate, Burst: o.Burst}
+	}
+
+	principals := newTokenBuckets(principalLimit, config.Principal)
+	principals.overrides = overrides
+	limiter.kinds = []*tokenBuckets{
+		principals,
+		newTokenBuckets(partnerLimit, config.Partner),
+		newTokenBuckets(deviceLimit, config.Device),
+	}
+
+	return limiter, counter, advance
+}
+
+func testRateLimiterAllow(t *testing.T) {
+	var (
+		assert              = assert.New(t)
+		limiter, _, advance = newTestRateLimiter(RateLimitConfig{
+			Principal:  RateLimit{Rate: 2, Burst: 3},
+			Principals: []PrincipalRateLimit{{Principal: "exempt"}, {Principal: "big", Rate: 100}},
+			Device:     RateLimit{Rate: 0.5},
+		})
+	)
+
+	keys := func(principal, deviceID string) []string {
+		return []string{principal, "", deviceID}
+	}
+
+	for i := 0; i < 3; i++ {
+		_, _, ok := limiter.allow(keys("caller", ""))
+		assert.True(ok)
+	}
+
+	kind, wait, ok := limiter.allow(keys("caller", ""))
+	assert.False(ok)
+	assert.Equal(principalLimit, kind)
+	assert.Equal(500*time.Millisecond, wait)
+
+	advance(500 * time.Millisecond)
+	_, _, ok = limiter.allow(keys("caller", ""))
+	assert.True(ok)
+
+	// a burst defaults to the rate, which is at least one message
+	_, _, ok = limiter.allow(keys("big", "mac:112233445566"))
+	assert.True(ok)
+	kind, wait, ok = limiter.allow(keys("big", "mac:112233445566"))
+	assert.False(ok)
+	assert.Equal(deviceLimit, kind)
+	assert.Equal(2*time.Second, wait)
+
+	// no tokens are taken from the principal's bucket when the device's is empty
+	for i := 0; i < 200; i++ {
+		_, _, ok = limiter.allow(keys("exempt", ""))
+		assert.True(ok)
+	}
+
+	for i := 0; i < 50; i++ {
+		limiter.allow(keys("big", "mac:112233445566"))
+	}
+
+	_, _, ok = limiter.allow(keys("big", "mac:665544332211"))
+	assert.True(ok)
+	assert.Len(limiter.kinds[0].buckets, 2)
+
+	// refilled buckets are forgotten
+	advance(rateLimitSweepInterval)
+	_, _, ok = limiter.allow(keys("caller", ""))
+	assert.True(ok)
+	assert.Len(limiter.kinds[0].buckets, 1)
+	assert.Empty(limiter.kinds[2].buckets)
+}
+
+func testWithRateLimit(t *testing.T) {
+	var (
+		assert              = assert.New(t)
+		limiter, counter, _ = newTestRateLimiter(RateLimitConfig{Partner: RateLimit{Rate: 1}})
+		routed              int
+		wrpRouterHandler    = func(w wrphttp.ResponseWriter, _ *wrphttp.Request) { routed++ }
+		handler             = withRateLimit(zaptest.NewLogger(t), wrpRouterHandler, limiter)
+		newRequest          = func(ctx context.Context, partnerIDs ...string) *wrphttp.Request {
+			return (&wrphttp.Request{
+				Entity: &wrphttp.Entity{
+					Message: wrp.Message{Destination: "mac:112233445566", PartnerIDs: partnerIDs},
+				},
+			}).WithContext(ctx)
+		}
+	)
+
+	recorder := httptest.NewRecorder()
+	handler(newTestWRPResponseWriter(recorder), newRequest(newTestTokenContext("client", "comcast"), "nbc"))
+	assert.Equal(1, routed)
+	assert.Equal(http.StatusOK, recorder.Code)
+
+	// the partner is the one claimed by the token, whatever the message's partner IDs are
+	recorder = httptest.NewRecorder()
+	handler(newTestWRPResponseWriter(recorder), newRequest(newTestTokenContext("client", "comcast"), "other"))
+	assert.Equal(1, routed)
+	assert.Equal(http.StatusTooManyRequests, recorder.Code)
+	assert.Equal("1", recorder.Header().Get("Retry-After"))
+	assert.Contains(recorder.Body.String(), "partner rate limit exceeded")
+	assert.Equal(float64(1), counter.count)
+	assert.Equal(map[string]string{limitLabel: partnerLimit, partnerIDLabel: "comcast"}, counter.labelPairs)
+
+	recorder = httptest.NewRecorder()
+	handler(newTestWRPResponseWriter(recorder), newRequest(newTestTokenContext("client", "nbc"), "comcast"))
+	assert.Equal(2, routed)
+
+	// callers without a partner claim are not partner limited
+	for i := 0; i < 2; i++ {
+		handler(newTestWRPResponseWriter(httptest.NewRecorder()), newRequest(context.Background(), "comcast"))
+	}
+
+	assert.Equal(4, routed)
+}
+
+func testWithRateLimitPrincipal(t *testing.T) {
+	var (
+		assert        = assert.New(t)
+		limiter, _, _ = newTestRateLimiter(RateLimitConfig{Principal: RateLimit{Rate: 1}})
+		handler       = withRateLimit(zaptest.NewLogger(t), func(wrphttp.ResponseWriter, *wrphttp.Request) {}, limiter)
+		authenticated = bascule.WithAuthentication(context.Background(), bascule.Authentication{
+			Token: bascule.NewToken("Bearer", "client", bascule.NewAttributes(nil)),
+		})
+	)
+
+	send := func(ctx context.Context) int {
+		recorder := httptest.NewRecorder()
+		handler(newTestWRPResponseWriter(recorder), (&wrphttp.Request{
+			Entity: &wrphttp.Entity{Message: wrp.Message{Destination: "mac:112233445566"}},
+		}).WithContext(ctx))
+
+		return recorder.Code
+	}
+
+	assert.Equal(http.StatusOK, send(authenticated))
+	assert.Equal(http.StatusTooManyRequests, send(authenticated))
+
+	// unauthenticated callers have no principal to limit
+	assert.Equal(http.StatusOK, send(context.Background()))
+	assert.Equal(http.StatusOK, send(context.Background()))
+}
+
+func testNewRateLimiter(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		require  = require.New(t)
+		registry = xmetrics.MustNewRegistry(nil, Metrics)
+		v        = viper.New()
+	)
+
+	limiter, err := newRateLimiter(v, registry)
+	assert.Nil(limiter)
+	assert.NoError(err)
+
+	v.SetConfigType("yaml")
+	require.NoError(v.ReadConfig(strings.NewReader(strings.Join([]string{
+		"inbound:",
+		"  rateLimit:",
+		"    principal:",
+		"      rate: 10",
+		"      burst: 20",
+		"    principals:",
+		"      - principal: Partner-A",
+		"        rate: 100",
+		"    device:",
+		"      rate: 1",
+	}, "\n"))))
+
+	limiter, err = newRateLimiter(v, registry)
+	require.NoError(err)
+	require.NotNil(limiter)
+	assert.Equal(RateLimit{Rate: 10, Burst: 20}, limiter.kinds[0].limit)
+	assert.Equal(map[string]RateLimit{"Partner-A": {Rate: 100}}, limiter.kinds[0].overrides)
+	assert.Equal(RateLimit{}, limiter.kinds[1].limit)
+	assert.Equal(RateLimit{Rate: 1}, limiter.kinds[2].limit)
+
+	v.Set(InboundRateLimitConfigKey+".principals", []map[string]interface{}{{"rate": 5}})
+	limiter, err = newRateLimiter(v, registry)
+	assert.Nil(limiter)
+	assert.Error(err)
+}
+
+func TestRateLimit(t *testing.T) {
+	t.Run("Allow", testRateLimiterAllow)
+	t.Run("Handler", testWithRateLimit)
+	t.Run("Principal", testWithRateLimitPrincipal)
+	t.Run("New", testNewRateLimiter)
+}
@@ -0,0 +1,305 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"go.uber.org/zap"
+
+	// nolint:staticcheck
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+// Supported jitter strategies
+const (
+	NoJitter           = "none"
+	FullJitter         = "full"
+	DecorrelatedJitter = "decorrelated"
+)
+
+const (
+	DefaultBackoffMultiplier           = 2.0
+	DefaultBackoffMaxInterval          = 30 * time.Second
+	DefaultBackoffMaxRetryAfter        = time.Minute
+	DefaultBackoffJitter               = NoJitter
+	retryAfterHeader                   = "Retry-After"
+	backoffDecorrelatedMinimumInterval = time.Millisecond
+)
+
+var errJitterNotSupported = errors.New("Jitter not supported")
+
+// BackoffConfig describes how long to wait between outbound retries.
+type BackoffConfig struct {
+	// InitialInterval is the delay before the first retry.  Zero means retry immediately.
+	InitialInterval time.Duration `json:"initialInterval"`
+
+	// Multiplier is the factor by which the interval grows with each retry.
+	Multiplier float64 `json:"multiplier"`
+
+	// MaxInterval caps the computed interval.
+	MaxInterval time.Duration `json:"maxInterval"`
+
+	// Jitter is one of "none", "full" or "decorrelated".
+	Jitter string `json:"jitter"`
+
+	// ObeyRetryAfter uses a response's Retry-After header as the delay, when present.
+	ObeyRetryAfter bool `json:"obeyRetryAfter"`
+
+	// MaxRetryAfter caps the delay taken from a Retry-After header.
+	MaxRetryAfter time.Duration `json:"maxRetryAfter"`
+}
+
+// backoffPolicy computes the delays between retries.
+type backoffPolicy struct {
+	initial        time.Duration
+	multiplier     float64
+	max            time.Duration
+	jitter         string
+	obeyRetryAfter bool
+	maxRetryAfter  time.Duration
+	now            func() time.Time
+
+	lock sync.Mutex
+	rand *rand.Rand
+}
+
+func newBackoffPolicy(o *Outbounder) (*backoffPolicy, error) {
+	bp := &backoffPolicy{
+		initial:        o.backoffInitialInterval(),
+		multiplier:     o.backoffMultiplier(),
+		max:            o.backoffMaxInterval(),
+		jitter:         o.backoffJitter(),
+		obeyRetryAfter: o.backoffObeyRetryAfter(),
+		maxRetryAfter:  o.backoffMaxRetryAfter(),
+		now:            time.Now,
+		// nolint:gosec
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	switch bp.jitter {
+	case NoJitter, FullJitter, DecorrelatedJitter:
+		return bp, nil
+	default:
+		return nil, errJitterNotSupported
+	}
+}
+
+func (bp *backoffPolicy) random(lo, hi time.Duration) time.Duration {
+	if hi <= lo {
+		return lo
+	}
+
+	bp.lock.Lock()
+	defer bp.lock.Unlock()
+	return lo + time.Duration(bp.rand.Int63n(int64(hi-lo)))
+}
+
+// delay returns how long to wait before the given retry, starting at 0.  previous is
+// the delay used for the prior retry, which decorrelated jitter builds upon.
+func (bp *backoffPolicy) delay(retry int, previous time.Duration) time.Duration {
+	if bp.initial <= 0 {
+		return 0
+	}
+
+	if bp.jitter == DecorrelatedJitter {
+		if previous < bp.initial {
+			previous = bp.initial
+		}
+
+		upper := time.Duration(math.Min(float64(previous)*bp.multiplier, float64(bp.max)))
+		d := bp.random(bp.initial, upper)
+		if d < backoffDecorrelatedMinimumInterval {
+			d = backoffDecorrelatedMinimumInterval
+		}
+
+		return d
+	}
+
+	d := time.Duration(math.Min(float64(bp.initial)*math.Pow(bp.multiplier, float64(retry)), float64(bp.max)))
+	if bp.jitter == FullJitter {
+		return bp.random(0, d)
+	}
+
+	return d
+}
+
+// retryAfter parses the Retry-After header of the given response, which may either be
+// a number of seconds or an HTTP date.  The result is capped by the configured maximum.
+func (bp *backoffPolicy) retryAfter(response *http.Response) (time.Duration, bool) {
+	if !bp.obeyRetryAfter || response == nil {
+		return 0, false
+	}
+
+	value := response.Header.Get(retryAfterHeader)
+	if len(value) == 0 {
+		return 0, false
+	}
+
+	var d time.Duration
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		d = time.Duration(seconds) * time.Second
+	} else if t, err := http.ParseTime(value); err == nil {
+		d = t.Sub(bp.now())
+	} else {
+		return 0, false
+	}
+
+	if d < 0 {
+		d = 0
+	} else if d > bp.maxRetryAfter {
+		d = bp.maxRetryAfter
+	}
+
+	return d, true
+}
+
+// temporary is implemented by errors, such as those from the net package, which
+// indicate whether an operation may succeed if retried
+type temporary interface {
+	Temporary() bool
+}
+
+// shouldRetryError returns true for errors that report themselves as temporary
+func shouldRetryError(err error) bool {
+	var t temporary
+	if errors.As(err, &t) {
+		return t.Temporary()
+	}
+
+	return false
+}
+
+// RetryOptions configures the outbound retry transactor.
+type RetryOptions struct {
+	Logger    *zap.Logger
+	Retries   int
+	Priority  int
+	Backoff   *backoffPolicy
+	Retryable map[int]bool
+	Counter   metrics.Counter
+}
+
+// RetryTransactor decorates next so that failed requests are retried according to the
+// supplied options.  Temporary errors and responses with a retryable status code are
+// retried, waiting between attempts as dictated by the backoff policy.  Retrying stops
+// early if the next attempt could not start before the request's context is done.
+// Requests for high and critical QoS messages get Priority retries in addition to Retries.
+func RetryTransactor(o RetryOptions, next func(*http.Request) (*http.Response, error)) func(*http.Request) (*http.Response, error) {
+	if o.Retries < 1 && o.Priority < 1 {
+		return next
+	}
+
+	return func(request *http.Request) (*http.Response, error) {
+		var (
+			ctx      = request.Context()
+			retries  = o.Retries
+			previous time.Duration
+		)
+
+		if level, _ := ctx.Value(qosLevelContextKey{}).(wrp.QOSLevel); level >= wrp.QOSHigh {
+			retries += o.Priority
+		}
+
+		attempts := 1
+		if counter, ok := ctx.Value(attemptsContextKey{}).(*int); ok {
+			defer func() { *counter = attempts }()
+		}
+
+		response, err := next(request)
+		for retry := 0; retry < retries; retry++ {
+			if !o.shouldRetry(response, err) {
+				break
+			}
+
+			d := o.Backoff.delay(retry, previous)
+			if ra, ok := o.Backoff.retryAfter(response); ok {
+				d = ra
+			}
+
+			if deadline, ok := ctx.Deadline(); ok && o.Backoff.now().Add(d).After(deadline) {
+				o.Logger.Debug("Not retrying outbound request past its deadline", zap.Any("url", request.URL), zap.Duration("delay", d))
+				break
+			}
+
+			if request.Body != nil && request.Body != http.NoBody && request.GetBody == nil {
+				// the body cannot be replayed
+				break
+			}
+
+			if !sleepWithContext(ctx, d) {
+				break
+			}
+
+			if request.GetBody != nil {
+				body, bodyErr := request.GetBody()
+				if bodyErr != nil {
+					break
+				}
+
+				request.Body = body
+			}
+
+			if response != nil {
+				io.Copy(io.Discard, response.Body)
+				response.Body.Close()
+			}
+
+			previous = d
+			o.Counter.Add(1.0)
+			o.Logger.Debug("Retrying outbound request", zap.Any("url", request.URL), zap.Int("retry", retry+1), zap.Duration("delay", d))
+			attempts++
+			response, err = next(request)
+		}
+
+		return response, err
+	}
+}
+
+func (o RetryOptions) shouldRetry(response *http.Response, err error) bool {
+	if err != nil {
+		return shouldRetryError(err)
+	}
+
+	return o.Retryable[response.StatusCode]
+}
+
+// sleepWithContext waits for the given duration, returning false if the context was done first.
+func sleepWithContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,320 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/wrp-go/v3"
+	"go.uber.org/zap/zaptest"
+)
+
+type testTemporaryError struct {
+	temporary bool
+}
+
+func (e testTemporaryError) Error() string   { return "test error" }
+func (e testTemporaryError) Temporary() bool { return e.temporary }
+
+func newTestBackoffPolicy(t *testing.T, config BackoffConfig) *backoffPolicy {
+	bp, err := newBackoffPolicy(&Outbounder{Backoff: config})
+	require.NoError(t, err)
+	return bp
+}
+
+func testBackoffPolicyDelay(t *testing.T) {
+	assert := assert.New(t)
+
+	immediate := newTestBackoffPolicy(t, BackoffConfig{})
+	assert.Equal(time.Duration(0), immediate.delay(0, 0))
+	assert.Equal(time.Duration(0), immediate.delay(5, 0))
+
+	exponential := newTestBackoffPolicy(t, BackoffConfig{InitialInterval: time.Second, Multiplier: 3, MaxInterval: 10 * time.Second})
+	assert.Equal(time.Second, exponential.delay(0, 0))
+	assert.Equal(3*time.Second, exponential.delay(1, 0))
+	assert.Equal(9*time.Second, exponential.delay(2, 0))
+	assert.Equal(10*time.Second, exponential.delay(3, 0))
+
+	full := newTestBackoffPolicy(t, BackoffConfig{InitialInterval: time.Second, Jitter: FullJitter})
+	for retry := 0; retry < 5; retry++ {
+		d := full.delay(retry, 0)
+		assert.GreaterOrEqual(d, time.Duration(0))
+		assert.Less(d, time.Second<<retry)
+	}
+
+	decorrelated := newTestBackoffPolicy(t, BackoffConfig{InitialInterval: time.Second, MaxInterval: 5 * time.Second, Jitter: DecorrelatedJitter})
+	previous := time.Duration(0)
+	for retry := 0; retry < 10; retry++ {
+		d := decorrelated.delay(retry, previous)
+		assert.GreaterOrEqual(d, time.Second)
+		assert.LessOrEqual(d, 5*time.Second)
+		previous = d
+	}
+
+	_, err := newBackoffPolicy(&Outbounder{Backoff: BackoffConfig{Jitter: "unsupported"}})
+	assert.Equal(errJitterNotSupported, err)
+}
+
+func testBackoffPolicyRetryAfter(t *testing.T) {
+	var (
+		assert = assert.New(t)
+		now    = time.Date(2023, 7, 20, 12, 0, 0, 0, time.UTC)
+		bp     = newTestBackoffPolicy(t, BackoffConfig{ObeyRetryAfter: true, MaxRetryAfter: time.Minute})
+	)
+
+	bp.now = func() time.Time { return now }
+
+	testData := []struct {
+		value    string
+		expected time.Duration
+		ok       bool
+	}{
+		{"", 0, false},
+		{"nonsense", 0, false},
+		{"5", 5 * time.Second, true},
+		{"3600", time.Minute, true},
+		{now.Add(30 * time.Second).Format(http.TimeFormat), 30 * time.Second, true},
+		{now.Add(-30 * time.Second).Format(http.TimeFormat), 0, true},
+	}
+
+	for _, record := range testData {
+		response := &http.Response{Header: http.Header{}}
+		if len(record.value) > 0 {
+			response.Header.Set(retryAfterHeader, record.value)
+		}
+
+		d, ok := bp.retryAfter(response)
+		assert.Equal(record.ok, ok, record.value)
+		assert.Equal(record.expected, d, record.value)
+	}
+
+	ignored := newTestBackoffPolicy(t, BackoffConfig{})
+	_, ok := ignored.retryAfter(&http.Response{Header: http.Header{retryAfterHeader: []string{"5"}}})
+	assert.False(ok)
+}
+
+func testRetryTransactorNoRetries(t *testing.T) {
+	var (
+		assert = assert.New(t)
+		calls  int
+		next   = func(*http.Request) (*http.Response, error) {
+			calls++
+			return nil, testTemporaryError{true}
+		}
+
+		transactor = RetryTransactor(RetryOptions{Retries: 0}, next)
+	)
+
+	// nolint:bodyclose
+	_, err := transactor(httptest.NewRequest("POST", "/", nil))
+	assert.Error(err)
+	assert.Equal(1, calls)
+}
+
+func testRetryTransactorErrors(t *testing.T) {
+	for _, record := range []struct {
+		err           error
+		expectedCalls int
+	}{
+		{testTemporaryError{true}, 3},
+		{testTemporaryError{false}, 1},
+		{errors.New("not temporary"), 1},
+		{errCircuitOpen, 1},
+	} {
+		var (
+			assert  = assert.New(t)
+			counter = new(mockCounter)
+			calls   int
+			next    = func(*http.Request) (*http.Response, error) {
+				calls++
+				return nil, record.err
+			}
+
+			transactor = RetryTransactor(
+				RetryOptions{
+					Logger:  zaptest.NewLogger(t),
+					Retries: 2,
+					Backoff: newTestBackoffPolicy(t, BackoffConfig{}),
+					Counter: counter,
+				},
+				next,
+			)
+		)
+
+		if record.expectedCalls > 1 {
+			counter.On("Add", 1.0).Times(record.expectedCalls - 1)
+		}
+
+		// nolint:bodyclose
+		_, err := transactor(httptest.NewRequest("POST", "/", nil))
+		assert.Equal(record.err, err)
+		assert.Equal(record.expectedCalls, calls)
+		counter.AssertExpectations(t)
+	}
+}
+
+func testRetryTransactorStatusCodes(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		require  = require.New(t)
+		counter  = new(mockCounter)
+		statuses = []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK}
+		bodies   []string
+
+		server = httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			body, _ := io.ReadAll(request.Body)
+			bodies = append(bodies, string(body))
+
+			status := statuses[0]
+			statuses = statuses[1:]
+			if status != http.StatusOK {
+				response.Header().Set(retryAfterHeader, "3600")
+			}
+
+			response.WriteHeader(status)
+		}))
+
+		transactor = RetryTransactor(
+			RetryOptions{
+				Logger:    zaptest.NewLogger(t),
+				Retries:   5,
+				Backoff:   newTestBackoffPolicy(t, BackoffConfig{InitialInterval: time.Millisecond, ObeyRetryAfter: true, MaxRetryAfter: 10 * time.Millisecond}),
+				Retryable: map[int]bool{http.StatusServiceUnavailable: true, http.StatusTooManyRequests: true},
+				Counter:   counter,
+			},
+			http.DefaultTransport.RoundTrip,
+		)
+	)
+
+	defer server.Close()
+	counter.On("Add", 1.0).Twice()
+
+	request, err := http.NewRequest("POST", server.URL, bytes.NewReader([]byte("payload")))
+	require.NoError(err)
+
+	start := time.Now()
+	response, err := transactor(request)
+	require.NoError(err)
+	defer response.Body.Close()
+
+	assert.Equal(http.StatusOK, response.StatusCode)
+	assert.Equal([]string{"payload", "payload", "payload"}, bodies)
+	assert.GreaterOrEqual(time.Since(start), 20*time.Millisecond)
+	counter.AssertExpectations(t)
+}
+
+func testRetryTransactorDeadline(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		calls   int
+		next    = func(*http.Request) (*http.Response, error) {
+			calls++
+			return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: io.NopCloser(strings.NewReader(""))}, nil
+		}
+
+		transactor = RetryTransactor(
+			RetryOptions{
+				Logger:    zaptest.NewLogger(t),
+				Retries:   3,
+				Backoff:   newTestBackoffPolicy(t, BackoffConfig{InitialInterval: time.Hour, MaxInterval: time.Hour, Jitter: NoJitter}),
+				Retryable: map[int]bool{http.StatusServiceUnavailable: true},
+				Counter:   new(mockCounter),
+			},
+			next,
+		)
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	response, err := transactor(httptest.NewRequest("POST", "/", nil).WithContext(ctx))
+	require.NoError(err)
+	defer response.Body.Close()
+
+	assert.Equal(http.StatusServiceUnavailable, response.StatusCode)
+	assert.Equal(1, calls)
+}
+
+func testRetryTransactorPriority(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		counter = new(mockCounter)
+		calls   int
+		next    = func(*http.Request) (*http.Response, error) {
+			calls++
+			return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: io.NopCloser(strings.NewReader(""))}, nil
+		}
+
+		transactor = RetryTransactor(
+			RetryOptions{
+				Logger:    zaptest.NewLogger(t),
+				Retries:   1,
+				Priority:  2,
+				Backoff:   newTestBackoffPolicy(t, BackoffConfig{}),
+				Retryable: map[int]bool{http.StatusServiceUnavailable: true},
+				Counter:   counter,
+			},
+			next,
+		)
+	)
+
+	counter.On("Add", 1.0)
+	testData := []struct {
+		level    wrp.QOSLevel
+		expected int
+	}{
+		{wrp.QOSLow, 2},
+		{wrp.QOSMedium, 2},
+		{wrp.QOSHigh, 4},
+		{wrp.QOSCritical, 4},
+	}
+
+	for _, record := range testData {
+		calls = 0
+		ctx := context.WithValue(context.Background(), qosLevelContextKey{}, record.level)
+		response, err := transactor(httptest.NewRequest("POST", "/", nil).WithContext(ctx))
+		assert.NoError(err)
+		response.Body.Close()
+		assert.Equal(record.expected, calls, record.level.String())
+	}
+}
+
+func TestRetry(t *testing.T) {
+	t.Run("BackoffPolicy", func(t *testing.T) {
+		t.Run("Delay", testBackoffPolicyDelay)
+		t.Run("RetryAfter", testBackoffPolicyRetryAfter)
+	})
+
+	t.Run("RetryTransactor", func(t *testing.T) {
+		t.Run("NoRetries", testRetryTransactorNoRetries)
+		t.Run("Errors", testRetryTransactorErrors)
+		t.Run("StatusCodes", testRetryTransactorStatusCodes)
+		t.Run("Deadline", testRetryTransactorDeadline)
+		t.Run("Priority", testRetryTransactorPriority)
+	})
+}
@@ -0,0 +1,489 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"go.uber.org/zap"
+
+	// nolint:staticcheck
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+const (
+	DefaultSpillMaxSegmentSize int64         = 4 * 1024 * 1024
+	DefaultSpillMaxSize        int64         = 1024 * 1024 * 1024
+	DefaultSpillMaxAge         time.Duration = time.Hour
+
+	// spillSegmentSuffix is the file extension used for spill queue segment files
+	spillSegmentSuffix = ".seg"
+
+	// spillRecordHeaderSize is the size of the length prefix written before each record
+	spillRecordHeaderSize = 4
+)
+
+var errSpillQueueFull = errors.New("outbound spill queue full")
+
+// SpillConfig describes the optional on-disk queue that absorbs outbound envelopes
+// when the in-memory outbound queue is full.
+type SpillConfig struct {
+	// Directory is where segment files are written.  The spill queue is disabled
+	// when this is empty.
+	Directory string `json:"directory"`
+
+	// MaxSegmentSize is the size in bytes at which a new segment file is started.
+	MaxSegmentSize int64 `json:"maxSegmentSize"`
+
+	// MaxSize is the upper bound in bytes of all segment files together.  Envelopes
+	// which would exceed this are dropped.
+	MaxSize int64 `json:"maxSize"`
+
+	// MaxAge is how long a spilled envelope remains eligible for replay.
+	MaxAge time.Duration `json:"maxAge"`
+}
+
+// spillRecord is the on-disk representation of an outbound request.
+type spillRecord struct {
+	Method    string       `json:"method"`
+	URL       string       `json:"url"`
+	Header    http.Header  `json:"header"`
+	Body      []byte       `json:"body"`
+	EventType string       `json:"eventType"`
+	PartnerID string       `json:"partnerID,omitempty"`
+	DeviceID  string       `json:"deviceID,omitempty"`
+	QOSLevel  wrp.QOSLevel `json:"qosLevel,omitempty"`
+	SpilledAt time.Time    `json:"spilledAt"`
+}
+
+// spillSegment tracks a single segment file
+type spillSegment struct {
+	seq  uint64
+	size int64
+}
+
+// spillPosition locates a record by its segment and its offset within that segment
+type spillPosition struct {
+	seq    uint64
+	offset int64
+}
+
+// spillQueue is a FIFO of outbound requests persisted as length-prefixed JSON
+// records in a sequence of segment files.  Segments are deleted once they have
+// been fully replayed.  Replay is at-least-once: after a restart, the oldest
+// segment is replayed from its beginning.
+type spillQueue struct {
+	logger         *zap.Logger
+	directory      string
+	maxSegmentSize int64
+	maxSize        int64
+	maxAge         time.Duration
+	timeout        time.Duration
+	overflow       metrics.Counter
+	replayed       metrics.Counter
+	expired        metrics.Counter
+	diskUsage      metrics.Gauge
+	now            func() time.Time
+
+	lock       sync.Mutex
+	segments   []spillSegment
+	usage      int64
+	writer     *os.File
+	reader     *os.File
+	readOffset int64
+	signal     chan struct{}
+
+	// deliveries holds the deliveries of the records spilled by this process which
+	// have not been replayed yet, so that their QoS acks reflect the replay
+	deliveries map[spillPosition]*delivery
+}
+
+// NewSpillQueue opens the spill queue described by the Outbounder, recovering any
+// segments left behind by a previous process.  If no spill directory is configured,
+// this function returns a nil queue and no error.
+func NewSpillQueue(om OutboundMeasures, o *Outbounder) (*spillQueue, error) {
+	if o == nil || len(o.Spill.Directory) == 0 {
+		return nil, nil
+	}
+
+	sq := &spillQueue{
+		logger:         o.logger(),
+		directory:      o.Spill.Directory,
+		maxSegmentSize: o.spillMaxSegmentSize(),
+		maxSize:        o.spillMaxSize(),
+		maxAge:         o.spillMaxAge(),
+		timeout:        o.requestTimeout(),
+		overflow:       om.SpillOverflow,
+		replayed:       om.SpillReplayed,
+		expired:        om.SpillExpired,
+		diskUsage:      om.SpillDiskUsage,
+		now:            time.Now,
+		signal:         make(chan struct{}, 1),
+		deliveries:     make(map[spillPosition]*delivery),
+	}
+
+	if err := os.MkdirAll(sq.directory, 0700); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(sq.directory)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), spillSegmentSuffix) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), spillSegmentSuffix), 10, 64)
+		if err != nil {
+			sq.logger.Error("Ignoring unrecognized spill file", zap.String("file", entry.Name()))
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		sq.segments = append(sq.segments, spillSegment{seq: seq, size: info.Size()})
+		sq.usage += info.Size()
+	}
+
+	sort.Slice(sq.segments, func(i, j int) bool { return sq.segments[i].seq < sq.segments[j].seq })
+	sq.diskUsage.Set(float64(sq.usage))
+	if len(sq.segments) > 0 {
+		sq.logger.Info("Recovered outbound spill queue", zap.Int("segments", len(sq.segments)), zap.Int64("bytes", sq.usage))
+		sq.notify()
+	}
+
+	return sq, nil
+}
+
+func (sq *spillQueue) segmentPath(seq uint64) string {
+	return filepath.Join(sq.directory, fmt.Sprintf("%020d%s", seq, spillSegmentSuffix))
+}
+
+// notify wakes up at most one waiting consumer
+func (sq *spillQueue) notify() {
+	select {
+	case sq.signal <- struct{}{}:
+	default:
+	}
+}
+
+// ready returns a channel that receives a value whenever envelopes may be available.
+// A nil spillQueue returns a nil channel, which blocks forever.
+func (sq *spillQueue) ready() <-chan struct{} {
+	if sq == nil {
+		return nil
+	}
+
+	return sq.signal
+}
+
+// empty returns true if there is nothing left to replay.  A nil spillQueue is always empty.
+func (sq *spillQueue) empty() bool {
+	if sq == nil {
+		return true
+	}
+
+	sq.lock.Lock()
+	defer sq.lock.Unlock()
+	return sq.emptyLocked()
+}
+
+func (sq *spillQueue) emptyLocked() bool {
+	return len(sq.segments) == 0 || (len(sq.segments) == 1 && sq.readOffset >= sq.segments[0].size)
+}
+
+// push appends the given request to the queue.  The request's body must be
+// re-readable via GetBody, which is the case for requests created by eventDispatcher.
+// The delivery carried by the context, if any, is completed once the request is replayed.
+func (sq *spillQueue) push(ctx context.Context, request *http.Request) error {
+	var body []byte
+	if request.GetBody != nil {
+		rc, err := request.GetBody()
+		if err != nil {
+			return err
+		}
+
+		body, err = io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	eventType, _ := ctx.Value(eventTypeContextKey{}).(string)
+	partnerID, _ := ctx.Value(partnerIDContextKey{}).(string)
+	deviceID, _ := ctx.Value(deviceIDContextKey{}).(string)
+	qosLevel, _ := ctx.Value(qosLevelContextKey{}).(wrp.QOSLevel)
+	data, err := json.Marshal(spillRecord{
+		Method:    request.Method,
+		URL:       request.URL.String(),
+		Header:    request.Header,
+		Body:      body,
+		EventType: eventType,
+		PartnerID: partnerID,
+		DeviceID:  deviceID,
+		QOSLevel:  qosLevel,
+		SpilledAt: sq.now(),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	sq.lock.Lock()
+	defer sq.lock.Unlock()
+
+	n := int64(spillRecordHeaderSize + len(data))
+	if sq.usage+n > sq.maxSize {
+		return errSpillQueueFull
+	}
+
+	last := len(sq.segments) - 1
+	if sq.writer == nil || (sq.segments[last].size > 0 && sq.segments[last].size+n > sq.maxSegmentSize) {
+		if err := sq.rotateLocked(); err != nil {
+			return err
+		}
+
+		last = len(sq.segments) - 1
+	}
+
+	record := make([]byte, n)
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	copy(record[spillRecordHeaderSize:], data)
+	if _, err := sq.writer.Write(record); err != nil {
+		return err
+	}
+
+	if dv := deliveryFrom(ctx); dv != nil {
+		sq.deliveries[spillPosition{seq: sq.segments[last].seq, offset: sq.segments[last].size}] = dv
+	}
+
+	sq.segments[last].size += n
+	sq.usage += n
+	sq.diskUsage.Set(float64(sq.usage))
+	sq.overflow.Add(1.0)
+	sq.notify()
+	return nil
+}
+
+// rotateLocked starts a new segment that subsequent records are appended to.  Segments
+// recovered from a previous process are never appended to, since they may end with a
+// partially written record.
+func (sq *spillQueue) rotateLocked() error {
+	if sq.writer != nil {
+		sq.writer.Close()
+		sq.writer = nil
+	}
+
+	var seq uint64
+	if last := len(sq.segments) - 1; last >= 0 {
+		seq = sq.segments[last].seq + 1
+	}
+
+	f, err := os.OpenFile(sq.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	sq.segments = append(sq.segments, spillSegment{seq: seq})
+	sq.writer = f
+	return nil
+}
+
+// pop removes the oldest eligible envelope from the queue.  Records older than
+// the configured maximum age are discarded.  The returned envelope carries a fresh
+// request timeout.
+func (sq *spillQueue) pop() (outboundEnvelope, bool) {
+	if sq == nil {
+		return outboundEnvelope{}, false
+	}
+
+	sq.lock.Lock()
+	defer sq.lock.Unlock()
+
+	for {
+		if sq.emptyLocked() {
+			sq.reclaimLocked()
+			return outboundEnvelope{}, false
+		}
+
+		if sq.readOffset >= sq.segments[0].size {
+			sq.removeHeadLocked()
+			continue
+		}
+
+		position := spillPosition{seq: sq.segments[0].seq, offset: sq.readOffset}
+		dv := sq.deliveries[position]
+		delete(sq.deliveries, position)
+
+		record, err := sq.readLocked()
+		if err != nil {
+			// skip whatever remains of a corrupt or truncated segment
+			sq.logger.Error("Unable to read spilled envelope", zap.Uint64("segment", sq.segments[0].seq), zap.Int64("offset", sq.readOffset), zap.Error(err))
+			sq.readOffset = sq.segments[0].size
+			dv.complete(rdrQueueFull)
+			continue
+		}
+
+		if sq.maxAge > 0 && sq.now().Sub(record.SpilledAt) > sq.maxAge {
+			sq.expired.Add(1.0)
+			dv.complete(rdrTimeout)
+			continue
+		}
+
+		e, err := sq.newEnvelope(record, dv)
+		if err != nil {
+			sq.logger.Error("Unable to rebuild spilled envelope", zap.String("url", record.URL), zap.Error(err))
+			dv.complete(rdrEndpointError)
+			continue
+		}
+
+		sq.replayed.Add(1.0)
+		if !sq.emptyLocked() {
+			sq.notify()
+		}
+
+		return e, true
+	}
+}
+
+func (sq *spillQueue) readLocked() (spillRecord, error) {
+	var record spillRecord
+	if sq.reader == nil {
+		f, err := os.Open(sq.segmentPath(sq.segments[0].seq))
+		if err != nil {
+			return record, err
+		}
+
+		sq.reader = f
+	}
+
+	var header [spillRecordHeaderSize]byte
+	if _, err := sq.reader.ReadAt(header[:], sq.readOffset); err != nil {
+		return record, err
+	}
+
+	n := int64(binary.BigEndian.Uint32(header[:]))
+	if sq.readOffset+spillRecordHeaderSize+n > sq.segments[0].size {
+		return record, io.ErrUnexpectedEOF
+	}
+
+	data := make([]byte, n)
+	if _, err := sq.reader.ReadAt(data, sq.readOffset+spillRecordHeaderSize); err != nil {
+		return record, err
+	}
+
+	sq.readOffset += spillRecordHeaderSize + n
+	return record, json.Unmarshal(data, &record)
+}
+
+// removeHeadLocked deletes the oldest segment, which must have been fully read
+// and must not be the segment currently being written to.
+func (sq *spillQueue) removeHeadLocked() {
+	if sq.reader != nil {
+		sq.reader.Close()
+		sq.reader = nil
+	}
+
+	head := sq.segments[0]
+	for position, dv := range sq.deliveries {
+		// records skipped over, e.g. in a corrupt segment, are never replayed
+		if position.seq == head.seq {
+			delete(sq.deliveries, position)
+			dv.complete(rdrQueueFull)
+		}
+	}
+
+	if err := os.Remove(sq.segmentPath(head.seq)); err != nil {
+		sq.logger.Error("Unable to remove spill segment", zap.Uint64("segment", head.seq), zap.Error(err))
+	}
+
+	sq.segments = sq.segments[1:]
+	sq.readOffset = 0
+	sq.usage -= head.size
+	sq.diskUsage.Set(float64(sq.usage))
+}
+
+// reclaimLocked deletes the last segment once everything in it has been replayed,
+// so that an idle spill queue does not hold on to disk space.
+func (sq *spillQueue) reclaimLocked() {
+	if len(sq.segments) != 1 || sq.segments[0].size == 0 {
+		return
+	}
+
+	if sq.writer != nil {
+		sq.writer.Close()
+		sq.writer = nil
+	}
+
+	sq.removeHeadLocked()
+}
+
+// newEnvelope rebuilds the envelope of a spilled record, carrying the record's delivery
+// if it was spilled by this process
+func (sq *spillQueue) newEnvelope(record spillRecord, dv *delivery) (outboundEnvelope, error) {
+	request, err := http.NewRequest(record.Method, record.URL, bytes.NewReader(record.Body))
+	if err != nil {
+		return outboundEnvelope{}, err
+	}
+
+	if record.Header != nil {
+		request.Header = record.Header
+	}
+
+	ctx := context.WithValue(context.Background(), eventTypeContextKey{}, record.EventType)
+	if len(record.PartnerID) > 0 {
+		ctx = context.WithValue(ctx, partnerIDContextKey{}, record.PartnerID)
+	}
+
+	if len(record.DeviceID) > 0 {
+		ctx = context.WithValue(ctx, deviceIDContextKey{}, record.DeviceID)
+	}
+
+	if record.QOSLevel > wrp.QOSLow {
+		ctx = context.WithValue(ctx, qosLevelContextKey{}, record.QOSLevel)
+	}
+
+	if dv != nil {
+		ctx = context.WithValue(ctx, deliveryContextKey{}, dv)
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithValue(ctx, attemptsContextKey{}, new(int)), sq.timeout)
+
+	return outboundEnvelope{request.WithContext(ctx), cancel}, nil
+}
@@ -0,0 +1,364 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/webpa-common/v2/device"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func newTestSpillRequest(t *testing.T, url string, body []byte) *http.Request {
+	request, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	require.NoError(t, err)
+	request.Header.Set("Content-Type", wrp.Msgpack.ContentType())
+	return request
+}
+
+func testSpillQueueDisabled(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		sq, err = NewSpillQueue(NewTestOutboundMeasures(), &Outbounder{})
+	)
+
+	assert.NoError(err)
+	assert.Nil(sq)
+	assert.True(sq.empty())
+	assert.Nil(sq.ready())
+
+	_, ok := sq.pop()
+	assert.False(ok)
+}
+
+func testSpillQueueFIFO(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		dir     = t.TempDir()
+		sq, err = NewSpillQueue(NewTestOutboundMeasures(), &Outbounder{
+			Spill: SpillConfig{Directory: dir, MaxSegmentSize: 200},
+		})
+	)
+
+	require.NoError(err)
+	require.NotNil(sq)
+	assert.True(sq.empty())
+
+	ctx := context.WithValue(context.Background(), eventTypeContextKey{}, "iot")
+	for _, body := range []string{"one", "two", "three", "four"} {
+		require.NoError(sq.push(ctx, newTestSpillRequest(t, "http://endpoint.com/"+body, []byte(body))))
+	}
+
+	assert.False(sq.empty())
+	segments, err := filepath.Glob(filepath.Join(dir, "*"+spillSegmentSuffix))
+	require.NoError(err)
+	assert.Greater(len(segments), 1)
+
+	for _, body := range []string{"one", "two", "three", "four"} {
+		e, ok := sq.pop()
+		require.True(ok)
+
+		assert.Equal("http://endpoint.com/"+body, e.request.URL.String())
+		assert.Equal(wrp.Msgpack.ContentType(), e.request.Header.Get("Content-Type"))
+		assert.Equal("iot", e.request.Context().Value(eventTypeContextKey{}))
+
+		_, hasDeadline := e.request.Context().Deadline()
+		assert.True(hasDeadline)
+
+		actual, err := io.ReadAll(e.request.Body)
+		assert.NoError(err)
+		assert.Equal(body, string(actual))
+		e.cancel()
+	}
+
+	_, ok := sq.pop()
+	assert.False(ok)
+	assert.True(sq.empty())
+
+	segments, err = filepath.Glob(filepath.Join(dir, "*"+spillSegmentSuffix))
+	require.NoError(err)
+	assert.Empty(segments)
+}
+
+func testSpillQueueRecovery(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		o       = &Outbounder{Spill: SpillConfig{Directory: t.TempDir()}}
+		sq, err = NewSpillQueue(NewTestOutboundMeasures(), o)
+	)
+
+	require.NoError(err)
+	require.NoError(sq.push(context.Background(), newTestSpillRequest(t, "http://endpoint.com/first", []byte("first"))))
+	require.NoError(sq.push(context.Background(), newTestSpillRequest(t, "http://endpoint.com/second", []byte("second"))))
+
+	// simulate a restart by opening another queue against the same directory
+	recovered, err := NewSpillQueue(NewTestOutboundMeasures(), o)
+	require.NoError(err)
+	assert.False(recovered.empty())
+
+	select {
+	case <-recovered.ready():
+	default:
+		assert.Fail("a recovered spill queue should signal readiness")
+	}
+
+	require.NoError(recovered.push(context.Background(), newTestSpillRequest(t, "http://endpoint.com/third", []byte("third"))))
+	for _, expected := range []string{"first", "second", "third"} {
+		e, ok := recovered.pop()
+		require.True(ok)
+		assert.Equal("http://endpoint.com/"+expected, e.request.URL.String())
+		e.cancel()
+	}
+
+	assert.True(recovered.empty())
+}
+
+func testSpillQueueMaxSize(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		sq, err = NewSpillQueue(NewTestOutboundMeasures(), &Outbounder{
+			Spill: SpillConfig{Directory: t.TempDir(), MaxSize: 300},
+		})
+	)
+
+	require.NoError(err)
+	require.NoError(sq.push(context.Background(), newTestSpillRequest(t, "http://endpoint.com", []byte("fits"))))
+	assert.Equal(errSpillQueueFull, sq.push(context.Background(), newTestSpillRequest(t, "http://endpoint.com", bytes.Repeat([]byte("x"), 300))))
+
+	e, ok := sq.pop()
+	require.True(ok)
+	e.cancel()
+	assert.True(sq.empty())
+}
+
+func testSpillQueueMaxAge(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		now     = time.Now()
+		sq, err = NewSpillQueue(NewTestOutboundMeasures(), &Outbounder{
+			Spill: SpillConfig{Directory: t.TempDir(), MaxAge: time.Minute},
+		})
+	)
+
+	require.NoError(err)
+	sq.now = func() time.Time { return now }
+	require.NoError(sq.push(context.Background(), newTestSpillRequest(t, "http://endpoint.com/old", nil)))
+
+	sq.now = func() time.Time { return now.Add(2 * time.Minute) }
+	require.NoError(sq.push(context.Background(), newTestSpillRequest(t, "http://endpoint.com/new", nil)))
+
+	e, ok := sq.pop()
+	require.True(ok)
+	assert.Equal("http://endpoint.com/new", e.request.URL.String())
+	e.cancel()
+
+	_, ok = sq.pop()
+	assert.False(ok)
+}
+
+func testSpillQueueCorruptSegment(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		dir     = t.TempDir()
+	)
+
+	require.NoError(os.WriteFile(filepath.Join(dir, "00000000000000000000"+spillSegmentSuffix), []byte{0, 0, 0, 9, '{'}, 0600))
+	sq, err := NewSpillQueue(NewTestOutboundMeasures(), &Outbounder{Spill: SpillConfig{Directory: dir}})
+	require.NoError(err)
+	require.NoError(sq.push(context.Background(), newTestSpillRequest(t, "http://endpoint.com", nil)))
+
+	e, ok := sq.pop()
+	require.True(ok)
+	assert.Equal("http://endpoint.com", e.request.URL.String())
+	e.cancel()
+}
+
+func testSpillQueueDelivery(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		now     = time.Now()
+		sq, err = NewSpillQueue(NewTestOutboundMeasures(), &Outbounder{
+			Spill: SpillConfig{Directory: t.TempDir(), MaxAge: time.Minute},
+		})
+
+		replayed = newDelivery()
+		expired  = newDelivery()
+	)
+
+	require.NoError(err)
+	sq.now = func() time.Time { return now }
+	for _, dv := range []*delivery{expired, replayed} {
+		dv.add()
+		dv.dispatched()
+		require.NoError(sq.push(context.WithValue(context.Background(), deliveryContextKey{}, dv), newTestSpillRequest(t, "http://endpoint.com", nil)))
+		now = now.Add(time.Minute)
+	}
+
+	// spilling does not complete a delivery
+	_, settled := replayed.outcome()
+	assert.False(settled)
+
+	e, ok := sq.pop()
+	require.True(ok)
+	assert.Equal(rdrTimeout, expired.wait(time.Second))
+	assert.Equal(replayed, deliveryFrom(e.request.Context()))
+	e.cancel()
+
+	_, settled = replayed.outcome()
+	assert.False(settled)
+	deliveryFrom(e.request.Context()).complete(rdrDelivered)
+	assert.Equal(rdrDelivered, replayed.wait(time.Second))
+	assert.Empty(sq.deliveries)
+}
+
+func testSpillQueueEventDispatcher(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		om      = NewTestOutboundMeasures()
+		o       = &Outbounder{
+			OutboundQueueSize: 1,
+			EventEndpoints:    map[string]interface{}{"default": []string{"http://endpoint1.com"}},
+			Spill:             SpillConfig{Directory: t.TempDir()},
+		}
+	)
+
+	spill, err := NewSpillQueue(om, o)
+	require.NoError(err)
+
+	dispatcher, outbounds, err := NewEventDispatcher(om, o, nil, spill, nil)
+	require.NoError(err)
+
+	for _, contents := range []string{"first", "second", "third"} {
+		dispatcher.OnDeviceEvent(&device.Event{
+			Type:     device.MessageReceived,
+			Message:  &wrp.Message{Destination: "event:iot"},
+			Format:   wrp.Msgpack,
+			Contents: []byte(contents),
+		})
+	}
+
+	assert.Equal(1, outbounds.len())
+	assert.False(spill.empty())
+
+	wp, err := NewWorkerPool(om, o, outbounds, spill, nil, nil)
+	require.NoError(err)
+
+	for _, expected := range []string{"first", "second", "third"} {
+		e, ok := wp.next()
+		require.True(ok)
+
+		actual, err := io.ReadAll(e.request.Body)
+		assert.NoError(err)
+		assert.Equal(expected, string(actual))
+		assert.Equal("iot", e.request.Context().Value(eventTypeContextKey{}))
+		e.cancel()
+	}
+
+	assert.True(spill.empty())
+}
+
+func testSpillQueueInterleaved(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		om      = NewTestOutboundMeasures()
+		o       = &Outbounder{
+			OutboundQueueSize: 1,
+			EventEndpoints:    map[string]interface{}{"default": []string{"http://endpoint1.com"}},
+			Spill:             SpillConfig{Directory: t.TempDir()},
+		}
+	)
+
+	spill, err := NewSpillQueue(om, o)
+	require.NoError(err)
+
+	dispatcher, outbounds, err := NewEventDispatcher(om, o, nil, spill, nil)
+	require.NoError(err)
+
+	wp, err := NewWorkerPool(om, o, outbounds, spill, nil, nil)
+	require.NoError(err)
+
+	dispatch := func(contents string) {
+		dispatcher.OnDeviceEvent(&device.Event{
+			Type:     device.MessageReceived,
+			Message:  &wrp.Message{Destination: "event:iot"},
+			Format:   wrp.Msgpack,
+			Contents: []byte(contents),
+		})
+	}
+
+	var delivered []string
+	deliver := func() {
+		e, ok := wp.next()
+		require.True(ok)
+
+		contents, err := io.ReadAll(e.request.Body)
+		assert.NoError(err)
+		delivered = append(delivered, string(contents))
+		e.cancel()
+	}
+
+	dispatch("first")
+	dispatch("second")
+	dispatch("third")
+	deliver()
+
+	// the queue has room again, but new traffic must not overtake what was spilled
+	dispatch("fourth")
+	assert.Zero(outbounds.len())
+	deliver()
+	dispatch("fifth")
+	deliver()
+	deliver()
+	deliver()
+
+	assert.Equal([]string{"first", "second", "third", "fourth", "fifth"}, delivered)
+	assert.True(spill.empty())
+
+	// once the spill queue has drained, the outbounds queue is used again
+	dispatch("sixth")
+	assert.Equal(1, outbounds.len())
+	assert.True(spill.empty())
+}
+
+func TestSpillQueue(t *testing.T) {
+	t.Run("Disabled", testSpillQueueDisabled)
+	t.Run("FIFO", testSpillQueueFIFO)
+	t.Run("Recovery", testSpillQueueRecovery)
+	t.Run("MaxSize", testSpillQueueMaxSize)
+	t.Run("MaxAge", testSpillQueueMaxAge)
+	t.Run("CorruptSegment", testSpillQueueCorruptSegment)
+	t.Run("Delivery", testSpillQueueDelivery)
+	t.Run("EventDispatcher", testSpillQueueEventDispatcher)
+	t.Run("Interleaved", testSpillQueueInterleaved)
+}
@@ -17,82 +17,384 @@
 package main
 
 import (
-	"io"
+	"context"
+	"errors"
 	"net/http"
 	"sync"
+	"sync/atomic"
 
-	"github.com/go-kit/kit/metrics"
 	"go.uber.org/zap"
 )
 
 // WorkerPool describes a pool of goroutines that dispatch http.Request objects to
-// a transactor function
+// an OutboundSink
 type WorkerPool struct {
-	logger         *zap.Logger
-	outbounds      <-chan outboundEnvelope
-	workerPoolSize uint
-	queueSize      metrics.Gauge
-	transactor     func(*http.Request) (*http.Response, error)
+	logger      *zap.Logger
+	outbounds   *outboundQueue
+	spill       *spillQueue
+	deadLetters *deadLetterStore
 
 	runOnce sync.Once
+	exited  sync.WaitGroup
+
+	// delivered and failed count the envelopes transacted by workers
+	delivered atomic.Int64
+	failed    atomic.Int64
+
+	// sendingLock guards sending, the cancel functions of the envelopes being transacted,
+	// and abandoned, which is set once those envelopes have been given up on
+	sendingLock sync.Mutex
+	sending     map[*http.Request]context.CancelFunc
+	abandoned   bool
+
+	// lock guards the fields below, which change when the pool is reconfigured
+	lock           sync.Mutex
+	running        bool
+	workerPoolSize uint
+	workers        uint
+	resized        chan struct{}
+	sink           *sinkGeneration
+}
+
+// sinkGeneration is the sink of one configuration of the pool, along with the requests
+// being sent through it
+type sinkGeneration struct {
+	OutboundSink
+	sending sync.WaitGroup
+}
+
+// close closes the generation's sink once the requests being sent through it are complete.
+// The generation must no longer be the pool's current one.
+func (g *sinkGeneration) close(logger *zap.Logger) {
+	g.sending.Wait()
+	if err := g.Close(); err != nil {
+		logger.Error("Unable to close outbound sink", zap.Error(err))
+	}
 }
 
-func NewWorkerPool(om OutboundMeasures, o *Outbounder, outbounds <-chan outboundEnvelope) *WorkerPool {
-	logger := o.logger()
+func NewWorkerPool(om OutboundMeasures, o *Outbounder, outbounds *outboundQueue, spill *spillQueue, breakers *circuitBreakers, deadLetters *deadLetterStore) (*WorkerPool, error) {
+	sink, err := newOutboundSink(om, o, breakers)
+	if err != nil {
+		return nil, err
+	}
+
 	return &WorkerPool{
-		logger:         logger,
+		logger:         o.logger(),
 		outbounds:      outbounds,
+		spill:          spill,
+		deadLetters:    deadLetters,
 		workerPoolSize: o.workerPoolSize(),
-		queueSize:      om.QueueSize,
-		transactor: (&http.Client{
-			Transport: NewOutboundRoundTripper(om, o),
-			Timeout:   o.clientTimeout(),
-		}).Do,
+		resized:        make(chan struct{}),
+		sink:           &sinkGeneration{OutboundSink: sink},
+	}, nil
+}
+
+// newOutboundSink creates the OutboundSink for every endpoint scheme
+func newOutboundSink(om OutboundMeasures, o *Outbounder, breakers *circuitBreakers) (OutboundSink, error) {
+	kafka, err := NewKafkaSinks(om, o)
+	if err != nil {
+		return nil, err
+	}
+
+	httpOutbound, err := newHTTPOutboundSink(om, o, breakers)
+	if err != nil {
+		return nil, err
+	}
+
+	return &outboundSinks{
+		http: httpOutbound,
+		byScheme: map[string]OutboundSink{
+			KafkaScheme: kafka,
+		},
+	}, nil
+}
+
+// newHTTPOutboundSink creates the OutboundSink for http and https endpoints, which sends
+// requests through the outbound round-tripper chain
+func newHTTPOutboundSink(om OutboundMeasures, o *Outbounder, breakers *circuitBreakers) (OutboundSink, error) {
+	transport, err := NewOutboundRoundTripper(om, o, breakers)
+	if err != nil {
+		return nil, err
 	}
+
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   o.clientTimeout(),
+	}
+
+	return NewBatchSink(om, o, &httpSink{
+		logger:               o.logger(),
+		transactor:           client.Do,
+		closeIdleConnections: client.CloseIdleConnections,
+	})
 }
 
-// Run spawns the configured number of goroutines to service the outbound channel.
+// Run spawns the configured number of goroutines to service the outbound queue.
 // This method is idempotent.
 func (wp *WorkerPool) Run() {
 	wp.runOnce.Do(func() {
-		for repeat := uint(0); repeat < wp.workerPoolSize; repeat++ {
-			go wp.worker()
-		}
+		wp.lock.Lock()
+		wp.running = true
+		wp.spawn()
+		wp.lock.Unlock()
 	})
 }
 
+// spawn starts workers until the configured number are running.  The lock must be held.
+func (wp *WorkerPool) spawn() {
+	for ; wp.workers < wp.workerPoolSize; wp.workers++ {
+		wp.exited.Add(1)
+		go wp.worker()
+	}
+}
+
+// Stop shuts down the outbound queue, so that no more envelopes are accepted.  Workers
+// keep sending the envelopes already queued, then exit.  Envelopes in the spill queue
+// are left for the next start.  This method is idempotent.
+func (wp *WorkerPool) Stop() {
+	wp.lock.Lock()
+	wp.running = false
+	wp.lock.Unlock()
+
+	wp.outbounds.shutdown()
+}
+
+// Wait blocks until every worker has exited after Stop, or the given context is done,
+// in which case the context's error is returned.
+func (wp *WorkerPool) Wait(ctx context.Context) error {
+	exited := make(chan struct{})
+	go func() {
+		wp.exited.Wait()
+		close(exited)
+	}()
+
+	select {
+	case <-exited:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// abandon cancels every envelope still queued or being sent, returning how many were
+// cancelled.  Workers give up on the envelopes they are sending, then exit.
+func (wp *WorkerPool) abandon() int {
+	wp.sendingLock.Lock()
+	wp.abandoned = true
+	abandoned := len(wp.sending)
+	for _, cancel := range wp.sending {
+		cancel()
+	}
+
+	wp.sendingLock.Unlock()
+	for e, ok := wp.outbounds.pop(); ok; e, ok = wp.outbounds.pop() {
+		e.cancel()
+		deliveryFrom(e.request.Context()).complete(rdrTimeout)
+		abandoned++
+	}
+
+	return abandoned
+}
+
+// update replaces the sink and resizes the pool.  Queued envelopes are unaffected, and
+// requests already being sent complete with the previous sink, which is closed afterwards.
+// When the pool shrinks, surplus workers exit once they finish their current envelope.
+func (wp *WorkerPool) update(sink OutboundSink, workerPoolSize uint) {
+	wp.lock.Lock()
+	defer wp.lock.Unlock()
+
+	go wp.sink.close(wp.logger)
+	wp.sink = &sinkGeneration{OutboundSink: sink}
+	wp.workerPoolSize = workerPoolSize
+	if wp.running {
+		wp.spawn()
+	}
+
+	if wp.workers > wp.workerPoolSize {
+		// wake up idle workers so that the surplus ones can exit
+		close(wp.resized)
+		wp.resized = make(chan struct{})
+	}
+}
+
+// size returns the number of running workers and the number the pool is configured for
+func (wp *WorkerPool) size() (workers, workerPoolSize uint) {
+	wp.lock.Lock()
+	defer wp.lock.Unlock()
+	return wp.workers, wp.workerPoolSize
+}
+
+// retire reports whether the calling worker should exit because the pool has shrunk, and
+// if so accounts for its exit
+func (wp *WorkerPool) retire() (bool, <-chan struct{}) {
+	wp.lock.Lock()
+	defer wp.lock.Unlock()
+	if wp.workers > wp.workerPoolSize {
+		wp.workers--
+		return true, nil
+	}
+
+	return false, wp.resized
+}
+
+// currentSink returns the sink to send a request through.  The caller must mark the
+// request as done with the returned generation's sending.
+func (wp *WorkerPool) currentSink() *sinkGeneration {
+	wp.lock.Lock()
+	defer wp.lock.Unlock()
+	wp.sink.sending.Add(1)
+	return wp.sink
+}
+
+// closeSink closes the current sink once the requests being sent through it are complete.
+// This method must only be called once the workers have exited.
+func (wp *WorkerPool) closeSink() {
+	wp.lock.Lock()
+	sink := wp.sink
+	wp.lock.Unlock()
+	sink.close(wp.logger)
+}
+
 // transact performs all the logic necessary to fulfill an outbound request.
 // This method ensures that the Context associated with the request is properly canceled.
+// Requests that cannot be delivered are written to the dead letter store, if configured.
 func (wp *WorkerPool) transact(e outboundEnvelope) {
 	defer e.cancel()
+	if !wp.startSending(e) {
+		deliveryFrom(e.request.Context()).complete(rdrTimeout)
+		return
+	}
+
+	defer wp.doneSending(e)
 
 	// bail out early if the request has been on the queue too long
 	if err := e.request.Context().Err(); err != nil {
 		wp.logger.Error("Outbound message expired while on queue", zap.Error(err))
+		wp.failed.Add(1)
+		wp.deadLetters.add(e.request, err, 0)
+		deliveryFrom(e.request.Context()).complete(rdrTimeout)
 		return
 	}
 
-	response, err := wp.transactor(e.request)
+	sink := wp.currentSink()
+	err := sink.Send(e.request)
+	sink.sending.Done()
 	if err != nil {
-		wp.logger.Error("HTTP transaction error", zap.Error(err))
+		if wp.wasAbandoned(err) {
+			// abandon has already accounted for the envelope
+			deliveryFrom(e.request.Context()).complete(rdrTimeout)
+			return
+		}
+
+		wp.logger.Error("Outbound delivery error", zap.Any("url", e.request.URL), zap.Error(err))
+		wp.failed.Add(1)
+
+		rdr := rdrEndpointError
+		if errors.Is(err, context.DeadlineExceeded) {
+			rdr = rdrTimeout
+		}
+
+		deliveryFrom(e.request.Context()).complete(rdr)
+
+		// attempts are not recorded if the request was not retried or was batched
+		attempts := 1
+		if counter, ok := e.request.Context().Value(attemptsContextKey{}).(*int); ok && *counter > 0 {
+			attempts = *counter
+		}
+
+		wp.deadLetters.add(e.request, err, attempts)
 		return
 	}
 
-	if response.StatusCode < 400 {
-		wp.logger.Debug("HTTP response", zap.String("status", response.Status), zap.Any("url", e.request.URL))
-	} else {
-		wp.logger.Error("HTTP response", zap.String("status", response.Status), zap.Any("url", e.request.URL))
+	wp.delivered.Add(1)
+	deliveryFrom(e.request.Context()).complete(rdrDelivered)
+}
+
+// startSending records that the envelope is being transacted, returning false if the pool
+// has already abandoned its envelopes
+func (wp *WorkerPool) startSending(e outboundEnvelope) bool {
+	wp.sendingLock.Lock()
+	defer wp.sendingLock.Unlock()
+	if wp.abandoned {
+		return false
+	}
+
+	if wp.sending == nil {
+		wp.sending = make(map[*http.Request]context.CancelFunc)
 	}
 
-	io.Copy(io.Discard, response.Body)
-	response.Body.Close()
+	wp.sending[e.request] = e.cancel
+	return true
+}
+
+func (wp *WorkerPool) doneSending(e outboundEnvelope) {
+	wp.sendingLock.Lock()
+	defer wp.sendingLock.Unlock()
+	delete(wp.sending, e.request)
+}
+
+// wasAbandoned tests whether err is the result of abandon cancelling an envelope
+func (wp *WorkerPool) wasAbandoned(err error) bool {
+	wp.sendingLock.Lock()
+	defer wp.sendingLock.Unlock()
+	return wp.abandoned && errors.Is(err, context.Canceled)
+}
+
+// next returns the next envelope to transact, blocking until one is available.
+// The outbounds queue is always drained before the spill queue.  Once anything has
+// spilled, the eventDispatcher spills everything after it, so whatever is still on the
+// queue was dispatched before anything that was spilled, short of messages the spill
+// queue could not take.  The second return is false once the outbounds queue has been
+// shut down and drained, or if the calling worker is no longer needed because the pool
+// has shrunk.
+func (wp *WorkerPool) next() (outboundEnvelope, bool) {
+	for {
+		retire, resized := wp.retire()
+		if retire {
+			return outboundEnvelope{}, false
+		}
+
+		if e, ok := wp.outbounds.pop(); ok {
+			return e, true
+		}
+
+		select {
+		case <-wp.outbounds.done():
+			// the spill queue survives a restart, so it is not drained on shutdown
+			wp.lock.Lock()
+			if wp.workers > 0 {
+				wp.workers--
+			}
+
+			wp.lock.Unlock()
+			return outboundEnvelope{}, false
+
+		default:
+		}
+
+		if e, ok := wp.spill.pop(); ok {
+			return e, true
+		}
+
+		select {
+		case <-wp.outbounds.ready():
+		case <-wp.spill.ready():
+		case <-resized:
+		case <-wp.outbounds.done():
+		}
+	}
 }
 
-// worker represents a single goroutine that processes the outbounds channel.
-// This method simply invokes transact for each *outboundEnvelope
+// worker represents a single goroutine that processes the outbounds queue and,
+// if configured, the spill queue. This method simply invokes transact for each *outboundEnvelope
 func (wp *WorkerPool) worker() {
-	for e := range wp.outbounds {
-		wp.queueSize.Add(-1.0)
+	defer wp.exited.Done()
+	for {
+		e, ok := wp.next()
+		if !ok {
+			return
+		}
+
 		wp.transact(e)
 	}
 }
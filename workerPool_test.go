@@ -18,13 +18,16 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/zap/zaptest"
 )
 
@@ -37,10 +40,13 @@ func testWorkerPoolTransactTransactorError(t *testing.T) {
 
 		wp = &WorkerPool{
 			logger: logger,
-			transactor: func(actualRequest *http.Request) (*http.Response, error) {
-				assert.Equal(expectedRequest, actualRequest)
-				return nil, errors.New("expected error")
-			},
+			sink: &sinkGeneration{OutboundSink: &httpSink{
+				logger: logger,
+				transactor: func(actualRequest *http.Request) (*http.Response, error) {
+					assert.Equal(expectedRequest, actualRequest)
+					return nil, errors.New("expected error")
+				},
+			}},
 		}
 	)
 
@@ -56,14 +62,17 @@ func testWorkerPoolTransactHTTPSuccess(t *testing.T) {
 
 		wp = &WorkerPool{
 			logger: logger,
-			transactor: func(actualRequest *http.Request) (*http.Response, error) {
-				assert.Equal(expectedRequest, actualRequest)
-				return &http.Response{
-					Status:     "200 OK",
-					StatusCode: 200,
-					Body:       io.NopCloser(new(bytes.Buffer)),
-				}, nil
-			},
+			sink: &sinkGeneration{OutboundSink: &httpSink{
+				logger: logger,
+				transactor: func(actualRequest *http.Request) (*http.Response, error) {
+					assert.Equal(expectedRequest, actualRequest)
+					return &http.Response{
+						Status:     "200 OK",
+						StatusCode: 200,
+						Body:       io.NopCloser(new(bytes.Buffer)),
+					}, nil
+				},
+			}},
 		}
 	)
 
@@ -79,24 +88,67 @@ func testWorkerPoolTransactHTTPError(t *testing.T) {
 
 		wp = &WorkerPool{
 			logger: logger,
-			transactor: func(actualRequest *http.Request) (*http.Response, error) {
-				assert.Equal(expectedRequest, actualRequest)
-				return &http.Response{
-					Status:     "500 It Burns!",
-					StatusCode: 500,
-					Body:       io.NopCloser(new(bytes.Buffer)),
-				}, nil
-			},
+			sink: &sinkGeneration{OutboundSink: &httpSink{
+				logger: logger,
+				transactor: func(actualRequest *http.Request) (*http.Response, error) {
+					assert.Equal(expectedRequest, actualRequest)
+					return &http.Response{
+						Status:     "500 It Burns!",
+						StatusCode: 500,
+						Body:       io.NopCloser(new(bytes.Buffer)),
+					}, nil
+				},
+			}},
 		}
 	)
 
 	wp.transact(envelope)
 }
 
+func testWorkerPoolStopWait(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		server  = httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+		om      = NewTestOutboundMeasures()
+		o       = &Outbounder{WorkerPoolSize: 2}
+		oq, _   = newOutboundQueue(om, o)
+		wp, err = NewWorkerPool(om, o, oq, nil, nil, nil)
+	)
+
+	defer server.Close()
+	require.NoError(err)
+	for i := 0; i < 5; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		request, err := http.NewRequestWithContext(ctx, "POST", server.URL, nil)
+		require.NoError(err)
+		require.NoError(oq.push(outboundEnvelope{request, cancel}))
+	}
+
+	wp.Run()
+	wp.Stop()
+	wp.Stop()
+	assert.Equal(errOutboundQueueClosed, oq.push(outboundEnvelope{httptest.NewRequest("POST", server.URL, nil), func() {}}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(wp.Wait(ctx))
+
+	// everything queued before Stop is sent before the workers exit
+	assert.Equal(int64(5), wp.delivered.Load())
+	assert.Equal(int64(0), wp.failed.Load())
+	assert.Equal(0, wp.abandon())
+
+	workers, _ := wp.size()
+	assert.Equal(uint(0), workers)
+}
+
 func TestWorkerPool(t *testing.T) {
 	t.Run("Transact", func(t *testing.T) {
 		t.Run("TransactorError", testWorkerPoolTransactTransactorError)
 		t.Run("HTTPSuccess", testWorkerPoolTransactHTTPSuccess)
 		t.Run("HTTPError", testWorkerPoolTransactHTTPError)
 	})
+
+	t.Run("StopWait", testWorkerPoolStopWait)
 }